@@ -0,0 +1,51 @@
+package cacheCommand
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/spf13/cobra"
+	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+)
+
+type CacheCommand struct {
+	CobraCommand *cobra.Command
+}
+
+func NewCacheCommand(
+	configFindService *configFindService.ConfigFindService,
+	responseCacheService *responseCache.ResponseCacheService,
+) *CacheCommand {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the response cache",
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear",
+		Short: "Remove all cached responses",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := configFindService.FindConfig()
+			if err != nil {
+				return eris.Wrap(err, "failed to find config file")
+			}
+
+			rootDir := configFindService.GetProjectRoot(configPath)
+
+			count, err := responseCacheService.Clear(rootDir)
+			if err != nil {
+				return eris.Wrap(err, "failed to clear response cache")
+			}
+
+			fmt.Fprintf(cmd.OutOrStdout(), "Removed %d cached responses.\n", count)
+			return nil
+		},
+	}
+
+	cmd.AddCommand(clearCmd)
+
+	return &CacheCommand{
+		CobraCommand: cmd,
+	}
+}
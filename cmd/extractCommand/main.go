@@ -1,19 +1,27 @@
 package extractCommand
 
 import (
+	"context"
 	"fmt"
 	"github.com/rotisserie/eris"
 	"github.com/spf13/cobra"
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"github.com/t-kuni/sisho/domain/model/prompts"
 	"github.com/t-kuni/sisho/domain/model/prompts/extract"
+	"github.com/t-kuni/sisho/domain/model/retry"
 	"github.com/t-kuni/sisho/domain/repository/config"
 	"github.com/t-kuni/sisho/domain/repository/knowledge"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
-	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/historyLog"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
-	"gopkg.in/yaml.v3"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
+	"github.com/t-kuni/sisho/domain/system/ksuid"
+	"github.com/t-kuni/sisho/domain/system/timer"
 	"os"
 	"path/filepath"
 )
@@ -28,34 +36,55 @@ func NewExtractCommand(
 	knowledgeRepository knowledge.Repository,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
 	knowledgePathNormalizeService *knowledgePathNormalize.KnowledgePathNormalizeService,
-	extractCodeBlockService *extractCodeBlock.CodeBlockExtractService,
-	chatFactory *chatFactory.ChatFactory,
+	structuredOutputService *structuredOutput.StructuredOutputService,
+	chatFactoryService *chatFactory.ChatFactory,
+	timer timer.ITimer,
+	ksuidGenerator ksuid.IKsuid,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
 ) *ExtractCommand {
+	var noCache bool
+	var override llmSelect.Override
+
 	cmd := &cobra.Command{
 		Use:   "extract [path]",
 		Short: "Extract knowledge list from Target Code",
 		Long:  `Extract knowledge list from the specified Target Code and generate or update a knowledge list file.`,
 		Args:  cobra.ExactArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runExtract(args[0], configFindService, configRepository, knowledgeRepository,
-				folderStructureMakeService, knowledgePathNormalizeService, extractCodeBlockService, chatFactory)
+			return runExtract(cmd.Context(), args[0], configFindService, configRepository, knowledgeRepository,
+				folderStructureMakeService, knowledgePathNormalizeService, structuredOutputService, chatFactoryService,
+				timer, ksuidGenerator, usageRecordService, systemPromptService, llmSelectService, noCache, override)
 		},
 	}
 
+	cmd.Flags().BoolVar(&noCache, "no-cache", false, "Do not use the response cache")
+	cmd.Flags().StringVar(&override.Driver, "driver", "", "Override llm.driver for this run")
+	cmd.Flags().StringVar(&override.Model, "model", "", "Override llm.model for this run")
+
 	return &ExtractCommand{
 		CobraCommand: cmd,
 	}
 }
 
 func runExtract(
+	ctx context.Context,
 	path string,
 	configFindService *configFindService.ConfigFindService,
 	configRepository config.Repository,
 	knowledgeRepository knowledge.Repository,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
 	knowledgePathNormalizeService *knowledgePathNormalize.KnowledgePathNormalizeService,
-	extractCodeBlockService *extractCodeBlock.CodeBlockExtractService,
-	chatFactory *chatFactory.ChatFactory,
+	structuredOutputService *structuredOutput.StructuredOutputService,
+	chatFactoryService *chatFactory.ChatFactory,
+	timer timer.ITimer,
+	ksuidGenerator ksuid.IKsuid,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
+	noCache bool,
+	override llmSelect.Override,
 ) error {
 	configPath, err := configFindService.FindConfig()
 	if err != nil {
@@ -66,6 +95,10 @@ func runExtract(
 	if err != nil {
 		return eris.Wrap(err, "failed to read config file")
 	}
+	cfg, err = llmSelectService.Select(cfg, config.CommandExtract, override)
+	if err != nil {
+		return eris.Wrap(err, "failed to select LLM")
+	}
 
 	rootDir := configFindService.GetProjectRoot(configPath)
 
@@ -110,20 +143,67 @@ func runExtract(
 		return eris.Wrap(err, "failed to build prompt")
 	}
 
-	chatClient, err := chatFactory.Make(cfg)
+	historyDir, err := createHistoryDir(rootDir, timer, ksuidGenerator)
 	if err != nil {
-		return eris.Wrap(err, "failed to create chat client")
+		return eris.Wrap(err, "failed to create history directory")
+	}
+
+	err = savePromptHistory(historyDir, prompt)
+	if err != nil {
+		return eris.Wrap(err, "failed to save prompt history")
+	}
+
+	system, err := systemPromptService.Resolve(rootDir, cfg, config.CommandExtract)
+	if err != nil {
+		return eris.Wrap(err, "failed to resolve system prompt")
+	}
+
+	err = systemPromptService.SaveHistory(historyDir, system)
+	if err != nil {
+		return eris.Wrap(err, "failed to save system prompt history")
 	}
 
-	answer, err := chatClient.Send(prompt, cfg.LLM.Model)
+	chatClient, err := chatFactoryService.Make(cfg, chatFactory.MakeOptions{
+		RootDir: rootDir,
+		NoCache: noCache,
+	})
 	if err != nil {
-		return eris.Wrap(err, "failed to send message to LLM")
+		return eris.Wrap(err, "failed to create chat client")
 	}
 
-	knowledgeList, err := extractKnowledgeList(extractCodeBlockService, answer.Content, relativeKnowledgeListPath, rootDir, knowledgePathNormalizeService)
+	var result extract.KnowledgeListResult
+	answer, err := structuredOutputService.Send(ctx, chatClient, prompt, cfg.LLM.Model, chat.SendOptions{
+		System: system,
+		OnRetry: func(event retry.Event) {
+			fmt.Printf("Retry: %s\n", event)
+			historyLog.Record(os.Stdout, historyDir, "retry.log", timer, event.String())
+		},
+		OnFallback: func(event chat.FallbackEvent) {
+			historyLog.Print(os.Stdout, historyDir, "provider.log", timer, fmt.Sprintf("Fallback: %s", event))
+		},
+	}, extract.ResultSchema, &result)
+	// 修正を依頼しても回答が不正だった場合も、回答と使用量は記録する
+	if answer.Content != "" {
+		recordErr := usageRecordService.Record(historyDir, "extract", cfg, answer)
+		if recordErr != nil {
+			fmt.Printf("Warning: failed to save usage: %v\n", recordErr)
+		}
+		saveErr := saveAnswerHistory(historyDir, answer.Content)
+		if saveErr != nil {
+			return eris.Wrap(saveErr, "failed to save answer history")
+		}
+	}
 	if err != nil {
+		if ctx.Err() != nil {
+			historyLog.Record(os.Stdout, historyDir, "aborted.log", timer, fmt.Sprintf("Aborted: %v", ctx.Err()))
+		}
 		return eris.Wrap(err, "failed to extract knowledge list")
 	}
+	if answer.Provider.Driver != "" {
+		historyLog.Print(os.Stdout, historyDir, "provider.log", timer, fmt.Sprintf("Answered by: %s", answer.Provider))
+	}
+
+	knowledgeList := toKnowledgeList(result)
 
 	existingKnowledgeFile := knowledge.KnowledgeFile{
 		KnowledgeList: []knowledge.Knowledge{},
@@ -145,19 +225,17 @@ func runExtract(
 	return nil
 }
 
-func extractKnowledgeList(extractCodeBlockService *extractCodeBlock.CodeBlockExtractService, answer string, knowledgeListPath string, rootDir string, knowledgePathNormalizeService *knowledgePathNormalize.KnowledgePathNormalizeService) ([]knowledge.Knowledge, error) {
-	yamlContent, err := extractCodeBlockService.ExtractCodeBlock(answer, knowledgeListPath)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to extract code block")
-	}
-
-	var knowledgeFile knowledge.KnowledgeFile
-	err = yaml.Unmarshal([]byte(yamlContent), &knowledgeFile)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to unmarshal YAML content")
+// toKnowledgeList converts the answer of the LLM to the knowledge list. chain-make is omitted if false.
+func toKnowledgeList(result extract.KnowledgeListResult) []knowledge.Knowledge {
+	knowledgeList := make([]knowledge.Knowledge, len(result.Knowledge))
+	for i, item := range result.Knowledge {
+		knowledgeList[i] = knowledge.Knowledge{
+			Path:      item.Path,
+			Kind:      item.Kind,
+			ChainMake: item.ChainMake,
+		}
 	}
-
-	return knowledgeFile.KnowledgeList, nil
+	return knowledgeList
 }
 
 func getKnowledgeListFilePath(path string) string {
@@ -190,3 +268,42 @@ func mergeKnowledgeLists(existing, new []knowledge.Knowledge, knowledgePathNorma
 
 	return merged
 }
+
+func createHistoryDir(rootDir string, timer timer.ITimer, ksuidGenerator ksuid.IKsuid) (string, error) {
+	historyBaseDir := filepath.Join(rootDir, ".sisho", "history", "extract")
+	err := os.MkdirAll(historyBaseDir, 0755)
+	if err != nil {
+		return "", eris.Wrap(err, "failed to create history base directory")
+	}
+
+	id := ksuidGenerator.New()
+	historyDir := filepath.Join(historyBaseDir, id)
+	err = os.Mkdir(historyDir, 0755)
+	if err != nil {
+		return "", eris.Wrap(err, "failed to create history directory")
+	}
+
+	timeFile := filepath.Join(historyDir, timer.Now().Format("2006-01-02T15-04-05"))
+	_, err = os.Create(timeFile)
+	if err != nil {
+		return "", eris.Wrap(err, "failed to create time file")
+	}
+
+	return historyDir, nil
+}
+
+func savePromptHistory(historyDir string, prompt string) error {
+	err := os.WriteFile(filepath.Join(historyDir, "prompt.md"), []byte(prompt), 0644)
+	if err != nil {
+		return eris.Wrap(err, "failed to write prompt to history")
+	}
+	return nil
+}
+
+func saveAnswerHistory(historyDir string, answer string) error {
+	err := os.WriteFile(filepath.Join(historyDir, "answer.md"), []byte(answer), 0644)
+	if err != nil {
+		return eris.Wrap(err, "failed to write answer to history")
+	}
+	return nil
+}
@@ -1,21 +1,34 @@
 package extractCommand
 
 import (
+	"context"
+	"errors"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/domain/external/claude"
 	"github.com/t-kuni/sisho/domain/external/openAi"
+	"github.com/t-kuni/sisho/domain/model/retry"
 	"github.com/t-kuni/sisho/domain/repository/file"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
-	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
+	"github.com/t-kuni/sisho/domain/system/ksuid"
+	"github.com/t-kuni/sisho/domain/system/timer"
 	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
 	knowledge2 "github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
 	"github.com/t-kuni/sisho/testUtil"
 	"go.uber.org/mock/gomock"
 	"testing"
+	"time"
 )
 
 func TestExtractCommand(t *testing.T) {
@@ -23,6 +36,8 @@ func TestExtractCommand(t *testing.T) {
 		ClaudeClient   *claude.MockClient
 		OpenAiClient   *openAi.MockClient
 		FileRepository *file.MockRepository
+		Timer          *timer.MockITimer
+		KsuidGenerator *ksuid.MockIKsuid
 	}
 
 	callCommand := func(
@@ -33,18 +48,23 @@ func TestExtractCommand(t *testing.T) {
 		mockClaudeClient := claude.NewMockClient(mockCtrl)
 		mockOpenAiClient := openAi.NewMockClient(mockCtrl)
 		mockFileRepo := file.NewMockRepository(mockCtrl)
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockKsuidGenerator := ksuid.NewMockIKsuid(mockCtrl)
 		configRepo := config2.NewConfigRepository()
 		knowledgeRepo := knowledge2.NewRepository()
 		configFindSvc := configFindService.NewConfigFindService(mockFileRepo)
 		folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
 		knowledgePathNormalizeService := knowledgePathNormalize.NewKnowledgePathNormalizeService()
-		extractCodeBlockService := extractCodeBlock.NewCodeBlockExtractService()
-		chatFactoryService := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient)
+		structuredOutputService := structuredOutput.NewStructuredOutputService()
+		mockOpenAiCompatibleClientFactory := openAi.NewMockCompatibleClientFactory(mockCtrl)
+		chatFactoryService := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient, mockOpenAiCompatibleClientFactory, responseCache.NewResponseCacheService(mockTimer), replayFixture.NewReplayFixtureService(), config2.NewConfigRepository(), credential.NewProvider())
 
 		customizeMocks(Mocks{
 			ClaudeClient:   mockClaudeClient,
 			OpenAiClient:   mockOpenAiClient,
 			FileRepository: mockFileRepo,
+			Timer:          mockTimer,
+			KsuidGenerator: mockKsuidGenerator,
 		})
 
 		extractCmd := NewExtractCommand(
@@ -53,8 +73,13 @@ func TestExtractCommand(t *testing.T) {
 			knowledgeRepo,
 			folderStructureMakeSvc,
 			knowledgePathNormalizeService,
-			extractCodeBlockService,
+			structuredOutputService,
 			chatFactoryService,
+			mockTimer,
+			mockKsuidGenerator,
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
 		)
 
 		rootCmd := &cobra.Command{}
@@ -82,25 +107,20 @@ llm:
 `))
 		space.WriteFile("dir/target.go", []byte("package main\n\nfunc main() {}"))
 
-		generatedKnowledge := `
-<!-- CODE_BLOCK_BEGIN -->` + "```" + `dir/target.go.know.yml
-knowledge:
-  - path: dir/some/path/file1.go
-    kind: examples
-  - path: dir/another/path/file2.go
-    kind: implementations
-    chain-make: true
-  - path: ./dir/another/path/file3.go
-    kind: implementations
-` + "```" + `<!-- CODE_BLOCK_END -->
-`
+		generatedKnowledge := `{"knowledge": [
+  {"path": "dir/some/path/file1.go", "kind": "examples", "chain-make": false},
+  {"path": "dir/another/path/file2.go", "kind": "implementations", "chain-make": true},
+  {"path": "./dir/another/path/file3.go", "kind": "implementations", "chain-make": false}
+]}`
 
 		err := callCommand(mockCtrl, []string{"extract", "dir/target.go"}, func(mocks Mocks) {
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
-				Content:           generatedKnowledge,
-				TerminationReason: "success",
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
+				ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "knowledge_list", Input: generatedKnowledge}},
+				TerminationReason: "tool_use",
 			}, nil)
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
 		})
 
 		assert.NoError(t, err)
@@ -121,6 +141,44 @@ knowledge:
 		})
 	})
 
+	t.Run("LLMのAPI呼び出しを再試行した場合、履歴フォルダに記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+lang: ja
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("dir/target.go", []byte("package main\n\nfunc main() {}"))
+
+		err := callCommand(mockCtrl, []string{"extract", "dir/target.go"}, func(mocks Mocks) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					options.OnRetry(retry.Event{Attempt: 1, MaxAttempts: 4, Wait: time.Second, Err: errors.New("overloaded")})
+					return claude.GenerationResult{
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "knowledge_list", Input: `{"knowledge": []}`}},
+						TerminationReason: "tool_use",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
+		})
+
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/extract/test-ksuid/retry.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z attempt 1/4 failed, retrying in 1s: overloaded\n", string(actual))
+		})
+	})
+
 	t.Run("既存の知識リストとマージされること", func(t *testing.T) {
 		mockCtrl := gomock.NewController(t)
 		defer mockCtrl.Finish()
@@ -142,22 +200,19 @@ knowledge:
     kind: specifications
 `))
 
-		generatedKnowledge := `
-<!-- CODE_BLOCK_BEGIN -->` + "```" + `target.go.know.yml
-knowledge:
-  - path: some/path/file1.go
-    kind: examples
-  - path: another/path/file2.go
-    kind: implementations
-` + "```" + `<!-- CODE_BLOCK_END -->
-`
+		generatedKnowledge := `{"knowledge": [
+  {"path": "some/path/file1.go", "kind": "examples", "chain-make": false},
+  {"path": "another/path/file2.go", "kind": "implementations", "chain-make": false}
+]}`
 
 		err := callCommand(mockCtrl, []string{"extract", "target.go"}, func(mocks Mocks) {
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
-				Content:           generatedKnowledge,
-				TerminationReason: "success",
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
+				ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "knowledge_list", Input: generatedKnowledge}},
+				TerminationReason: "tool_use",
 			}, nil)
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
 		})
 
 		assert.NoError(t, err)
@@ -196,26 +251,22 @@ additional-knowledge:
 		space.WriteFile("dir1/file1.go", []byte(""))
 		space.WriteFile("dir2/subdir/file2.go", []byte(""))
 
-		generatedKnowledge := `
-<!-- CODE_BLOCK_BEGIN -->` + "```" + `target.go.know.yml
-knowledge:
-  - path: some/path/file1.go
-    kind: examples
-` + "```" + `<!-- CODE_BLOCK_END -->
-`
+		generatedKnowledge := `{"knowledge": [{"path": "some/path/file1.go", "kind": "examples", "chain-make": false}]}`
 
 		var capturedPrompt string
 
 		err := callCommand(mockCtrl, []string{"extract", "target.go"}, func(mocks Mocks) {
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					capturedPrompt = messages[0].Content
 					return claude.GenerationResult{
-						Content:           generatedKnowledge,
-						TerminationReason: "success",
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "knowledge_list", Input: generatedKnowledge}},
+						TerminationReason: "tool_use",
 					}, nil
 				})
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
 		})
 
 		assert.NoError(t, err)
@@ -252,17 +303,11 @@ additional-knowledge:
 		space.WriteFile("ignore_this.txt", []byte(""))
 		space.WriteFile(".sishoignore", []byte("ignore_this.txt\ndir2"))
 
-		generatedKnowledge := `
-<!-- CODE_BLOCK_BEGIN -->` + "```" + `target.go.know.yml
-knowledge:
- - path: some/path/file1.go
-   kind: examples
-` + "```" + `<!-- CODE_BLOCK_END -->
-`
+		generatedKnowledge := `{"knowledge": [{"path": "some/path/file1.go", "kind": "examples", "chain-make": false}]}`
 
 		err := callCommand(mockCtrl, []string{"extract", "target.go"}, func(mocks Mocks) {
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "# Folder Structure")
 					assert.Contains(t, messages[0].Content, "target.go")
 					assert.Contains(t, messages[0].Content, "/dir1")
@@ -272,11 +317,13 @@ knowledge:
 					assert.NotContains(t, messages[0].Content, "/subdir")
 					assert.NotContains(t, messages[0].Content, "file2.go")
 					return claude.GenerationResult{
-						Content:           generatedKnowledge,
-						TerminationReason: "success",
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "knowledge_list", Input: generatedKnowledge}},
+						TerminationReason: "tool_use",
 					}, nil
 				})
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
 		})
 
 		assert.NoError(t, err)
@@ -1,24 +1,28 @@
 package fixTaskCommand
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/rotisserie/eris"
 	"github.com/spf13/cobra"
 	"github.com/t-kuni/sisho/domain/model/chat"
 	"github.com/t-kuni/sisho/domain/model/prompts/extractPaths"
+	"github.com/t-kuni/sisho/domain/model/retry"
 	"github.com/t-kuni/sisho/domain/repository/config"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
-	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/historyLog"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
 	"github.com/t-kuni/sisho/domain/service/make"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
 	"github.com/t-kuni/sisho/domain/system/timer"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"strings"
 )
 
 type FixTaskCommand struct {
@@ -29,20 +33,28 @@ func NewFixTaskCommand(
 	configFindService *configFindService.ConfigFindService,
 	configRepo config.Repository,
 	makeService *make.MakeService,
-	chatFactory *chatFactory.ChatFactory,
+	chatFactoryService *chatFactory.ChatFactory,
 	timer timer.ITimer,
 	ksuidGenerator ksuid.IKsuid,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
-	extractCodeBlockService *extractCodeBlock.CodeBlockExtractService,
+	structuredOutputService *structuredOutput.StructuredOutputService,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
+	taskRunService *taskRun.TaskRunService,
 ) *FixTaskCommand {
 	var tryCount int
 	var dryRun bool
+	var noCache bool
+	var allowDirty bool
+	var override llmSelect.Override
 
 	cmd := &cobra.Command{
 		Use:   "fix:task [taskName]",
 		Short: "Run a task and fix errors using LLM",
 		Args:  cobra.ExactArgs(1),
-		RunE: func(cmd *cobra.Command, args []string) error {
+		RunE: func(cmd *cobra.Command, args []string) (err error) {
+			ctx := cmd.Context()
 			taskName := args[0]
 
 			cfg, projectRoot, err := loadConfig(configFindService, configRepo)
@@ -50,7 +62,7 @@ func NewFixTaskCommand(
 				return err
 			}
 
-			task, err := findTask(cfg, taskName)
+			task, err := taskRunService.Find(cfg, taskName)
 			if err != nil {
 				return err
 			}
@@ -60,7 +72,33 @@ func NewFixTaskCommand(
 				return err
 			}
 
-			chat, err := chatFactory.Make(cfg)
+			// 中断された場合は履歴に記録する
+			defer func() {
+				if err != nil && ctx.Err() != nil {
+					historyLog.Record(os.Stdout, historyDir, "aborted.log", timer, fmt.Sprintf("Aborted: %v", ctx.Err()))
+				}
+			}()
+
+			system, err := systemPromptService.Resolve(projectRoot, cfg, config.CommandFixTask)
+			if err != nil {
+				return eris.Wrap(err, "failed to resolve system prompt")
+			}
+
+			err = systemPromptService.SaveHistory(historyDir, system)
+			if err != nil {
+				return eris.Wrap(err, "failed to save system prompt history")
+			}
+
+			// 修正対象のパスの抽出にはfix-taskのLLMの設定を使う
+			pathsCfg, err := llmSelectService.Select(cfg, config.CommandFixTask, override)
+			if err != nil {
+				return eris.Wrap(err, "failed to select LLM")
+			}
+
+			chatClient, err := chatFactoryService.Make(pathsCfg, chatFactory.MakeOptions{
+				RootDir: projectRoot,
+				NoCache: noCache,
+			})
 			if err != nil {
 				return eris.Wrap(err, "failed to create chat model")
 			}
@@ -68,15 +106,18 @@ func NewFixTaskCommand(
 			for i := 0; i < tryCount; i++ {
 				fmt.Printf("Attempt %d/%d\n", i+1, tryCount)
 
-				stdout, stderr, err := runTask(task, projectRoot)
+				stdout, stderr, err := taskRunService.Run(ctx, task, projectRoot)
+				if ctx.Err() != nil {
+					return eris.Wrap(ctx.Err(), "aborted")
+				}
 				if err == nil {
 					fmt.Println("Task completed successfully")
 					return nil
 				}
 
-				errorMessage := buildErrorMessage(stdout, stderr, err)
+				errorMessage := taskRun.ErrorMessage(stdout, stderr, err)
 
-				paths, err := getPathsToFix(chat, cfg, task.Run, errorMessage, historyDir, i+1, projectRoot, folderStructureMakeService, extractCodeBlockService)
+				paths, err := getPathsToFix(ctx, chatClient, pathsCfg, system, task.Run, errorMessage, historyDir, i+1, projectRoot, timer, usageRecordService, folderStructureMakeService, structuredOutputService)
 				if err != nil {
 					return err
 				}
@@ -91,26 +132,42 @@ func NewFixTaskCommand(
 					fmt.Printf("- %s\n", path)
 				}
 
-				err = makeService.Make(paths, true, false, errorMessage, dryRun)
+				err = makeService.Make(ctx, paths, make.Options{
+					Apply:        true,
+					Instructions: errorMessage,
+					DryRun:       dryRun,
+					NoCache:      noCache,
+					Driver:       override.Driver,
+					Model:        override.Model,
+					// 2回目以降の試行では、前の試行でsishoが書き換えたファイルを修正するため確認しない
+					AllowDirty: allowDirty || i > 0,
+				})
 				if err != nil {
 					return eris.Wrap(err, "failed to fix files")
 				}
 			}
 
 			// Run the task one last time to check if it's fixed
-			stdout, stderr, err := runTask(task, projectRoot)
+			stdout, stderr, err := taskRunService.Run(ctx, task, projectRoot)
+			if ctx.Err() != nil {
+				return eris.Wrap(ctx.Err(), "aborted")
+			}
 			if err == nil {
 				fmt.Println("Task completed successfully after fixes")
 				return nil
 			}
 
-			errorMessage := buildErrorMessage(stdout, stderr, err)
+			errorMessage := taskRun.ErrorMessage(stdout, stderr, err)
 			return eris.New(fmt.Sprintf("failed to fix the task after maximum attempts. Last error: %s", errorMessage))
 		},
 	}
 
 	cmd.Flags().IntVarP(&tryCount, "try", "t", 1, "Number of attempts to fix the task")
 	cmd.Flags().BoolVarP(&dryRun, "dry-run", "d", false, "Perform a dry run without applying changes")
+	cmd.Flags().BoolVar(&noCache, "no-cache", false, "Do not use the response cache")
+	cmd.Flags().BoolVar(&allowDirty, "allow-dirty", false, "Apply to files with uncommitted changes when git.enabled is true")
+	cmd.Flags().StringVar(&override.Driver, "driver", "", "Override llm.driver for this run")
+	cmd.Flags().StringVar(&override.Model, "model", "", "Override llm.model for this run")
 
 	return &FixTaskCommand{
 		CobraCommand: cmd,
@@ -133,45 +190,21 @@ func loadConfig(configFindService *configFindService.ConfigFindService, configRe
 	return cfg, projectRoot, nil
 }
 
-// findTask finds the specified task in the configuration
-func findTask(cfg *config.Config, taskName string) (*config.Task, error) {
-	for _, t := range cfg.Tasks {
-		if t.Name == taskName {
-			return &t, nil
-		}
-	}
-	return nil, eris.Errorf("task not found: %s", taskName)
-}
-
-// runTask executes the specified task and returns stdout, stderr, and error
-func runTask(task *config.Task, projectRoot string) (string, string, error) {
-	cmd := exec.Command("sh", "-c", task.Run)
-	cmd.Dir = projectRoot
-
-	var stdout, stderr strings.Builder
-	cmd.Stdout = &stdout
-	cmd.Stderr = &stderr
-
-	err := cmd.Run()
-	return stdout.String(), stderr.String(), err
-}
-
-// buildErrorMessage constructs an error message from stdout, stderr, and error
-func buildErrorMessage(stdout, stderr string, err error) string {
-	return fmt.Sprintf("Stdout:\n%s\nStderr:\n%s\nError:\n%s", stdout, stderr, err.Error())
-}
-
 // getPathsToFix gets the paths that need to be fixed based on the error message
 func getPathsToFix(
-	chat chat.Chat,
+	ctx context.Context,
+	chatClient chat.Chat,
 	cfg *config.Config,
+	system string,
 	command string,
 	errorMessage string,
 	historyDir string,
 	attempt int,
 	projectRoot string,
+	timer timer.ITimer,
+	usageRecordService *usageRecord.UsageRecordService,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
-	extractCodeBlockService *extractCodeBlock.CodeBlockExtractService,
+	structuredOutputService *structuredOutput.StructuredOutputService,
 ) ([]string, error) {
 	var folderStructure string
 	var err error
@@ -197,29 +230,38 @@ func getPathsToFix(
 		return nil, err
 	}
 
-	result, err := chat.Send(prompt, cfg.LLM.Model)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to send message to LLM")
-	}
-	err = saveAnswerHistory(historyDir, attempt, result.Content)
-	if err != nil {
-		return nil, err
+	var paths extractPaths.ExtractPathsResult
+	result, err := structuredOutputService.Send(ctx, chatClient, prompt, cfg.LLM.Model, chat.SendOptions{
+		System: system,
+		OnRetry: func(event retry.Event) {
+			fmt.Printf("Retry: %s\n", event)
+			historyLog.Record(os.Stdout, historyDir, fmt.Sprintf("retry_%02d.log", attempt), timer, event.String())
+		},
+		OnFallback: func(event chat.FallbackEvent) {
+			historyLog.Print(os.Stdout, historyDir, fmt.Sprintf("provider_%02d.log", attempt), timer, fmt.Sprintf("Fallback: %s", event))
+		},
+	}, extractPaths.ResultSchema, &paths)
+	// 修正を依頼しても回答が不正だった場合も、回答と使用量は記録する
+	if result.Content != "" {
+		recordErr := usageRecordService.Record(historyDir, "fix:task", cfg, result)
+		if recordErr != nil {
+			fmt.Printf("Warning: failed to save usage: %v\n", recordErr)
+		}
+		saveErr := saveAnswerHistory(historyDir, attempt, result.Content)
+		if saveErr != nil {
+			return nil, saveErr
+		}
 	}
-
-	jsonContent, err := extractCodeBlockService.ExtractCodeBlock(result.Content, "json")
 	if err != nil {
-		return nil, eris.Wrap(err, "failed to extract JSON from LLM response")
+		return nil, eris.Wrap(err, "failed to get the paths to fix from LLM")
 	}
-
-	var paths extractPaths.ExtractPathsResult
-	err = json.Unmarshal([]byte(jsonContent), &paths)
-	if err != nil {
-		return nil, eris.Wrap(err, "failed to unmarshal LLM response")
+	if result.Provider.Driver != "" {
+		historyLog.Print(os.Stdout, historyDir, fmt.Sprintf("provider_%02d.log", attempt), timer, fmt.Sprintf("Answered by: %s", result.Provider))
 	}
 
 	// Check if the paths to fix exist
 	var validPaths []string
-	for _, path := range paths {
+	for _, path := range paths.Paths {
 		fullPath := filepath.Join(projectRoot, path)
 		if _, err := os.Stat(fullPath); err == nil {
 			validPaths = append(validPaths, path)
@@ -2,6 +2,7 @@ package fixTaskCommand
 
 import (
 	"bytes"
+	"context"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/domain/external/claude"
@@ -11,18 +12,35 @@ import (
 	"github.com/t-kuni/sisho/domain/service/autoCollect"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
 	"github.com/t-kuni/sisho/domain/service/contextScan"
 	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
 	"github.com/t-kuni/sisho/domain/service/make"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
+	"github.com/t-kuni/sisho/domain/system/terminal"
 	"github.com/t-kuni/sisho/domain/system/timer"
 	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
 	"github.com/t-kuni/sisho/infrastructure/repository/depsGraph"
 	knowledge2 "github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	snapshot2 "github.com/t-kuni/sisho/infrastructure/repository/snapshot"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/git"
 	"github.com/t-kuni/sisho/testUtil"
 	"go.uber.org/mock/gomock"
 	"testing"
@@ -44,6 +62,7 @@ func TestFixTaskCommand(t *testing.T) {
 		customizeMocks func(mocks Mocks),
 	) (string, error) {
 		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
 		mockClaudeClient := claude.NewMockClient(mockCtrl)
 		mockOpenAiClient := openAi.NewMockClient(mockCtrl)
 		mockFileRepo := file.NewMockRepository(mockCtrl)
@@ -60,7 +79,8 @@ func TestFixTaskCommand(t *testing.T) {
 		folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
 		extractCodeBlockSvc := extractCodeBlock.NewCodeBlockExtractService()
 		mockChat := chat.NewMockChat(mockCtrl)
-		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient)
+		mockOpenAiCompatibleClientFactory := openAi.NewMockCompatibleClientFactory(mockCtrl)
+		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient, mockOpenAiCompatibleClientFactory, responseCache.NewResponseCacheService(mockTimer), replayFixture.NewReplayFixtureService(), config2.NewConfigRepository(), credential.NewProvider())
 
 		customizeMocks(Mocks{
 			ClaudeClient:   mockClaudeClient,
@@ -82,6 +102,16 @@ func TestFixTaskCommand(t *testing.T) {
 			folderStructureMakeSvc,
 			extractCodeBlockSvc,
 			chatFactorySvc,
+			tokenBudget.NewTokenBudgetService(),
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
+			fileTools.NewFileToolsService(knowledgeRepo),
+			hunkReview.NewHunkReviewService(mockTerminal),
+			snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer),
+			git.NewGit(),
+			taskRun.NewTaskRunService(),
+			conflictResolve.NewConflictResolveService(mockTerminal),
 		)
 		fixTaskCmd := NewFixTaskCommand(
 			configFindSvc,
@@ -91,7 +121,11 @@ func TestFixTaskCommand(t *testing.T) {
 			mockTimer,
 			mockKsuidGenerator,
 			folderStructureMakeSvc,
-			extractCodeBlockSvc,
+			structuredOutput.NewStructuredOutputService(),
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
+			taskRun.NewTaskRunService(),
 		)
 
 		rootCmd := &cobra.Command{}
@@ -127,20 +161,18 @@ tasks:
 
 		_, err := callCommand(mockCtrl, []string{"fix:task", "test-task"}, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "Stderr:\nエラーメッセージ")
 					assert.Contains(t, messages[0].Content, "(>&2 echo \"エラーメッセージ\") && exit 1")
-					generated := "<!-- CODE_BLOCK_BEGIN -->```json" + `
-[ "aaa/bbb.txt" ]
-` + "```<!-- CODE_BLOCK_END -->"
+					assert.Equal(t, "extract_paths", options.ToolChoice)
 					return claude.GenerationResult{
-						Content:           generated,
-						TerminationReason: "success",
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "extract_paths", Input: `{"paths":["aaa/bbb.txt"]}`}},
+						TerminationReason: "tool_use",
 					}, nil
 				})
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "エラーメッセージ")
 					generated := "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb.txt" + `
 UPDATED_CONTENT
@@ -161,6 +193,53 @@ UPDATED_CONTENT
 		})
 	})
 
+	t.Run("修正対象のパスの抽出にはfix-task用のモデルが使われ、修正にはmake用のモデルが使われること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    commands:
+        fix-task:
+            model: claude-3-haiku-20240307
+            max-tokens: 1024
+tasks:
+  - name: test-task
+    run: |
+      (>&2 echo "エラーメッセージ") && exit 1
+`))
+		space.WriteFile("aaa/bbb.txt", []byte("CURRENT_CONTENT"))
+
+		_, err := callCommand(mockCtrl, []string{"fix:task", "test-task"}, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "claude-3-haiku-20240307", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, 1024, options.MaxTokens)
+					return claude.GenerationResult{
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "extract_paths", Input: `{"paths":["aaa/bbb.txt"]}`}},
+						TerminationReason: "tool_use",
+					}, nil
+				})
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "claude-3-5-sonnet-20240620", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, 0, options.MaxTokens)
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").Times(2)
+		})
+		assert.Error(t, err)
+	})
+
 	t.Run("フォルダ構造情報がプロンプトに含まれること", func(t *testing.T) {
 		// パスが検出出来なかった場合makeに進まず終了すること
 
@@ -187,16 +266,15 @@ tasks:
 
 		_, err := callCommand(mockCtrl, []string{"fix:task", "test-task"}, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
-					generated := "<!-- CODE_BLOCK_BEGIN -->```json\n[]\n```<!-- CODE_BLOCK_END -->"
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "aaa")
 					assert.Contains(t, messages[0].Content, "bbb.txt")
 					assert.Contains(t, messages[0].Content, "ccc")
 					assert.Contains(t, messages[0].Content, "ddd.txt")
 					return claude.GenerationResult{
-						Content:           generated,
-						TerminationReason: "success",
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "extract_paths", Input: `{"paths":[]}`}},
+						TerminationReason: "tool_use",
 					}, nil
 				})
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
@@ -210,6 +288,61 @@ tasks:
 		})
 	})
 
+	t.Run("修正対象のパスの回答がスキーマに従わない場合は修正を依頼すること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+tasks:
+  - name: test-task
+    run: |
+      (>&2 echo "エラーメッセージ") && exit 1
+`))
+		space.WriteFile("aaa/bbb.txt", []byte("CURRENT_CONTENT"))
+
+		_, err := callCommand(mockCtrl, []string{"fix:task", "test-task"}, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					return claude.GenerationResult{
+						ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "extract_paths", Input: `{"files":["aaa/bbb.txt"]}`}},
+						TerminationReason: "tool_use",
+					}, nil
+				})
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Len(t, messages, 3)
+					assert.Contains(t, messages[2].Content, `missing required property "paths"`)
+					return claude.GenerationResult{
+						ToolUses:          []claude.ToolUse{{ID: "toolu_02", Name: "extract_paths", Input: `{"paths":["aaa/bbb.txt"]}`}},
+						TerminationReason: "tool_use",
+					}, nil
+				})
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").Times(2)
+		})
+		assert.Error(t, err)
+
+		// Assert
+		space.AssertFile("aaa/bbb.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+	})
+
 	t.Run("taskが成功した場合終了すること", func(t *testing.T) {
 		mockCtrl := gomock.NewController(t)
 		defer mockCtrl.Finish()
@@ -3,31 +3,52 @@ package cmd
 import (
 	"github.com/spf13/cobra"
 	"github.com/t-kuni/sisho/cmd/addCommand"
+	"github.com/t-kuni/sisho/cmd/cacheCommand"
 	"github.com/t-kuni/sisho/cmd/depsGraphCommand"
 	"github.com/t-kuni/sisho/cmd/extractCommand"
 	"github.com/t-kuni/sisho/cmd/fixTaskCommand"
 	"github.com/t-kuni/sisho/cmd/initCommand"
 	"github.com/t-kuni/sisho/cmd/makeCommand"
 	"github.com/t-kuni/sisho/cmd/qCommand"
+	"github.com/t-kuni/sisho/cmd/undoCommand"
+	"github.com/t-kuni/sisho/cmd/usageCommand"
 	"github.com/t-kuni/sisho/cmd/versionCommand"
 	"github.com/t-kuni/sisho/domain/service/autoCollect"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
 	"github.com/t-kuni/sisho/domain/service/contextScan"
 	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
 	"github.com/t-kuni/sisho/domain/service/make"
 	"github.com/t-kuni/sisho/domain/service/projectScan"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
+	"github.com/t-kuni/sisho/domain/service/usageReport"
 	"github.com/t-kuni/sisho/infrastructure/external/claude"
 	"github.com/t-kuni/sisho/infrastructure/external/openAi"
 	"github.com/t-kuni/sisho/infrastructure/repository/config"
 	depsGraph2 "github.com/t-kuni/sisho/infrastructure/repository/depsGraph"
 	"github.com/t-kuni/sisho/infrastructure/repository/file"
 	"github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	snapshot2 "github.com/t-kuni/sisho/infrastructure/repository/snapshot"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/git"
 	"github.com/t-kuni/sisho/infrastructure/system/ksuid"
+	"github.com/t-kuni/sisho/infrastructure/system/terminal"
 	"github.com/t-kuni/sisho/infrastructure/system/timer"
 )
 
@@ -52,6 +73,7 @@ func NewRootCommand() *RootCommand {
 	configRepo := config.NewConfigRepository()
 	knowledgeRepo := knowledge.NewRepository()
 	depsGraphRepo := depsGraph2.NewRepository()
+	usageRepo := usage.NewRepository()
 	ksuidGenerator := ksuid.NewKsuidGenerator()
 	configFindSvc := configFindService.NewConfigFindService(fileRepo)
 	contextScanSvc := contextScan.NewContextScanService(fileRepo)
@@ -62,14 +84,31 @@ func NewRootCommand() *RootCommand {
 	projectScanSvc := projectScan.NewProjectScanService(fileRepo)
 	folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
 	extractCodeBlockSvc := extractCodeBlock.NewCodeBlockExtractService()
+	tokenBudgetSvc := tokenBudget.NewTokenBudgetService()
+	systemPromptSvc := systemPrompt.NewSystemPromptService()
+	llmSelectSvc := llmSelect.NewLLMSelectService()
+	usageRecordSvc := usageRecord.NewUsageRecordService(usageRepo, timer.NewTimer())
+	usageReportSvc := usageReport.NewUsageReportService(usageRepo)
+	responseCacheSvc := responseCache.NewResponseCacheService(timer.NewTimer())
+	replayFixtureSvc := replayFixture.NewReplayFixtureService()
+	fileToolsSvc := fileTools.NewFileToolsService(knowledgeRepo)
+	// 標準入力を読み込むバッファを共有するため、同じ端末を使う
+	terminalSys := terminal.NewTerminal()
+	hunkReviewSvc := hunkReview.NewHunkReviewService(terminalSys)
+	conflictResolveSvc := conflictResolve.NewConflictResolveService(terminalSys)
+	snapshotSvc := snapshot.NewSnapshotService(snapshot2.NewRepository(), timer.NewTimer())
+	structuredOutputSvc := structuredOutput.NewStructuredOutputService()
 
 	claudeClient := claude.NewClaudeClient()
 	openAiClient := openAi.NewOpenAIClient()
-	chatFactory := chatFactory.NewChatFactory(openAiClient, claudeClient)
+	openAiCompatibleClientFactory := openAi.NewCompatibleClientFactory()
+	credentialProvider := credential.NewProvider()
+	chatFactory := chatFactory.NewChatFactory(openAiClient, claudeClient, openAiCompatibleClientFactory, responseCacheSvc, replayFixtureSvc, configRepo, credentialProvider)
 
 	versionCmd := versionCommand.NewVersionCommand()
 	initCmd := initCommand.NewInitCommand(configRepo, fileRepo)
 	addCmd := addCommand.NewAddCommand(knowledgeRepo)
+	taskRunSvc := taskRun.NewTaskRunService()
 	makeService := make.NewMakeService(
 		configFindSvc,
 		configRepo,
@@ -81,6 +120,16 @@ func NewRootCommand() *RootCommand {
 		folderStructureMakeSvc,
 		extractCodeBlockSvc,
 		chatFactory,
+		tokenBudgetSvc,
+		usageRecordSvc,
+		systemPromptSvc,
+		llmSelectSvc,
+		fileToolsSvc,
+		hunkReviewSvc,
+		snapshotSvc,
+		git.NewGit(),
+		taskRunSvc,
+		conflictResolveSvc,
 	)
 	makeCmd := makeCommand.NewMakeCommand(makeService)
 	extractCmd := extractCommand.NewExtractCommand(
@@ -89,8 +138,13 @@ func NewRootCommand() *RootCommand {
 		knowledgeRepo,
 		folderStructureMakeSvc,
 		knowledgePathNormalizeSvc,
-		extractCodeBlockSvc,
+		structuredOutputSvc,
 		chatFactory,
+		timer.NewTimer(),
+		ksuidGenerator,
+		usageRecordSvc,
+		systemPromptSvc,
+		llmSelectSvc,
 	)
 	depsGraphCmd := depsGraphCommand.NewDepsGraphCommand(
 		configFindSvc,
@@ -108,6 +162,10 @@ func NewRootCommand() *RootCommand {
 		ksuidGenerator,
 		folderStructureMakeSvc,
 		chatFactory,
+		usageRecordSvc,
+		systemPromptSvc,
+		llmSelectSvc,
+		fileToolsSvc,
 	)
 	fixTaskCmd := fixTaskCommand.NewFixTaskCommand(
 		configFindSvc,
@@ -117,7 +175,24 @@ func NewRootCommand() *RootCommand {
 		timer.NewTimer(),
 		ksuidGenerator,
 		folderStructureMakeSvc,
-		extractCodeBlockSvc,
+		structuredOutputSvc,
+		usageRecordSvc,
+		systemPromptSvc,
+		llmSelectSvc,
+		taskRunSvc,
+	)
+	usageCmd := usageCommand.NewUsageCommand(
+		configFindSvc,
+		configRepo,
+		usageReportSvc,
+	)
+	cacheCmd := cacheCommand.NewCacheCommand(
+		configFindSvc,
+		responseCacheSvc,
+	)
+	undoCmd := undoCommand.NewUndoCommand(
+		configFindSvc,
+		snapshotSvc,
 	)
 
 	cmd.AddCommand(versionCmd.CobraCommand)
@@ -128,6 +203,9 @@ func NewRootCommand() *RootCommand {
 	cmd.AddCommand(depsGraphCmd.CobraCommand)
 	cmd.AddCommand(qCmd.CobraCommand)
 	cmd.AddCommand(fixTaskCmd.CobraCommand)
+	cmd.AddCommand(usageCmd.CobraCommand)
+	cmd.AddCommand(cacheCmd.CobraCommand)
+	cmd.AddCommand(undoCmd.CobraCommand)
 
 	return &RootCommand{
 		CobraCommand: cmd,
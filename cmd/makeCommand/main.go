@@ -23,13 +23,25 @@ func NewMakeCommand(makeService *make.MakeService) *MakeCommand {
 	var chainFlag bool
 	var inputFlag bool
 	var dryRunFlag bool
+	var noCacheFlag bool
+	var toolsFlag bool
+	var driverFlag string
+	var modelFlag string
+	var jobsFlag int
+	var togetherFlag bool
+	var editFormatFlag string
+	var interactiveFlag bool
+	var allowDirtyFlag bool
+	var verifyFlag []string
+	var verifyRoundsFlag int
+	var onConflictFlag string
 
 	cmd := &cobra.Command{
 		Use:   "make [path...]",
 		Short: "Generate files using LLM",
 		Long:  `Generate files at the specified paths using LLM based on the knowledge sets.`,
 		Args:  cobra.MinimumNArgs(1),
-		RunE:  runMake(&promptFlag, &applyFlag, &chainFlag, &inputFlag, &dryRunFlag, makeService),
+		RunE:  runMake(&promptFlag, &applyFlag, &chainFlag, &inputFlag, &dryRunFlag, &noCacheFlag, &toolsFlag, &driverFlag, &modelFlag, &jobsFlag, &togetherFlag, &editFormatFlag, &interactiveFlag, &allowDirtyFlag, &verifyFlag, &verifyRoundsFlag, &onConflictFlag, makeService),
 	}
 
 	cmd.Flags().BoolVarP(&promptFlag, "prompt", "p", false, "Open editor for additional instructions")
@@ -37,6 +49,18 @@ func NewMakeCommand(makeService *make.MakeService) *MakeCommand {
 	cmd.Flags().BoolVarP(&chainFlag, "chain", "c", false, "Include dependent files based on deps-graph")
 	cmd.Flags().BoolVarP(&inputFlag, "input", "i", false, "Read additional instructions from stdin")
 	cmd.Flags().BoolVarP(&dryRunFlag, "dry-run", "d", false, "Perform a dry run without applying changes")
+	cmd.Flags().BoolVar(&noCacheFlag, "no-cache", false, "Do not use the response cache")
+	cmd.Flags().BoolVar(&toolsFlag, "tools", false, "Let the LLM read files of the project with tools")
+	cmd.Flags().StringVar(&driverFlag, "driver", "", "Override llm.driver for this run")
+	cmd.Flags().StringVar(&modelFlag, "model", "", "Override llm.model for this run")
+	cmd.Flags().IntVarP(&jobsFlag, "jobs", "j", 1, "Number of targets generated in parallel")
+	cmd.Flags().BoolVar(&togetherFlag, "together", false, "Generate all targets in one request")
+	cmd.Flags().StringVar(&editFormatFlag, "edit-format", "", "Override edit.format for this run (whole, search-replace or udiff)")
+	cmd.Flags().BoolVar(&interactiveFlag, "interactive", false, "Review each hunk before applying LLM output to files")
+	cmd.Flags().BoolVar(&allowDirtyFlag, "allow-dirty", false, "Apply to files with uncommitted changes when git.enabled is true")
+	cmd.Flags().StringSliceVar(&verifyFlag, "verify", nil, "Run the tasks after applying and ask the LLM to fix the errors")
+	cmd.Flags().IntVar(&verifyRoundsFlag, "verify-rounds", 3, "Maximum number of rounds of fixes when --verify fails")
+	cmd.Flags().StringVar(&onConflictFlag, "on-conflict", "", "How to apply to files changed during generation without asking (merge, new or abort)")
 
 	return &MakeCommand{
 		CobraCommand: cmd,
@@ -50,9 +74,40 @@ func runMake(
 	chainFlag *bool,
 	inputFlag *bool,
 	dryRunFlag *bool,
+	noCacheFlag *bool,
+	toolsFlag *bool,
+	driverFlag *string,
+	modelFlag *string,
+	jobsFlag *int,
+	togetherFlag *bool,
+	editFormatFlag *string,
+	interactiveFlag *bool,
+	allowDirtyFlag *bool,
+	verifyFlag *[]string,
+	verifyRoundsFlag *int,
+	onConflictFlag *string,
 	makeService *make.MakeService,
 ) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
+		if *jobsFlag < 1 {
+			return eris.New("-j must be 1 or more")
+		}
+		if *togetherFlag && *jobsFlag > 1 {
+			return eris.New("cannot use both --together and -j")
+		}
+		if *interactiveFlag && *jobsFlag > 1 {
+			return eris.New("cannot use both --interactive and -j")
+		}
+		if *interactiveFlag && *inputFlag {
+			return eris.New("cannot use both --interactive and -i flags")
+		}
+		if len(*verifyFlag) > 0 && !*applyFlag && !*interactiveFlag {
+			return eris.New("--verify needs -a or --interactive")
+		}
+		if *verifyRoundsFlag < 1 {
+			return eris.New("--verify-rounds must be 1 or more")
+		}
+
 		// 追加の指示の取得
 		var instructions string
 		if *promptFlag && *inputFlag {
@@ -75,7 +130,24 @@ func runMake(
 			fmt.Println(instructions)
 		}
 
-		err := makeService.Make(args, *applyFlag, *chainFlag, instructions, *dryRunFlag)
+		err := makeService.Make(cmd.Context(), args, make.Options{
+			Apply:        *applyFlag,
+			Chain:        *chainFlag,
+			Instructions: instructions,
+			DryRun:       *dryRunFlag,
+			NoCache:      *noCacheFlag,
+			Driver:       *driverFlag,
+			Model:        *modelFlag,
+			Tools:        *toolsFlag,
+			Jobs:         *jobsFlag,
+			Together:     *togetherFlag,
+			EditFormat:   *editFormatFlag,
+			Interactive:  *interactiveFlag,
+			AllowDirty:   *allowDirtyFlag,
+			Verify:       *verifyFlag,
+			VerifyRounds: *verifyRoundsFlag,
+			OnConflict:   *onConflictFlag,
+		})
 		if err != nil {
 			return eris.Wrap(err, "failed to execute make command")
 		}
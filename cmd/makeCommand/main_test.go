@@ -1,6 +1,7 @@
 package makeCommand
 
 import (
+	"context"
 	"fmt"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
@@ -10,18 +11,34 @@ import (
 	"github.com/t-kuni/sisho/domain/service/autoCollect"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
 	"github.com/t-kuni/sisho/domain/service/contextScan"
 	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
 	makeService "github.com/t-kuni/sisho/domain/service/make"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
+	"github.com/t-kuni/sisho/domain/system/terminal"
 	"github.com/t-kuni/sisho/domain/system/timer"
 	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
 	"github.com/t-kuni/sisho/infrastructure/repository/depsGraph"
 	knowledge2 "github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	snapshot2 "github.com/t-kuni/sisho/infrastructure/repository/snapshot"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/git"
 	"github.com/t-kuni/sisho/testUtil"
 	"go.uber.org/mock/gomock"
 	"testing"
@@ -42,6 +59,7 @@ func TestMakeCommand(t *testing.T) {
 		customizeMocks func(mocks Mocks),
 	) error {
 		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
 		mockClaudeClient := claude.NewMockClient(mockCtrl)
 		mockOpenAiClient := openAi.NewMockClient(mockCtrl)
 		mockFileRepo := file.NewMockRepository(mockCtrl)
@@ -57,7 +75,8 @@ func TestMakeCommand(t *testing.T) {
 		mockKsuidGenerator := ksuid.NewMockIKsuid(mockCtrl)
 		folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
 		extractCodeBlockSvc := extractCodeBlock.NewCodeBlockExtractService()
-		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient)
+		mockOpenAiCompatibleClientFactory := openAi.NewMockCompatibleClientFactory(mockCtrl)
+		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient, mockOpenAiCompatibleClientFactory, responseCache.NewResponseCacheService(mockTimer), replayFixture.NewReplayFixtureService(), config2.NewConfigRepository(), credential.NewProvider())
 
 		customizeMocks(Mocks{
 			ClaudeClient:   mockClaudeClient,
@@ -78,6 +97,16 @@ func TestMakeCommand(t *testing.T) {
 			folderStructureMakeSvc,
 			extractCodeBlockSvc,
 			chatFactorySvc,
+			tokenBudget.NewTokenBudgetService(),
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
+			fileTools.NewFileToolsService(knowledgeRepo),
+			hunkReview.NewHunkReviewService(mockTerminal),
+			snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer),
+			git.NewGit(),
+			taskRun.NewTaskRunService(),
+			conflictResolve.NewConflictResolveService(mockTerminal),
 		)
 		makeCmd := NewMakeCommand(makeSvc)
 
@@ -112,8 +141,8 @@ UPDATED_CONTENT%d
 
 		err := callCommand(mockCtrl, []string{"make", "aaa/bbb.txt", "aaa/ccc.txt", "-a"}, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Len(t, messages, 1)
 					assert.Contains(t, messages[0].Content, "aaa/bbb.txt")
 					assert.Contains(t, messages[0].Content, "CURRENT_CONTENT1")
@@ -124,8 +153,8 @@ UPDATED_CONTENT%d
 						TerminationReason: "success",
 					}, nil
 				})
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Len(t, messages, 1)
 					assert.Contains(t, messages[0].Content, "aaa/bbb.txt")
 					assert.Contains(t, messages[0].Content, "UPDATED_CONTENT1")
@@ -186,8 +215,8 @@ dummy text
 
 		err := callCommand(mockCtrl, []string{"make", "aaa/bbb/ccc/ddd.txt", "-ai"}, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "Additional Instruction")
 					assert.Contains(t, messages[0].Content, inputText)
 					return claude.GenerationResult{
@@ -238,24 +267,24 @@ UPDATED_CONTENT%d
 
 		err := callCommand(mockCtrl, []string{"make", "file3.go", "-ac"}, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					//assert.Contains(t, messages[0].Content, "FILE3_CONTENT")
 					return claude.GenerationResult{
 						Content:           fmt.Sprintf(generatedFormat, "file3.go", 1),
 						TerminationReason: "success",
 					}, nil
 				})
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					//assert.Contains(t, messages[0].Content, "FILE2_CONTENT")
 					return claude.GenerationResult{
 						Content:           fmt.Sprintf(generatedFormat, "file2.go", 2),
 						TerminationReason: "success",
 					}, nil
 				})
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					//assert.Contains(t, messages[0].Content, "FILE1_CONTENT")
 					return claude.GenerationResult{
 						Content:           fmt.Sprintf(generatedFormat, "file1.go", 3),
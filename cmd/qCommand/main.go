@@ -2,8 +2,10 @@ package qCommand
 
 import (
 	"fmt"
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"github.com/t-kuni/sisho/domain/model/prompts"
 	"github.com/t-kuni/sisho/domain/model/prompts/question"
+	"github.com/t-kuni/sisho/domain/model/retry"
 	"io"
 	"os"
 	"os/exec"
@@ -15,9 +17,14 @@ import (
 	"github.com/t-kuni/sisho/domain/repository/config"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/historyLog"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
 	"github.com/t-kuni/sisho/domain/system/timer"
 )
@@ -35,22 +42,34 @@ func NewQCommand(
 	ksuidGenerator ksuid.IKsuid,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
 	chatFactoryService *chatFactory.ChatFactory,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
+	fileToolsService *fileTools.FileToolsService,
 ) *QCommand {
 	var promptFlag bool
 	var inputFlag bool
+	var noCacheFlag bool
+	var toolsFlag bool
+	var override llmSelect.Override
 
 	cmd := &cobra.Command{
 		Use:   "q [path...]",
 		Short: "Ask questions about specified files using LLM",
 		Long:  `Ask questions about specified files using LLM based on the knowledge sets.`,
 		Args:  cobra.MinimumNArgs(1),
-		RunE: runQ(&promptFlag, &inputFlag, configFindService, configRepository,
+		RunE: runQ(&promptFlag, &inputFlag, &noCacheFlag, &toolsFlag, &override, configFindService, configRepository,
 			knowledgeScanService, knowledgeLoadService, timer, ksuidGenerator,
-			folderStructureMakeService, chatFactoryService),
+			folderStructureMakeService, chatFactoryService, usageRecordService, systemPromptService, llmSelectService,
+			fileToolsService),
 	}
 
 	cmd.Flags().BoolVarP(&promptFlag, "prompt", "p", false, "Open editor for additional instructions")
 	cmd.Flags().BoolVarP(&inputFlag, "input", "i", false, "Read additional instructions from stdin")
+	cmd.Flags().BoolVar(&noCacheFlag, "no-cache", false, "Do not use the response cache")
+	cmd.Flags().BoolVar(&toolsFlag, "tools", false, "Let the LLM read files of the project with tools")
+	cmd.Flags().StringVar(&override.Driver, "driver", "", "Override llm.driver for this run")
+	cmd.Flags().StringVar(&override.Model, "model", "", "Override llm.model for this run")
 
 	return &QCommand{
 		CobraCommand: cmd,
@@ -60,6 +79,9 @@ func NewQCommand(
 func runQ(
 	promptFlag *bool,
 	inputFlag *bool,
+	noCacheFlag *bool,
+	toolsFlag *bool,
+	override *llmSelect.Override,
 	configFindService *configFindService.ConfigFindService,
 	configRepository config.Repository,
 	knowledgeScanService *knowledgeScan.KnowledgeScanService,
@@ -68,6 +90,10 @@ func runQ(
 	ksuidGenerator ksuid.IKsuid,
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
 	chatFactoryService *chatFactory.ChatFactory,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
+	fileToolsService *fileTools.FileToolsService,
 ) func(cmd *cobra.Command, args []string) error {
 	return func(cmd *cobra.Command, args []string) error {
 		configPath, err := configFindService.FindConfig()
@@ -79,6 +105,10 @@ func runQ(
 		if err != nil {
 			return eris.Wrap(err, "failed to read config file")
 		}
+		cfg, err = llmSelectService.Select(cfg, config.CommandQ, *override)
+		if err != nil {
+			return eris.Wrap(err, "failed to select LLM")
+		}
 
 		rootDir := configFindService.GetProjectRoot(configPath)
 
@@ -122,7 +152,10 @@ func runQ(
 			}
 		}
 
-		chat, err := chatFactoryService.Make(cfg)
+		chatClient, err := chatFactoryService.Make(cfg, chatFactory.MakeOptions{
+			RootDir: rootDir,
+			NoCache: *noCacheFlag,
+		})
 		if err != nil {
 			return eris.Wrap(err, "failed to create chat instance")
 		}
@@ -159,18 +192,78 @@ func runQ(
 			return eris.Wrap(err, "failed to save prompt history")
 		}
 
-		answer, err := chat.Send(prompt, cfg.LLM.Model)
+		system, err := systemPromptService.Resolve(rootDir, cfg, config.CommandQ)
 		if err != nil {
+			return eris.Wrap(err, "failed to resolve system prompt")
+		}
+
+		err = systemPromptService.SaveHistory(historyDir, system)
+		if err != nil {
+			return eris.Wrap(err, "failed to save system prompt history")
+		}
+
+		// 回答は受信しながら標準出力に出力する
+		sendOptions := chat.SendOptions{
+			System:      system,
+			Attachments: prompts.Attachments(knowledgeSets),
+			OnDelta: func(delta string) {
+				fmt.Print(delta)
+			},
+			OnRetry: func(event retry.Event) {
+				fmt.Printf("\nRetry: %s\n", event)
+				historyLog.Record(os.Stdout, historyDir, "retry.log", timer, event.String())
+			},
+			OnFallback: func(event chat.FallbackEvent) {
+				historyLog.Print(os.Stdout, historyDir, "provider.log", timer, fmt.Sprintf("Fallback: %s", event))
+			},
+		}
+
+		// ツールを使う場合は、モデルが読み込んだファイルを記録する
+		var toolSession *fileTools.Session
+		if *toolsFlag || cfg.Tools.Enabled {
+			toolSession, err = fileToolsService.Open(rootDir)
+			if err != nil {
+				return eris.Wrap(err, "failed to open file tools")
+			}
+			sendOptions.Tools = fileToolsService.Tools()
+			sendOptions.MaxToolRounds = cfg.Tools.MaxRounds
+			sendOptions.OnToolCall = func(call chat.ToolCall) string {
+				historyLog.Print(os.Stdout, historyDir, "tools.log", timer, fmt.Sprintf("Tool: %s %s", call.Name, call.Arguments))
+				return toolSession.Call(call)
+			}
+		}
+
+		answer, err := chatClient.Send(cmd.Context(), prompt, cfg.LLM.Model, sendOptions)
+		fmt.Println()
+		if toolSession != nil {
+			saveErr := fileToolsService.SaveFetched(filepath.Join(historyDir, "fetched.know.yml"), toolSession)
+			if saveErr != nil {
+				fmt.Printf("Warning: failed to save fetched files: %v\n", saveErr)
+			}
+		}
+		if err != nil {
+			if cmd.Context().Err() != nil {
+				historyLog.Record(os.Stdout, historyDir, "aborted.log", timer, fmt.Sprintf("Aborted: %v", cmd.Context().Err()))
+			}
 			return eris.Wrap(err, "failed to send message to LLM")
 		}
+		if answer.Cached {
+			fmt.Println("Answer loaded from the response cache")
+		}
+		if answer.Provider.Driver != "" {
+			historyLog.Print(os.Stdout, historyDir, "provider.log", timer, fmt.Sprintf("Answered by: %s", answer.Provider))
+		}
+
+		err = usageRecordService.Record(historyDir, "q", cfg, answer)
+		if err != nil {
+			fmt.Printf("Warning: failed to save usage: %v\n", err)
+		}
 
 		err = saveAnswerHistory(historyDir, answer.Content)
 		if err != nil {
 			return eris.Wrap(err, "failed to save answer history")
 		}
 
-		fmt.Println(answer.Content)
-
 		return nil
 	}
 }
@@ -217,6 +310,10 @@ func printKnowledgePaths(knowledgeSets []prompts.KnowledgeSet) {
 	fmt.Println("Knowledge paths:")
 	for _, set := range knowledgeSets {
 		for _, k := range set.Knowledge {
+			if k.MediaType != "" {
+				fmt.Printf("- %s (%s, attached as %s)\n", k.Path, set.Kind, k.MediaType)
+				continue
+			}
 			fmt.Printf("- %s (%s)\n", k.Path, set.Kind)
 		}
 	}
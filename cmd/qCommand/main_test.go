@@ -1,6 +1,7 @@
 package qCommand_test
 
 import (
+	"context"
 	"github.com/spf13/cobra"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/cmd/qCommand"
@@ -11,14 +12,22 @@ import (
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
 	"github.com/t-kuni/sisho/domain/service/contextScan"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
 	"github.com/t-kuni/sisho/domain/system/timer"
 	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
 	knowledge2 "github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
 	"github.com/t-kuni/sisho/testUtil"
 	"go.uber.org/mock/gomock"
 	"testing"
@@ -52,7 +61,8 @@ func TestQCommand(t *testing.T) {
 		knowledgeLoadSvc := knowledgeLoad.NewKnowledgeLoadService(knowledgeRepo)
 		mockKsuidGenerator := ksuid.NewMockIKsuid(mockCtrl)
 		folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
-		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient)
+		mockOpenAiCompatibleClientFactory := openAi.NewMockCompatibleClientFactory(mockCtrl)
+		chatFactorySvc := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient, mockOpenAiCompatibleClientFactory, responseCache.NewResponseCacheService(mockTimer), replayFixture.NewReplayFixtureService(), config2.NewConfigRepository(), credential.NewProvider())
 
 		customizeMocks(Mocks{
 			ClaudeClient:   mockClaudeClient,
@@ -71,6 +81,10 @@ func TestQCommand(t *testing.T) {
 			mockKsuidGenerator,
 			folderStructureMakeSvc,
 			chatFactorySvc,
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
+			fileTools.NewFileToolsService(knowledgeRepo),
 		)
 
 		rootCmd := &cobra.Command{}
@@ -98,8 +112,8 @@ llm:
 		testUtil.Stdin(t, "This is a test question")
 
 		err := callCommand(mockCtrl, []string{"q", "main.go", "-i"}, func(mocks Mocks) {
-			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), "gpt-4").
-				DoAndReturn(func(messages []openAi.Message, model string) (openAi.GenerationResult, error) {
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "main.go")
 					assert.Contains(t, messages[0].Content, "package main")
 					assert.Contains(t, messages[0].Content, "This is a test question")
@@ -116,6 +130,43 @@ llm:
 		assert.NoError(t, err)
 	})
 
+	t.Run("qコマンド用のシステムプロンプトが指定されている場合、それが送信されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+  driver: open-ai
+  model: gpt-4
+system-prompt:
+  text: HOUSE_RULES
+  commands:
+    q:
+      text: QUESTION_RULES
+`))
+
+		space.WriteFile("main.go", []byte(`package main`))
+
+		err := callCommand(mockCtrl, []string{"q", "main.go"}, func(mocks Mocks) {
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					assert.Equal(t, "QUESTION_RULES", options.System)
+					return openAi.GenerationResult{
+						Content:           "LLM Response",
+						TerminationReason: "stop",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2021-01-02T15:04:05Z")).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
+		})
+
+		assert.NoError(t, err)
+	})
+
 	t.Run("複数のTargetを指定した場合、それらのファイルが読み込まれてプロンプトに記載されること", func(t *testing.T) {
 		mockCtrl := gomock.NewController(t)
 		defer mockCtrl.Finish()
@@ -136,7 +187,7 @@ llm:
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2021-01-02T15:04:05Z")).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
-			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), "gpt-4").DoAndReturn(func(messages []openAi.Message, model string) (openAi.GenerationResult, error) {
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
 				assert.Contains(t, messages[0].Content, "main.go")
 				assert.Contains(t, messages[0].Content, "package main")
 				assert.Contains(t, messages[0].Content, "helper.go")
@@ -171,8 +222,8 @@ additional-knowledge:
 		space.WriteFile("subdir/helper.go", []byte(`package helper`))
 
 		err := callCommand(mockCtrl, []string{"q", "main.go"}, func(mocks Mocks) {
-			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), "gpt-4").
-				DoAndReturn(func(messages []openAi.Message, model string) (openAi.GenerationResult, error) {
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "main.go")
 					assert.Contains(t, messages[0].Content, "package main")
 					assert.Contains(t, messages[0].Content, "/subdir")
@@ -212,8 +263,8 @@ knowledge:
 		space.WriteFile("example.go", []byte(`package example`))
 
 		err := callCommand(mockCtrl, []string{"q", "main.go"}, func(mocks Mocks) {
-			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), "gpt-4").
-				DoAndReturn(func(messages []openAi.Message, model string) (openAi.GenerationResult, error) {
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
 					assert.Contains(t, messages[0].Content, "main.go")
 					assert.Contains(t, messages[0].Content, "package main")
 					assert.Contains(t, messages[0].Content, "example.go")
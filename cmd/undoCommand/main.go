@@ -0,0 +1,59 @@
+package undoCommand
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/spf13/cobra"
+	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+)
+
+type UndoCommand struct {
+	CobraCommand *cobra.Command
+}
+
+func NewUndoCommand(
+	configFindService *configFindService.ConfigFindService,
+	snapshotService *snapshot.SnapshotService,
+) *UndoCommand {
+	var force bool
+
+	cmd := &cobra.Command{
+		Use:   "undo [history-id]",
+		Short: "Restore the files changed by a make run",
+		Long:  `Restore the files changed by the make run of the history ID to their content before the run. Without a history ID, the latest run that has not been undone is restored.`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			configPath, err := configFindService.FindConfig()
+			if err != nil {
+				return eris.Wrap(err, "failed to find config file")
+			}
+
+			rootDir := configFindService.GetProjectRoot(configPath)
+
+			var historyID string
+			if len(args) > 0 {
+				historyID = args[0]
+			} else {
+				historyID, err = snapshotService.Latest(rootDir)
+				if err != nil {
+					return eris.Wrap(err, "failed to find the latest run")
+				}
+			}
+
+			out := cmd.OutOrStdout()
+			fmt.Fprintf(out, "Undoing %s\n", historyID)
+			err = snapshotService.Undo(out, rootDir, historyID, force)
+			if err != nil {
+				return eris.Wrapf(err, "failed to undo %s", historyID)
+			}
+			return nil
+		},
+	}
+
+	cmd.Flags().BoolVar(&force, "force", false, "Undo even if the files were changed after sisho wrote them")
+
+	return &UndoCommand{
+		CobraCommand: cmd,
+	}
+}
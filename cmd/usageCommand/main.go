@@ -0,0 +1,129 @@
+package usageCommand
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/spf13/cobra"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/usageReport"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+type UsageCommand struct {
+	CobraCommand *cobra.Command
+}
+
+func NewUsageCommand(
+	configFindService *configFindService.ConfigFindService,
+	configRepository config.Repository,
+	usageReportService *usageReport.UsageReportService,
+) *UsageCommand {
+	var since string
+
+	cmd := &cobra.Command{
+		Use:   "usage",
+		Short: "Show token usage and estimated cost",
+		Long:  `Total the token usage recorded in the history and show it by day, command and model with the estimated cost.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return runUsage(cmd.OutOrStdout(), since, configFindService, configRepository, usageReportService)
+		},
+	}
+
+	cmd.Flags().StringVar(&since, "since", "", "Only include usage on or after this date (YYYY-MM-DD)")
+
+	return &UsageCommand{
+		CobraCommand: cmd,
+	}
+}
+
+func runUsage(
+	out io.Writer,
+	since string,
+	configFindService *configFindService.ConfigFindService,
+	configRepository config.Repository,
+	usageReportService *usageReport.UsageReportService,
+) error {
+	configPath, err := configFindService.FindConfig()
+	if err != nil {
+		return eris.Wrap(err, "failed to find config file")
+	}
+
+	cfg, err := configRepository.Read(configPath)
+	if err != nil {
+		return eris.Wrap(err, "failed to read config file")
+	}
+
+	rootDir := configFindService.GetProjectRoot(configPath)
+
+	var sinceTime time.Time
+	if since != "" {
+		sinceTime, err = time.ParseInLocation("2006-01-02", since, time.Local)
+		if err != nil {
+			return eris.Wrapf(err, "invalid --since: %s", since)
+		}
+	}
+
+	records, err := usageReportService.Collect(rootDir, sinceTime)
+	if err != nil {
+		return eris.Wrap(err, "failed to collect usage")
+	}
+
+	if len(records) == 0 {
+		fmt.Fprintln(out, "No usage recorded.")
+		return nil
+	}
+
+	report := usageReportService.Summarize(records, cfg.Prices)
+
+	// プロンプトキャッシュを使った記録がある場合だけ、キャッシュのトークン数の列を出力する
+	withCache := report.Total.CacheReadTokens > 0 || report.Total.CacheWriteTokens > 0
+
+	printRows(out, "By day", "DATE", report.Days, withCache)
+	printRows(out, "By command", "COMMAND", report.Commands, withCache)
+	printRows(out, "By model", "MODEL", report.Models, withCache)
+	fmt.Fprintf(out, "Total: %d runs, %d input tokens, %d output tokens, ",
+		report.Total.Runs, report.Total.InputTokens, report.Total.OutputTokens)
+	if withCache {
+		fmt.Fprintf(out, "%d cache read tokens, %d cache write tokens, ", report.Total.CacheReadTokens, report.Total.CacheWriteTokens)
+	}
+	fmt.Fprintf(out, "%s\n", formatCost(report.Total))
+
+	if report.Total.CostUnknown {
+		fmt.Fprintln(out, "* Includes models that are not in the price table. Their cost is not included.")
+	}
+
+	return nil
+}
+
+func printRows(out io.Writer, title string, keyHeader string, rows []usageReport.Row, withCache bool) {
+	fmt.Fprintf(out, "%s:\n", title)
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	if withCache {
+		fmt.Fprintf(w, "%s\tRUNS\tINPUT\tOUTPUT\tCACHE READ\tCACHE WRITE\tCOST (USD)\n", keyHeader)
+	} else {
+		fmt.Fprintf(w, "%s\tRUNS\tINPUT\tOUTPUT\tCOST (USD)\n", keyHeader)
+	}
+	for _, row := range rows {
+		if withCache {
+			fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", row.Key, row.Runs, row.InputTokens, row.OutputTokens, row.CacheReadTokens, row.CacheWriteTokens, formatCost(row))
+			continue
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\n", row.Key, row.Runs, row.InputTokens, row.OutputTokens, formatCost(row))
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+}
+
+func formatCost(row usageReport.Row) string {
+	cost := fmt.Sprintf("$%.4f", row.Cost)
+	if row.CostUnknown {
+		cost += " *"
+	}
+	return cost
+}
@@ -0,0 +1,193 @@
+package usageCommand
+
+import (
+	"bytes"
+	"github.com/spf13/cobra"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/repository/file"
+	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/usageReport"
+	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	"github.com/t-kuni/sisho/testUtil"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func TestUsageCommand(t *testing.T) {
+	type Mocks struct {
+		FileRepository *file.MockRepository
+	}
+
+	callCommand := func(
+		mockCtrl *gomock.Controller,
+		args []string,
+		customizeMocks func(mocks Mocks),
+	) (string, error) {
+		mockFileRepo := file.NewMockRepository(mockCtrl)
+		configRepo := config2.NewConfigRepository()
+		configFindSvc := configFindService.NewConfigFindService(mockFileRepo)
+		usageReportSvc := usageReport.NewUsageReportService(usage.NewRepository())
+
+		customizeMocks(Mocks{
+			FileRepository: mockFileRepo,
+		})
+
+		usageCmd := NewUsageCommand(configFindSvc, configRepo, usageReportSvc)
+
+		rootCmd := &cobra.Command{}
+		rootCmd.AddCommand(usageCmd.CobraCommand)
+
+		buf := new(bytes.Buffer)
+		rootCmd.SetOut(buf)
+		rootCmd.SetErr(buf)
+		rootCmd.SetArgs(args)
+
+		err := rootCmd.Execute()
+		return buf.String(), err
+	}
+
+	writeUsages := func(space testUtil.Space) {
+		space.WriteFile(".sisho/history/aaa/usage.yml", []byte(`
+command: make
+driver: anthropic
+model: claude-3-5-sonnet-20240620
+time: 2022-01-01T10:00:00Z
+input-tokens: 1000000
+output-tokens: 100000
+`))
+		space.WriteFile(".sisho/history/questions/bbb/usage.yml", []byte(`
+command: q
+driver: anthropic
+model: claude-3-5-sonnet-20240620
+time: 2022-01-02T10:00:00Z
+input-tokens: 2000000
+output-tokens: 0
+`))
+		space.WriteFile(".sisho/fixTask/ccc/usage.yml", []byte(`
+command: fix:task
+driver: open-ai-compatible
+model: llama3
+time: 2022-01-02T11:00:00Z
+input-tokens: 500
+output-tokens: 50
+`))
+	}
+
+	t.Run("日別・コマンド別・モデル別に集計されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		writeUsages(space)
+
+		out, err := callCommand(mockCtrl, []string{"usage"}, func(mocks Mocks) {
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+		})
+		assert.NoError(t, err)
+
+		assert.Regexp(t, `2022-01-01\s+1\s+1000000\s+100000\s+\$4\.5000\n`, out)
+		assert.Regexp(t, `2022-01-02\s+2\s+2000500\s+50\s+\$6\.0000 \*\n`, out)
+		assert.Regexp(t, `make\s+1\s+1000000\s+100000\s+\$4\.5000\n`, out)
+		assert.Regexp(t, `fix:task\s+1\s+500\s+50\s+\$0\.0000 \*\n`, out)
+		assert.Regexp(t, `claude-3-5-sonnet-20240620\s+2\s+3000000\s+100000\s+\$10\.5000\n`, out)
+		assert.Contains(t, out, "Total: 3 runs, 3000500 input tokens, 100050 output tokens, $10.5000 *")
+	})
+
+	t.Run("プロジェクトコンフィグの料金表が優先されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+prices:
+  - model: claude-3-5-sonnet
+    input: 1
+    output: 1
+  - model: llama
+    input: 0
+    output: 0
+`))
+		writeUsages(space)
+
+		out, err := callCommand(mockCtrl, []string{"usage"}, func(mocks Mocks) {
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+		})
+		assert.NoError(t, err)
+
+		assert.Regexp(t, `claude-3-5-sonnet-20240620\s+2\s+3000000\s+100000\s+\$3\.1000\n`, out)
+		assert.Regexp(t, `llama3\s+1\s+500\s+50\s+\$0\.0000\n`, out)
+		assert.NotContains(t, out, "not in the price table")
+	})
+
+	t.Run("sinceより前の記録は集計されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		writeUsages(space)
+
+		out, err := callCommand(mockCtrl, []string{"usage", "--since", "2022-01-02"}, func(mocks Mocks) {
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+		})
+		assert.NoError(t, err)
+
+		assert.NotContains(t, out, "2022-01-01")
+		assert.Contains(t, out, "Total: 2 runs")
+	})
+	t.Run("プロンプトキャッシュを使った記録がある場合、キャッシュのトークン数が出力されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile(".sisho/history/aaa/usage.yml", []byte(`
+command: make
+driver: anthropic
+model: claude-3-5-sonnet-20240620
+time: 2022-01-01T10:00:00Z
+input-tokens: 1000000
+output-tokens: 100000
+cache-read-tokens: 2000000
+cache-write-tokens: 1000000
+`))
+
+		out, err := callCommand(mockCtrl, []string{"usage"}, func(mocks Mocks) {
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+		})
+		assert.NoError(t, err)
+
+		assert.Contains(t, out, "CACHE READ")
+		assert.Regexp(t, `make\s+1\s+1000000\s+100000\s+2000000\s+1000000\s+\$8\.8500\n`, out)
+		assert.Contains(t, out, "Total: 1 runs, 1000000 input tokens, 100000 output tokens, 2000000 cache read tokens, 1000000 cache write tokens, $8.8500")
+	})
+}
@@ -2,18 +2,99 @@
 
 package claude
 
+import (
+	"context"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/system/credential"
+)
+
 // Client はClaude APIとの通信を抽象化するインターフェースです。
 type Client interface {
 	// SendMessage はメッセージを送信し、応答を返します。
+	// ctxが終了した場合は送信を中止し、ctxのエラーを返します。
 	// モデルのバリデーションは行いません。
 	// ステータスコード200以外が返却された場合、レスポンスボディ全体をエラーメッセージに含めます。
-	SendMessage(messages []Message, model string) (GenerationResult, error)
+	// options.OnDeltaが指定された場合、生成されたテキストを受信する度に呼び出します。
+	// レート制限や一時的なエラーの場合、options.Retryに従って再試行します。
+	SendMessage(ctx context.Context, messages []Message, model string, options SendOptions) (GenerationResult, error)
+}
+
+// SendOptions はSendMessageの付加的な設定を表します。
+type SendOptions struct {
+	// System はシステムプロンプトです。空の場合は送信しません。
+	System string
+	// MaxTokens は出力トークン数の上限です。0の場合はデフォルト値を使います。
+	MaxTokens int
+	// Temperature はサンプリングの温度です。nilの場合は送信しません。
+	Temperature *float64
+	// TopP はnucleus samplingの確率です。nilの場合は送信しません。
+	TopP *float64
+	// Stop は生成を停止する文字列のリストです。空の場合は送信しません。
+	Stop []string
+	// Tools はモデルが呼び出せるツールです。空の場合は送信しません。
+	Tools []Tool
+	// ToolChoice はモデルに必ず呼び出させるツールの名前です。空の場合はモデルが選択します。
+	ToolChoice string
+	// OnDelta はストリームで生成されたテキストの断片を受信する度に呼び出されます。nilの場合は呼び出されません。
+	OnDelta func(delta string)
+	// Retry は送信に失敗した場合の再試行の方針です。ゼロ値の場合は再試行しません。
+	Retry retry.Policy
+	// OnRetry は再試行の待機に入る直前に呼び出されます。nilの場合は呼び出されません。
+	OnRetry func(event retry.Event)
+	// Credential は送信時に使うAPIキーの取得元です。nilの場合はクライアントに設定されたAPIキーを使います。
+	// 認証に失敗した場合、エラーメッセージに取得元を含めます。
+	Credential credential.Credential
 }
 
 // Message はClaude APIに送信するメッセージの構造を表します。
+// Blocksが空でない場合は、Contentの代わりにBlocksをコンテンツブロックの配列として送信します。
 type Message struct {
 	Role    string
 	Content string
+	Blocks  []ContentBlock
+}
+
+// ContentBlock はメッセージを構成するコンテンツブロックです。
+// ToolUse、ToolResult、Attachmentのいずれも指定されていない場合はテキストのブロックです。
+type ContentBlock struct {
+	Text string
+	// Cache がtrueの場合、このブロックまでをプロンプトキャッシュの対象にします（cache_control）。
+	Cache bool
+	// ToolUse はモデルが要求したツールの呼び出しです（assistantのメッセージで使います）。
+	ToolUse *ToolUse
+	// ToolResult はツールの呼び出しの結果です（userのメッセージで使います）。
+	ToolResult *ToolResult
+	// Attachment は画像またはPDFのファイルです（userのメッセージで使います）。
+	Attachment *Attachment
+}
+
+// Attachment はメッセージに添付するファイルです。
+// MediaTypeがimage/で始まる場合は画像（image）、それ以外はドキュメント（document）として送信します。
+type Attachment struct {
+	MediaType string
+	Data      []byte
+}
+
+// Tool はモデルが呼び出せるツールの定義です。
+type Tool struct {
+	Name        string
+	Description string
+	// InputSchema は引数のJSONスキーマです。
+	InputSchema map[string]interface{}
+}
+
+// ToolUse はモデルが要求したツールの呼び出しです。
+type ToolUse struct {
+	ID   string
+	Name string
+	// Input は引数のJSONオブジェクトです。
+	Input string
+}
+
+// ToolResult はツールの呼び出しの結果です。
+type ToolResult struct {
+	ToolUseID string
+	Content   string
 }
 
 // ModelName はClaude APIで使用可能なモデル名を定義する型です。
@@ -56,4 +137,17 @@ func ValidateModel(model string) bool {
 type GenerationResult struct {
 	Content           string
 	TerminationReason string
+	Usage             Usage
+	// ToolUses はモデルが要求したツールの呼び出しです。TerminationReasonはtool_useになります。
+	ToolUses []ToolUse
+}
+
+// Usage はAPIが報告したトークンの使用量を表す構造体です。
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+	// CacheCreationInputTokens はプロンプトキャッシュに書き込んだ入力トークン数です。
+	CacheCreationInputTokens int
+	// CacheReadInputTokens はプロンプトキャッシュから読み込んだ入力トークン数です。
+	CacheReadInputTokens int
 }
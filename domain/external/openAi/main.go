@@ -2,18 +2,115 @@
 
 package openAi
 
+import (
+	"context"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/system/credential"
+)
+
 // Client はOpenAI APIとの通信を抽象化するインターフェースです。
 type Client interface {
 	// SendMessage はメッセージを送信し、応答を返します。
+	// ctxが終了した場合は送信を中止し、ctxのエラーを返します。
 	// モデルのバリデーションは行いません。
 	// ステータスコード200以外が返却された場合、レスポンスボディ全体をエラーメッセージに含めます。
-	SendMessage(messages []Message, model string) (GenerationResult, error)
+	// options.OnDeltaが指定された場合、生成されたテキストを受信する度に呼び出します。
+	// レート制限や一時的なエラーの場合、options.Retryに従って再試行します。
+	SendMessage(ctx context.Context, messages []Message, model string, options SendOptions) (GenerationResult, error)
+}
+
+// SendOptions はSendMessageの付加的な設定を表します。
+type SendOptions struct {
+	// System はシステムプロンプトです。空の場合は送信しません。
+	System string
+	// MaxTokens は出力トークン数の上限です。0の場合はデフォルト値を使います。
+	MaxTokens int
+	// Temperature はサンプリングの温度です。nilの場合は送信しません。
+	Temperature *float64
+	// TopP はnucleus samplingの確率です。nilの場合は送信しません。
+	TopP *float64
+	// Stop は生成を停止する文字列のリストです。空の場合は送信しません。
+	Stop []string
+	// Tools はモデルが呼び出せる関数です（function calling）。空の場合は送信しません。
+	Tools []Tool
+	// ResponseFormat は回答のJSONスキーマです（response_format）。nilの場合は送信しません。
+	ResponseFormat *ResponseFormat
+	// OnDelta はストリームで生成されたテキストの断片を受信する度に呼び出されます。nilの場合は呼び出されません。
+	OnDelta func(delta string)
+	// Retry は送信に失敗した場合の再試行の方針です。ゼロ値の場合は再試行しません。
+	Retry retry.Policy
+	// OnRetry は再試行の待機に入る直前に呼び出されます。nilの場合は呼び出されません。
+	OnRetry func(event retry.Event)
+	// Credential は送信時に使うAPIキーの取得元です。nilの場合はクライアントに設定されたAPIキーを使い、それも無い場合は認証ヘッダーを送信しません。
+	// 認証に失敗した場合、エラーメッセージに取得元を含めます。
+	Credential credential.Credential
+}
+
+// CompatibleClientFactory はOpenAI互換APIと通信するClientを生成するインターフェースです。
+type CompatibleClientFactory interface {
+	// NewCompatibleClient はsettingで指定したエンドポイントと通信するClientを生成します。
+	// 通信のプロトコルはOpenAI APIのChat Completions（Stream通信）と同じです。
+	NewCompatibleClient(setting CompatibleSetting) (Client, error)
+}
+
+// CompatibleSetting はOpenAI互換APIとの接続設定を表します。
+type CompatibleSetting struct {
+	// BaseURL はAPIのベースURLです（例: http://localhost:11434/v1）
+	BaseURL string
+	// Headers はリクエストに付与する追加のヘッダーです。
+	Headers map[string]string
 }
 
 // Message はOpenAI APIに送信するメッセージの構造を表します。
+// Partsが空でない場合は、Contentの代わりにPartsをコンテンツパートの配列として送信します。
 type Message struct {
 	Role    string
 	Content string
+	Parts   []ContentPart
+	// ToolCalls はモデルが要求した関数の呼び出しです（assistantのメッセージで使います）。
+	ToolCalls []ToolCall
+	// ToolCallID は結果を返す関数の呼び出しのIDです（toolのメッセージで使います）。
+	ToolCallID string
+}
+
+// ContentPart はメッセージを構成するコンテンツパートです。
+// Attachmentが指定されていない場合はテキストのパートです。
+type ContentPart struct {
+	Text string
+	// Attachment は画像またはPDFのファイルです（userのメッセージで使います）。
+	Attachment *Attachment
+}
+
+// Attachment はメッセージに添付するファイルです。
+// MediaTypeがimage/で始まる場合は画像（image_url）、それ以外はファイル（file）として送信します。
+type Attachment struct {
+	// Filename はファイルとして送信する場合のファイル名です。
+	Filename  string
+	MediaType string
+	Data      []byte
+}
+
+// ResponseFormat は回答をJSONスキーマに従わせるための指定です。
+type ResponseFormat struct {
+	Name string
+	// Schema は回答のJSONスキーマです。
+	Schema map[string]interface{}
+}
+
+// Tool はモデルが呼び出せる関数の定義です。
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters は引数のJSONスキーマです。
+	Parameters map[string]interface{}
+}
+
+// ToolCall はモデルが要求した関数の呼び出しです。
+type ToolCall struct {
+	ID   string
+	Name string
+	// Arguments は引数のJSONオブジェクトです。
+	Arguments string
 }
 
 // ModelName はOpenAI APIで使用可能なモデル名を定義する型です。
@@ -58,4 +155,13 @@ func ValidateModel(model string) bool {
 type GenerationResult struct {
 	Content           string
 	TerminationReason string
+	Usage             Usage
+	// ToolCalls はモデルが要求した関数の呼び出しです。TerminationReasonはtool_callsになります。
+	ToolCalls []ToolCall
+}
+
+// Usage はAPIが報告したトークンの使用量を表す構造体です。
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
 }
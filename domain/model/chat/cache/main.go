@@ -0,0 +1,137 @@
+//go:generate mockgen -source=$GOFILE -destination=${GOFILE}_mock.go -package=$GOPACKAGE
+
+package cache
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/t-kuni/sisho/domain/model/chat"
+)
+
+// Store はレスポンスキャッシュの保存先を抽象化するインターフェースです。
+// キャッシュの読み書きに失敗しても生成は継続できるため、エラーは返さずにキャッシュが無いものとして扱います。
+type Store interface {
+	// Get はkeyに対応する結果を返します。存在しない場合はokがfalseになります。
+	Get(key string) (result chat.SendResult, ok bool)
+	// Put はkeyに対応する結果を保存します。
+	Put(key string, result chat.SendResult)
+}
+
+// KeyParams はキャッシュのキーに含める、プロンプト以外の生成条件です。
+type KeyParams struct {
+	Driver string
+	// Params はモデル以外の生成に影響するパラメータです。
+	Params map[string]string
+}
+
+// CachedChat はchat.Chatの前段でレスポンスをキャッシュするチャットモデルです。
+// キーはドライバ、モデル、パラメータ、会話履歴を含むプロンプトのハッシュです。
+type CachedChat struct {
+	chat      chat.ChatWithHistory
+	store     Store
+	keyParams KeyParams
+	history   []chat.Message
+}
+
+func NewCachedChat(c chat.ChatWithHistory, store Store, keyParams KeyParams) *CachedChat {
+	return &CachedChat{
+		chat:      c,
+		store:     store,
+		keyParams: keyParams,
+		history:   []chat.Message{},
+	}
+}
+
+// Send はキャッシュに同じリクエストの結果があればそれを返し、無ければ内部のチャットモデルに送信して結果を保存します。
+// キャッシュから返した場合、OnDeltaには回答全体を1度だけ渡し、Usageは0とします。
+// ツールが有効な場合、回答は送信時点のファイルの内容に依存するためキャッシュを使いません。
+func (c *CachedChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	messages := append(append([]chat.Message{}, c.history...), chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints})
+
+	if options.ToolsEnabled() {
+		return c.sendWithoutCache(ctx, prompt, model, options, messages)
+	}
+
+	key, err := c.key(model, options.System, options.ResponseSchema, messages)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	result, ok := c.store.Get(key)
+	if ok && validAnswer(options, result.Content) {
+		if options.OnDelta != nil {
+			options.OnDelta(result.Content)
+		}
+		result.Usage = chat.Usage{}
+		result.Cached = true
+		c.history = append(messages, chat.Message{Role: "assistant", Content: result.Content})
+		return result, nil
+	}
+
+	result, err = c.sendWithoutCache(ctx, prompt, model, options, messages)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	if validAnswer(options, result.Content) {
+		c.store.Put(key, result)
+	}
+
+	return result, nil
+}
+
+// validAnswer はSendOptions.ValidateAnswerで回答を検証します。検証が指定されていない場合はtrueを返します。
+func validAnswer(options chat.SendOptions, content string) bool {
+	return options.ValidateAnswer == nil || options.ValidateAnswer(content) == nil
+}
+
+// sendWithoutCache は内部のチャットモデルに送信し、会話の履歴に回答を追加します。
+func (c *CachedChat) sendWithoutCache(ctx context.Context, prompt string, model string, options chat.SendOptions, messages []chat.Message) (chat.SendResult, error) {
+	// 以前のやり取りをキャッシュから返している場合は、内部のチャットモデルの履歴を合わせる
+	if len(c.chat.GetHistory()) != len(c.history) {
+		c.chat.SetHistory(c.history)
+	}
+
+	result, err := c.chat.Send(ctx, prompt, model, options)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+	c.history = append(messages, chat.Message{Role: "assistant", Content: result.Content})
+
+	return result, nil
+}
+
+func (c *CachedChat) GetHistory() []chat.Message {
+	return c.history
+}
+
+func (c *CachedChat) SetHistory(history []chat.Message) {
+	c.history = append([]chat.Message{}, history...)
+	c.chat.SetHistory(history)
+}
+
+func (c *CachedChat) key(model string, system string, schema *chat.ResponseSchema, messages []chat.Message) (string, error) {
+	b, err := json.Marshal(struct {
+		Driver   string
+		Model    string
+		Params   map[string]string
+		System   string
+		Schema   *chat.ResponseSchema `json:",omitempty"`
+		Messages []chat.Message
+	}{
+		Driver:   c.keyParams.Driver,
+		Model:    model,
+		Params:   c.keyParams.Params,
+		System:   system,
+		Schema:   schema,
+		Messages: messages,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:]), nil
+}
@@ -1,47 +1,241 @@
 package claude
 
 import (
+	"context"
 	"github.com/t-kuni/sisho/domain/external/claude"
 	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"strings"
 )
 
 type ClaudeChat struct {
-	client  claude.Client
-	history []chat.Message
+	client        claude.Client
+	retryPolicy   retry.Policy
+	params        chat.GenerationParams
+	promptCaching bool
+	credential    credential.Credential
+	history       []chat.Message
 }
 
-func NewClaudeChat(client claude.Client) *ClaudeChat {
+// NewClaudeChat はClaudeChatを生成します。
+// promptCachingがtrueの場合、SendOptions.CacheBreakpointsで区切られたプロンプトの接頭辞をプロンプトキャッシュの対象にします。
+// credentialはAPIキーの取得元です。APIキーは最初に送信する時点で読み込みます。
+func NewClaudeChat(client claude.Client, retryPolicy retry.Policy, params chat.GenerationParams, promptCaching bool, credential credential.Credential) *ClaudeChat {
 	return &ClaudeChat{
-		client:  client,
-		history: []chat.Message{},
+		client:        client,
+		retryPolicy:   retryPolicy,
+		params:        params,
+		promptCaching: promptCaching,
+		credential:    credential,
+		history:       []chat.Message{},
 	}
 }
 
-func (c *ClaudeChat) Send(prompt string, model string) (chat.SendResult, error) {
-	// Add user message to history
-	c.history = append(c.history, chat.Message{Role: "user", Content: prompt})
+func (c *ClaudeChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	err := chat.CheckAttachments(options.Attachments, acceptedMediaTypes())
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	// 送信に失敗した場合（中断を含む）に履歴にプロンプトが残らないよう、成功してから履歴に反映する
+	history := append(append([]chat.Message{}, c.history...), chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints})
 
 	// Convert history to Claude messages
-	claudeMessages := make([]claude.Message, len(c.history))
-	for i, msg := range c.history {
-		claudeMessages[i] = claude.Message{Role: msg.Role, Content: msg.Content}
+	// 以前のメッセージも送信した時点のブロックで送信し、続きの会話でもプロンプトキャッシュを使えるようにする
+	claudeMessages := make([]claude.Message, len(history))
+	for i, msg := range history {
+		var blocks []claude.ContentBlock
+		if c.promptCaching {
+			blocks = splitBlocks(msg.Content, msg.CacheBreakpoints)
+		}
+		claudeMessages[i] = claude.Message{Role: msg.Role, Content: msg.Content, Blocks: withAttachments(msg.Content, blocks, msg.Attachments)}
 	}
+	limitCacheBlocks(claudeMessages)
 
-	// Send message to Claude API
-	response, err := c.client.SendMessage(claudeMessages, model)
-	if err != nil {
-		return chat.SendResult{}, err
+	sendOptions := claude.SendOptions{
+		Credential:  c.credential,
+		System:      options.System,
+		MaxTokens:   c.params.MaxTokens,
+		Temperature: c.params.Temperature,
+		TopP:        c.params.TopP,
+		Stop:        c.params.Stop,
+		OnDelta:     options.OnDelta,
+		Retry:       c.retryPolicy,
+		OnRetry:     options.OnRetry,
+	}
+	if options.ToolsEnabled() {
+		sendOptions.Tools = convertTools(options.Tools)
+	}
+	if options.ResponseSchema != nil {
+		// 構造化出力は、スキーマを引数とするツールを必ず呼び出させることで実現する
+		sendOptions.Tools = []claude.Tool{{
+			Name:        options.ResponseSchema.Name,
+			Description: options.ResponseSchema.Description,
+			InputSchema: options.ResponseSchema.Schema,
+		}}
+		sendOptions.ToolChoice = options.ResponseSchema.Name
+	}
+
+	// Send message to Claude API until the model stops calling tools
+	var response claude.GenerationResult
+	var usage chat.Usage
+	for round := 1; ; round++ {
+		var err error
+		response, err = c.client.SendMessage(ctx, claudeMessages, model, sendOptions)
+		if err != nil {
+			return chat.SendResult{}, err
+		}
+		usage = usage.Add(chat.Usage{
+			InputTokens:      response.Usage.InputTokens,
+			OutputTokens:     response.Usage.OutputTokens,
+			CacheReadTokens:  response.Usage.CacheReadInputTokens,
+			CacheWriteTokens: response.Usage.CacheCreationInputTokens,
+		})
+		if len(response.ToolUses) == 0 || !options.ToolsEnabled() {
+			break
+		}
+
+		assistantBlocks := []claude.ContentBlock{}
+		if response.Content != "" {
+			assistantBlocks = append(assistantBlocks, claude.ContentBlock{Text: response.Content})
+		}
+		resultBlocks := []claude.ContentBlock{}
+		for _, toolUse := range response.ToolUses {
+			toolUse := toolUse
+			assistantBlocks = append(assistantBlocks, claude.ContentBlock{ToolUse: &toolUse})
+			result, err := options.ToolResult(round, chat.ToolCall{ID: toolUse.ID, Name: toolUse.Name, Arguments: toolUse.Input})
+			if err != nil {
+				return chat.SendResult{}, err
+			}
+			resultBlocks = append(resultBlocks, claude.ContentBlock{ToolResult: &claude.ToolResult{ToolUseID: toolUse.ID, Content: result}})
+		}
+		claudeMessages = append(claudeMessages,
+			claude.Message{Role: "assistant", Content: response.Content, Blocks: assistantBlocks},
+			claude.Message{Role: "user", Blocks: resultBlocks},
+		)
+	}
+
+	content := response.Content
+	finishReason := convertFinishReason(response.TerminationReason)
+	if options.ResponseSchema != nil {
+		content, finishReason = structuredContent(response, options.ResponseSchema.Name)
 	}
 
-	// Add assistant response to history
-	c.history = append(c.history, chat.Message{Role: "assistant", Content: response.Content})
+	// Add assistant response to history. The tool calls are not kept in the history.
+	c.history = append(history, chat.Message{Role: "assistant", Content: content})
 
 	return chat.SendResult{
-		Content:      response.Content,
-		FinishReason: response.TerminationReason,
+		Content:      content,
+		FinishReason: finishReason,
+		Usage:        usage,
 	}, nil
 }
 
+// structuredContent は構造化出力のために呼び出させたツールの引数（JSON）を回答として返します。
+// ツールが呼び出されていない場合はテキストの回答をそのまま返します。
+func structuredContent(response claude.GenerationResult, name string) (string, string) {
+	for _, toolUse := range response.ToolUses {
+		if toolUse.Name == name {
+			return toolUse.Input, chat.FinishReasonStop
+		}
+	}
+	return response.Content, convertFinishReason(response.TerminationReason)
+}
+
+// convertTools converts the tools of chat to the tools of Claude API.
+func convertTools(tools []chat.Tool) []claude.Tool {
+	converted := make([]claude.Tool, len(tools))
+	for i, tool := range tools {
+		converted[i] = claude.Tool{Name: tool.Name, Description: tool.Description, InputSchema: tool.Parameters}
+	}
+	return converted
+}
+
+// acceptedMediaTypes はClaude APIに添付できるファイルの種類です。
+func acceptedMediaTypes() []string {
+	return append(append([]string{}, chat.ImageMediaTypes...), chat.DocumentMediaTypes...)
+}
+
+// withAttachments はテキストのブロックの最後のブロックの直前に、添付ファイルのパスを示すテキストと添付ファイルのブロックを挿入します。
+// 最後のブロックの直前に置くのは、プロンプトキャッシュの対象となる接頭辞を添付ファイルで変えないためです。
+// テキストのブロックが無い場合はcontent全体を1つのブロックとします。添付ファイルが無い場合はblocksをそのまま返します。
+func withAttachments(content string, blocks []claude.ContentBlock, attachments []chat.Attachment) []claude.ContentBlock {
+	if len(attachments) == 0 {
+		return blocks
+	}
+	if len(blocks) == 0 {
+		blocks = []claude.ContentBlock{{Text: content}}
+	}
+
+	converted := append([]claude.ContentBlock{}, blocks[:len(blocks)-1]...)
+	for _, attachment := range attachments {
+		converted = append(converted,
+			claude.ContentBlock{Text: attachment.Path},
+			claude.ContentBlock{Attachment: &claude.Attachment{MediaType: attachment.MediaType, Data: attachment.Data}},
+		)
+	}
+	return append(converted, blocks[len(blocks)-1])
+}
+
+// splitBlocks はプロンプトを区切り位置で分割し、最後以外のブロックをキャッシュの対象にします。
+// 空白だけのブロックはAPIが受け付けないため、次のブロックに含めます。
+// 区切り位置が無い場合はnilを返します（プロンプトを文字列のまま送信します）。
+func splitBlocks(prompt string, breakpoints []int) []claude.ContentBlock {
+	var blocks []claude.ContentBlock
+	start := 0
+	for _, end := range breakpoints {
+		if end <= start || end >= len(prompt) {
+			continue
+		}
+		if strings.TrimSpace(prompt[start:end]) == "" {
+			continue
+		}
+		blocks = append(blocks, claude.ContentBlock{Text: prompt[start:end], Cache: true})
+		start = end
+	}
+	if len(blocks) == 0 {
+		return nil
+	}
+	return append(blocks, claude.ContentBlock{Text: prompt[start:]})
+}
+
+// maxCacheBreakpoints はClaude APIが1回のリクエストで受け付けるcache_controlの数の上限です。
+const maxCacheBreakpoints = 4
+
+// limitCacheBlocks はキャッシュの対象にするブロックを後ろから数えてmaxCacheBreakpoints個までにします。
+// 後ろのブロックほど長い接頭辞を表すため、後ろのブロックを残します。
+func limitCacheBlocks(messages []claude.Message) {
+	count := 0
+	for i := len(messages) - 1; i >= 0; i-- {
+		for j := len(messages[i].Blocks) - 1; j >= 0; j-- {
+			if !messages[i].Blocks[j].Cache {
+				continue
+			}
+			count++
+			if count > maxCacheBreakpoints {
+				messages[i].Blocks[j].Cache = false
+			}
+		}
+	}
+}
+
+// convertFinishReason converts the stop_reason of Claude API to the finish reason of chat.
+func convertFinishReason(stopReason string) string {
+	switch stopReason {
+	case "end_turn", "stop_sequence":
+		return chat.FinishReasonStop
+	case "max_tokens":
+		return chat.FinishReasonLength
+	default:
+		return stopReason
+	}
+}
+
 func (c *ClaudeChat) GetHistory() []chat.Message {
 	return c.history
 }
+
+func (c *ClaudeChat) SetHistory(history []chat.Message) {
+	c.history = append([]chat.Message{}, history...)
+}
@@ -0,0 +1,46 @@
+package claude_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/external/claude"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	chatClaude "github.com/t-kuni/sisho/domain/model/chat/claude"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	t.Run("送信に失敗した場合、プロンプトが履歴に残らず、次の送信に含まれないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockClient := claude.NewMockClient(mockCtrl)
+		gomock.InOrder(
+			mockClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{}, context.Canceled),
+			mockClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, []claude.Message{{Role: "user", Content: "SECOND"}}, messages)
+					return claude.GenerationResult{Content: "ANSWER", TerminationReason: "end_turn"}, nil
+				}),
+		)
+
+		testee := chatClaude.NewClaudeChat(mockClient, retry.Policy{}, chat.GenerationParams{}, false, nil)
+
+		_, err := testee.Send(context.Background(), "FIRST", "claude-3-5-sonnet-20240620", chat.SendOptions{})
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Empty(t, testee.GetHistory())
+
+		_, err = testee.Send(context.Background(), "SECOND", "claude-3-5-sonnet-20240620", chat.SendOptions{})
+		assert.NoError(t, err)
+
+		// Assert
+		assert.Equal(t, []chat.Message{
+			{Role: "user", Content: "SECOND"},
+			{Role: "assistant", Content: "ANSWER"},
+		}, testee.GetHistory())
+	})
+}
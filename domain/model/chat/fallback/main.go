@@ -0,0 +1,83 @@
+package fallback
+
+import (
+	"context"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"strings"
+)
+
+// Member はフォールバックチェーンを構成する1つのプロバイダーです。
+type Member struct {
+	Provider chat.Provider
+	Chat     chat.Chat
+}
+
+// FallbackChat は先頭のプロバイダーから順に送信し、失敗した場合は次のプロバイダーに切り替えるチャットモデルです。
+// 再試行はそれぞれのチャットモデルの中で行われるため、ここに届くのは再試行できないエラーか再試行を使い切ったエラーです。
+type FallbackChat struct {
+	members []Member
+	history []chat.Message
+}
+
+func NewFallbackChat(members []Member) *FallbackChat {
+	return &FallbackChat{
+		members: members,
+		history: []chat.Message{},
+	}
+}
+
+// Send は先頭のプロバイダーから順に送信し、最初に成功した結果を返します。
+// modelは使わず、各プロバイダーのモデルで送信します。
+// 送信前に、そのプロバイダーの会話の履歴をSetHistory()でFallbackChatの履歴に揃えます。
+func (c *FallbackChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	// 回答の一部をOnDeltaに渡した後は、次のプロバイダーの回答が続けて渡されないように切り替えない
+	delivered := false
+	sendOptions := options
+	if options.OnDelta != nil {
+		sendOptions.OnDelta = func(delta string) {
+			delivered = true
+			options.OnDelta(delta)
+		}
+	}
+
+	var messages []string
+	for i, member := range c.members {
+		if withHistory, ok := member.Chat.(chat.ChatWithHistory); ok {
+			withHistory.SetHistory(c.history)
+		}
+
+		result, err := member.Chat.Send(ctx, prompt, member.Provider.Model, sendOptions)
+		if err == nil {
+			c.history = append(c.history,
+				chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints},
+				chat.Message{Role: "assistant", Content: result.Content},
+			)
+			result.Provider = member.Provider
+			return result, nil
+		}
+		if ctx.Err() != nil || delivered {
+			// 中断された場合は次のプロバイダーに切り替えない
+			return chat.SendResult{}, err
+		}
+
+		messages = append(messages, member.Provider.String()+": "+err.Error())
+		if i+1 < len(c.members) && options.OnFallback != nil {
+			options.OnFallback(chat.FallbackEvent{
+				From: member.Provider,
+				To:   c.members[i+1].Provider,
+				Err:  err,
+			})
+		}
+	}
+
+	return chat.SendResult{}, eris.Errorf("all providers failed:\n%s", strings.Join(messages, "\n"))
+}
+
+func (c *FallbackChat) GetHistory() []chat.Message {
+	return c.history
+}
+
+func (c *FallbackChat) SetHistory(history []chat.Message) {
+	c.history = append([]chat.Message{}, history...)
+}
@@ -0,0 +1,50 @@
+package limit
+
+import (
+	"context"
+	"github.com/t-kuni/sisho/domain/model/chat"
+)
+
+// Slots は同じプロバイダーに同時に送信できる数を制限するセマフォです。
+// 同じプロバイダーのLimitedChatで共有します。
+type Slots chan struct{}
+
+// NewSlots は同時にn個まで送信できるSlotsを生成します。
+func NewSlots(n int) Slots {
+	return make(Slots, n)
+}
+
+// LimitedChat はSlotsの空きを待ってから送信するチャットモデルです。
+// 並行して生成する場合に、プロバイダーのレート制限に掛からないよう同時に送信する数を制限します。
+type LimitedChat struct {
+	chat  chat.ChatWithHistory
+	slots Slots
+}
+
+func NewLimitedChat(c chat.ChatWithHistory, slots Slots) *LimitedChat {
+	return &LimitedChat{
+		chat:  c,
+		slots: slots,
+	}
+}
+
+// Send はSlotsに空きができるまで待ってから送信します。送信が終わるまでSlotsを1つ使います。
+// 待っている間にctxが終了した場合は送信せずにctxのエラーを返します。
+func (c *LimitedChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return chat.SendResult{}, ctx.Err()
+	}
+	defer func() { <-c.slots }()
+
+	return c.chat.Send(ctx, prompt, model, options)
+}
+
+func (c *LimitedChat) GetHistory() []chat.Message {
+	return c.chat.GetHistory()
+}
+
+func (c *LimitedChat) SetHistory(history []chat.Message) {
+	c.chat.SetHistory(history)
+}
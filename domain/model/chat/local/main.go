@@ -1,6 +1,7 @@
 package local
 
 import (
+	"context"
 	_ "embed"
 	"github.com/t-kuni/sisho/domain/model/chat"
 )
@@ -14,7 +15,16 @@ func NewLocalChat() *LocalChat {
 	return &LocalChat{}
 }
 
-func (l *LocalChat) Send(prompt string, model string) (chat.SendResult, error) {
+func (l *LocalChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	err := chat.CheckAttachments(options.Attachments, nil)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	if options.OnDelta != nil {
+		options.OnDelta(resultContent)
+	}
+
 	// Return the embedded content of result.txt as the response
 	return chat.SendResult{
 		Content:      resultContent,
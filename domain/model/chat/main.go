@@ -2,22 +2,230 @@
 
 package chat
 
+import (
+	"context"
+	"fmt"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"strings"
+)
+
 type Chat interface {
-	Send(prompt string, model string) (SendResult, error)
+	// Send sends the prompt and returns the answer. It stops and returns the error of ctx when ctx is done.
+	Send(ctx context.Context, prompt string, model string, options SendOptions) (SendResult, error)
 }
 
 type Message struct {
 	Role    string
 	Content string
+	// Attachments are the files sent along with the content. They are kept in the history so that continued conversations still include them.
+	Attachments []Attachment `json:",omitempty"`
+	// CacheBreakpoints are the SendOptions.CacheBreakpoints the content was sent with. They are kept in the history so that
+	// continued conversations send the same cacheable prefix again. They do not affect the answer and are not serialized.
+	CacheBreakpoints []int `json:"-"`
 }
 
 type ChatWithHistory interface {
 	Chat
 	GetHistory() []Message
+	// SetHistory replaces the conversation history. The next Send continues from this history.
+	SetHistory(history []Message)
+}
+
+// SendOptions represents optional settings of a chat interaction
+type SendOptions struct {
+	// System is the system prompt sent along with the conversation. It is not sent if empty.
+	System string
+	// OnDelta is called with each piece of generated text as it arrives. It is ignored if nil.
+	OnDelta func(delta string)
+	// OnRetry is called before waiting for the next attempt when sending fails with a retryable error. It is ignored if nil.
+	OnRetry func(event retry.Event)
+	// CacheBreakpoints are byte offsets in the prompt. Each part of the prompt before an offset is sent as a cacheable prefix
+	// when the driver supports prompt caching and it is enabled. It is ignored otherwise.
+	CacheBreakpoints []int
+	// Tools are the tools the model can call while answering. Tools are not used if empty, OnToolCall is nil or ResponseSchema is set.
+	Tools []Tool
+	// OnToolCall executes a tool call requested by the model and returns the result passed back to the model.
+	OnToolCall func(call ToolCall) string
+	// MaxToolRounds is the maximum number of requests that return tool calls in a single Send. 0 means the default value.
+	MaxToolRounds int
+	// ResponseSchema requests the answer as a JSON document that matches the schema. The answer is not constrained if nil.
+	// Drivers that cannot constrain the output ignore it, so the answer must still be validated.
+	ResponseSchema *ResponseSchema
+	// ValidateAnswer checks the content of the answer. An answer that fails the check is neither stored in nor served from
+	// the response cache, so that an invalid answer is not replayed on the next run. It is ignored if nil.
+	ValidateAnswer func(content string) error
+	// OnFallback is called when a provider of a fallback chain fails and the next provider is tried. It is ignored if nil.
+	OnFallback func(event FallbackEvent)
+	// Attachments are binary files such as images and PDFs sent along with the prompt.
+	// Drivers that cannot accept the media type of an attachment return an error without sending the prompt.
+	Attachments []Attachment
+}
+
+// Attachment represents a binary file sent along with the prompt
+type Attachment struct {
+	// Path is the path the prompt uses to refer to the file
+	Path string
+	// MediaType is the MIME type of the file. See ImageMediaTypes and DocumentMediaTypes.
+	MediaType string
+	Data      []byte
+}
+
+// ImageMediaTypes are the media types of images that can be attached
+var ImageMediaTypes = []string{"image/png", "image/jpeg", "image/gif", "image/webp"}
+
+// DocumentMediaTypes are the media types of documents that can be attached
+var DocumentMediaTypes = []string{"application/pdf"}
+
+// IsAttachmentMediaType reports whether files of the media type are sent as attachments instead of text
+func IsAttachmentMediaType(mediaType string) bool {
+	return containsMediaType(ImageMediaTypes, mediaType) || containsMediaType(DocumentMediaTypes, mediaType)
+}
+
+// CheckAttachments returns an error if an attachment has a media type that is not in accepted.
+func CheckAttachments(attachments []Attachment, accepted []string) error {
+	for _, attachment := range attachments {
+		if !containsMediaType(accepted, attachment.MediaType) {
+			if len(accepted) == 0 {
+				return fmt.Errorf("%s (%s) cannot be sent: the driver does not accept attachments", attachment.Path, attachment.MediaType)
+			}
+			return fmt.Errorf("%s (%s) cannot be sent: the driver only accepts %s", attachment.Path, attachment.MediaType, strings.Join(accepted, ", "))
+		}
+	}
+	return nil
+}
+
+func containsMediaType(mediaTypes []string, mediaType string) bool {
+	for _, t := range mediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// ResponseSchema represents the JSON schema of a structured answer
+type ResponseSchema struct {
+	// Name identifies the schema. It is used as the name of the forced tool for drivers that use tool calls for structured output.
+	Name        string
+	Description string
+	// Schema is the JSON schema of the answer. The top level must be an object.
+	Schema map[string]interface{}
+}
+
+// Tool represents a tool the model can call
+type Tool struct {
+	Name        string
+	Description string
+	// Parameters is the JSON schema of the arguments
+	Parameters map[string]interface{}
+}
+
+// ToolCall represents a call of a tool requested by the model
+type ToolCall struct {
+	ID   string
+	Name string
+	// Arguments is the JSON object of the arguments
+	Arguments string
+}
+
+// DefaultMaxToolRounds is the maximum number of requests that return tool calls in a single Send when SendOptions.MaxToolRounds is 0
+const DefaultMaxToolRounds = 10
+
+// ToolLimitReached is passed back to the model instead of the result of a tool call after MaxToolRounds is reached
+const ToolLimitReached = "tool call limit reached, answer with the information you have"
+
+// ToolsEnabled reports whether the model can call tools
+func (o SendOptions) ToolsEnabled() bool {
+	return len(o.Tools) > 0 && o.OnToolCall != nil && o.ResponseSchema == nil
+}
+
+// ToolResult returns the result of call passed back to the model in the given round (1-based).
+// It returns an error if the model keeps calling tools after it was told that the limit was reached.
+func (o SendOptions) ToolResult(round int, call ToolCall) (string, error) {
+	limit := o.MaxToolRounds
+	if limit <= 0 {
+		limit = DefaultMaxToolRounds
+	}
+	switch {
+	case round <= limit:
+		return o.OnToolCall(call), nil
+	case round == limit+1:
+		return ToolLimitReached, nil
+	default:
+		return "", fmt.Errorf("the model kept calling tools after %d rounds", limit)
+	}
+}
+
+// Provider identifies the driver and the model that answered
+type Provider struct {
+	Driver string
+	Model  string
+}
+
+func (p Provider) String() string {
+	return p.Driver + "/" + p.Model
+}
+
+// FallbackEvent represents a switch to the next provider of a fallback chain
+type FallbackEvent struct {
+	From Provider
+	To   Provider
+	Err  error
+}
+
+func (e FallbackEvent) String() string {
+	return fmt.Sprintf("%s failed, falling back to %s: %v", e.From, e.To, e.Err)
+}
+
+// GenerationParams represents the parameters that control the generation.
+// Zero values mean the default value of each LLM API.
+type GenerationParams struct {
+	// MaxTokens is the maximum number of output tokens.
+	MaxTokens int
+	// Temperature is the sampling temperature. nil means the default value.
+	Temperature *float64
+	// TopP is the nucleus sampling probability. nil means the default value.
+	TopP *float64
+	// Stop is the list of sequences that stop the generation.
+	Stop []string
 }
 
 // SendResult represents the result of a chat interaction
 type SendResult struct {
-	Content      string
+	Content string
+	// FinishReason is the reason the generation finished. See FinishReasonStop and FinishReasonLength.
 	FinishReason string
+	// Usage is the number of tokens reported by the LLM API. It is zero if the API does not report it.
+	Usage Usage
+	// Cached is true if the result was served from the response cache without calling the LLM API.
+	Cached bool
+	// Provider is the provider that actually answered. It is set only when a fallback chain is configured.
+	Provider Provider
 }
+
+// Usage represents the number of tokens used by a chat interaction
+type Usage struct {
+	InputTokens  int
+	OutputTokens int
+	// CacheReadTokens is the number of input tokens read from the prompt cache. They are not included in InputTokens.
+	CacheReadTokens int
+	// CacheWriteTokens is the number of input tokens written to the prompt cache. They are not included in InputTokens.
+	CacheWriteTokens int
+}
+
+// Add returns the sum of u and other
+func (u Usage) Add(other Usage) Usage {
+	return Usage{
+		InputTokens:      u.InputTokens + other.InputTokens,
+		OutputTokens:     u.OutputTokens + other.OutputTokens,
+		CacheReadTokens:  u.CacheReadTokens + other.CacheReadTokens,
+		CacheWriteTokens: u.CacheWriteTokens + other.CacheWriteTokens,
+	}
+}
+
+const (
+	// FinishReasonStop means the generation finished normally
+	FinishReasonStop = "stop"
+	// FinishReasonLength means the generation was cut off because it reached the max output tokens
+	FinishReasonLength = "length"
+)
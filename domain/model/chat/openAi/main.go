@@ -1,47 +1,144 @@
 package openai
 
 import (
+	"context"
 	"github.com/t-kuni/sisho/domain/external/openAi"
 	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"path"
 )
 
 type OpenAiChat struct {
-	client  openAi.Client
-	history []chat.Message
+	client             openAi.Client
+	retryPolicy        retry.Policy
+	params             chat.GenerationParams
+	acceptedMediaTypes []string
+	credential         credential.Credential
+	history            []chat.Message
 }
 
-func NewOpenAiChat(client openAi.Client) *OpenAiChat {
+// NewOpenAiChat はOpenAiChatを生成します。
+// acceptedMediaTypesはAPIに添付できるファイルの種類です。これ以外の添付ファイルを指定した場合、Sendは送信せずにエラーを返します。
+// credentialはAPIキーの取得元です。APIキーは最初に送信する時点で読み込みます。nilの場合は認証ヘッダーを送信しません。
+func NewOpenAiChat(client openAi.Client, retryPolicy retry.Policy, params chat.GenerationParams, acceptedMediaTypes []string, credential credential.Credential) *OpenAiChat {
 	return &OpenAiChat{
-		client:  client,
-		history: []chat.Message{},
+		client:             client,
+		retryPolicy:        retryPolicy,
+		params:             params,
+		acceptedMediaTypes: acceptedMediaTypes,
+		credential:         credential,
+		history:            []chat.Message{},
 	}
 }
 
-func (o *OpenAiChat) Send(prompt string, model string) (chat.SendResult, error) {
-	// Add user message to history
-	o.history = append(o.history, chat.Message{Role: "user", Content: prompt})
+func (o *OpenAiChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	err := chat.CheckAttachments(options.Attachments, o.acceptedMediaTypes)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	// 送信に失敗した場合（中断を含む）に履歴にプロンプトが残らないよう、成功してから履歴に反映する
+	history := append(append([]chat.Message{}, o.history...), chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints})
 
 	// Convert history to OpenAI messages
-	openAiMessages := make([]openAi.Message, len(o.history))
-	for i, msg := range o.history {
-		openAiMessages[i] = openAi.Message{Role: msg.Role, Content: msg.Content}
+	openAiMessages := make([]openAi.Message, len(history))
+	for i, msg := range history {
+		openAiMessages[i] = openAi.Message{Role: msg.Role, Content: msg.Content, Parts: convertAttachments(msg.Content, msg.Attachments)}
 	}
 
-	// Send message to OpenAI API
-	response, err := o.client.SendMessage(openAiMessages, model)
-	if err != nil {
-		return chat.SendResult{}, err
+	sendOptions := openAi.SendOptions{
+		Credential:  o.credential,
+		System:      options.System,
+		MaxTokens:   o.params.MaxTokens,
+		Temperature: o.params.Temperature,
+		TopP:        o.params.TopP,
+		Stop:        o.params.Stop,
+		OnDelta:     options.OnDelta,
+		Retry:       o.retryPolicy,
+		OnRetry:     options.OnRetry,
+	}
+	if options.ToolsEnabled() {
+		sendOptions.Tools = convertTools(options.Tools)
+	}
+	if options.ResponseSchema != nil {
+		sendOptions.ResponseFormat = &openAi.ResponseFormat{
+			Name:   options.ResponseSchema.Name,
+			Schema: options.ResponseSchema.Schema,
+		}
+	}
+
+	// Send message to OpenAI API until the model stops calling functions
+	var response openAi.GenerationResult
+	var usage chat.Usage
+	for round := 1; ; round++ {
+		var err error
+		response, err = o.client.SendMessage(ctx, openAiMessages, model, sendOptions)
+		if err != nil {
+			return chat.SendResult{}, err
+		}
+		usage = usage.Add(chat.Usage{
+			InputTokens:  response.Usage.InputTokens,
+			OutputTokens: response.Usage.OutputTokens,
+		})
+		if len(response.ToolCalls) == 0 || !options.ToolsEnabled() {
+			break
+		}
+
+		openAiMessages = append(openAiMessages, openAi.Message{Role: "assistant", Content: response.Content, ToolCalls: response.ToolCalls})
+		for _, call := range response.ToolCalls {
+			result, err := options.ToolResult(round, chat.ToolCall{ID: call.ID, Name: call.Name, Arguments: call.Arguments})
+			if err != nil {
+				return chat.SendResult{}, err
+			}
+			openAiMessages = append(openAiMessages, openAi.Message{Role: "tool", Content: result, ToolCallID: call.ID})
+		}
 	}
 
-	// Add assistant response to history
-	o.history = append(o.history, chat.Message{Role: "assistant", Content: response.Content})
+	// Add assistant response to history. The function calls are not kept in the history.
+	o.history = append(history, chat.Message{Role: "assistant", Content: response.Content})
 
 	return chat.SendResult{
 		Content:      response.Content,
 		FinishReason: response.TerminationReason,
+		Usage:        usage,
 	}, nil
 }
 
+// convertAttachments は添付ファイルのパスを示すテキストと添付ファイルのパートを並べ、最後にcontentのパートを置きます。
+// 添付ファイルが無い場合はnilを返します（contentを文字列のまま送信します）。
+func convertAttachments(content string, attachments []chat.Attachment) []openAi.ContentPart {
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	var parts []openAi.ContentPart
+	for _, attachment := range attachments {
+		parts = append(parts,
+			openAi.ContentPart{Text: attachment.Path},
+			openAi.ContentPart{Attachment: &openAi.Attachment{
+				Filename:  path.Base(attachment.Path),
+				MediaType: attachment.MediaType,
+				Data:      attachment.Data,
+			}},
+		)
+	}
+	return append(parts, openAi.ContentPart{Text: content})
+}
+
+// convertTools converts the tools of chat to the functions of OpenAI API.
+func convertTools(tools []chat.Tool) []openAi.Tool {
+	converted := make([]openAi.Tool, len(tools))
+	for i, tool := range tools {
+		converted[i] = openAi.Tool{Name: tool.Name, Description: tool.Description, Parameters: tool.Parameters}
+	}
+	return converted
+}
+
 func (o *OpenAiChat) GetHistory() []chat.Message {
 	return o.history
 }
+
+func (o *OpenAiChat) SetHistory(history []chat.Message) {
+	o.history = append([]chat.Message{}, history...)
+}
@@ -0,0 +1,46 @@
+package openai_test
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/external/openAi"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	chatOpenAi "github.com/t-kuni/sisho/domain/model/chat/openAi"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func TestSend(t *testing.T) {
+	t.Run("送信に失敗した場合、プロンプトが履歴に残らず、次の送信に含まれないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockClient := openAi.NewMockClient(mockCtrl)
+		gomock.InOrder(
+			mockClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(openAi.GenerationResult{}, context.Canceled),
+			mockClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					assert.Equal(t, []openAi.Message{{Role: "user", Content: "SECOND"}}, messages)
+					return openAi.GenerationResult{Content: "ANSWER", TerminationReason: "stop"}, nil
+				}),
+		)
+
+		testee := chatOpenAi.NewOpenAiChat(mockClient, retry.Policy{}, chat.GenerationParams{}, nil, nil)
+
+		_, err := testee.Send(context.Background(), "FIRST", "gpt-4o", chat.SendOptions{})
+		assert.True(t, errors.Is(err, context.Canceled))
+		assert.Empty(t, testee.GetHistory())
+
+		_, err = testee.Send(context.Background(), "SECOND", "gpt-4o", chat.SendOptions{})
+		assert.NoError(t, err)
+
+		// Assert
+		assert.Equal(t, []chat.Message{
+			{Role: "user", Content: "SECOND"},
+			{Role: "assistant", Content: "ANSWER"},
+		}, testee.GetHistory())
+	})
+}
@@ -0,0 +1,106 @@
+//go:generate mockgen -source=$GOFILE -destination=${GOFILE}_mock.go -package=$GOPACKAGE
+
+package replay
+
+import (
+	"context"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+)
+
+// Fixtures は記録済みのプロンプトと回答の組を抽象化するインターフェースです。
+type Fixtures interface {
+	// Find はpromptに対応する記録済みの回答を返します。見つからない場合はエラーを返します。
+	Find(prompt string) (string, error)
+	// Record はpromptと回答の組を記録します。
+	Record(prompt string, answer string) error
+}
+
+// ReplayChat は記録済みの回答を返すチャットモデルです。
+// recorderが指定されている場合（recordモード）は、recorderに送信した結果を記録しながら返します。
+// 会話の履歴を保持するため、同じ会話の続き（make --verifyの修正依頼など）も扱えます。
+type ReplayChat struct {
+	fixtures Fixtures
+	recorder chat.Chat
+	history  []chat.Message
+}
+
+func NewReplayChat(fixtures Fixtures) *ReplayChat {
+	return &ReplayChat{
+		fixtures: fixtures,
+		history:  []chat.Message{},
+	}
+}
+
+func NewRecordChat(recorder chat.Chat, fixtures Fixtures) *ReplayChat {
+	return &ReplayChat{
+		fixtures: fixtures,
+		recorder: recorder,
+		history:  []chat.Message{},
+	}
+}
+
+func (r *ReplayChat) Send(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	if r.recorder != nil {
+		return r.record(ctx, prompt, model, options)
+	}
+
+	// 添付ファイルはCheckAttachmentsで確認しない。記録した時点のドライバーが受け付けたものであり、
+	// 回答はプロンプト（添付ファイルのパスを含む）だけで決まるため、replayでは送信しない添付ファイルを拒否する理由が無い
+	answer, err := r.fixtures.Find(prompt)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	if options.OnDelta != nil {
+		options.OnDelta(answer)
+	}
+
+	r.history = append(r.history,
+		chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints},
+		chat.Message{Role: "assistant", Content: answer},
+	)
+
+	return chat.SendResult{
+		Content:      answer,
+		FinishReason: chat.FinishReasonStop,
+	}, nil
+}
+
+// record はrecorderに送信し、promptと回答の組を記録します。
+// recorderが履歴を保持するチャットモデルの場合は、この会話の履歴を渡してから送信し、送信後の履歴を引き継ぎます。
+func (r *ReplayChat) record(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+	withHistory, ok := r.recorder.(chat.ChatWithHistory)
+	if ok {
+		withHistory.SetHistory(r.history)
+	}
+
+	result, err := r.recorder.Send(ctx, prompt, model, options)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+
+	err = r.fixtures.Record(prompt, result.Content)
+	if err != nil {
+		return chat.SendResult{}, eris.Wrap(err, "failed to record answer")
+	}
+
+	if ok {
+		r.history = withHistory.GetHistory()
+	} else {
+		r.history = append(r.history,
+			chat.Message{Role: "user", Content: prompt, Attachments: options.Attachments, CacheBreakpoints: options.CacheBreakpoints},
+			chat.Message{Role: "assistant", Content: result.Content},
+		)
+	}
+
+	return result, nil
+}
+
+func (r *ReplayChat) GetHistory() []chat.Message {
+	return r.history
+}
+
+func (r *ReplayChat) SetHistory(history []chat.Message) {
+	r.history = append([]chat.Message{}, history...)
+}
@@ -0,0 +1,30 @@
+package continuation
+
+import (
+	_ "embed"
+	"strings"
+	"text/template"
+)
+
+//go:embed prompt.md.tmpl
+var promptTmpl string
+
+type PromptParam struct {
+	// GeneratePath は生成対象のパスです。複数のTarget Codeをまとめて生成する場合は空にします。
+	GeneratePath string
+}
+
+func BuildPrompt(param PromptParam) (string, error) {
+	tmpl, err := template.New("markdown").Parse(promptTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	err = tmpl.Execute(&output, param)
+	if err != nil {
+		return "", err
+	}
+
+	return output.String(), nil
+}
@@ -3,6 +3,8 @@ package extract
 import (
 	"bytes"
 	_ "embed"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/kinds"
 	"github.com/t-kuni/sisho/domain/model/prompts"
 	"path/filepath"
 	"text/template"
@@ -17,6 +19,51 @@ type PromptParam struct {
 	KnowledgeListPath string
 }
 
+// KnowledgeListResult is the answer of the prompt
+type KnowledgeListResult struct {
+	Knowledge []KnowledgeItem `json:"knowledge"`
+}
+
+type KnowledgeItem struct {
+	// Path is the path from the project root
+	Path      string         `json:"path"`
+	Kind      kinds.KindName `json:"kind"`
+	ChainMake bool           `json:"chain-make"`
+}
+
+// ResultSchema is the JSON schema of KnowledgeListResult
+var ResultSchema = chat.ResponseSchema{
+	Name:        "knowledge_list",
+	Description: "Report the knowledge list of the target code",
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"knowledge": map[string]interface{}{
+				"type": "array",
+				"items": map[string]interface{}{
+					"type": "object",
+					"properties": map[string]interface{}{
+						"path": map[string]interface{}{"type": "string"},
+						"kind": map[string]interface{}{
+							"type": "string",
+							"enum": []string{
+								string(kinds.KindNameExamples),
+								string(kinds.KindNameImplementations),
+								string(kinds.KindNameSpecifications),
+							},
+						},
+						"chain-make": map[string]interface{}{"type": "boolean"},
+					},
+					"required":             []string{"path", "kind", "chain-make"},
+					"additionalProperties": false,
+				},
+			},
+		},
+		"required":             []string{"knowledge"},
+		"additionalProperties": false,
+	},
+}
+
 func BuildPrompt(param PromptParam) (string, error) {
 	tmpl, err := template.New("markdown").Parse(promptTmpl)
 	if err != nil {
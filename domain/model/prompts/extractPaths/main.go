@@ -2,6 +2,7 @@ package extractPaths
 
 import (
 	_ "embed"
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"strings"
 	"text/template"
 )
@@ -15,7 +16,28 @@ type PromptParam struct {
 	FolderStructure string
 }
 
-type ExtractPathsResult []string
+// ExtractPathsResult is the answer of the prompt. See ExtractPathsResult.yaml.
+type ExtractPathsResult struct {
+	Paths []string `json:"paths"`
+}
+
+// ResultSchema is the JSON schema of ExtractPathsResult
+var ResultSchema = chat.ResponseSchema{
+	Name:        "extract_paths",
+	Description: "Report the paths of the files that need to be fixed",
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"paths": map[string]interface{}{
+				"type":        "array",
+				"description": "修正が必要なパスのリスト（プロジェクトルートからの相対パス）",
+				"items":       map[string]interface{}{"type": "string"},
+			},
+		},
+		"required":             []string{"paths"},
+		"additionalProperties": false,
+	},
+}
 
 func BuildPrompt(param PromptParam) (string, error) {
 	tmpl, err := template.New("markdown").Parse(promptTmpl)
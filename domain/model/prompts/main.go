@@ -2,10 +2,14 @@ package prompts
 
 import (
 	_ "embed"
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"strings"
 	"text/template"
 )
 
+// generatePathHeading は生成対象のパスを示す見出しの接頭辞です。prompt.md.tmplの末尾に対応します。
+const generatePathHeading = "## "
+
 //go:embed prompt.md.tmpl
 var promptTmpl string
 
@@ -15,6 +19,10 @@ type PromptParam struct {
 	Targets         []Target
 	FolderStructure string
 	GeneratePath    string
+	// GeneratePaths が空でない場合は、GeneratePathの代わりにこれらのTarget Codeを1つの回答でまとめて生成するよう依頼します。
+	GeneratePaths []string
+	// EditFormat はコードブロックに記載させる形式です（config.EditFormatXxx）。空の場合はファイル全体を記載させます。
+	EditFormat string
 }
 
 type Target struct {
@@ -30,19 +38,72 @@ type KnowledgeSet struct {
 type Knowledge struct {
 	Path    string
 	Content string
+	// MediaType は画像・PDFの知識のMIMEタイプです。空でない場合、ファイルはDataとしてプロンプトに添付し、Contentは使いません。
+	MediaType string
+	Data      []byte
+}
+
+// Attachments は知識のうち、プロンプトに添付する画像・PDFのファイルを返します。
+func Attachments(knowledgeSets []KnowledgeSet) []chat.Attachment {
+	var attachments []chat.Attachment
+	for _, set := range knowledgeSets {
+		for _, k := range set.Knowledge {
+			if k.MediaType == "" {
+				continue
+			}
+			attachments = append(attachments, chat.Attachment{Path: k.Path, MediaType: k.MediaType, Data: k.Data})
+		}
+	}
+	return attachments
 }
 
+// promptBlocks はプロンプトを構成するprompt.md.tmpl内のテンプレート名です。この順に連結します。
+var promptBlocks = []string{"shared", "knowledge", "target"}
+
 func BuildPrompt(param PromptParam) (string, error) {
-	tmpl, err := template.New("markdown").Parse(promptTmpl)
+	blocks, err := BuildPromptBlocks(param)
 	if err != nil {
 		return "", err
 	}
+	return strings.Join(blocks, ""), nil
+}
 
-	var output strings.Builder
-	err = tmpl.Execute(&output, param)
+// BuildPromptBlocks はプロンプトを以下のブロックに分けて組み立てます。連結するとBuildPromptの結果と一致します。
+//   - 指示とフォルダ構造（1回の実行の中で変わらない部分）
+//   - 知識
+//   - Target Codeと生成対象のパス（生成対象毎に変わる部分）
+func BuildPromptBlocks(param PromptParam) ([]string, error) {
+	tmpl, err := template.New("markdown").Parse(promptTmpl)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+
+	blocks := make([]string, 0, len(promptBlocks))
+	for _, name := range promptBlocks {
+		var output strings.Builder
+		err = tmpl.ExecuteTemplate(&output, name, param)
+		if err != nil {
+			return nil, err
+		}
+		blocks = append(blocks, output.String())
 	}
 
-	return output.String(), nil
+	return blocks, nil
+}
+
+// GeneratePath はBuildPromptで組み立てたプロンプトから生成対象のパス（GeneratePath）を取り出します。
+// 見つからない場合（GeneratePathsでまとめて生成する場合を含む）は空文字を返します。
+func GeneratePath(prompt string) string {
+	lines := strings.Split(strings.TrimRight(prompt, "\n"), "\n")
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := strings.TrimSpace(lines[i])
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, generatePathHeading) {
+			return strings.TrimSpace(strings.TrimPrefix(line, generatePathHeading))
+		}
+		return ""
+	}
+	return ""
 }
@@ -0,0 +1,42 @@
+package verify
+
+import (
+	_ "embed"
+	"github.com/t-kuni/sisho/domain/model/prompts"
+	"strings"
+	"text/template"
+)
+
+//go:embed prompt.md.tmpl
+var promptTmpl string
+
+type PromptParam struct {
+	// Failures は失敗したタスクです
+	Failures []Failure
+	// Targets は現在の（前の回答を反映した後の）Target Codeです
+	Targets []prompts.Target
+	// EditFormat はコードブロックに記載させる形式です（config.EditFormatXxx）。空の場合はファイル全体を記載させます。
+	EditFormat string
+}
+
+type Failure struct {
+	Name string
+	Run  string
+	// Output はタスクの標準出力、標準エラー出力、エラーです
+	Output string
+}
+
+func BuildPrompt(param PromptParam) (string, error) {
+	tmpl, err := template.New("markdown").Parse(promptTmpl)
+	if err != nil {
+		return "", err
+	}
+
+	var output strings.Builder
+	err = tmpl.Execute(&output, param)
+	if err != nil {
+		return "", err
+	}
+
+	return output.String(), nil
+}
@@ -0,0 +1,45 @@
+package retry
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy はLLMのAPI呼び出しに失敗した場合の再試行の方針を表します。
+type Policy struct {
+	// MaxAttempts は初回を含む最大試行回数です。1以下の場合は再試行しません。
+	MaxAttempts int
+	// InitialWait は1回目の再試行までの待機時間です。再試行毎に2倍になります。
+	InitialWait time.Duration
+	// MaxWait は1回の待機時間の上限です。0の場合は上限を設けません。
+	MaxWait time.Duration
+	// Timeout は1回の試行（ストリームの受信完了まで）の制限時間です。0の場合は制限しません。
+	// 制限時間を超えた試行は再試行の対象になります。
+	Timeout time.Duration
+}
+
+// DefaultPolicy はプロジェクトコンフィグで指定がない場合の再試行の方針を返します。
+func DefaultPolicy() Policy {
+	return Policy{
+		MaxAttempts: 4,
+		InitialWait: 1 * time.Second,
+		MaxWait:     60 * time.Second,
+		Timeout:     10 * time.Minute,
+	}
+}
+
+// Event は再試行の発生を表します。
+type Event struct {
+	// Attempt は失敗した試行の回数です（1始まり）
+	Attempt int
+	// MaxAttempts は最大試行回数です
+	MaxAttempts int
+	// Wait は次の試行までの待機時間です
+	Wait time.Duration
+	// Err は試行が失敗した原因のエラーです
+	Err error
+}
+
+func (e Event) String() string {
+	return fmt.Sprintf("attempt %d/%d failed, retrying in %s: %v", e.Attempt, e.MaxAttempts, e.Wait, e.Err)
+}
@@ -0,0 +1,65 @@
+package tokens
+
+import "strings"
+
+// ReservedOutputTokens はコンテキストウィンドウのうち、出力用に確保するトークン数です。
+// コンテキストウィンドウが小さいモデルでは、ReservedOutput()でウィンドウの1/4までに抑えます。
+const ReservedOutputTokens = 8192
+
+// contextWindows はモデル名の接頭辞とコンテキストウィンドウのトークン数の対応表です。
+// 先頭から順に比較するため、より長い接頭辞を先に記載します。
+var contextWindows = []struct {
+	prefix string
+	tokens int
+}{
+	{prefix: "claude-", tokens: 200000},
+	{prefix: "gpt-5", tokens: 400000},
+	{prefix: "gpt-4o", tokens: 128000},
+	{prefix: "chatgpt-4o", tokens: 128000},
+	{prefix: "gpt-4-turbo", tokens: 128000},
+	{prefix: "gpt-4-32k", tokens: 32768},
+	{prefix: "gpt-4.1", tokens: 1047576},
+	{prefix: "gpt-4.5", tokens: 128000},
+	{prefix: "o3", tokens: 200000},
+	{prefix: "o4", tokens: 200000},
+	{prefix: "gpt-4", tokens: 8192},
+	{prefix: "gpt-3.5-turbo", tokens: 16385},
+	{prefix: "o1-mini", tokens: 128000},
+	{prefix: "o1-preview", tokens: 128000},
+	{prefix: "o1", tokens: 200000},
+}
+
+// Estimate はテキストのトークン数を概算します。
+// ASCII文字は4文字で1トークン、それ以外の文字（日本語など）は1文字で1トークンとして数えます。
+func Estimate(text string) int {
+	ascii := 0
+	other := 0
+	for _, r := range text {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+	}
+	return (ascii+3)/4 + other
+}
+
+// ContextWindow はモデルのコンテキストウィンドウのトークン数を返します。
+// 対応表に存在しないモデルの場合は0を返します。
+func ContextWindow(model string) int {
+	for _, w := range contextWindows {
+		if strings.HasPrefix(model, w.prefix) {
+			return w.tokens
+		}
+	}
+	return 0
+}
+
+// ReservedOutput はコンテキストウィンドウがwindowのモデルで、出力用に確保するトークン数を返します。
+// ReservedOutputTokensとwindowの1/4の小さい方です。出力トークン数の上限が指定されていない場合に使います。
+func ReservedOutput(window int) int {
+	if window/4 < ReservedOutputTokens {
+		return window / 4
+	}
+	return ReservedOutputTokens
+}
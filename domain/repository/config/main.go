@@ -1,16 +1,169 @@
 package config
 
+import (
+	"gopkg.in/yaml.v3"
+	"time"
+)
+
+// Command names used as the keys of per-command settings.
+const (
+	CommandMake    = "make"
+	CommandQ       = "q"
+	CommandExtract = "extract"
+	CommandFixTask = "fix-task"
+)
+
 type Config struct {
 	Lang                string              `yaml:"lang"`
 	LLM                 LLM                 `yaml:"llm"`
 	AutoCollect         AutoCollect         `yaml:"auto-collect"`
 	AdditionalKnowledge AdditionalKnowledge `yaml:"additional-knowledge"`
 	Tasks               []Task              `yaml:"tasks"`
+	// Prices is the price table used by the usage command. It takes precedence over the built-in table.
+	Prices []Price `yaml:"prices,omitempty"`
+	// Cache is the setting of the response cache.
+	Cache Cache `yaml:"cache,omitempty"`
+	// SystemPrompt is the system prompt sent to the LLM.
+	SystemPrompt SystemPrompts `yaml:"system-prompt,omitempty"`
+	// Tools is the setting of the tool-use mode of make and q.
+	Tools Tools `yaml:"tools,omitempty"`
+	// Edit is the setting of the format in which make asks the model to write changes.
+	Edit Edit `yaml:"edit,omitempty"`
+	// Git is the setting of the git integration of make.
+	Git Git `yaml:"git,omitempty"`
 }
 
 type LLM struct {
 	Driver string `yaml:"driver"`
 	Model  string `yaml:"model"`
+	// BaseURL is the base URL of an OpenAI compatible API. Used by the open-ai-compatible driver.
+	BaseURL string `yaml:"base-url,omitempty"`
+	// APIKeyEnv is the name of the environment variable holding the API key.
+	APIKeyEnv string `yaml:"api-key-env,omitempty"`
+	// APIKeyFile is the path of a file holding the API key. A relative path is resolved from the project root.
+	APIKeyFile string `yaml:"api-key-file,omitempty"`
+	// APIKeyCommand is a shell command that prints the API key to stdout (e.g. a password manager CLI).
+	// Only one of APIKeyEnv, APIKeyFile and APIKeyCommand can be specified.
+	APIKeyCommand string `yaml:"api-key-command,omitempty"`
+	// Headers are extra HTTP headers sent with each request. Used by the open-ai-compatible driver.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// Retry is the retry setting used when a request to the LLM API fails.
+	Retry Retry `yaml:"retry,omitempty"`
+	// Timeout is the time limit of a single request to the LLM API including the whole stream (e.g. 5m).
+	// 0 means the default value. A request that timed out is retried according to Retry.
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+	// MaxContinuations is the maximum number of follow-up requests when the generation is cut off at max tokens.
+	// nil means the default value.
+	MaxContinuations *int `yaml:"max-continuations,omitempty"`
+	// ContextWindow is the context window size of the model in tokens. 0 means the value in the built-in table.
+	ContextWindow int `yaml:"context-window,omitempty"`
+	// Replay is the setting of the replay driver.
+	Replay Replay `yaml:"replay,omitempty"`
+	// MaxTokens is the maximum number of output tokens. 0 means the default value of each driver.
+	MaxTokens int `yaml:"max-tokens,omitempty"`
+	// Temperature is the sampling temperature. nil means the default value of each driver.
+	Temperature *float64 `yaml:"temperature,omitempty"`
+	// TopP is the nucleus sampling probability. nil means the default value of each driver.
+	TopP *float64 `yaml:"top-p,omitempty"`
+	// Stop is the list of sequences that stop the generation.
+	Stop []string `yaml:"stop,omitempty"`
+	// PromptCaching enables the prompt caching of the shared prefix of prompts. Used by the anthropic driver.
+	PromptCaching bool `yaml:"prompt-caching,omitempty"`
+	// MaxConcurrency is the maximum number of requests sent to this provider at the same time when targets are
+	// generated in parallel (make -j). 0 means no limit.
+	MaxConcurrency int `yaml:"max-concurrency,omitempty"`
+	// Commands overrides the settings above per command (make, q, extract, fix-task).
+	// Only the specified fields are overridden.
+	Commands map[string]LLM `yaml:"commands,omitempty"`
+	// Fallbacks are the providers tried in order when the provider above fails.
+	// They are written as the second and later entries when llm is a list.
+	Fallbacks []LLM `yaml:"-"`
+}
+
+// UnmarshalYAML accepts both a single mapping and a list of mappings.
+// In the list form, the first entry is the primary provider and the rest become Fallbacks.
+func (l *LLM) UnmarshalYAML(value *yaml.Node) error {
+	type plain LLM
+
+	if value.Kind != yaml.SequenceNode {
+		return value.Decode((*plain)(l))
+	}
+
+	var entries []plain
+	err := value.Decode(&entries)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 0 {
+		*l = LLM{}
+		return nil
+	}
+
+	*l = LLM(entries[0])
+	for _, entry := range entries[1:] {
+		l.Fallbacks = append(l.Fallbacks, LLM(entry))
+	}
+	return nil
+}
+
+// MarshalYAML writes the list form when Fallbacks exist.
+func (l LLM) MarshalYAML() (interface{}, error) {
+	type plain LLM
+
+	if len(l.Fallbacks) == 0 {
+		return plain(l), nil
+	}
+
+	entries := []plain{plain(l)}
+	for _, fallback := range l.Fallbacks {
+		entries = append(entries, plain(fallback))
+	}
+	return entries, nil
+}
+
+type Replay struct {
+	// Dir is the fixture directory holding prompt/answer pairs. A relative path is resolved from the project root.
+	Dir string `yaml:"dir"`
+	// Mode is "replay" (default) or "record".
+	Mode string `yaml:"mode,omitempty"`
+	// Driver is the driver that actually answers in record mode.
+	Driver string `yaml:"driver,omitempty"`
+}
+
+type Retry struct {
+	// MaxAttempts is the maximum number of attempts including the first one.
+	MaxAttempts int `yaml:"max-attempts,omitempty"`
+	// MaxWait is the upper limit of a single wait between attempts (e.g. 30s).
+	MaxWait time.Duration `yaml:"max-wait,omitempty"`
+}
+
+type Tools struct {
+	// Enabled lets the model read files of the project with tools (read_file, list_dir, grep) while answering.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// MaxRounds is the maximum number of responses that call tools in a single request. 0 means the default value.
+	MaxRounds int `yaml:"max-rounds,omitempty"`
+}
+
+const (
+	EditFormatWhole         = "whole"
+	EditFormatSearchReplace = "search-replace"
+	EditFormatUnifiedDiff   = "udiff"
+)
+
+type Edit struct {
+	// Format is one of EditFormatWhole, EditFormatSearchReplace and EditFormatUnifiedDiff. Empty means EditFormatWhole.
+	Format string `yaml:"format,omitempty"`
+}
+
+type Git struct {
+	// Enabled makes make refuse to apply changes to files with uncommitted changes, and enables AutoBranch and AutoCommit.
+	Enabled bool `yaml:"enabled,omitempty"`
+	// AutoBranch creates a branch named BranchPrefix + history ID before make applies changes.
+	AutoBranch bool `yaml:"auto-branch,omitempty"`
+	// BranchPrefix is the prefix of the branches created by AutoBranch. Empty means "sisho/".
+	BranchPrefix string `yaml:"branch-prefix,omitempty"`
+	// AutoCommit commits the files written by make after it succeeds.
+	AutoCommit bool `yaml:"auto-commit,omitempty"`
 }
 
 type AutoCollect struct {
@@ -22,12 +175,68 @@ type AdditionalKnowledge struct {
 	FolderStructure bool `yaml:"folder-structure"`
 }
 
+type Price struct {
+	// Model is the model name. It matches models that start with this value.
+	Model string `yaml:"model"`
+	// Input is the price in USD per 1M input tokens.
+	Input float64 `yaml:"input"`
+	// Output is the price in USD per 1M output tokens.
+	Output float64 `yaml:"output"`
+	// CacheRead is the price in USD per 1M input tokens read from the prompt cache. nil means 0.1 times Input.
+	CacheRead *float64 `yaml:"cache-read,omitempty"`
+	// CacheWrite is the price in USD per 1M input tokens written to the prompt cache. nil means 1.25 times Input.
+	CacheWrite *float64 `yaml:"cache-write,omitempty"`
+}
+
+type Cache struct {
+	// Enabled enables the response cache under .sisho/cache.
+	Enabled bool `yaml:"enabled"`
+	// MaxAge is the lifetime of a cache entry (e.g. 168h). 0 means the default value.
+	MaxAge time.Duration `yaml:"max-age,omitempty"`
+	// MaxSizeMB is the upper limit of the total size of the cache in megabytes. 0 means the default value.
+	MaxSizeMB int `yaml:"max-size-mb,omitempty"`
+}
+
+type SystemPrompt struct {
+	// Text is the system prompt written inline.
+	Text string `yaml:"text,omitempty"`
+	// File is the path of a file holding the system prompt. A relative path is resolved from the project root.
+	File string `yaml:"file,omitempty"`
+}
+
+type SystemPrompts struct {
+	// SystemPrompt is the project-level system prompt used by every command.
+	SystemPrompt `yaml:",inline"`
+	// Commands overrides the project-level system prompt per command (make, q, extract, fix-task).
+	Commands map[string]SystemPrompt `yaml:"commands,omitempty"`
+}
+
 type Task struct {
 	Name string `yaml:"name"`
 	Run  string `yaml:"run"`
 }
 
+// UserConfig is the per-user config shared by all projects.
+type UserConfig struct {
+	// Credentials are the sources of the API keys keyed by driver (anthropic, open-ai, open-ai-compatible).
+	// They are used when the llm of the project config does not specify a source.
+	Credentials map[string]Credential `yaml:"credentials,omitempty"`
+}
+
+type Credential struct {
+	// APIKeyEnv is the name of the environment variable holding the API key.
+	APIKeyEnv string `yaml:"api-key-env,omitempty"`
+	// APIKeyFile is the path of a file holding the API key. A relative path is resolved from the user config directory.
+	APIKeyFile string `yaml:"api-key-file,omitempty"`
+	// APIKeyCommand is a shell command that prints the API key to stdout.
+	APIKeyCommand string `yaml:"api-key-command,omitempty"`
+}
+
 type Repository interface {
 	Read(path string) (*Config, error)
 	Write(path string, cfg *Config) error
+	// ReadUser reads the user config. It returns an empty UserConfig when the file does not exist.
+	ReadUser() (*UserConfig, error)
+	// UserConfigDir returns the directory holding the user config.
+	UserConfigDir() (string, error)
 }
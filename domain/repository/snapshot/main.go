@@ -0,0 +1,37 @@
+package snapshot
+
+import "time"
+
+// FileName は履歴フォルダに保存するスナップショットの一覧ファイルの名前です。
+const FileName = "snapshots.yml"
+
+// DirName は履歴フォルダの中で、ファイルの内容を保存するフォルダの名前です。
+const DirName = "snapshots"
+
+// Snapshots はmakeが1回の実行で書き換えたファイルの一覧です。
+type Snapshots struct {
+	// Files は書き換えた順のファイルの一覧です
+	Files []File `yaml:"files"`
+	// UndoneAt はundoで元に戻した日時です。元に戻していない場合はnilです
+	UndoneAt *time.Time `yaml:"undone-at,omitempty"`
+}
+
+// File は書き換えた1つのファイルの記録です。
+type File struct {
+	// Path はプロジェクトルートからの相対パスです
+	Path string `yaml:"path"`
+	// Existed がfalseの場合、書き換える前はファイルが存在しなかったことを表します
+	Existed bool `yaml:"existed"`
+	// Before は書き換える前の内容を保存したファイルの名前です（DirNameからの相対パス）。Existedがfalseの場合は空です
+	Before string `yaml:"before,omitempty"`
+	// After は書き込んだ内容を保存したファイルの名前です（DirNameからの相対パス）
+	After string `yaml:"after"`
+	// AfterHash は書き込んだ内容のSHA-256です
+	AfterHash string `yaml:"after-hash"`
+}
+
+type Repository interface {
+	// Read はpathのスナップショットの一覧を読み込みます。ファイルが存在しない場合は、os.IsNotExistで判定できるエラーを返します
+	Read(path string) (Snapshots, error)
+	Write(path string, snapshots Snapshots) error
+}
@@ -0,0 +1,26 @@
+package usage
+
+import "time"
+
+// FileName は履歴フォルダに保存する使用量ファイルの名前です。
+const FileName = "usage.yml"
+
+// Usage は1回のコマンド実行で使用したトークン数の記録です。
+type Usage struct {
+	// Command はコマンド名です（make, q, fix:task, extract）
+	Command      string    `yaml:"command"`
+	Driver       string    `yaml:"driver"`
+	Model        string    `yaml:"model"`
+	Time         time.Time `yaml:"time"`
+	InputTokens  int       `yaml:"input-tokens"`
+	OutputTokens int       `yaml:"output-tokens"`
+	// CacheReadTokens はプロンプトキャッシュから読み込んだ入力トークン数です（InputTokensには含みません）
+	CacheReadTokens int `yaml:"cache-read-tokens,omitempty"`
+	// CacheWriteTokens はプロンプトキャッシュに書き込んだ入力トークン数です（InputTokensには含みません）
+	CacheWriteTokens int `yaml:"cache-write-tokens,omitempty"`
+}
+
+type Repository interface {
+	Read(path string) (Usage, error)
+	Write(path string, usage Usage) error
+}
@@ -5,38 +5,340 @@ import (
 	"github.com/t-kuni/sisho/domain/external/claude"
 	"github.com/t-kuni/sisho/domain/external/openAi"
 	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/chat/cache"
 	modelClaude "github.com/t-kuni/sisho/domain/model/chat/claude"
+	"github.com/t-kuni/sisho/domain/model/chat/fallback"
+	"github.com/t-kuni/sisho/domain/model/chat/limit"
 	"github.com/t-kuni/sisho/domain/model/chat/local"
 	modelOpenAi "github.com/t-kuni/sisho/domain/model/chat/openAi"
+	"github.com/t-kuni/sisho/domain/model/chat/replay"
+	"github.com/t-kuni/sisho/domain/model/retry"
 	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 type ChatFactory struct {
-	openAiClient openAi.Client
-	claudeClient claude.Client
+	openAiClient                  openAi.Client
+	claudeClient                  claude.Client
+	openAiCompatibleClientFactory openAi.CompatibleClientFactory
+	responseCacheService          *responseCache.ResponseCacheService
+	replayFixtureService          *replayFixture.ReplayFixtureService
+	configRepository              config.Repository
+	credentialProvider            credential.Provider
+
+	// slots はプロバイダー毎の同時に送信できる数の制限です。生成したチャットモデルの間で共有します
+	slotsMu sync.Mutex
+	slots   map[string]limit.Slots
 }
 
-func NewChatFactory(openAiClient openAi.Client, claudeClient claude.Client) *ChatFactory {
+func NewChatFactory(
+	openAiClient openAi.Client,
+	claudeClient claude.Client,
+	openAiCompatibleClientFactory openAi.CompatibleClientFactory,
+	responseCacheService *responseCache.ResponseCacheService,
+	replayFixtureService *replayFixture.ReplayFixtureService,
+	configRepository config.Repository,
+	credentialProvider credential.Provider,
+) *ChatFactory {
 	return &ChatFactory{
-		openAiClient: openAiClient,
-		claudeClient: claudeClient,
+		openAiClient:                  openAiClient,
+		claudeClient:                  claudeClient,
+		openAiCompatibleClientFactory: openAiCompatibleClientFactory,
+		responseCacheService:          responseCacheService,
+		replayFixtureService:          replayFixtureService,
+		configRepository:              configRepository,
+		credentialProvider:            credentialProvider,
+		slots:                         map[string]limit.Slots{},
+	}
+}
+
+// MakeOptions はチャットモデルの生成に関する付加的な設定です。
+type MakeOptions struct {
+	// RootDir はプロジェクトルートです。レスポンスキャッシュの保存先とreplayドライバーのフォルダの基準に使います。
+	RootDir string
+	// NoCache がtrueの場合、プロジェクトコンフィグの設定に関わらずレスポンスキャッシュを使いません。
+	NoCache bool
+}
+
+// Make はプロジェクトコンフィグのllmに従ってチャットモデルを生成します。
+// llmがリストで指定されている場合は、先頭から順にプロバイダーを試すフォールバックチェーンを生成します。
+// プロジェクトコンフィグでcache.enabledが指定されている場合は、レスポンスキャッシュを前段に配置します。
+func (s *ChatFactory) Make(cfg *config.Config, options MakeOptions) (chat.Chat, error) {
+	c, err := s.makeChat(cfg, options)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cfg.LLM.Fallbacks) > 0 {
+		members := []fallback.Member{{
+			Provider: chat.Provider{Driver: cfg.LLM.Driver, Model: cfg.LLM.Model},
+			Chat:     c,
+		}}
+		for _, llm := range cfg.LLM.Fallbacks {
+			fallbackCfg := *cfg
+			fallbackCfg.LLM = llm
+			fallbackChat, err := s.makeChat(&fallbackCfg, options)
+			if err != nil {
+				return nil, eris.Wrapf(err, "failed to create fallback chat model: %s/%s", llm.Driver, llm.Model)
+			}
+			members = append(members, fallback.Member{
+				Provider: chat.Provider{Driver: llm.Driver, Model: llm.Model},
+				Chat:     fallbackChat,
+			})
+		}
+		c = fallback.NewFallbackChat(members)
 	}
+
+	// replayドライバーのrecordモードは、キャッシュが当たると回答が記録されないためキャッシュを使わない
+	recording := cfg.LLM.Driver == "replay" && cfg.LLM.Replay.Mode == "record"
+	if cfg.Cache.Enabled && !options.NoCache && options.RootDir != "" && !recording {
+		if withHistory, ok := c.(chat.ChatWithHistory); ok {
+			c = cache.NewCachedChat(withHistory, s.responseCacheService.Open(options.RootDir, cfg.Cache), cacheKeyParams(cfg))
+		}
+	}
+
+	return c, nil
 }
 
-func (s *ChatFactory) Make(cfg *config.Config) (chat.Chat, error) {
+// makeChat はllmのドライバーに対応するチャットモデルを1つ生成します。
+func (s *ChatFactory) makeChat(cfg *config.Config, options MakeOptions) (chat.Chat, error) {
 	var c chat.Chat
 	var err error
 
 	switch cfg.LLM.Driver {
 	case "open-ai":
-		c = modelOpenAi.NewOpenAiChat(s.openAiClient)
+		cred, err := s.credential(cfg, options, "OPENAI_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		c = modelOpenAi.NewOpenAiChat(s.openAiClient, retryPolicy(cfg), generationParams(cfg), openAiMediaTypes(cfg.LLM.Model), cred)
+	case "open-ai-compatible":
+		client, err := s.openAiCompatibleClientFactory.NewCompatibleClient(openAi.CompatibleSetting{
+			BaseURL: cfg.LLM.BaseURL,
+			Headers: cfg.LLM.Headers,
+		})
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to create OpenAI compatible client")
+		}
+		// 認証が不要なサーバー（Ollama等）があるため、既定の環境変数は無い
+		cred, err := s.credential(cfg, options, "")
+		if err != nil {
+			return nil, err
+		}
+		// OpenAI互換APIが受け付けるのは画像（image_url）までとする。PDF（file）はOpenAI APIの独自の形式のため
+		c = modelOpenAi.NewOpenAiChat(client, retryPolicy(cfg), generationParams(cfg), chat.ImageMediaTypes, cred)
 	case "anthropic":
-		c = modelClaude.NewClaudeChat(s.claudeClient)
+		cred, err := s.credential(cfg, options, "ANTHROPIC_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		c = modelClaude.NewClaudeChat(s.claudeClient, retryPolicy(cfg), generationParams(cfg), cfg.LLM.PromptCaching, cred)
 	case "local":
-		c = local.NewLocalChat()
+		return local.NewLocalChat(), nil
+	case "replay":
+		c, err = s.makeReplayChat(cfg, options)
+		if err != nil {
+			return nil, err
+		}
 	default:
 		return nil, eris.Errorf("unsupported LLM driver: %s", cfg.LLM.Driver)
 	}
 
+	// replayドライバーは記録する場合の実際のドライバーに制限を掛ける
+	if withHistory, ok := c.(chat.ChatWithHistory); ok && cfg.LLM.Driver != "replay" && cfg.LLM.MaxConcurrency > 0 {
+		c = limit.NewLimitedChat(withHistory, s.providerSlots(cfg.LLM))
+	}
+
 	return c, err
 }
+
+// providerSlots はllmのプロバイダー（ドライバーとbase-url）で共有するSlotsを返します。
+// 同じプロバイダーに異なるmax-concurrencyが指定されている場合は、最初に生成したチャットモデルの値を使います。
+func (s *ChatFactory) providerSlots(llm config.LLM) limit.Slots {
+	s.slotsMu.Lock()
+	defer s.slotsMu.Unlock()
+
+	key := llm.Driver + " " + llm.BaseURL
+	slots, ok := s.slots[key]
+	if !ok {
+		slots = limit.NewSlots(llm.MaxConcurrency)
+		s.slots[key] = slots
+	}
+	return slots
+}
+
+// credential はllmのドライバーで使うAPIキーの取得元を決めます。APIキーはこの時点では読み込みません。
+// llmのapi-key-env、api-key-file、api-key-commandを優先し、いずれも無い場合はユーザーコンフィグのcredentials、
+// それも無い場合はdefaultEnvの環境変数を使います。defaultEnvが空の場合はnilを返します。
+func (s *ChatFactory) credential(cfg *config.Config, options MakeOptions, defaultEnv string) (credential.Credential, error) {
+	source, err := credentialSource(config.Credential{
+		APIKeyEnv:     cfg.LLM.APIKeyEnv,
+		APIKeyFile:    cfg.LLM.APIKeyFile,
+		APIKeyCommand: cfg.LLM.APIKeyCommand,
+	}, options.RootDir)
+	if err != nil {
+		return nil, eris.Wrapf(err, "invalid credential of llm (%s)", cfg.LLM.Driver)
+	}
+
+	if source.IsZero() {
+		userCfg, err := s.configRepository.ReadUser()
+		if err != nil {
+			return nil, eris.Wrap(err, "failed to read user config")
+		}
+		if userCredential, ok := userCfg.Credentials[cfg.LLM.Driver]; ok {
+			userCfgDir, err := s.configRepository.UserConfigDir()
+			if err != nil {
+				return nil, eris.Wrap(err, "failed to resolve user config directory")
+			}
+			source, err = credentialSource(userCredential, userCfgDir)
+			if err != nil {
+				return nil, eris.Wrapf(err, "invalid credentials.%s of user config", cfg.LLM.Driver)
+			}
+		}
+	}
+
+	if source.IsZero() {
+		if defaultEnv == "" {
+			return nil, nil
+		}
+		source = credential.Source{Env: defaultEnv}
+	}
+
+	return s.credentialProvider.Credential(source), nil
+}
+
+// credentialSource はAPIキーの取得元の設定をSourceに変換します。相対パスのapi-key-fileはbaseDirからのパスとします。
+func credentialSource(c config.Credential, baseDir string) (credential.Source, error) {
+	count := 0
+	for _, v := range []string{c.APIKeyEnv, c.APIKeyFile, c.APIKeyCommand} {
+		if v != "" {
+			count++
+		}
+	}
+	if count > 1 {
+		return credential.Source{}, eris.New("only one of api-key-env, api-key-file and api-key-command can be specified")
+	}
+
+	file := c.APIKeyFile
+	if file != "" && !filepath.IsAbs(file) && !strings.HasPrefix(file, "~/") {
+		file = filepath.Join(baseDir, file)
+	}
+
+	return credential.Source{Env: c.APIKeyEnv, File: file, Command: c.APIKeyCommand}, nil
+}
+
+// makeReplayChat はプロジェクトコンフィグのllm.replayに従ってreplayドライバーのチャットモデルを生成します。
+func (s *ChatFactory) makeReplayChat(cfg *config.Config, options MakeOptions) (chat.Chat, error) {
+	dir := cfg.LLM.Replay.Dir
+	if dir == "" {
+		return nil, eris.New("llm.replay.dir is required for the replay driver")
+	}
+	if !filepath.IsAbs(dir) {
+		dir = filepath.Join(options.RootDir, dir)
+	}
+
+	fixtures, err := s.replayFixtureService.Open(dir)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to open replay fixtures")
+	}
+
+	switch cfg.LLM.Replay.Mode {
+	case "", "replay":
+		return replay.NewReplayChat(fixtures), nil
+	case "record":
+		if cfg.LLM.Replay.Driver == "" || cfg.LLM.Replay.Driver == "replay" {
+			return nil, eris.New("llm.replay.driver must be a real driver in record mode")
+		}
+
+		// 記録する回答は必ず実際のドライバーから取得する
+		recordCfg := *cfg
+		recordCfg.LLM.Driver = cfg.LLM.Replay.Driver
+		recorder, err := s.makeChat(&recordCfg, MakeOptions{RootDir: options.RootDir, NoCache: true})
+		if err != nil {
+			return nil, err
+		}
+		return replay.NewRecordChat(recorder, fixtures), nil
+	default:
+		return nil, eris.Errorf("unsupported replay mode: %s", cfg.LLM.Replay.Mode)
+	}
+}
+
+// cacheKeyParams はレスポンスキャッシュのキーに含める生成条件を組み立てます。
+func cacheKeyParams(cfg *config.Config) cache.KeyParams {
+	params := map[string]string{}
+	if cfg.LLM.BaseURL != "" {
+		params["base-url"] = cfg.LLM.BaseURL
+	}
+	if cfg.LLM.MaxTokens != 0 {
+		params["max-tokens"] = strconv.Itoa(cfg.LLM.MaxTokens)
+	}
+	if cfg.LLM.Temperature != nil {
+		params["temperature"] = strconv.FormatFloat(*cfg.LLM.Temperature, 'g', -1, 64)
+	}
+	if cfg.LLM.TopP != nil {
+		params["top-p"] = strconv.FormatFloat(*cfg.LLM.TopP, 'g', -1, 64)
+	}
+	if len(cfg.LLM.Stop) > 0 {
+		params["stop"] = strings.Join(cfg.LLM.Stop, "\n")
+	}
+	return cache.KeyParams{
+		Driver: cfg.LLM.Driver,
+		Params: params,
+	}
+}
+
+// generationParams はプロジェクトコンフィグのllmから生成パラメータを組み立てます。
+func generationParams(cfg *config.Config) chat.GenerationParams {
+	return chat.GenerationParams{
+		MaxTokens:   cfg.LLM.MaxTokens,
+		Temperature: cfg.LLM.Temperature,
+		TopP:        cfg.LLM.TopP,
+		Stop:        cfg.LLM.Stop,
+	}
+}
+
+// retryPolicy はプロジェクトコンフィグのllm.retryとllm.timeoutから再試行の方針を組み立てます。
+// 指定がない項目はデフォルト値を使います。
+func retryPolicy(cfg *config.Config) retry.Policy {
+	policy := retry.DefaultPolicy()
+	if cfg.LLM.Retry.MaxAttempts > 0 {
+		policy.MaxAttempts = cfg.LLM.Retry.MaxAttempts
+	}
+	if cfg.LLM.Timeout > 0 {
+		policy.Timeout = cfg.LLM.Timeout
+	}
+	if cfg.LLM.Retry.MaxWait > 0 {
+		policy.MaxWait = cfg.LLM.Retry.MaxWait
+		if policy.InitialWait > policy.MaxWait {
+			policy.InitialWait = policy.MaxWait
+		}
+	}
+	return policy
+}
+
+// visionModelPrefixes は画像とPDFを受け付けるOpenAIのモデル名の接頭辞です。
+var visionModelPrefixes = []string{"gpt-4o", "chatgpt-4o", "gpt-4.1", "gpt-4.5", "gpt-4-turbo", "gpt-5", "o1", "o3", "o4"}
+
+// nonVisionModelPrefixes はvisionModelPrefixesに一致するが、画像とPDFを受け付けないモデル名の接頭辞です。
+var nonVisionModelPrefixes = []string{"o1-mini", "o1-preview", "o3-mini"}
+
+// openAiMediaTypes はopen-aiドライバーのmodelに添付できるファイルの種類を返します。ビジョンに対応していないモデルの場合は添付できません。
+func openAiMediaTypes(model string) []string {
+	for _, prefix := range nonVisionModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return nil
+		}
+	}
+	for _, prefix := range visionModelPrefixes {
+		if strings.HasPrefix(model, prefix) {
+			return append(append([]string{}, chat.ImageMediaTypes...), chat.DocumentMediaTypes...)
+		}
+	}
+	return nil
+}
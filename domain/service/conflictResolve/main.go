@@ -0,0 +1,194 @@
+package conflictResolve
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
+	"github.com/t-kuni/sisho/domain/system/terminal"
+	"io"
+	"strings"
+)
+
+const (
+	// ActionMerge は生成結果をファイルの現在の内容と3-way mergeします
+	ActionMerge = "merge"
+	// ActionNew はファイルを書き換えず、生成結果を `[パス].sisho-new` に保存します
+	ActionNew = "new"
+	// ActionAbort はファイルを書き換えずにエラーとします
+	ActionAbort = "abort"
+)
+
+// NewFileSuffix はActionNewで生成結果を保存するファイルの接尾辞です。
+const NewFileSuffix = ".sisho-new"
+
+const (
+	markerCurrent   = "<<<<<<< current"
+	markerDivider   = "======="
+	markerGenerated = ">>>>>>> generated"
+)
+
+type ConflictResolveService struct {
+	terminal terminal.Terminal
+}
+
+func NewConflictResolveService(terminal terminal.Terminal) *ConflictResolveService {
+	return &ConflictResolveService{
+		terminal: terminal,
+	}
+}
+
+// Ask は生成中に変更されたファイルをどう扱うかを利用者に確認し、ActionXxxを返します。
+func (s *ConflictResolveService) Ask(out io.Writer, path string) (string, error) {
+	for {
+		fmt.Fprintf(out, "%s was changed on disk during generation. How to apply the generation [m,n,a,?]? ", path)
+		answer, err := s.terminal.ReadLine()
+		if err != nil {
+			return "", eris.Wrap(err, "failed to read the answer")
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "m":
+			return ActionMerge, nil
+		case "n":
+			return ActionNew, nil
+		case "a":
+			return ActionAbort, nil
+		default:
+			fmt.Fprintln(out, "m - merge the generation with the current content (conflicts are marked in the file)")
+			fmt.Fprintf(out, "n - keep the file and save the generation as %s%s\n", path, NewFileSuffix)
+			fmt.Fprintln(out, "a - keep the file and abort")
+		}
+	}
+}
+
+// change はbaseの[start, end)の行をlinesに置き換える変更です。startとendが同じ場合は挿入です。
+type change struct {
+	start int
+	end   int
+	lines []string
+}
+
+// Merge はbaseからcurrentへの変更と、baseからgeneratedへの変更を行単位で3-way mergeします。
+// 両方が同じ箇所を異なる内容に変更している場合は、その箇所をコンフリクトマーカーで囲み、コンフリクトの数と共に返します。
+func Merge(base, current, generated string) (string, int) {
+	baseLines := splitLines(base)
+	ours := changes(base, current)
+	theirs := changes(base, generated)
+
+	var b strings.Builder
+	conflicts := 0
+	pos := 0
+	i, j := 0, 0
+	for i < len(ours) || j < len(theirs) {
+		// 次に始まる変更と、それに重なる（隣接する）変更をまとめる
+		var groupOurs, groupTheirs []change
+		var start, end int
+		take := func() {
+			if j >= len(theirs) || (i < len(ours) && ours[i].start <= theirs[j].start) {
+				groupOurs = append(groupOurs, ours[i])
+				end = max(end, ours[i].end)
+				i++
+			} else {
+				groupTheirs = append(groupTheirs, theirs[j])
+				end = max(end, theirs[j].end)
+				j++
+			}
+		}
+		if j >= len(theirs) || (i < len(ours) && ours[i].start <= theirs[j].start) {
+			start, end = ours[i].start, ours[i].end
+		} else {
+			start, end = theirs[j].start, theirs[j].end
+		}
+		take()
+		for (i < len(ours) && ours[i].start <= end) || (j < len(theirs) && theirs[j].start <= end) {
+			take()
+		}
+
+		b.WriteString(strings.Join(baseLines[pos:start], ""))
+		pos = end
+
+		oursText := apply(baseLines, start, end, groupOurs)
+		theirsText := apply(baseLines, start, end, groupTheirs)
+		switch {
+		case len(groupTheirs) == 0:
+			b.WriteString(oursText)
+		case len(groupOurs) == 0, oursText == theirsText:
+			b.WriteString(theirsText)
+		default:
+			conflicts++
+			b.WriteString(markerCurrent + "\n")
+			b.WriteString(withNewline(oursText))
+			b.WriteString(markerDivider + "\n")
+			b.WriteString(withNewline(theirsText))
+			b.WriteString(markerGenerated + "\n")
+		}
+	}
+	b.WriteString(strings.Join(baseLines[pos:], ""))
+
+	return b.String(), conflicts
+}
+
+// changes はbaseからotherへの変更を、baseの行の位置の順に返します。
+func changes(base, other string) []change {
+	var result []change
+	var current *change
+	pos := 0
+	for _, line := range hunkReview.DiffLines(base, other) {
+		switch line.Kind {
+		case ' ':
+			if current != nil {
+				result = append(result, *current)
+				current = nil
+			}
+			pos++
+		case '-':
+			if current == nil {
+				current = &change{start: pos, end: pos}
+			}
+			current.end++
+			pos++
+		case '+':
+			if current == nil {
+				current = &change{start: pos, end: pos}
+			}
+			current.lines = append(current.lines, line.Text)
+		}
+	}
+	if current != nil {
+		result = append(result, *current)
+	}
+	return result
+}
+
+// apply はbaseの[start, end)の行に、その範囲の変更を適用した内容を返します。
+func apply(baseLines []string, start, end int, group []change) string {
+	var b strings.Builder
+	pos := start
+	for _, c := range group {
+		b.WriteString(strings.Join(baseLines[pos:c.start], ""))
+		b.WriteString(strings.Join(c.lines, ""))
+		pos = c.end
+	}
+	b.WriteString(strings.Join(baseLines[pos:end], ""))
+	return b.String()
+}
+
+// withNewline はコンフリクトマーカーが同じ行に続かないよう、末尾に改行が無い場合は改行を付けます。
+func withNewline(text string) string {
+	if text == "" || strings.HasSuffix(text, "\n") {
+		return text
+	}
+	return text + "\n"
+}
+
+// splitLines はテキストを末尾の改行を含む行に分けます。
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
@@ -0,0 +1,72 @@
+package conflictResolve_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
+	"github.com/t-kuni/sisho/domain/system/terminal"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+func TestMerge(t *testing.T) {
+	base := "a\nb\nc\nd\ne\nf\ng\n"
+
+	t.Run("異なる箇所の変更は両方反映されること", func(t *testing.T) {
+		current := "a\nB\nc\nd\ne\nf\ng\n"
+		generated := "a\nb\nc\nd\ne\nF\ng\nh\n"
+
+		merged, conflicts := conflictResolve.Merge(base, current, generated)
+
+		assert.Equal(t, 0, conflicts)
+		assert.Equal(t, "a\nB\nc\nd\ne\nF\ng\nh\n", merged)
+	})
+
+	t.Run("同じ箇所を同じ内容に変更した場合は1度だけ反映されること", func(t *testing.T) {
+		current := "a\nb\nC\nd\ne\nf\ng\n"
+		generated := "a\nb\nC\nd\ne\nf\ng\n"
+
+		merged, conflicts := conflictResolve.Merge(base, current, generated)
+
+		assert.Equal(t, 0, conflicts)
+		assert.Equal(t, "a\nb\nC\nd\ne\nf\ng\n", merged)
+	})
+
+	t.Run("同じ箇所を異なる内容に変更した場合はコンフリクトマーカーで囲むこと", func(t *testing.T) {
+		current := "a\nb\nCURRENT\nd\ne\nf\ng\n"
+		generated := "a\nb\nGENERATED\nd\ne\nf\nG\n"
+
+		merged, conflicts := conflictResolve.Merge(base, current, generated)
+
+		assert.Equal(t, 1, conflicts)
+		assert.Equal(t, "a\nb\n<<<<<<< current\nCURRENT\n=======\nGENERATED\n>>>>>>> generated\nd\ne\nf\nG\n", merged)
+	})
+
+	t.Run("最終行に改行が無い場合もコンフリクトマーカーが別の行になること", func(t *testing.T) {
+		merged, conflicts := conflictResolve.Merge("a\nb", "a\nc", "a\nd")
+
+		assert.Equal(t, 1, conflicts)
+		assert.Equal(t, "a\n<<<<<<< current\nc\n=======\nd\n>>>>>>> generated\n", merged)
+	})
+}
+
+func TestAsk(t *testing.T) {
+	t.Run("入力に対応する扱いを返し、それ以外の入力の場合は説明を出力して再度確認すること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
+		gomock.InOrder(
+			mockTerminal.EXPECT().ReadLine().Return("?", nil),
+			mockTerminal.EXPECT().ReadLine().Return("n", nil),
+		)
+		var out bytes.Buffer
+
+		action, err := conflictResolve.NewConflictResolveService(mockTerminal).Ask(&out, "aaa.txt")
+
+		assert.NoError(t, err)
+		assert.Equal(t, conflictResolve.ActionNew, action)
+		assert.Contains(t, out.String(), "aaa.txt was changed on disk during generation.")
+		assert.Contains(t, out.String(), "save the generation as aaa.txt.sisho-new")
+	})
+}
@@ -0,0 +1,281 @@
+package editApply
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"strings"
+)
+
+const (
+	searchMarker  = "<<<<<<< SEARCH"
+	dividerMarker = "======="
+	replaceMarker = ">>>>>>> REPLACE"
+)
+
+// Hunk はファイルの1箇所の変更を表します。Searchに一致する行をReplaceに置き換えます。
+type Hunk struct {
+	Search  string
+	Replace string
+}
+
+// Parse はコードブロックの内容から変更箇所を読み取ります。
+// SEARCH/REPLACEブロックとunified diffに対応します。どちらでも無い場合（ファイル全体が記載されている場合）はnilを返します。
+func Parse(block string) ([]Hunk, error) {
+	lines := strings.Split(block, "\n")
+	for _, line := range lines {
+		if strings.TrimSpace(line) == searchMarker {
+			return parseSearchReplace(lines)
+		}
+	}
+
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "--- ") || strings.HasPrefix(line, "@@") {
+			return parseUnifiedDiff(lines)
+		}
+		break
+	}
+
+	return nil, nil
+}
+
+func parseSearchReplace(lines []string) ([]Hunk, error) {
+	const (
+		outside = iota
+		inSearch
+		inReplace
+	)
+
+	var hunks []Hunk
+	var search, replace []string
+	state := outside
+	for _, line := range lines {
+		marker := strings.TrimSpace(line)
+		switch {
+		case state == outside && marker == searchMarker:
+			search, replace = nil, nil
+			state = inSearch
+		case state == inSearch && marker == dividerMarker:
+			state = inReplace
+		case state == inReplace && marker == replaceMarker:
+			hunks = append(hunks, Hunk{
+				Search:  strings.Join(search, "\n"),
+				Replace: strings.Join(replace, "\n"),
+			})
+			state = outside
+		case state == inSearch:
+			search = append(search, line)
+		case state == inReplace:
+			replace = append(replace, line)
+		}
+	}
+
+	switch state {
+	case inSearch:
+		return nil, eris.Errorf("hunk %d has no %s line", len(hunks)+1, dividerMarker)
+	case inReplace:
+		return nil, eris.Errorf("hunk %d has no %s line", len(hunks)+1, replaceMarker)
+	}
+	return hunks, nil
+}
+
+// parseUnifiedDiff はunified diffを読み取ります。
+// モデルが記載する行番号は信用できないため使わず、コンテキスト行と削除行を検索する行として扱います。
+func parseUnifiedDiff(lines []string) ([]Hunk, error) {
+	// コードブロックが改行で終わる場合の最後の空の要素は、空のコンテキスト行ではない
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var hunks []Hunk
+	var search, replace []string
+	inHunk := false
+	flush := func() {
+		if inHunk {
+			hunks = append(hunks, Hunk{
+				Search:  strings.Join(search, "\n"),
+				Replace: strings.Join(replace, "\n"),
+			})
+		}
+		search, replace = nil, nil
+	}
+
+	for _, line := range lines {
+		if strings.HasPrefix(line, "@@") {
+			flush()
+			inHunk = true
+			continue
+		}
+		if !inHunk {
+			// ---, +++ などのヘッダーは読み飛ばす
+			continue
+		}
+
+		switch {
+		case strings.HasPrefix(line, "\\"):
+			// \ No newline at end of file
+		case strings.HasPrefix(line, "-"):
+			search = append(search, line[1:])
+		case strings.HasPrefix(line, "+"):
+			replace = append(replace, line[1:])
+		case strings.HasPrefix(line, " "):
+			search = append(search, line[1:])
+			replace = append(replace, line[1:])
+		case line == "":
+			// 空のコンテキスト行は先頭の空白が省略されることがある
+			search = append(search, "")
+			replace = append(replace, "")
+		default:
+			return nil, eris.Errorf("hunk %d has an invalid line: %q", len(hunks)+1, line)
+		}
+	}
+	flush()
+
+	if len(hunks) == 0 {
+		return nil, eris.New("the unified diff has no hunks")
+	}
+	return hunks, nil
+}
+
+// Apply はcontentにhunksを順に適用した結果を返します。
+// 一致する箇所が無い、または複数ある変更箇所が1つでもあればエラーを返します（一部だけ適用した結果は返しません）。
+func Apply(content string, hunks []Hunk) (string, error) {
+	for i, hunk := range hunks {
+		updated, err := applyHunk(content, hunk)
+		if err != nil {
+			return "", eris.Wrapf(err, "hunk %d of %d did not match", i+1, len(hunks))
+		}
+		content = updated
+	}
+	return content, nil
+}
+
+// matchers は検索する行とファイルの行を比較する方法です。先頭から順に試し、一致する箇所が見つかった方法を使います。
+var matchers = []func(a, b string) bool{
+	// 完全一致
+	func(a, b string) bool { return a == b },
+	// 行末の空白を無視
+	func(a, b string) bool {
+		return strings.TrimRight(a, " \t\r") == strings.TrimRight(b, " \t\r")
+	},
+	// 行頭と行末の空白を無視（インデントの違い）
+	func(a, b string) bool { return strings.TrimSpace(a) == strings.TrimSpace(b) },
+}
+
+func applyHunk(content string, hunk Hunk) (string, error) {
+	if strings.TrimSpace(hunk.Search) == "" {
+		// 検索する行が無い変更箇所は、空のファイルへの追加としてのみ扱う
+		if strings.TrimSpace(content) != "" {
+			return "", eris.New("the hunk has no lines to search for")
+		}
+		return hunk.Replace, nil
+	}
+
+	lines := strings.Split(content, "\n")
+	search, leading, trailing := trimBlankEdges(strings.Split(hunk.Search, "\n"))
+	// 検索する行から取り除いた前後の空行は、置き換える行からも同じ数だけ取り除く（空行が増えないように）
+	replace := dropBlankEdges(strings.Split(hunk.Replace, "\n"), leading, trailing)
+
+	for _, match := range matchers {
+		var found []int
+		for start := 0; start+len(search) <= len(lines); start++ {
+			if matchLines(lines[start:start+len(search)], search, match) {
+				found = append(found, start)
+			}
+		}
+		if len(found) == 0 {
+			continue
+		}
+		if len(found) > 1 {
+			return "", eris.Errorf("the search text matches %d places:\n%s", len(found), preview(search))
+		}
+
+		start := found[0]
+		replace = reindent(replace, search, lines[start:start+len(search)])
+		updated := append([]string{}, lines[:start]...)
+		updated = append(updated, replace...)
+		updated = append(updated, lines[start+len(search):]...)
+		return strings.Join(updated, "\n"), nil
+	}
+
+	return "", eris.Errorf("the search text was not found:\n%s", preview(search))
+}
+
+func matchLines(lines, search []string, match func(a, b string) bool) bool {
+	for i := range search {
+		if !match(lines[i], search[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// trimBlankEdges は先頭と末尾の空行を取り除き、取り除いた先頭と末尾の行数と共に返します（モデルが前後に空行を付けることがあるため）。
+func trimBlankEdges(lines []string) ([]string, int, int) {
+	leading, trailing := 0, 0
+	for len(lines) > 1 && strings.TrimSpace(lines[0]) == "" {
+		lines = lines[1:]
+		leading++
+	}
+	for len(lines) > 1 && strings.TrimSpace(lines[len(lines)-1]) == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	return lines, leading, trailing
+}
+
+// dropBlankEdges は先頭からleading行、末尾からtrailing行までの空行を取り除きます。
+func dropBlankEdges(lines []string, leading, trailing int) []string {
+	for i := 0; i < leading && len(lines) > 0 && strings.TrimSpace(lines[0]) == ""; i++ {
+		lines = lines[1:]
+	}
+	for i := 0; i < trailing && len(lines) > 0 && strings.TrimSpace(lines[len(lines)-1]) == ""; i++ {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// reindent はインデントを無視して一致した場合に、置き換える行のインデントをファイルに合わせます。
+func reindent(replace, search, matched []string) []string {
+	for i := range search {
+		if strings.TrimSpace(search[i]) == "" {
+			continue
+		}
+		want := leadingSpace(matched[i])
+		got := leadingSpace(search[i])
+		if want == got {
+			return replace
+		}
+
+		result := make([]string, len(replace))
+		for j, line := range replace {
+			switch {
+			case strings.TrimSpace(line) == "":
+				result[j] = line
+			case strings.HasSuffix(want, got):
+				result[j] = want[:len(want)-len(got)] + line
+			case strings.HasSuffix(got, want):
+				result[j] = strings.TrimPrefix(line, got[:len(got)-len(want)])
+			default:
+				result[j] = line
+			}
+		}
+		return result
+	}
+	return replace
+}
+
+func leadingSpace(line string) string {
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// preview はエラーメッセージに含める検索する行です（長い場合は先頭の数行だけにします）。
+func preview(search []string) string {
+	const maxLines = 5
+	if len(search) <= maxLines {
+		return strings.Join(search, "\n")
+	}
+	return strings.Join(search[:maxLines], "\n") + fmt.Sprintf("\n... (%d more lines)", len(search)-maxLines)
+}
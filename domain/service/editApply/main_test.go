@@ -0,0 +1,168 @@
+package editApply_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/editApply"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("SEARCH/REPLACEブロックを読み取れること", func(t *testing.T) {
+		hunks, err := editApply.Parse(`<<<<<<< SEARCH
+a
+b
+=======
+A
+>>>>>>> REPLACE
+
+<<<<<<< SEARCH
+c
+=======
+C
+>>>>>>> REPLACE`)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []editApply.Hunk{
+			{Search: "a\nb", Replace: "A"},
+			{Search: "c", Replace: "C"},
+		}, hunks)
+	})
+
+	t.Run("unified diffを読み取れること", func(t *testing.T) {
+		hunks, err := editApply.Parse(`--- a/main.go
++++ b/main.go
+@@ -1,3 +1,3 @@
+ a
+-b
++B
+
+@@ -10,1 +10,2 @@
+ x
++y
+\ No newline at end of file`)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []editApply.Hunk{
+			{Search: "a\nb\n", Replace: "a\nB\n"},
+			{Search: "x", Replace: "x\ny"},
+		}, hunks)
+	})
+
+	t.Run("ファイル全体が記載されている場合はnilを返すこと", func(t *testing.T) {
+		hunks, err := editApply.Parse("package main\n\nfunc main() {}")
+
+		assert.NoError(t, err)
+		assert.Nil(t, hunks)
+	})
+
+	t.Run("閉じられていないSEARCH/REPLACEブロックはエラーになること", func(t *testing.T) {
+		_, err := editApply.Parse("<<<<<<< SEARCH\na\n=======\nA")
+
+		assert.ErrorContains(t, err, "hunk 1 has no >>>>>>> REPLACE line")
+	})
+}
+
+func TestApply(t *testing.T) {
+	t.Run("一致する行が置き換えられ、それ以外の行は変わらないこと", func(t *testing.T) {
+		actual, err := editApply.Apply("a\nb\nc\n", []editApply.Hunk{
+			{Search: "b", Replace: "B1\nB2"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "a\nB1\nB2\nc\n", actual)
+	})
+
+	t.Run("行末の空白の違いを無視して一致すること", func(t *testing.T) {
+		actual, err := editApply.Apply("a  \nb\n", []editApply.Hunk{
+			{Search: "a\nb", Replace: "A\nB"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "A\nB\n", actual)
+	})
+
+	t.Run("インデントの違いを無視して一致し、置き換える行のインデントをファイルに合わせること", func(t *testing.T) {
+		actual, err := editApply.Apply("func f() {\n\treturn 1\n}\n", []editApply.Hunk{
+			{Search: "return 1", Replace: "x := 1\nreturn x"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "func f() {\n\tx := 1\n\treturn x\n}\n", actual)
+	})
+
+	t.Run("一致しない変更箇所がある場合はエラーになること", func(t *testing.T) {
+		_, err := editApply.Apply("a\nb\n", []editApply.Hunk{
+			{Search: "a", Replace: "A"},
+			{Search: "z", Replace: "Z"},
+		})
+
+		assert.ErrorContains(t, err, "hunk 2 of 2 did not match")
+		assert.ErrorContains(t, err, "the search text was not found:\nz")
+	})
+
+	t.Run("複数の箇所に一致する変更箇所はエラーになること", func(t *testing.T) {
+		_, err := editApply.Apply("a\nb\na\n", []editApply.Hunk{
+			{Search: "a", Replace: "A"},
+		})
+
+		assert.ErrorContains(t, err, "the search text matches 2 places")
+	})
+
+	t.Run("検索する行が空の変更箇所は、空のファイルの内容になること", func(t *testing.T) {
+		actual, err := editApply.Apply("", []editApply.Hunk{
+			{Search: "", Replace: "NEW"},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "NEW", actual)
+	})
+}
+
+func TestParseAndApply(t *testing.T) {
+	content := "package main\n\nimport \"fmt\"\n\nfunc a() {\n\tfmt.Println(\"a\")\n}\n\nfunc b() {\n\tfmt.Println(\"b\")\n}\n"
+
+	tests := []struct {
+		name     string
+		block    string
+		expected string
+	}{
+		{
+			name: "unified diff: 先頭と末尾が空のコンテキスト行の変更箇所で空行が増えないこと",
+			block: "--- a/main.go\n+++ b/main.go\n@@ -4,5 +4,5 @@\n \n func a() {\n-\tfmt.Println(\"a\")\n+\tfmt.Println(\"A\")\n }\n \n" +
+				"@@ -8,5 +8,5 @@\n \n func b() {\n-\tfmt.Println(\"b\")\n+\tfmt.Println(\"B\")\n }\n",
+			expected: "package main\n\nimport \"fmt\"\n\nfunc a() {\n\tfmt.Println(\"A\")\n}\n\nfunc b() {\n\tfmt.Println(\"B\")\n}\n",
+		},
+		{
+			name:     "unified diff: 末尾の改行が空のコンテキスト行として扱われないこと",
+			block:    "@@ -9,3 +9,3 @@\n func b() {\n-\tfmt.Println(\"b\")\n+\tfmt.Println(\"B\")\n }\n",
+			expected: "package main\n\nimport \"fmt\"\n\nfunc a() {\n\tfmt.Println(\"a\")\n}\n\nfunc b() {\n\tfmt.Println(\"B\")\n}\n",
+		},
+		{
+			name:     "unified diff: 空のコンテキスト行に挟まれた行を削除できること",
+			block:    "@@ -2,3 +2,2 @@\n \n-import \"fmt\"\n \n",
+			expected: "package main\n\n\nfunc a() {\n\tfmt.Println(\"a\")\n}\n\nfunc b() {\n\tfmt.Println(\"b\")\n}\n",
+		},
+		{
+			name:     "SEARCH/REPLACE: 先頭と末尾が空行の変更箇所で空行が増えないこと",
+			block:    "<<<<<<< SEARCH\n\nfunc a() {\n\tfmt.Println(\"a\")\n}\n\n=======\n\nfunc a() {\n\tfmt.Println(\"A\")\n}\n\n>>>>>>> REPLACE\n",
+			expected: "package main\n\nimport \"fmt\"\n\nfunc a() {\n\tfmt.Println(\"A\")\n}\n\nfunc b() {\n\tfmt.Println(\"b\")\n}\n",
+		},
+		{
+			name:     "SEARCH/REPLACE: 置き換える行の前後の空行が検索する行より多い場合は、多い分の空行を追加すること",
+			block:    "<<<<<<< SEARCH\n\nfunc b() {\n=======\n\n\nfunc b() {\n>>>>>>> REPLACE\n",
+			expected: "package main\n\nimport \"fmt\"\n\nfunc a() {\n\tfmt.Println(\"a\")\n}\n\n\nfunc b() {\n\tfmt.Println(\"b\")\n}\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hunks, err := editApply.Parse(tt.block)
+			assert.NoError(t, err)
+
+			actual, err := editApply.Apply(content, hunks)
+
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, actual)
+		})
+	}
+}
@@ -0,0 +1,348 @@
+package fileTools
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/denormal/go-gitignore"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/kinds"
+	"github.com/t-kuni/sisho/domain/repository/knowledge"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	// maxReadBytes は read_file が返すファイルの内容の上限です。
+	maxReadBytes = 100 * 1024
+	// maxGrepMatches は grep が返す一致行の上限です。
+	maxGrepMatches = 100
+)
+
+type FileToolsService struct {
+	knowledgeRepository knowledge.Repository
+}
+
+func NewFileToolsService(knowledgeRepository knowledge.Repository) *FileToolsService {
+	return &FileToolsService{
+		knowledgeRepository: knowledgeRepository,
+	}
+}
+
+// Tools はモデルに提供する読み取り専用のツールの定義を返します。
+func (s *FileToolsService) Tools() []chat.Tool {
+	return []chat.Tool{
+		{
+			Name:        "read_file",
+			Description: "Read a file in the project. The path is relative to the project root.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{"type": "string", "description": "Path relative to the project root"},
+				},
+				"required": []string{"path"},
+			},
+		},
+		{
+			Name:        "list_dir",
+			Description: "List the files and directories in a directory of the project. Directories end with '/'.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"path": map[string]interface{}{"type": "string", "description": "Path relative to the project root. Defaults to the project root"},
+				},
+			},
+		},
+		{
+			Name:        "grep",
+			Description: "Search files under a directory of the project with a regular expression (RE2 syntax). Returns 'path:line: text' for each match.",
+			Parameters: map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"pattern": map[string]interface{}{"type": "string", "description": "Regular expression"},
+					"path":    map[string]interface{}{"type": "string", "description": "Path relative to the project root. Defaults to the project root"},
+				},
+				"required": []string{"pattern"},
+			},
+		},
+	}
+}
+
+// Session はrootDir以下のファイルに対するツールの呼び出しを実行し、読み込んだファイルを記録します。
+type Session struct {
+	rootDir string
+	ignore  gitignore.GitIgnore
+	fetched []string
+}
+
+// Open はrootDirをプロジェクトルートとするSessionを返します。プロジェクトルートの`.sishoignore`を読み込みます。
+func (s *FileToolsService) Open(rootDir string) (*Session, error) {
+	rootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to resolve project root")
+	}
+
+	ignore, err := gitignore.NewFromFile(filepath.Join(rootDir, ".sishoignore"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, eris.Wrap(err, "failed to read .sishoignore")
+	}
+
+	return &Session{
+		rootDir: rootDir,
+		ignore:  ignore,
+	}, nil
+}
+
+// Call はツールの呼び出しを実行し、モデルに返す結果を返します。
+// 失敗した場合もエラーにはせず、エラーの内容を結果としてモデルに返します。
+func (s *Session) Call(call chat.ToolCall) string {
+	var args struct {
+		Path    string `json:"path"`
+		Pattern string `json:"pattern"`
+	}
+	if strings.TrimSpace(call.Arguments) != "" {
+		if err := json.Unmarshal([]byte(call.Arguments), &args); err != nil {
+			return fmt.Sprintf("error: invalid arguments: %v", err)
+		}
+	}
+
+	var result string
+	var err error
+	switch call.Name {
+	case "read_file":
+		result, err = s.readFile(args.Path)
+	case "list_dir":
+		result, err = s.listDir(args.Path)
+	case "grep":
+		result, err = s.grep(args.Pattern, args.Path)
+	default:
+		err = fmt.Errorf("unknown tool: %s", call.Name)
+	}
+	if err != nil {
+		return fmt.Sprintf("error: %v", err)
+	}
+	return result
+}
+
+// Fetched はread_fileで読み込んだファイルのプロジェクトルートからの相対パスを、読み込んだ順に返します。
+func (s *Session) Fetched() []string {
+	return s.fetched
+}
+
+func (s *Session) readFile(path string) (string, error) {
+	rel, abs, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	info, err := os.Stat(abs)
+	if err != nil {
+		return "", fmt.Errorf("file not found: %s", rel)
+	}
+	if info.IsDir() {
+		return "", fmt.Errorf("%s is a directory", rel)
+	}
+
+	content, err := os.ReadFile(abs)
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s", rel)
+	}
+
+	s.addFetched(rel)
+
+	if len(content) > maxReadBytes {
+		return string(content[:maxReadBytes]) + fmt.Sprintf("\n... (truncated, the file is %d bytes)", len(content)), nil
+	}
+	return string(content), nil
+}
+
+func (s *Session) listDir(path string) (string, error) {
+	rel, abs, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	entries, err := os.ReadDir(abs)
+	if err != nil {
+		return "", fmt.Errorf("directory not found: %s", rel)
+	}
+
+	var lines []string
+	for _, entry := range entries {
+		entryRel := filepath.Join(rel, entry.Name())
+		if s.excluded(entryRel, entry.IsDir()) {
+			continue
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			name += "/"
+		}
+		lines = append(lines, name)
+	}
+	sort.Strings(lines)
+
+	if len(lines) == 0 {
+		return "(empty)", nil
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+func (s *Session) grep(pattern string, path string) (string, error) {
+	if pattern == "" {
+		return "", fmt.Errorf("pattern is required")
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return "", fmt.Errorf("invalid pattern: %v", err)
+	}
+
+	_, abs, err := s.resolve(path)
+	if err != nil {
+		return "", err
+	}
+
+	var matches []string
+	err = filepath.Walk(abs, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(s.rootDir, p)
+		if err != nil {
+			return nil
+		}
+		if rel != "." && p != abs && s.excluded(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !info.Mode().IsRegular() {
+			return nil
+		}
+		return s.grepFile(re, p, filepath.ToSlash(rel), &matches)
+	})
+	if err != nil && err != filepath.SkipAll {
+		return "", fmt.Errorf("failed to search: %v", err)
+	}
+
+	if len(matches) == 0 {
+		return "(no matches)", nil
+	}
+	result := strings.Join(matches, "\n")
+	if len(matches) >= maxGrepMatches {
+		result += fmt.Sprintf("\n... (stopped at %d matches)", maxGrepMatches)
+	}
+	return result, nil
+}
+
+// grepFile はファイルの一致行をmatchesに追加します。上限に達した場合はfilepath.SkipAllを返します。
+func (s *Session) grepFile(re *regexp.Regexp, path string, rel string, matches *[]string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxReadBytes)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Text()
+		if strings.ContainsRune(line, 0) {
+			// バイナリファイルは検索しない
+			return nil
+		}
+		if re.MatchString(line) {
+			*matches = append(*matches, fmt.Sprintf("%s:%d: %s", rel, n, line))
+			if len(*matches) >= maxGrepMatches {
+				return filepath.SkipAll
+			}
+		}
+	}
+	return nil
+}
+
+// resolve はツールに渡されたパスを検証し、プロジェクトルートからの相対パスと絶対パスを返します。
+// プロジェクトルートの外、隠しファイル・フォルダ、`.sishoignore`に記載されたパスはエラーにします。
+func (s *Session) resolve(path string) (string, string, error) {
+	if path == "" {
+		path = "."
+	}
+	if filepath.IsAbs(path) {
+		return "", "", fmt.Errorf("absolute paths are not allowed: %s", path)
+	}
+
+	rel := filepath.Clean(filepath.FromSlash(path))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", "", fmt.Errorf("paths outside the project root are not allowed: %s", path)
+	}
+	abs := filepath.Join(s.rootDir, rel)
+
+	// シンボリックリンクでプロジェクトルートの外を指している場合も許可しない
+	if resolved, err := filepath.EvalSymlinks(abs); err == nil {
+		root, err := filepath.EvalSymlinks(s.rootDir)
+		if err == nil && resolved != root && !strings.HasPrefix(resolved, root+string(filepath.Separator)) {
+			return "", "", fmt.Errorf("paths outside the project root are not allowed: %s", path)
+		}
+	}
+
+	if rel != "." {
+		info, err := os.Stat(abs)
+		if s.excluded(rel, err == nil && info.IsDir()) {
+			return "", "", fmt.Errorf("access to %s is not allowed", path)
+		}
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			if s.excluded(dir, true) {
+				return "", "", fmt.Errorf("access to %s is not allowed", path)
+			}
+		}
+	}
+
+	return filepath.ToSlash(rel), abs, nil
+}
+
+// excluded はプロジェクトルートからの相対パスが隠しファイル・フォルダ、または`.sishoignore`の対象かどうかを返します。
+func (s *Session) excluded(rel string, isDir bool) bool {
+	if strings.HasPrefix(filepath.Base(rel), ".") {
+		return true
+	}
+	if s.ignore == nil {
+		return false
+	}
+	match := s.ignore.Relative(rel, isDir)
+	return match != nil && match.Ignore()
+}
+
+func (s *Session) addFetched(rel string) {
+	for _, fetched := range s.fetched {
+		if fetched == rel {
+			return
+		}
+	}
+	s.fetched = append(s.fetched, rel)
+}
+
+// SaveFetched はsessionで読み込んだファイルをimplementationsの知識として、pathに知識リストファイルの形式で保存します。
+// 読み込んだファイルが無い場合は何もしません。
+func (s *FileToolsService) SaveFetched(path string, session *Session) error {
+	if len(session.fetched) == 0 {
+		return nil
+	}
+
+	knowledgeFile := knowledge.KnowledgeFile{}
+	for _, fetched := range session.fetched {
+		knowledgeFile.KnowledgeList = append(knowledgeFile.KnowledgeList, knowledge.Knowledge{
+			Path: "@/" + fetched,
+			Kind: kinds.KindNameImplementations,
+		})
+	}
+
+	err := s.knowledgeRepository.Write(path, knowledgeFile)
+	if err != nil {
+		return eris.Wrap(err, "failed to save fetched files")
+	}
+	return nil
+}
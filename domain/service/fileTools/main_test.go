@@ -0,0 +1,90 @@
+package fileTools_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
+	"github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	"github.com/t-kuni/sisho/testUtil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileToolsService(t *testing.T) {
+	setup := func(t *testing.T) (*fileTools.FileToolsService, *fileTools.Session, testUtil.Space) {
+		space := testUtil.BeginTestSpace(t)
+		space.WriteFile("main.go", []byte("package main\n\nfunc main() {}\n"))
+		space.WriteFile("lib/util.go", []byte("package lib\n\nfunc Util() {}\n"))
+		space.WriteFile("secret/key.txt", []byte("SECRET"))
+		space.WriteFile(".env", []byte("TOKEN=xxx"))
+		space.WriteFile(".sishoignore", []byte("secret\n"))
+
+		service := fileTools.NewFileToolsService(knowledge.NewRepository())
+		session, err := service.Open(space.Dir)
+		assert.NoError(t, err)
+		return service, session, space
+	}
+
+	t.Run("read_fileでファイルの内容が取得でき、読み込んだファイルとして記録されること", func(t *testing.T) {
+		_, session, space := setup(t)
+		defer space.CleanUp()
+
+		actual := session.Call(chat.ToolCall{Name: "read_file", Arguments: `{"path":"lib/util.go"}`})
+
+		assert.Equal(t, "package lib\n\nfunc Util() {}\n", actual)
+		assert.Equal(t, []string{"lib/util.go"}, session.Fetched())
+	})
+
+	t.Run("list_dirで隠しファイルと.sishoignoreに記載されたパスを除いた一覧が取得できること", func(t *testing.T) {
+		_, session, space := setup(t)
+		defer space.CleanUp()
+
+		actual := session.Call(chat.ToolCall{Name: "list_dir", Arguments: `{}`})
+
+		assert.Equal(t, "lib/\nmain.go", actual)
+	})
+
+	t.Run("grepで一致した行が取得できること", func(t *testing.T) {
+		_, session, space := setup(t)
+		defer space.CleanUp()
+
+		actual := session.Call(chat.ToolCall{Name: "grep", Arguments: `{"pattern":"^func"}`})
+
+		assert.Equal(t, "lib/util.go:3: func Util() {}\nmain.go:3: func main() {}", actual)
+	})
+
+	t.Run("プロジェクトルートの外、隠しファイル、.sishoignoreに記載されたパスにはアクセスできないこと", func(t *testing.T) {
+		_, session, space := setup(t)
+		defer space.CleanUp()
+
+		for _, path := range []string{"../main.go", "lib/../../main.go", filepath.Join(space.Dir, "main.go"), ".env", "secret/key.txt", "secret"} {
+			actual := session.Call(chat.ToolCall{Name: "read_file", Arguments: `{"path":"` + filepath.ToSlash(path) + `"}`})
+			assert.True(t, strings.HasPrefix(actual, "error: "), path)
+		}
+		actual := session.Call(chat.ToolCall{Name: "list_dir", Arguments: `{"path":"secret"}`})
+		assert.True(t, strings.HasPrefix(actual, "error: "))
+		assert.Empty(t, session.Fetched())
+	})
+
+	t.Run("読み込んだファイルが知識リストファイルの形式で保存されること", func(t *testing.T) {
+		service, session, space := setup(t)
+		defer space.CleanUp()
+
+		session.Call(chat.ToolCall{Name: "read_file", Arguments: `{"path":"main.go"}`})
+		session.Call(chat.ToolCall{Name: "read_file", Arguments: `{"path":"lib/util.go"}`})
+		session.Call(chat.ToolCall{Name: "read_file", Arguments: `{"path":"main.go"}`})
+
+		err := service.SaveFetched(filepath.Join(space.Dir, "fetched.know.yml"), session)
+		assert.NoError(t, err)
+
+		space.AssertFile("fetched.know.yml", func(actual []byte) {
+			assert.Equal(t, `knowledge:
+    - path: '@/main.go'
+      kind: implementations
+    - path: '@/lib/util.go'
+      kind: implementations
+`, string(actual))
+		})
+	})
+}
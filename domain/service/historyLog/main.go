@@ -0,0 +1,43 @@
+package historyLog
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Append は履歴フォルダのnameのログに、現在時刻とmessageを1行追記します。ログが存在しない場合は作成します。
+func Append(historyDir string, name string, timer timer.ITimer, message string) error {
+	f, err := os.OpenFile(filepath.Join(historyDir, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return eris.Wrapf(err, "failed to open history: %s", name)
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s\n", timer.Now().Format(time.RFC3339), message)
+	if err != nil {
+		return eris.Wrapf(err, "failed to write history: %s", name)
+	}
+	return nil
+}
+
+// Record はAppend()で履歴フォルダのnameのログに追記します。
+// 追記に失敗してもコマンドは止めず、outに警告を出力します。
+func Record(out io.Writer, historyDir string, name string, timer timer.ITimer, message string) {
+	err := Append(historyDir, name, timer, message)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: failed to save history: %v\n", err)
+	}
+}
+
+// Print はmessageをoutに出力し、Record()で履歴フォルダのnameのログに追記します。
+// ストリーミング中の回答と混ざらないよう、前に改行を入れて出力します。
+func Print(out io.Writer, historyDir string, name string, timer timer.ITimer, message string) {
+	fmt.Fprintf(out, "\n%s\n", message)
+
+	Record(out, historyDir, name, timer, message)
+}
@@ -0,0 +1,90 @@
+package historyLog_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/historyLog"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"github.com/t-kuni/sisho/testUtil"
+	"go.uber.org/mock/gomock"
+	"path/filepath"
+	"testing"
+)
+
+func TestAppend(t *testing.T) {
+	t.Run("現在時刻とメッセージがログに追記されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		gomock.InOrder(
+			mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")),
+			mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:05Z")),
+		)
+
+		err := historyLog.Append(space.Dir, "provider.log", mockTimer, "Fallback: first")
+		assert.NoError(t, err)
+		err = historyLog.Append(space.Dir, "provider.log", mockTimer, "Answered by: second")
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("provider.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z Fallback: first\n2022-01-01T00:00:05Z Answered by: second\n", string(actual))
+		})
+	})
+
+	t.Run("履歴フォルダが存在しない場合はエラーを返すこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+
+		err := historyLog.Append(filepath.Join(space.Dir, "missing"), "retry.log", mockTimer, "message")
+		assert.Error(t, err)
+	})
+}
+
+func TestPrint(t *testing.T) {
+	t.Run("メッセージが出力され、ログに追記されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z"))
+
+		var out bytes.Buffer
+		historyLog.Print(&out, space.Dir, "tools_01.log", mockTimer, "Tool: read_file {}")
+
+		// Assert
+		assert.Equal(t, "\nTool: read_file {}\n", out.String())
+		space.AssertFile("tools_01.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z Tool: read_file {}\n", string(actual))
+		})
+	})
+
+	t.Run("ログに追記できない場合は警告が出力されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+
+		var out bytes.Buffer
+		historyLog.Print(&out, filepath.Join(space.Dir, "missing"), "provider.log", mockTimer, "Answered by: open-ai/gpt-4o")
+
+		// Assert
+		assert.Contains(t, out.String(), "\nAnswered by: open-ai/gpt-4o\n")
+		assert.Contains(t, out.String(), "Warning: failed to save history")
+	})
+}
@@ -0,0 +1,325 @@
+package hunkReview
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/t-kuni/sisho/domain/system/terminal"
+	"io"
+	"strings"
+)
+
+// contextLines は変更箇所の前後に表示する変更の無い行の数です（diff -U3と同じ）。
+const contextLines = 3
+
+const (
+	colorReset = "\x1b[0m"
+	colorBold  = "\x1b[1m"
+	colorRed   = "\x1b[31m"
+	colorGreen = "\x1b[32m"
+	colorCyan  = "\x1b[36m"
+)
+
+const (
+	DecisionAccepted = "accepted"
+	DecisionRejected = "rejected"
+	DecisionEdited   = "edited"
+	DecisionSkipped  = "skipped"
+)
+
+// Line はunified diffの1行です。Kindは ' '（変更無し）, '-'（削除）, '+'（追加）のいずれかです。
+// Textは末尾の改行を含みます（ファイルの最終行に改行が無い場合は含みません）。
+type Line struct {
+	Kind byte
+	Text string
+}
+
+// Hunk はunified diffの1つの変更箇所です。OldStart, NewStartは0始まりの行番号です。
+type Hunk struct {
+	OldStart int
+	OldLines int
+	NewStart int
+	NewLines int
+	Lines    []Line
+}
+
+// Header は `@@ -1,3 +1,4 @@` の形式の見出しを返します。
+func (h Hunk) Header() string {
+	return fmt.Sprintf("@@ -%s +%s @@", hunkRange(h.OldStart, h.OldLines), hunkRange(h.NewStart, h.NewLines))
+}
+
+func hunkRange(start, lines int) string {
+	if lines == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, lines)
+}
+
+// OldText は変更前の内容（変更の無い行と削除する行）を返します。
+func (h Hunk) OldText() string {
+	return h.text('-')
+}
+
+// NewText は変更後の内容（変更の無い行と追加する行）を返します。
+func (h Hunk) NewText() string {
+	return h.text('+')
+}
+
+func (h Hunk) text(kind byte) string {
+	var b strings.Builder
+	for _, line := range h.Lines {
+		if line.Kind == ' ' || line.Kind == kind {
+			b.WriteString(line.Text)
+		}
+	}
+	return b.String()
+}
+
+// Review は1つのファイルの変更を確認した結果です。
+type Review struct {
+	Path  string
+	Hunks []Hunk
+	// Decisions はHunks毎の判断（DecisionXxx）です
+	Decisions []string
+	// Skipped がtrueの場合、ファイル全体を反映しません
+	Skipped bool
+	// Content は判断に従って変更を反映したファイルの内容です
+	Content string
+}
+
+// Log は履歴フォルダに記録する判断の一覧を返します。1行に1つの変更箇所の判断を記載します。
+func (r Review) Log() string {
+	var b strings.Builder
+	for i, hunk := range r.Hunks {
+		fmt.Fprintf(&b, "%s %s %s\n", r.Path, hunk.Header(), r.Decisions[i])
+	}
+	return b.String()
+}
+
+type HunkReviewService struct {
+	terminal terminal.Terminal
+}
+
+func NewHunkReviewService(terminal terminal.Terminal) *HunkReviewService {
+	return &HunkReviewService{
+		terminal: terminal,
+	}
+}
+
+// Review はoldContentからnewContentへの変更を変更箇所毎に表示し、反映するかどうかを利用者に確認します。
+// 変更箇所が無い場合は確認せずにnewContentを返します。
+func (s *HunkReviewService) Review(out io.Writer, path, oldContent, newContent string) (Review, error) {
+	review := Review{
+		Path:    path,
+		Hunks:   Diff(oldContent, newContent),
+		Content: newContent,
+	}
+	if len(review.Hunks) == 0 {
+		return review, nil
+	}
+
+	fmt.Fprintf(out, "\n%s--- a/%s\n+++ b/%s%s\n", colorBold, path, path, colorReset)
+
+	chosen := make([]string, len(review.Hunks))
+	for i, hunk := range review.Hunks {
+		fmt.Fprint(out, Format(hunk))
+
+		decision, text, err := s.ask(out, path, i, hunk, len(review.Hunks))
+		if err != nil {
+			return Review{}, err
+		}
+		if decision == DecisionSkipped {
+			review.Skipped = true
+			review.Decisions = make([]string, len(review.Hunks))
+			for j := range review.Decisions {
+				review.Decisions[j] = DecisionSkipped
+			}
+			review.Content = oldContent
+			return review, nil
+		}
+		review.Decisions = append(review.Decisions, decision)
+		chosen[i] = text
+	}
+
+	review.Content = Merge(oldContent, review.Hunks, chosen)
+	return review, nil
+}
+
+// ask は変更箇所を反映するかどうかを利用者に確認し、判断と変更箇所を置き換える内容を返します。
+func (s *HunkReviewService) ask(out io.Writer, path string, index int, hunk Hunk, total int) (string, string, error) {
+	for {
+		fmt.Fprintf(out, "(%d/%d) Apply this hunk to %s [y,n,e,s,?]? ", index+1, total, path)
+		answer, err := s.terminal.ReadLine()
+		if err != nil {
+			return "", "", eris.Wrap(err, "failed to read the answer")
+		}
+
+		switch strings.ToLower(strings.TrimSpace(answer)) {
+		case "y":
+			return DecisionAccepted, hunk.NewText(), nil
+		case "n":
+			return DecisionRejected, hunk.OldText(), nil
+		case "e":
+			edited, err := s.terminal.Edit(hunk.NewText())
+			if err != nil {
+				return "", "", eris.Wrap(err, "failed to edit the hunk")
+			}
+			if strings.HasSuffix(hunk.NewText(), "\n") && edited != "" && !strings.HasSuffix(edited, "\n") {
+				edited += "\n"
+			}
+			return DecisionEdited, edited, nil
+		case "s":
+			return DecisionSkipped, "", nil
+		default:
+			fmt.Fprintln(out, "y - apply this hunk")
+			fmt.Fprintln(out, "n - do not apply this hunk")
+			fmt.Fprintln(out, "e - edit this hunk in $EDITOR and apply it")
+			fmt.Fprintln(out, "s - do not apply any hunk of this file")
+		}
+	}
+}
+
+// Diff はoldContentからnewContentへの変更を行単位で比較し、unified diffの変更箇所に分けて返します。
+func Diff(oldContent, newContent string) []Hunk {
+	lines := DiffLines(oldContent, newContent)
+
+	var hunks []Hunk
+	oldLine, newLine := 0, 0
+	for i := 0; i < len(lines); {
+		if lines[i].Kind == ' ' {
+			oldLine++
+			newLine++
+			i++
+			continue
+		}
+
+		// 変更の前のコンテキスト行
+		start := max(0, i-contextLines)
+		hunk := Hunk{
+			OldStart: oldLine - (i - start),
+			NewStart: newLine - (i - start),
+		}
+
+		// 間の変更の無い行がコンテキスト行2つ分以下であれば、次の変更も同じ変更箇所に含める
+		end := i
+		unchanged := 0
+		for j := i; j < len(lines); j++ {
+			if lines[j].Kind != ' ' {
+				end = j + 1
+				unchanged = 0
+				continue
+			}
+			unchanged++
+			if unchanged > contextLines*2 {
+				break
+			}
+		}
+		end = min(len(lines), end+contextLines)
+
+		hunk.Lines = lines[start:end]
+		for _, line := range hunk.Lines {
+			if line.Kind != '+' {
+				hunk.OldLines++
+			}
+			if line.Kind != '-' {
+				hunk.NewLines++
+			}
+		}
+		hunks = append(hunks, hunk)
+
+		oldLine = hunk.OldStart + hunk.OldLines
+		newLine = hunk.NewStart + hunk.NewLines
+		i = end
+	}
+	return hunks
+}
+
+// DiffLines はoldContentからnewContentへの変更を行単位で比較し、全ての行を変更の無い行、削除する行、追加する行に分けて返します。
+func DiffLines(oldContent, newContent string) []Line {
+	// 行を1文字に置き換えて比較する（go-diffのDiffLinesToRunesは行数が多いと誤った結果を返すため自前で置き換える）
+	lineIndex := map[string]rune{}
+	lineOf := map[rune]string{}
+	toRunes := func(text string) []rune {
+		var runes []rune
+		for _, line := range splitLines(text) {
+			r, ok := lineIndex[line]
+			if !ok {
+				r = rune(len(lineIndex))
+				if r >= 0xD800 {
+					// サロゲートの範囲はstringに変換できないため避ける
+					r += 0x800
+				}
+				lineIndex[line] = r
+				lineOf[r] = line
+			}
+			runes = append(runes, r)
+		}
+		return runes
+	}
+	oldRunes := toRunes(oldContent)
+	newRunes := toRunes(newContent)
+	diffs := diffmatchpatch.New().DiffMainRunes(oldRunes, newRunes, false)
+
+	var lines []Line
+	for _, diff := range diffs {
+		kind := byte(' ')
+		switch diff.Type {
+		case diffmatchpatch.DiffDelete:
+			kind = '-'
+		case diffmatchpatch.DiffInsert:
+			kind = '+'
+		}
+		for _, r := range diff.Text {
+			lines = append(lines, Line{Kind: kind, Text: lineOf[r]})
+		}
+	}
+	return lines
+}
+
+// Merge はoldContentの各変更箇所をchosenの内容に置き換えます。chosenはhunks毎の置き換える内容です。
+func Merge(oldContent string, hunks []Hunk, chosen []string) string {
+	oldLines := splitLines(oldContent)
+
+	var b strings.Builder
+	pos := 0
+	for i, hunk := range hunks {
+		b.WriteString(strings.Join(oldLines[pos:hunk.OldStart], ""))
+		b.WriteString(chosen[i])
+		pos = hunk.OldStart + hunk.OldLines
+	}
+	b.WriteString(strings.Join(oldLines[pos:], ""))
+	return b.String()
+}
+
+// Format は変更箇所を色付きのunified diffの形式で返します。
+func Format(hunk Hunk) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s%s%s\n", colorCyan, hunk.Header(), colorReset)
+	for _, line := range hunk.Lines {
+		text := strings.TrimSuffix(line.Text, "\n")
+		switch line.Kind {
+		case '-':
+			fmt.Fprintf(&b, "%s-%s%s\n", colorRed, text, colorReset)
+		case '+':
+			fmt.Fprintf(&b, "%s+%s%s\n", colorGreen, text, colorReset)
+		default:
+			fmt.Fprintf(&b, " %s\n", text)
+		}
+		if !strings.HasSuffix(line.Text, "\n") {
+			b.WriteString("\\ No newline at end of file\n")
+		}
+	}
+	return b.String()
+}
+
+// splitLines はテキストを末尾の改行を含む行に分けます。
+func splitLines(text string) []string {
+	if text == "" {
+		return nil
+	}
+	lines := strings.SplitAfter(text, "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
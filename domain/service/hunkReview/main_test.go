@@ -0,0 +1,73 @@
+package hunkReview_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
+	"github.com/t-kuni/sisho/domain/system/terminal"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+const oldContent = "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\n15\n"
+const newContent = "1\nTWO\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\nFIFTEEN\n"
+
+func TestDiff(t *testing.T) {
+	t.Run("離れた変更は別の変更箇所に分けられること", func(t *testing.T) {
+		hunks := hunkReview.Diff(oldContent, newContent)
+
+		assert.Len(t, hunks, 2)
+		assert.Equal(t, "@@ -1,5 +1,5 @@", hunks[0].Header())
+		assert.Equal(t, "1\n2\n3\n4\n5\n", hunks[0].OldText())
+		assert.Equal(t, "1\nTWO\n3\n4\n5\n", hunks[0].NewText())
+		assert.Equal(t, "@@ -12,4 +12,4 @@", hunks[1].Header())
+	})
+
+	t.Run("変更が無い場合は変更箇所が無いこと", func(t *testing.T) {
+		assert.Empty(t, hunkReview.Diff(oldContent, oldContent))
+	})
+}
+
+func TestReview(t *testing.T) {
+	t.Run("変更箇所毎の判断に従って反映されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
+		gomock.InOrder(
+			mockTerminal.EXPECT().ReadLine().Return("?", nil),
+			mockTerminal.EXPECT().ReadLine().Return("n", nil),
+			mockTerminal.EXPECT().ReadLine().Return("e", nil),
+			mockTerminal.EXPECT().Edit("12\n13\n14\nFIFTEEN\n").Return("12\n13\n14\nEDITED", nil),
+		)
+
+		var out bytes.Buffer
+		review, err := hunkReview.NewHunkReviewService(mockTerminal).Review(&out, "a.txt", oldContent, newContent)
+
+		assert.NoError(t, err)
+		assert.False(t, review.Skipped)
+		assert.Equal(t, "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n11\n12\n13\n14\nEDITED\n", review.Content)
+		assert.Equal(t, "a.txt @@ -1,5 +1,5 @@ rejected\na.txt @@ -12,4 +12,4 @@ edited\n", review.Log())
+		assert.Contains(t, out.String(), "\x1b[32m+TWO\x1b[0m")
+		assert.Contains(t, out.String(), "s - do not apply any hunk of this file")
+	})
+
+	t.Run("sを入力した場合はファイル全体が反映されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
+		gomock.InOrder(
+			mockTerminal.EXPECT().ReadLine().Return("y", nil),
+			mockTerminal.EXPECT().ReadLine().Return("s", nil),
+		)
+
+		var out bytes.Buffer
+		review, err := hunkReview.NewHunkReviewService(mockTerminal).Review(&out, "a.txt", oldContent, newContent)
+
+		assert.NoError(t, err)
+		assert.True(t, review.Skipped)
+		assert.Equal(t, oldContent, review.Content)
+		assert.Equal(t, "a.txt @@ -1,5 +1,5 @@ skipped\na.txt @@ -12,4 +12,4 @@ skipped\n", review.Log())
+	})
+}
@@ -1,11 +1,14 @@
 package knowledgeLoad
 
 import (
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"github.com/t-kuni/sisho/domain/model/prompts"
 	"github.com/t-kuni/sisho/domain/repository/knowledge"
 	"github.com/t-kuni/sisho/util/path"
+	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 )
 
 type KnowledgeLoadService struct {
@@ -33,14 +36,31 @@ func (s *KnowledgeLoadService) LoadKnowledge(rootDir string, knowledgeList []kno
 		}
 
 		converted := prompts.Knowledge{
-			Path:    path.BeforeWrite(relPath),
-			Content: content,
+			Path: path.BeforeWrite(relPath),
+		}
+		if mediaType := http.DetectContentType(content); chat.IsAttachmentMediaType(mediaType) {
+			// 画像・PDFはテキストとして埋め込まず、プロンプトに添付する
+			converted.MediaType = mediaType
+			converted.Data = content
+		} else {
+			converted.Content = string(content)
 		}
 		kindMap[string(k.Kind)] = append(kindMap[string(k.Kind)], converted)
 	}
 
+	// プロンプトが実行毎に変わらないように、kind名とパスの順に並べる
+	kindNames := make([]string, 0, len(kindMap))
+	for kind := range kindMap {
+		kindNames = append(kindNames, kind)
+	}
+	sort.Strings(kindNames)
+
 	var knowledgeSets []prompts.KnowledgeSet
-	for kind, knowledges := range kindMap {
+	for _, kind := range kindNames {
+		knowledges := kindMap[kind]
+		sort.SliceStable(knowledges, func(i, j int) bool {
+			return knowledges[i].Path < knowledges[j].Path
+		})
 		knowledgeSets = append(knowledgeSets, prompts.KnowledgeSet{
 			Kind:      kind,
 			Knowledge: knowledges,
@@ -50,10 +70,10 @@ func (s *KnowledgeLoadService) LoadKnowledge(rootDir string, knowledgeList []kno
 	return knowledgeSets, nil
 }
 
-func (s *KnowledgeLoadService) readFile(path string) (string, error) {
+func (s *KnowledgeLoadService) readFile(path string) ([]byte, error) {
 	content, err := os.ReadFile(path)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	return string(content), nil
+	return content, nil
 }
@@ -31,7 +31,8 @@ func NewKnowledgeScanService(
 
 // ScanKnowledgeMultipleTarget performs a knowledge scan for multiple target paths
 func (s *KnowledgeScanService) ScanKnowledgeMultipleTarget(rootDir string, targetPaths []string) ([]knowledge.Knowledge, error) {
-	uniqueKnowledge := make(map[string]knowledge.Knowledge)
+	seen := make(map[string]struct{})
+	var result []knowledge.Knowledge
 
 	for _, targetPath := range targetPaths {
 		knowledgeList, err := s.ScanKnowledge(rootDir, targetPath)
@@ -39,17 +40,16 @@ func (s *KnowledgeScanService) ScanKnowledgeMultipleTarget(rootDir string, targe
 			return nil, eris.Wrapf(err, "failed to scan knowledge for target: %s", targetPath)
 		}
 
-		// Remove duplicates
+		// Remove duplicates while keeping the order, so that the same targets always build the same prompt
 		for _, k := range knowledgeList {
-			uniqueKnowledge[k.Path] = k
+			if _, ok := seen[k.Path]; ok {
+				continue
+			}
+			seen[k.Path] = struct{}{}
+			result = append(result, k)
 		}
 	}
 
-	var result []knowledge.Knowledge
-	for _, k := range uniqueKnowledge {
-		result = append(result, k)
-	}
-
 	return result, nil
 }
 
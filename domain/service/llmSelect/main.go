@@ -0,0 +1,127 @@
+package llmSelect
+
+import (
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/repository/config"
+)
+
+type LLMSelectService struct {
+}
+
+func NewLLMSelectService() *LLMSelectService {
+	return &LLMSelectService{}
+}
+
+// Override はコマンドラインオプションで指定された、1回の実行だけに適用するLLMの設定です。
+type Override struct {
+	Driver string
+	Model  string
+}
+
+// Select はcommandで使うLLMの設定を反映したプロジェクトコンフィグを返します。
+// llm直下の設定に、llm.commandsのcommandの設定、overrideの順に上書きします。
+// 上書きでドライバーが変わる場合は、元のドライバー向けのモデル・接続先・APIキー・ヘッダーを引き継がず、モデルの指定がなければエラーを返します。
+// フォールバックチェーンは、llm.commandsにリストで指定された場合に置き換え、overrideでドライバーが指定された場合は使いません。
+// 引数のcfgは変更しません。
+func (s *LLMSelectService) Select(cfg *config.Config, command string, override Override) (*config.Config, error) {
+	selected := *cfg
+	selected.LLM.Commands = nil
+
+	if commandLLM, ok := cfg.LLM.Commands[command]; ok {
+		if switchesDriver(selected.LLM, commandLLM) && commandLLM.Model == "" {
+			return nil, eris.Errorf("llm.commands.%s: model is required because the driver is changed from %s to %s", command, selected.LLM.Driver, commandLLM.Driver)
+		}
+		selected.LLM = merge(selected.LLM, commandLLM)
+	}
+
+	overrideLLM := config.LLM{
+		Driver: override.Driver,
+		Model:  override.Model,
+	}
+	if switchesDriver(selected.LLM, overrideLLM) && overrideLLM.Model == "" {
+		return nil, eris.Errorf("--model is required because --driver changes the driver from %s to %s", selected.LLM.Driver, overrideLLM.Driver)
+	}
+	selected.LLM = merge(selected.LLM, overrideLLM)
+	if override.Driver != "" {
+		selected.LLM.Fallbacks = nil
+	}
+
+	return &selected, nil
+}
+
+// switchesDriver はoverrideでbaseと異なるドライバーに切り替わるかを返します。
+// replayドライバーのrecordモードは元のドライバーの設定で回答を記録するため、replayへの切り替えは含めません。
+func switchesDriver(base config.LLM, override config.LLM) bool {
+	return override.Driver != "" && override.Driver != base.Driver && override.Driver != "replay"
+}
+
+// merge はbaseにoverrideで指定された項目を上書きしたLLMの設定を返します。
+func merge(base config.LLM, override config.LLM) config.LLM {
+	// モデル・接続先・APIキー・ヘッダーはドライバー毎に異なるため、ドライバーが変わる場合は引き継がない
+	if switchesDriver(base, override) {
+		base.Model = ""
+		base.BaseURL = ""
+		base.APIKeyEnv = ""
+		base.APIKeyFile = ""
+		base.APIKeyCommand = ""
+		base.Headers = nil
+	}
+	if override.Driver != "" {
+		base.Driver = override.Driver
+	}
+	if override.Model != "" {
+		base.Model = override.Model
+	}
+	if override.BaseURL != "" {
+		base.BaseURL = override.BaseURL
+	}
+	// APIキーの取得元は1つしか指定できないため、いずれかが指定されている場合はまとめて上書きする
+	if override.APIKeyEnv != "" || override.APIKeyFile != "" || override.APIKeyCommand != "" {
+		base.APIKeyEnv = override.APIKeyEnv
+		base.APIKeyFile = override.APIKeyFile
+		base.APIKeyCommand = override.APIKeyCommand
+	}
+	if override.Headers != nil {
+		base.Headers = override.Headers
+	}
+	if override.Retry.MaxAttempts != 0 {
+		base.Retry.MaxAttempts = override.Retry.MaxAttempts
+	}
+	if override.Retry.MaxWait != 0 {
+		base.Retry.MaxWait = override.Retry.MaxWait
+	}
+	if override.Timeout != 0 {
+		base.Timeout = override.Timeout
+	}
+	if override.MaxContinuations != nil {
+		base.MaxContinuations = override.MaxContinuations
+	}
+	if override.MaxConcurrency != 0 {
+		base.MaxConcurrency = override.MaxConcurrency
+	}
+	if override.ContextWindow != 0 {
+		base.ContextWindow = override.ContextWindow
+	}
+	if override.Replay.Dir != "" {
+		base.Replay = override.Replay
+	}
+	if override.MaxTokens != 0 {
+		base.MaxTokens = override.MaxTokens
+	}
+	if override.Temperature != nil {
+		base.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		base.TopP = override.TopP
+	}
+	if override.Stop != nil {
+		base.Stop = override.Stop
+	}
+	if override.PromptCaching {
+		base.PromptCaching = true
+	}
+	if override.Fallbacks != nil {
+		base.Fallbacks = override.Fallbacks
+	}
+	return base
+}
@@ -1,25 +1,58 @@
 package make
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/rotisserie/eris"
 	"github.com/sergi/go-diff/diffmatchpatch"
+	"github.com/t-kuni/sisho/domain/model/chat"
 	"github.com/t-kuni/sisho/domain/model/prompts"
+	"github.com/t-kuni/sisho/domain/model/prompts/continuation"
+	"github.com/t-kuni/sisho/domain/model/prompts/verify"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/model/tokens"
 	"github.com/t-kuni/sisho/domain/repository/config"
 	"github.com/t-kuni/sisho/domain/repository/depsGraph"
+	"github.com/t-kuni/sisho/domain/repository/knowledge"
+	snapshot2 "github.com/t-kuni/sisho/domain/repository/snapshot"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
+	"github.com/t-kuni/sisho/domain/service/editApply"
 	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/historyLog"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
+	"github.com/t-kuni/sisho/domain/system/git"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
 	"github.com/t-kuni/sisho/domain/system/timer"
+	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
+	"strings"
+	"sync"
 )
 
+// defaultMaxContinuations は生成が途切れた場合に続きの生成を依頼する回数のデフォルト値です。
+const defaultMaxContinuations = 3
+
+// defaultVerifyRounds は検証が失敗した場合に修正を依頼する回数のデフォルト値です。
+const defaultVerifyRounds = 3
+
 type MakeService struct {
 	configFindService          *configFindService.ConfigFindService
 	configRepository           config.Repository
@@ -31,6 +64,16 @@ type MakeService struct {
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService
 	extractCodeBlockService    *extractCodeBlock.CodeBlockExtractService
 	chatFactory                *chatFactory.ChatFactory
+	tokenBudgetService         *tokenBudget.TokenBudgetService
+	usageRecordService         *usageRecord.UsageRecordService
+	systemPromptService        *systemPrompt.SystemPromptService
+	llmSelectService           *llmSelect.LLMSelectService
+	fileToolsService           *fileTools.FileToolsService
+	hunkReviewService          *hunkReview.HunkReviewService
+	snapshotService            *snapshot.SnapshotService
+	git                        git.Git
+	taskRunService             *taskRun.TaskRunService
+	conflictResolveService     *conflictResolve.ConflictResolveService
 }
 
 func NewMakeService(
@@ -44,6 +87,16 @@ func NewMakeService(
 	folderStructureMakeService *folderStructureMake.FolderStructureMakeService,
 	extractCodeBlockService *extractCodeBlock.CodeBlockExtractService,
 	chatFactory *chatFactory.ChatFactory,
+	tokenBudgetService *tokenBudget.TokenBudgetService,
+	usageRecordService *usageRecord.UsageRecordService,
+	systemPromptService *systemPrompt.SystemPromptService,
+	llmSelectService *llmSelect.LLMSelectService,
+	fileToolsService *fileTools.FileToolsService,
+	hunkReviewService *hunkReview.HunkReviewService,
+	snapshotService *snapshot.SnapshotService,
+	git git.Git,
+	taskRunService *taskRun.TaskRunService,
+	conflictResolveService *conflictResolve.ConflictResolveService,
 ) *MakeService {
 	return &MakeService{
 		configFindService:          configFindService,
@@ -56,10 +109,59 @@ func NewMakeService(
 		folderStructureMakeService: folderStructureMakeService,
 		extractCodeBlockService:    extractCodeBlockService,
 		chatFactory:                chatFactory,
+		tokenBudgetService:         tokenBudgetService,
+		usageRecordService:         usageRecordService,
+		systemPromptService:        systemPromptService,
+		llmSelectService:           llmSelectService,
+		fileToolsService:           fileToolsService,
+		hunkReviewService:          hunkReviewService,
+		snapshotService:            snapshotService,
+		git:                        git,
+		taskRunService:             taskRunService,
+		conflictResolveService:     conflictResolveService,
 	}
 }
 
-func (s *MakeService) Make(paths []string, applyFlag, chainFlag bool, instructions string, dryRun bool) error {
+// Options はmakeの実行条件です。
+type Options struct {
+	// Apply がtrueの場合、生成結果をファイルに反映します
+	Apply bool
+	// Chain がtrueの場合、依存グラフを使って依存するファイルもターゲットに含めます
+	Chain bool
+	// Instructions は追加の指示です
+	Instructions string
+	// DryRun がtrueの場合、LLMによる生成を行いません
+	DryRun bool
+	// NoCache がtrueの場合、レスポンスキャッシュを使いません
+	NoCache bool
+	// Driver が指定された場合、プロジェクトコンフィグのllm.driverの代わりに使います
+	Driver string
+	// Model が指定された場合、プロジェクトコンフィグのllm.modelの代わりに使います
+	Model string
+	// Tools がtrueの場合、プロジェクトコンフィグのtools.enabledに関わらず、モデルがツールでファイルを読めるようにします
+	Tools bool
+	// Jobs は並行して生成するターゲットの数の上限です。1以下の場合は1つずつ順に生成します
+	Jobs int
+	// Together がtrueの場合、全てのTarget Codeを1回の問い合わせでまとめて生成します
+	Together bool
+	// EditFormat は指定された場合、プロジェクトコンフィグのedit.formatの代わりに使います
+	EditFormat string
+	// Interactive がtrueの場合、変更箇所毎に反映するかどうかを確認してからファイルに反映します
+	Interactive bool
+	// AllowDirty がtrueの場合、git連携が有効でも、コミットされていない変更があるファイルに反映します
+	AllowDirty bool
+	// Verify は反映した後に実行して検証するタスクの名前です
+	Verify []string
+	// VerifyRounds は検証が失敗した場合に修正を依頼する回数の上限です。0の場合はデフォルト値を使います
+	VerifyRounds int
+	// OnConflict は生成中にTarget Codeが変更された場合の扱いです（conflictResolve.ActionXxx）。空の場合は利用者に確認します
+	OnConflict string
+}
+
+// Make はpathsのTarget Codeを順に生成します。
+// options.Jobsが2以上の場合は、依存グラフの順序を守りながら最大Jobs個の生成ターゲットを並行して生成します。
+// ctxが終了した場合は生成を中止し、履歴フォルダに中止した記録を残します。中止した時点で生成中のファイルには反映しません。
+func (s *MakeService) Make(ctx context.Context, paths []string, options Options) (err error) {
 	// 設定ファイルの読み込み
 	configPath, err := s.configFindService.FindConfig()
 	if err != nil {
@@ -70,11 +172,18 @@ func (s *MakeService) Make(paths []string, applyFlag, chainFlag bool, instructio
 	if err != nil {
 		return eris.Wrap(err, "failed to read config file")
 	}
+	cfg, err = s.llmSelectService.Select(cfg, config.CommandMake, llmSelect.Override{
+		Driver: options.Driver,
+		Model:  options.Model,
+	})
+	if err != nil {
+		return eris.Wrap(err, "failed to select LLM")
+	}
 
 	rootDir := s.configFindService.GetProjectRoot(configPath)
 
 	// チェーンフラグが設定されている場合、依存グラフを使用してターゲットを拡張
-	if chainFlag {
+	if options.Chain {
 		paths, err = s.expandTargetsWithDependencies(paths, rootDir)
 		if err != nil {
 			if os.IsNotExist(err) {
@@ -84,6 +193,45 @@ func (s *MakeService) Make(paths []string, applyFlag, chainFlag bool, instructio
 		}
 	}
 
+	if options.Together && options.Jobs > 1 {
+		return eris.New("together mode cannot be combined with parallel jobs")
+	}
+	if options.Interactive && options.Jobs > 1 {
+		return eris.New("interactive mode cannot be combined with parallel jobs")
+	}
+
+	editFormat, err := s.editFormat(cfg, options)
+	if err != nil {
+		return err
+	}
+
+	switch options.OnConflict {
+	case "", conflictResolve.ActionMerge, conflictResolve.ActionNew, conflictResolve.ActionAbort:
+	default:
+		return eris.Errorf("unknown conflict action: %s (must be one of %s, %s and %s)", options.OnConflict, conflictResolve.ActionMerge, conflictResolve.ActionNew, conflictResolve.ActionAbort)
+	}
+
+	if len(options.Verify) > 0 && !options.Apply && !options.Interactive {
+		return eris.New("verify mode needs apply or interactive mode")
+	}
+	var tasks []*config.Task
+	for _, name := range options.Verify {
+		task, err := s.taskRunService.Find(cfg, name)
+		if err != nil {
+			return eris.Wrap(err, "failed to find the task to verify")
+		}
+		tasks = append(tasks, task)
+	}
+
+	// git連携が有効な場合は、コミットされていない変更を上書きしないことを確認する
+	applying := (options.Apply || options.Interactive) && !options.DryRun
+	if cfg.Git.Enabled && applying {
+		err = s.checkGit(rootDir, paths, options)
+		if err != nil {
+			return err
+		}
+	}
+
 	// Target Codeの一覧を標準出力に出力
 	fmt.Println("Target Codes:")
 	for _, path := range paths {
@@ -98,93 +246,895 @@ func (s *MakeService) Make(paths []string, applyFlag, chainFlag bool, instructio
 	if err != nil {
 		return eris.Wrap(err, "failed to create history directory")
 	}
+	historyID := filepath.Base(historyDir)
+
+	if cfg.Git.Enabled && cfg.Git.AutoBranch && applying {
+		branch := cfg.Git.BranchPrefix
+		if branch == "" {
+			branch = defaultBranchPrefix
+		}
+		branch += historyID
+		err = s.git.CreateBranch(rootDir, branch)
+		if err != nil {
+			return eris.Wrap(err, "failed to create branch")
+		}
+		fmt.Printf("Created branch: %s\n", branch)
+	}
+
+	run := &makeRun{
+		cfg:        cfg,
+		rootDir:    rootDir,
+		historyDir: historyDir,
+		paths:      paths,
+		options:    options,
+		editFormat: editFormat,
+		tasks:      tasks,
+		running:    map[string]struct{}{},
+		bases:      map[string]string{},
+	}
+
+	// 中断された場合は履歴に記録する
+	defer func() {
+		if err != nil && ctx.Err() != nil {
+			s.saveAbortedHistory(historyDir, run.runningPaths(), ctx.Err())
+		}
+	}()
+
+	// システムプロンプトの取得
+	run.system, err = s.systemPromptService.Resolve(rootDir, cfg, config.CommandMake)
+	if err != nil {
+		return eris.Wrap(err, "failed to resolve system prompt")
+	}
+
+	err = s.systemPromptService.SaveHistory(historyDir, run.system)
+	if err != nil {
+		return eris.Wrap(err, "failed to save system prompt history")
+	}
 
 	// フォルダ構造情報の取得
-	var folderStructure string
 	if cfg.AdditionalKnowledge.FolderStructure {
-		folderStructure, err = s.folderStructureMakeService.MakeTree(rootDir)
+		run.folderStructure, err = s.folderStructureMakeService.MakeTree(rootDir)
 		if err != nil {
 			return eris.Wrap(err, "failed to get folder structure")
 		}
 	}
 
-	// 各ターゲットに対する処理
-	for i, path := range paths {
-		fmt.Printf("\n--- Processing target: %s ---\n", path)
+	// 全ターゲットのトークンの使用量（実行の最後に出力する）
+	var totalUsage chat.Usage
+	if options.Together {
+		totalUsage, err = s.makeTarget(ctx, run, 0, paths, os.Stdout)
+		if err != nil {
+			return err
+		}
+	} else if options.Jobs > 1 {
+		totalUsage, err = s.makeParallel(ctx, run)
+		if err != nil {
+			return err
+		}
+	} else {
+		// 各ターゲットに対する処理
+		for i, path := range paths {
+			if ctx.Err() != nil {
+				return eris.Wrap(ctx.Err(), "aborted")
+			}
 
-		// チャットモデルの選択
-		chat, err := s.chatFactory.Make(cfg)
+			usage, err := s.makeTarget(ctx, run, i, []string{path}, os.Stdout)
+			if err != nil {
+				return err
+			}
+			totalUsage = totalUsage.Add(usage)
+		}
+	}
+
+	// 反映した後にタスクを実行して検証し、失敗した場合は修正を依頼する
+	if len(tasks) > 0 && !options.DryRun {
+		usage, err := s.verify(ctx, run)
+		totalUsage = totalUsage.Add(usage)
 		if err != nil {
-			return eris.Wrap(err, "failed to create chat model")
+			s.printUsage(totalUsage)
+			return err
 		}
+	}
 
-		// Target Codeの読み込み
-		targets, err := s.readAllTargets(paths)
+	if !options.DryRun {
+		s.printUsage(totalUsage)
+	}
+	written := run.writtenPaths()
+	if cfg.Git.Enabled && cfg.Git.AutoCommit && len(written) > 0 {
+		err = s.git.Commit(rootDir, written, commitMessage(paths, historyID, options.Instructions))
 		if err != nil {
-			return eris.Wrap(err, "failed to read all targets")
+			return eris.Wrap(err, "failed to commit the changes")
 		}
+		fmt.Printf("Committed %d file(s)\n", len(written))
+	}
+	if _, err := os.Stat(filepath.Join(historyDir, snapshot2.FileName)); err == nil {
+		fmt.Printf("To undo the changes: sisho undo %s\n", historyID)
+	}
+
+	return nil
+}
+
+// checkGit はpathsにコミットされていない変更が無いことを確認します。options.AllowDirtyがtrueの場合は確認しません。
+func (s *MakeService) checkGit(rootDir string, paths []string, options Options) error {
+	if !s.git.IsRepository(rootDir) {
+		return eris.Errorf("git.enabled is true but %s is not in a git repository", rootDir)
+	}
+	if options.AllowDirty {
+		return nil
+	}
+
+	dirty, err := s.git.DirtyFiles(rootDir, absPaths(paths))
+	if err != nil {
+		return eris.Wrap(err, "failed to check uncommitted changes")
+	}
+	if len(dirty) > 0 {
+		return eris.Errorf("the targets have uncommitted changes: %s (commit or stash them, or pass --allow-dirty)", strings.Join(dirty, ", "))
+	}
+	return nil
+}
+
+// commitMessage はgit.auto-commitでコミットする際のメッセージです。
+func commitMessage(paths []string, historyID string, instructions string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "sisho make %s\n\n", strings.Join(paths, " "))
+	b.WriteString("Targets:\n")
+	for _, path := range paths {
+		fmt.Fprintf(&b, "- %s\n", path)
+	}
+	fmt.Fprintf(&b, "\nHistory: %s\n", historyID)
+	if instructions != "" {
+		fmt.Fprintf(&b, "\nInstructions:\n%s\n", instructions)
+	}
+	return b.String()
+}
 
-		// 知識のスキャンとロード
-		scannedKnowledge, err := s.knowledgeScanService.ScanKnowledge(rootDir, path)
+// absPaths はカレントディレクトリからの相対パスを絶対パスにします（gitコマンドはプロジェクトルートで実行するため）。
+func absPaths(paths []string) []string {
+	result := make([]string, 0, len(paths))
+	for _, path := range paths {
+		abs, err := filepath.Abs(path)
 		if err != nil {
-			return eris.Wrap(err, "failed to scan knowledge")
+			abs = path
 		}
+		result = append(result, abs)
+	}
+	return result
+}
 
-		knowledgeSets, err := s.knowledgeLoadService.LoadKnowledge(rootDir, scannedKnowledge)
+// defaultBranchPrefix はgit.auto-branchで作成するブランチの名前の接頭辞のデフォルト値です。
+const defaultBranchPrefix = "sisho/"
+
+// makeRun は1回のmakeの実行の中で、全ての生成ターゲットに共通する情報です。
+type makeRun struct {
+	cfg             *config.Config
+	rootDir         string
+	historyDir      string
+	system          string
+	folderStructure string
+	paths           []string
+	options         Options
+	editFormat      string
+	// tasks は反映した後に実行して検証するタスクです
+	tasks []*config.Task
+
+	// running は生成中、または失敗したターゲットのパスです（中断した場合の記録に使います）
+	mu      sync.Mutex
+	running map[string]struct{}
+	// written は書き換えたファイルのパスです
+	written []string
+	// conversations は検証が失敗した場合に修正を依頼する、生成ターゲット毎の会話です（検証する場合のみ記録します）
+	conversations []conversation
+	// bases はプロンプトを組み立てた時点の生成ターゲットの内容です（反映する前に変更されていないかを確認するため）
+	bases map[string]string
+}
+
+// recordBase はプロンプトに含めた生成ターゲットの内容を記録します。
+func (r *makeRun) recordBase(paths []string, targets []prompts.Target) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, target := range targets {
+		if slices.Contains(paths, target.Path) {
+			r.bases[target.Path] = target.Content
+		}
+	}
+}
+
+// changedOnDisk はpathの現在の内容がプロンプトを組み立てた時点から変わっているかどうかと、その時点の内容を返します。
+func (r *makeRun) changedOnDisk(path string, current []byte) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	base, ok := r.bases[path]
+	if !ok {
+		return "", false
+	}
+	return base, contentHash([]byte(base)) != contentHash(current)
+}
+
+// conversation は生成ターゲットを生成した会話です。同じ会話の履歴を引き継いだまま修正を依頼します。
+type conversation struct {
+	index       int
+	paths       []string
+	chatClient  chat.Chat
+	sendOptions chat.SendOptions
+}
+
+func (r *makeRun) remember(c conversation) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.conversations = append(r.conversations, c)
+}
+
+// conversationList は記録した会話を生成ターゲットの順に返します（並行生成では終わった順に記録されるため）。
+func (r *makeRun) conversationList() []conversation {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	result := slices.Clone(r.conversations)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].index < result[j].index
+	})
+	return result
+}
+
+func (r *makeRun) start(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.running[path] = struct{}{}
+}
+
+func (r *makeRun) finish(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.running, path)
+}
+
+// wrote は生成ターゲットのファイルを書き換えたことを記録します（git.auto-commitでコミットするため）。
+func (r *makeRun) wrote(path string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.written = append(r.written, path)
+}
+
+// writtenPaths は書き換えたファイルの絶対パスを返します。
+func (r *makeRun) writtenPaths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return absPaths(r.written)
+}
+
+// runningPaths は生成中のターゲットのパスをpathsの順に返します。
+func (r *makeRun) runningPaths() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var result []string
+	for _, path := range r.paths {
+		if _, ok := r.running[path]; ok {
+			result = append(result, path)
+		}
+	}
+	return result
+}
+
+// makeTarget はgeneratePathsを1回の問い合わせで生成し、トークンの使用量を返します。
+// 通常は生成ターゲットを1つだけ指定します。複数指定した場合（togetherモード）は、全てのコードブロックを1つの回答で依頼し、
+// 回答に含まれていなかった生成ターゲットを報告します。
+// indexは履歴フォルダのファイルの連番に使います（pathsの中での位置）。標準出力に出力する内容はoutに書き込みます。
+func (s *MakeService) makeTarget(ctx context.Context, run *makeRun, index int, generatePaths []string, out io.Writer) (_ chat.Usage, err error) {
+	// 失敗した場合は中断した記録に含めるため、生成中のまま残す
+	for _, path := range generatePaths {
+		run.start(path)
+	}
+	defer func() {
+		if err == nil {
+			for _, path := range generatePaths {
+				run.finish(path)
+			}
+		}
+	}()
+
+	cfg := run.cfg
+	options := run.options
+	together := len(generatePaths) > 1
+
+	if together {
+		fmt.Fprintf(out, "\n--- Processing targets together: %s ---\n", strings.Join(generatePaths, ", "))
+	} else {
+		fmt.Fprintf(out, "\n--- Processing target: %s ---\n", generatePaths[0])
+	}
+
+	// チャットモデルの選択
+	chatClient, err := s.chatFactory.Make(cfg, chatFactory.MakeOptions{
+		RootDir: run.rootDir,
+		NoCache: options.NoCache,
+	})
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to create chat model")
+	}
+
+	// Target Codeの読み込み
+	targets, err := s.readAllTargets(run.paths)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to read all targets")
+	}
+	run.recordBase(generatePaths, targets)
+
+	// 知識のスキャンとロード
+	var scannedKnowledge []knowledge.Knowledge
+	if together {
+		scannedKnowledge, err = s.knowledgeScanService.ScanKnowledgeMultipleTarget(run.rootDir, generatePaths)
+	} else {
+		scannedKnowledge, err = s.knowledgeScanService.ScanKnowledge(run.rootDir, generatePaths[0])
+	}
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to scan knowledge")
+	}
+
+	knowledgeSets, err := s.knowledgeLoadService.LoadKnowledge(run.rootDir, scannedKnowledge)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to load knowledge")
+	}
+
+	s.printKnowledgePaths(out, knowledgeSets)
+
+	// コンテキストウィンドウに収まるように知識を調整
+	budget, err := s.tokenBudget(cfg, run.system)
+	if err != nil {
+		return chat.Usage{}, err
+	}
+	param := prompts.PromptParam{
+		KnowledgeSets:   knowledgeSets,
+		Targets:         targets,
+		Instructions:    options.Instructions,
+		FolderStructure: run.folderStructure,
+		EditFormat:      run.editFormat,
+	}
+	if together {
+		param.GeneratePaths = generatePaths
+	} else {
+		param.GeneratePath = generatePaths[0]
+	}
+	promptParam, cuts, err := s.tokenBudgetService.Fit(param, budget)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to fit prompt into the context window")
+	}
+	s.printCuts(out, cuts, budget)
+
+	// プロンプトの生成
+	// ターゲット間で共通する接頭辞（フォルダ構造、知識）をプロンプトキャッシュの対象にできるよう、ブロック毎に組み立てる
+	promptBlocks, err := prompts.BuildPromptBlocks(promptParam)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to build prompt")
+	}
+	prompt := strings.Join(promptBlocks, "")
+
+	err = s.savePromptHistory(run.historyDir, index+1, prompt)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to save prompt history")
+	}
+
+	if options.DryRun {
+		err = s.printTokenEstimate(out, promptParam, budget)
 		if err != nil {
-			return eris.Wrap(err, "failed to load knowledge")
+			return chat.Usage{}, eris.Wrap(err, "failed to estimate tokens")
 		}
+		fmt.Fprintln(out, "Dry run: Skipping LLM file generation")
+		return chat.Usage{}, nil
+	}
 
-		s.printKnowledgePaths(knowledgeSets)
+	sendOptions := chat.SendOptions{
+		System: run.system,
+		OnRetry: func(event retry.Event) {
+			fmt.Fprintf(out, "\nRetry: %s\n", event)
+			historyLog.Record(out, run.historyDir, fmt.Sprintf("retry_%02d.log", index+1), s.timer, event.String())
+		},
+		OnFallback: func(event chat.FallbackEvent) {
+			historyLog.Print(out, run.historyDir, fmt.Sprintf("provider_%02d.log", index+1), s.timer, fmt.Sprintf("Fallback: %s", event))
+		},
+	}
+	if !options.Apply && !options.Interactive {
+		// ファイルに反映しない場合は、生成結果を受信しながら標準出力に出力する
+		sendOptions.OnDelta = func(delta string) {
+			fmt.Fprint(out, delta)
+		}
+	}
 
-		// プロンプトの生成
-		prompt, err := prompts.BuildPrompt(prompts.PromptParam{
-			KnowledgeSets:   knowledgeSets,
-			Targets:         targets,
-			Instructions:    instructions,
-			FolderStructure: folderStructure,
-			GeneratePath:    path,
-		})
+	// ツールを使う場合は、モデルが読み込んだファイルを記録する
+	var toolSession *fileTools.Session
+	if options.Tools || cfg.Tools.Enabled {
+		toolSession, err = s.fileToolsService.Open(run.rootDir)
 		if err != nil {
-			return eris.Wrap(err, "failed to build prompt")
+			return chat.Usage{}, eris.Wrap(err, "failed to open file tools")
+		}
+		sendOptions.Tools = s.fileToolsService.Tools()
+		sendOptions.MaxToolRounds = cfg.Tools.MaxRounds
+		sendOptions.OnToolCall = func(call chat.ToolCall) string {
+			historyLog.Print(out, run.historyDir, fmt.Sprintf("tools_%02d.log", index+1), s.timer, fmt.Sprintf("Tool: %s %s", call.Name, call.Arguments))
+			return toolSession.Call(call)
+		}
+	}
+
+	// 検証が失敗した場合に同じ会話で修正を依頼するため、会話の履歴を保持するチャットモデルが必要
+	if len(run.tasks) > 0 {
+		if _, ok := chatClient.(chat.ChatWithHistory); !ok {
+			return chat.Usage{}, eris.Errorf("verify mode needs a chat model that keeps the conversation history (driver: %s)", cfg.LLM.Driver)
 		}
+	}
 
-		err = s.savePromptHistory(historyDir, i+1, prompt)
+	promptOptions := sendOptions
+	promptOptions.CacheBreakpoints = cacheBreakpoints(promptBlocks)
+	promptOptions.Attachments = prompts.Attachments(promptParam.KnowledgeSets)
+	result, err := chatClient.Send(ctx, prompt, cfg.LLM.Model, promptOptions)
+	if err == nil {
+		result, err = s.continueGeneration(ctx, out, chatClient, cfg, generatePaths, result, sendOptions)
+	}
+	if sendOptions.OnDelta != nil {
+		fmt.Fprintln(out)
+	}
+	if toolSession != nil {
+		saveErr := s.fileToolsService.SaveFetched(filepath.Join(run.historyDir, fmt.Sprintf("fetched_%02d.know.yml", index+1)), toolSession)
+		if saveErr != nil {
+			fmt.Fprintf(out, "Warning: failed to save fetched files: %v\n", saveErr)
+		}
+	}
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to send message to LLM")
+	}
+	if result.Cached {
+		fmt.Fprintln(out, "Answer loaded from the response cache")
+	}
+	if result.Provider.Driver != "" {
+		historyLog.Print(out, run.historyDir, fmt.Sprintf("provider_%02d.log", index+1), s.timer, fmt.Sprintf("Answered by: %s", result.Provider))
+	}
+
+	err = s.usageRecordService.Record(run.historyDir, "make", cfg, result)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: failed to save usage: %v\n", err)
+	}
+
+	err = s.saveAnswerHistory(run.historyDir, index+1, result.Content)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to save answer history")
+	}
+
+	if result.FinishReason != "" && result.FinishReason != chat.FinishReasonStop {
+		fmt.Fprintf(out, "Warning: LLM response was cut off. Reason: %s\n", result.FinishReason)
+	}
+
+	// togetherモードでは、回答に含まれていなかった生成ターゲットを除いて反映する
+	var missing []string
+	if together {
+		missing = s.missingCodeBlocks(result.Content, generatePaths)
+	}
+
+	if options.Apply || options.Interactive {
+		if ctx.Err() != nil {
+			return chat.Usage{}, eris.Wrap(ctx.Err(), "aborted before applying changes")
+		}
+		for _, path := range generatePaths {
+			if slices.Contains(missing, path) {
+				continue
+			}
+			err = s.applyChanges(out, run, index+1, path, result.Content)
+			if err != nil {
+				return chat.Usage{}, eris.Wrapf(err, "failed to apply changes to %s", path)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		fmt.Fprintln(out, "Targets missing in the answer:")
+		for _, path := range missing {
+			fmt.Fprintf(out, "- %s\n", path)
+		}
+		return chat.Usage{}, eris.Errorf("the answer did not include %d of %d targets: %s", len(missing), len(generatePaths), strings.Join(missing, ", "))
+	}
+
+	if len(run.tasks) > 0 {
+		run.remember(conversation{
+			index:       index,
+			paths:       generatePaths,
+			chatClient:  chatClient,
+			sendOptions: sendOptions,
+		})
+	}
+
+	return result.Usage, nil
+}
+
+// verify は反映した後にrun.tasksを実行して検証します。
+// 失敗した場合はエラーの内容を生成ターゲット毎の会話に渡して修正を依頼し、反映してから再び検証します。
+// 修正を依頼する回数の上限に達しても検証が成功しない場合は、この実行で書き換えたファイルを元に戻してエラーを返します。
+func (s *MakeService) verify(ctx context.Context, run *makeRun) (chat.Usage, error) {
+	usage, err := s.verifyRounds(ctx, run)
+	if err == nil || ctx.Err() != nil {
+		return usage, err
+	}
+
+	if len(run.writtenPaths()) > 0 {
+		fmt.Println("\nVerification did not pass. Rolling back the changes")
+		rollbackErr := s.snapshotService.Undo(os.Stdout, run.rootDir, filepath.Base(run.historyDir), true)
+		if rollbackErr != nil {
+			return usage, eris.Wrapf(rollbackErr, "failed to roll back the changes after the verification failed: %v", err)
+		}
+	}
+	return usage, err
+}
+
+func (s *MakeService) verifyRounds(ctx context.Context, run *makeRun) (chat.Usage, error) {
+	rounds := run.options.VerifyRounds
+	if rounds <= 0 {
+		rounds = defaultVerifyRounds
+	}
+
+	var usage chat.Usage
+	for round := 0; ; round++ {
+		failures, err := s.runTasks(ctx, run, round+1)
 		if err != nil {
-			return eris.Wrap(err, "failed to save prompt history")
+			return usage, err
+		}
+		if len(failures) == 0 {
+			fmt.Println("Verification passed")
+			return usage, nil
+		}
+		if round == rounds {
+			names := make([]string, 0, len(failures))
+			for _, failure := range failures {
+				names = append(names, failure.Name)
+			}
+			return usage, eris.Errorf("verification did not pass after %d round(s) of fixes: %s", rounds, strings.Join(names, ", "))
+		}
+
+		fmt.Printf("Verification failed. Asking the LLM to fix the errors (%d/%d)\n", round+1, rounds)
+		for _, c := range run.conversationList() {
+			if ctx.Err() != nil {
+				return usage, eris.Wrap(ctx.Err(), "aborted")
+			}
+			fixUsage, err := s.fixTarget(ctx, run, c, failures, round+1)
+			usage = usage.Add(fixUsage)
+			if err != nil {
+				return usage, err
+			}
 		}
+	}
+}
 
-		if dryRun {
-			fmt.Println("Dry run: Skipping LLM file generation")
+// runTasks はrun.tasksを順に実行し、失敗したタスクを返します。実行結果は履歴フォルダのverify_XX.logに記録します。
+func (s *MakeService) runTasks(ctx context.Context, run *makeRun, round int) ([]verify.Failure, error) {
+	fmt.Printf("\n--- Verifying (%d) ---\n", round)
+
+	var failures []verify.Failure
+	var log strings.Builder
+	for _, task := range run.tasks {
+		fmt.Printf("Running task: %s\n", task.Name)
+		stdout, stderr, err := s.taskRunService.Run(ctx, task, run.rootDir)
+		if ctx.Err() != nil {
+			return nil, eris.Wrap(ctx.Err(), "aborted")
+		}
+		if err == nil {
+			fmt.Printf("Task %s passed\n", task.Name)
+			fmt.Fprintf(&log, "## %s\n\npassed\n\n", task.Name)
 			continue
 		}
 
-		result, err := chat.Send(prompt, cfg.LLM.Model)
+		output := taskRun.ErrorMessage(stdout, stderr, err)
+		fmt.Printf("Task %s failed:\n%s\n", task.Name, output)
+		fmt.Fprintf(&log, "## %s\n\nfailed\n\n%s\n\n", task.Name, output)
+		failures = append(failures, verify.Failure{
+			Name:   task.Name,
+			Run:    task.Run,
+			Output: output,
+		})
+	}
+
+	err := os.WriteFile(filepath.Join(run.historyDir, fmt.Sprintf("verify_%02d.log", round)), []byte(log.String()), 0644)
+	if err != nil {
+		fmt.Printf("Warning: failed to save verify history: %v\n", err)
+	}
+	return failures, nil
+}
+
+// fixTarget は生成ターゲットを生成した会話にタスクのエラーを渡して修正を依頼し、回答を反映します。
+// 修正が不要な生成ターゲットは回答にコードブロックが含まれないため、反映しません。
+func (s *MakeService) fixTarget(ctx context.Context, run *makeRun, c conversation, failures []verify.Failure, round int) (chat.Usage, error) {
+	out := os.Stdout
+	fmt.Fprintf(out, "\n--- Fixing target: %s ---\n", strings.Join(c.paths, ", "))
+
+	// 前の回答を反映した後の内容を提示する（変更箇所の形式では現在の内容に対して変更箇所を記載させるため）
+	targets, err := s.readAllTargets(c.paths)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to read targets")
+	}
+	run.recordBase(c.paths, targets)
+	prompt, err := verify.BuildPrompt(verify.PromptParam{
+		Failures:   failures,
+		Targets:    targets,
+		EditFormat: run.editFormat,
+	})
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to build verify prompt")
+	}
+
+	name := fmt.Sprintf("verify_prompt_%02d_%02d.md", round, c.index+1)
+	err = os.WriteFile(filepath.Join(run.historyDir, name), []byte(prompt), 0644)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to save verify prompt history")
+	}
+
+	result, err := c.chatClient.Send(ctx, prompt, run.cfg.LLM.Model, c.sendOptions)
+	if err == nil {
+		result, err = s.continueGeneration(ctx, out, c.chatClient, run.cfg, c.paths, result, c.sendOptions)
+	}
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to send message to LLM")
+	}
+
+	err = s.usageRecordService.Record(run.historyDir, "make", run.cfg, result)
+	if err != nil {
+		fmt.Fprintf(out, "Warning: failed to save usage: %v\n", err)
+	}
+
+	name = fmt.Sprintf("verify_answer_%02d_%02d.md", round, c.index+1)
+	err = os.WriteFile(filepath.Join(run.historyDir, name), []byte(result.Content), 0644)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to save verify answer history")
+	}
+
+	if ctx.Err() != nil {
+		return chat.Usage{}, eris.Wrap(ctx.Err(), "aborted before applying changes")
+	}
+	for _, path := range c.paths {
+		if len(s.missingCodeBlocks(result.Content, []string{path})) > 0 {
+			continue
+		}
+		err = s.applyChanges(out, run, c.index+1, path, result.Content)
 		if err != nil {
-			return eris.Wrap(err, "failed to send message to LLM")
+			return chat.Usage{}, eris.Wrapf(err, "failed to apply changes to %s", path)
 		}
+	}
 
-		err = s.saveAnswerHistory(historyDir, i+1, result.Content)
-		if err != nil {
-			return eris.Wrap(err, "failed to save answer history")
+	return result.Usage, nil
+}
+
+// editFormat はコードブロックに記載させる形式を返します。options.EditFormat、プロジェクトコンフィグのedit.formatの順に使います。
+func (s *MakeService) editFormat(cfg *config.Config, options Options) (string, error) {
+	format := options.EditFormat
+	if format == "" {
+		format = cfg.Edit.Format
+	}
+	switch format {
+	case "":
+		return config.EditFormatWhole, nil
+	case config.EditFormatWhole, config.EditFormatSearchReplace, config.EditFormatUnifiedDiff:
+		return format, nil
+	}
+	return "", eris.Errorf("unknown edit format: %s (must be one of %s, %s and %s)", format, config.EditFormatWhole, config.EditFormatSearchReplace, config.EditFormatUnifiedDiff)
+}
+
+// missingCodeBlocks はpathsのうち、回答にCapturable Code Blockが含まれていないパスを返します。
+func (s *MakeService) missingCodeBlocks(answer string, paths []string) []string {
+	var missing []string
+	for _, path := range paths {
+		if _, err := s.extractCodeBlockService.ExtractCodeBlock(answer, path); err != nil {
+			missing = append(missing, path)
+		}
+	}
+	return missing
+}
+
+// makeParallel は最大run.options.Jobs個の生成ターゲットを並行して生成し、トークンの使用量の合計を返します。
+// 生成ターゲットは、依存グラフで依存している生成ターゲットが全て完了してから開始します。
+// 生成ターゲット毎の出力はまとめて、生成ターゲットが終わった時点で標準出力に出力します。
+// 失敗した生成ターゲットがある場合は、以降の生成ターゲットを開始せず、実行中の生成ターゲットが終わるのを待ってから最初のエラーを返します。
+func (s *MakeService) makeParallel(ctx context.Context, run *makeRun) (chat.Usage, error) {
+	prerequisites, err := s.prerequisites(run.paths, run.rootDir)
+	if err != nil {
+		return chat.Usage{}, eris.Wrap(err, "failed to resolve the order of targets")
+	}
+
+	n := len(run.paths)
+	done := make([]chan struct{}, n)
+	for i := range done {
+		done[i] = make(chan struct{})
+	}
+	errs := make([]error, n)
+	usages := make([]chat.Usage, n)
+	workers := make(chan struct{}, run.options.Jobs)
+
+	var stdoutMu sync.Mutex
+	var failedMu sync.Mutex
+	failed := false
+	isFailed := func() bool {
+		failedMu.Lock()
+		defer failedMu.Unlock()
+		return failed
+	}
+
+	var wg sync.WaitGroup
+	for i, path := range run.paths {
+		wg.Add(1)
+		go func(i int, path string) {
+			defer wg.Done()
+			defer close(done[i])
+
+			for _, p := range prerequisites[i] {
+				<-done[p]
+			}
+
+			// 依存するターゲットが失敗した場合や、他のターゲットが失敗した場合は開始しない
+			skipped := false
+			for _, p := range prerequisites[i] {
+				if errs[p] != nil {
+					skipped = true
+				}
+			}
+			if skipped || isFailed() {
+				errs[i] = errSkipped
+				return
+			}
+
+			select {
+			case workers <- struct{}{}:
+			case <-ctx.Done():
+				errs[i] = errSkipped
+				return
+			}
+			defer func() { <-workers }()
+
+			if ctx.Err() != nil || isFailed() {
+				errs[i] = errSkipped
+				return
+			}
+
+			var out bytes.Buffer
+			usages[i], errs[i] = s.makeTarget(ctx, run, i, []string{path}, &out)
+			if errs[i] != nil {
+				fmt.Fprintf(&out, "Error: %v\n", errs[i])
+				failedMu.Lock()
+				failed = true
+				failedMu.Unlock()
+			}
+
+			stdoutMu.Lock()
+			defer stdoutMu.Unlock()
+			_, _ = os.Stdout.Write(out.Bytes())
+		}(i, path)
+	}
+	wg.Wait()
+
+	var totalUsage chat.Usage
+	for i, path := range run.paths {
+		totalUsage = totalUsage.Add(usages[i])
+		if errs[i] != nil && errs[i] != errSkipped {
+			return chat.Usage{}, eris.Wrapf(errs[i], "failed to make %s", path)
 		}
+	}
+	if ctx.Err() != nil {
+		return chat.Usage{}, eris.Wrap(ctx.Err(), "aborted")
+	}
 
-		if result.FinishReason != "" && result.FinishReason != "stop" {
-			fmt.Printf("Warning: LLM response was cut off. Reason: %s\n", result.FinishReason)
+	return totalUsage, nil
+}
+
+// errSkipped は依存するターゲットの失敗や中断によって生成ターゲットを開始しなかったことを表します。
+var errSkipped = eris.New("skipped")
+
+// prerequisites は生成ターゲット毎に、先に完了している必要がある生成ターゲットの位置を返します。
+// 依存グラフで生成ターゲットから辿れる（間接的に依存している）生成ターゲットを先に完了させます。
+// 依存関係が循環している場合はpathsの順に生成します。deps-graph.jsonが存在しない場合は順序の制約はありません。
+func (s *MakeService) prerequisites(paths []string, rootDir string) ([][]int, error) {
+	result := make([][]int, len(paths))
+
+	graph, err := s.depsGraphRepo.Read(filepath.Join(rootDir, ".sisho", "deps-graph.json"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return result, nil
 		}
+		return nil, eris.Wrap(err, "failed to read deps-graph.json")
+	}
 
-		if applyFlag {
-			err = s.applyChanges(path, result.Content)
-			if err != nil {
-				return eris.Wrapf(err, "failed to apply changes to %s", path)
+	// reach[i][j] は依存グラフでpaths[i]からpaths[j]に辿れる（paths[j]がpaths[i]に依存している）ことを表す
+	reach := make([][]bool, len(paths))
+	for i, path := range paths {
+		reachable := map[string]bool{}
+		var visit func(node string)
+		visit = func(node string) {
+			for _, dependent := range graph[depsGraph.Dependency(node)] {
+				if !reachable[string(dependent)] {
+					reachable[string(dependent)] = true
+					visit(string(dependent))
+				}
 			}
-			fmt.Printf("Applied changes to %s\n", path)
-		} else {
-			fmt.Println(result.Content)
+		}
+		visit(path)
+
+		reach[i] = make([]bool, len(paths))
+		for j, other := range paths {
+			reach[i][j] = i != j && reachable[other]
 		}
 	}
 
-	return nil
+	for j := range paths {
+		for i := range paths {
+			if reach[i][j] && (!reach[j][i] || i < j) {
+				result[j] = append(result[j], i)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// cacheBreakpoints はプロンプトのブロックの境界の位置を返します（最後のブロックの後は含みません）。
+func cacheBreakpoints(blocks []string) []int {
+	var breakpoints []int
+	offset := 0
+	for _, block := range blocks[:len(blocks)-1] {
+		offset += len(block)
+		breakpoints = append(breakpoints, offset)
+	}
+	return breakpoints
+}
+
+// printUsage は実行全体のトークンの使用量を標準出力に出力します。
+// プロンプトキャッシュを使った場合は、キャッシュの読み込み・書き込みトークン数も出力します。
+func (s *MakeService) printUsage(usage chat.Usage) {
+	fmt.Printf("\nTokens used: input %d, output %d\n", usage.InputTokens, usage.OutputTokens)
+	if usage.CacheReadTokens > 0 || usage.CacheWriteTokens > 0 {
+		fmt.Printf("Prompt cache: read %d, write %d\n", usage.CacheReadTokens, usage.CacheWriteTokens)
+	}
+}
+
+// continueGeneration は生成が出力トークン数の上限で途切れた場合に、続きの生成を依頼して回答を連結します。
+// pathsの全てのCapturable Code Blockが揃うか、継続回数の上限に達するまで繰り返します。
+// 履歴を保持しないチャットモデルの場合は何もしません。
+func (s *MakeService) continueGeneration(
+	ctx context.Context,
+	out io.Writer,
+	chatClient chat.Chat,
+	cfg *config.Config,
+	paths []string,
+	result chat.SendResult,
+	options chat.SendOptions,
+) (chat.SendResult, error) {
+	if _, ok := chatClient.(chat.ChatWithHistory); !ok {
+		return result, nil
+	}
+
+	maxContinuations := defaultMaxContinuations
+	if cfg.LLM.MaxContinuations != nil {
+		maxContinuations = *cfg.LLM.MaxContinuations
+	}
+
+	param := continuation.PromptParam{}
+	if len(paths) == 1 {
+		param.GeneratePath = paths[0]
+	}
+	prompt, err := continuation.BuildPrompt(param)
+	if err != nil {
+		return chat.SendResult{}, eris.Wrap(err, "failed to build continuation prompt")
+	}
+
+	content := result.Content
+	usage := result.Usage
+	for n := 1; result.FinishReason == chat.FinishReasonLength && n <= maxContinuations; n++ {
+		if len(s.missingCodeBlocks(content, paths)) == 0 {
+			break
+		}
+
+		fmt.Fprintf(out, "\nLLM response was cut off. Continuing generation (%d/%d)\n", n, maxContinuations)
+
+		result, err = chatClient.Send(ctx, prompt, cfg.LLM.Model, options)
+		if err != nil {
+			return chat.SendResult{}, eris.Wrap(err, "failed to continue generation")
+		}
+		content += result.Content
+		usage = usage.Add(result.Usage)
+	}
+
+	result.Content = content
+	result.Usage = usage
+	return result, nil
 }
 
 func (s *MakeService) expandTargetsWithDependencies(targets []string, rootDir string) ([]string, error) {
@@ -227,14 +1177,78 @@ func (s *MakeService) expandDependencies(target string, graph depsGraph.DepsGrap
 	}
 }
 
-func (s *MakeService) printKnowledgePaths(knowledgeSets []prompts.KnowledgeSet) {
-	fmt.Println("Knowledge paths:")
+func (s *MakeService) printKnowledgePaths(out io.Writer, knowledgeSets []prompts.KnowledgeSet) {
+	fmt.Fprintln(out, "Knowledge paths:")
 	for _, set := range knowledgeSets {
 		for _, k := range set.Knowledge {
-			fmt.Printf("- %s (%s)\n", k.Path, set.Kind)
+			if k.MediaType != "" {
+				fmt.Fprintf(out, "- %s (%s, attached as %s)\n", k.Path, set.Kind, k.MediaType)
+				continue
+			}
+			fmt.Fprintf(out, "- %s (%s)\n", k.Path, set.Kind)
 		}
 	}
-	fmt.Println()
+	fmt.Fprintln(out)
+}
+
+// tokenBudget はプロンプトに使用できるトークン数を返します。
+// コンテキストウィンドウの大きさが不明なモデルの場合は0を返します。
+// 出力用のトークン数とシステムプロンプトでコンテキストウィンドウを使い切る場合はエラーを返します。
+func (s *MakeService) tokenBudget(cfg *config.Config, system string) (int, error) {
+	window := cfg.LLM.ContextWindow
+	if window == 0 {
+		window = tokens.ContextWindow(cfg.LLM.Model)
+	}
+	if window == 0 {
+		return 0, nil
+	}
+	reserved := tokens.ReservedOutput(window)
+	if cfg.LLM.MaxTokens != 0 {
+		reserved = cfg.LLM.MaxTokens
+	}
+	// システムプロンプトもコンテキストウィンドウを消費する
+	systemTokens := tokens.Estimate(system)
+	budget := window - reserved - systemTokens
+	if budget <= 0 {
+		return 0, eris.Errorf("no room is left for the prompt in the context window of %s (%d tokens): %d tokens are reserved for the output and %d for the system prompt (lower llm.max-tokens or set llm.context-window)",
+			cfg.LLM.Model, window, reserved, systemTokens)
+	}
+	return budget, nil
+}
+
+func (s *MakeService) printCuts(out io.Writer, cuts []tokenBudget.Cut, budget int) {
+	if len(cuts) == 0 {
+		return
+	}
+
+	fmt.Fprintf(out, "Knowledge trimmed to fit the context window (budget: %d tokens):\n", budget)
+	for _, cut := range cuts {
+		action := "dropped"
+		if cut.Truncated {
+			action = "truncated"
+		}
+		fmt.Fprintf(out, "- %s (%s): %s, about %d tokens\n", cut.Path, cut.Kind, action, cut.Tokens)
+	}
+	fmt.Fprintln(out)
+}
+
+func (s *MakeService) printTokenEstimate(out io.Writer, param prompts.PromptParam, budget int) error {
+	sections, total, err := s.tokenBudgetService.EstimateSections(param)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(out, "Estimated tokens:")
+	for _, section := range sections {
+		fmt.Fprintf(out, "- %s: %d\n", section.Name, section.Tokens)
+	}
+	if budget > 0 {
+		fmt.Fprintf(out, "- Total: %d / %d\n", total, budget)
+	} else {
+		fmt.Fprintf(out, "- Total: %d\n", total)
+	}
+	fmt.Fprintln(out)
+	return nil
 }
 
 func (s *MakeService) readAllTargets(paths []string) ([]prompts.Target, error) {
@@ -305,7 +1319,18 @@ func (s *MakeService) saveAnswerHistory(historyDir string, index int, answer str
 	return nil
 }
 
-func (s *MakeService) applyChanges(path, answer string) error {
+// saveAbortedHistory は中断されたことを履歴フォルダのaborted.logに記録します。pathsは中断した時点で生成中だったターゲットです。
+func (s *MakeService) saveAbortedHistory(historyDir string, paths []string, cause error) {
+	message := fmt.Sprintf("Aborted: %v", cause)
+	if len(paths) > 0 {
+		message = fmt.Sprintf("Aborted while processing %s: %v", strings.Join(paths, ", "), cause)
+	}
+	historyLog.Record(os.Stdout, historyDir, "aborted.log", s.timer, message)
+}
+
+// applyChanges は回答のコードブロックをpathに反映します。
+// interactiveモードの場合は変更箇所毎に反映するかどうかを確認し、判断を履歴フォルダのreview_XX.logに記録します。
+func (s *MakeService) applyChanges(out io.Writer, run *makeRun, index int, path, answer string) error {
 	newContent, err := s.extractCodeBlockService.ExtractCodeBlock(answer, path)
 	if err != nil {
 		return eris.Wrapf(err, "failed to extract code block from answer")
@@ -315,31 +1340,191 @@ func (s *MakeService) applyChanges(path, answer string) error {
 	if err != nil && !os.IsNotExist(err) {
 		return eris.Wrapf(err, "failed to read file: %s", path)
 	}
+	existed := err == nil
+
+	// 生成中にファイルが変更された場合は、プロンプトを組み立てた時点の内容に対する生成結果を求めてから扱いを決める
+	base, changed := run.changedOnDisk(path, oldContent)
+	editTarget := string(oldContent)
+	if changed {
+		editTarget = base
+	}
+
+	// 変更箇所の形式の場合は現在の内容に適用する。変更箇所の形式ではないコードブロック（新規ファイルなど）はファイル全体として扱う
+	if run.editFormat != config.EditFormatWhole {
+		hunks, err := editApply.Parse(newContent)
+		if err != nil {
+			return eris.Wrap(err, "failed to parse the edits")
+		}
+		if hunks != nil {
+			newContent, err = editApply.Apply(editTarget, hunks)
+			if err != nil {
+				return eris.Wrap(err, "failed to apply the edits")
+			}
+		}
+	}
+
+	if changed {
+		merged, ok, err := s.resolveConflict(out, run, path, base, string(oldContent), newContent)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		newContent = merged
+	}
+
+	if run.options.Interactive {
+		review, err := s.hunkReviewService.Review(out, path, string(oldContent), newContent)
+		if err != nil {
+			return eris.Wrap(err, "failed to review the changes")
+		}
+		err = s.saveReviewHistory(run.historyDir, index, review)
+		if err != nil {
+			fmt.Fprintf(out, "Warning: failed to save review history: %v\n", err)
+		}
+		if review.Skipped {
+			fmt.Fprintf(out, "Skipped changes to %s\n", path)
+			return nil
+		}
+		newContent = review.Content
+	}
 
 	if string(oldContent) != newContent {
+		// 確認している間に変更された場合も上書きしない
+		current, err := os.ReadFile(path)
+		if (err == nil) != existed || contentHash(current) != contentHash(oldContent) {
+			return eris.Errorf("%s was changed on disk while applying the changes; it was not overwritten", path)
+		}
+
+		// undoで元に戻せるよう、書き換える前の内容を保存してから書き込む
+		err = s.snapshotService.Record(run.historyDir, run.rootDir, path, existed, oldContent, []byte(newContent))
+		if err != nil {
+			return eris.Wrap(err, "failed to save the snapshot")
+		}
+
 		err = s.write(path, []byte(newContent))
 		if err != nil {
 			return eris.Wrapf(err, "failed to write file: %s", path)
 		}
+		run.wrote(path)
+
+		if !run.options.Interactive {
+			s.printDiff(out, string(oldContent), newContent)
+		}
+	}
+
+	fmt.Fprintf(out, "Applied changes to %s\n", path)
+	return nil
+}
+
+// resolveConflict は生成中に変更されたpathの扱いをoptions.OnConflict、または利用者への確認で決めます。
+// ファイルに反映する内容と、反映するかどうかを返します。反映しない場合、生成結果は `[パス].sisho-new` に保存します。
+func (s *MakeService) resolveConflict(out io.Writer, run *makeRun, path, base, current, generated string) (string, bool, error) {
+	action := run.options.OnConflict
+	if action == "" {
+		if run.options.Jobs > 1 {
+			// 並行して生成する場合は出力をまとめて表示するため確認できない
+			fmt.Fprintf(out, "%s was changed on disk during generation\n", path)
+			action = conflictResolve.ActionNew
+		} else {
+			var err error
+			action, err = s.conflictResolveService.Ask(out, path)
+			if err != nil {
+				fmt.Fprintf(out, "\nWarning: failed to ask how to apply the changes: %v\n", err)
+				action = conflictResolve.ActionNew
+			}
+		}
+	} else {
+		fmt.Fprintf(out, "%s was changed on disk during generation\n", path)
+	}
+
+	switch action {
+	case conflictResolve.ActionMerge:
+		merged, conflicts := conflictResolve.Merge(base, current, generated)
+		if conflicts > 0 {
+			fmt.Fprintf(out, "Merged with %d conflict(s); resolve the conflict markers in %s\n", conflicts, path)
+		} else {
+			fmt.Fprintf(out, "Merged the changes on disk into %s\n", path)
+		}
+		return merged, true, nil
+	case conflictResolve.ActionNew:
+		newPath := path + conflictResolve.NewFileSuffix
+		before, err := os.ReadFile(newPath)
+		if err != nil && !os.IsNotExist(err) {
+			return "", false, eris.Wrapf(err, "failed to read file: %s", newPath)
+		}
+		err = s.snapshotService.Record(run.historyDir, run.rootDir, newPath, err == nil, before, []byte(generated))
+		if err != nil {
+			return "", false, eris.Wrap(err, "failed to save the snapshot")
+		}
+		err = s.write(newPath, []byte(generated))
+		if err != nil {
+			return "", false, eris.Wrapf(err, "failed to write file: %s", newPath)
+		}
+		fmt.Fprintf(out, "Kept %s and saved the generation as %s\n", path, newPath)
+		return "", false, nil
+	}
+	return "", false, eris.Errorf("%s was changed on disk during generation; it was not overwritten", path)
+}
 
-		s.printDiff(string(oldContent), newContent)
+func (s *MakeService) saveReviewHistory(historyDir string, index int, review hunkReview.Review) error {
+	filename := fmt.Sprintf("review_%02d.log", index)
+	f, err := os.OpenFile(filepath.Join(historyDir, filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return eris.Wrap(err, "failed to open review history")
 	}
+	defer f.Close()
 
+	_, err = f.WriteString(review.Log())
+	if err != nil {
+		return eris.Wrap(err, "failed to write review history")
+	}
 	return nil
 }
 
-func (s *MakeService) printDiff(oldContent, newContent string) {
+func (s *MakeService) printDiff(out io.Writer, oldContent, newContent string) {
 	dmp := diffmatchpatch.New()
 	diffs := dmp.DiffMain(oldContent, newContent, false)
-	fmt.Println(dmp.DiffPrettyText(diffs))
+	fmt.Fprintln(out, dmp.DiffPrettyText(diffs))
 }
 
+// write はファイルを書き換えます。
+// 書き込み途中で終了しても中途半端な内容が残らないよう、同じフォルダの一時ファイルに書き込んでから置き換えます。
 func (s *MakeService) write(path string, data []byte) error {
 	dir := filepath.Dir(path)
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
 		return eris.Wrapf(err, "failed to create directory: %s", dir)
 	}
-	return eris.Wrapf(os.WriteFile(path, data, 0644), "failed to write file: %s", path)
+
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".sisho-tmp-*")
+	if err != nil {
+		return eris.Wrapf(err, "failed to create temporary file: %s", path)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(mode)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return eris.Wrapf(err, "failed to write file: %s", path)
+	}
+
+	return eris.Wrapf(os.Rename(tmp.Name(), path), "failed to write file: %s", path)
+}
+
+func contentHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
 }
 
 func (s *MakeService) getDepth(g depsGraph.DepsGraph, node string) int {
@@ -1,40 +1,67 @@
 package make_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/domain/external/claude"
 	"github.com/t-kuni/sisho/domain/external/openAi"
+	"github.com/t-kuni/sisho/domain/model/prompts"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	"github.com/t-kuni/sisho/domain/model/tokens"
 	"github.com/t-kuni/sisho/domain/repository/file"
 	"github.com/t-kuni/sisho/domain/service/autoCollect"
 	"github.com/t-kuni/sisho/domain/service/chatFactory"
 	"github.com/t-kuni/sisho/domain/service/configFindService"
+	"github.com/t-kuni/sisho/domain/service/conflictResolve"
 	"github.com/t-kuni/sisho/domain/service/contextScan"
 	"github.com/t-kuni/sisho/domain/service/extractCodeBlock"
+	"github.com/t-kuni/sisho/domain/service/fileTools"
 	"github.com/t-kuni/sisho/domain/service/folderStructureMake"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
 	"github.com/t-kuni/sisho/domain/service/knowledgeLoad"
 	"github.com/t-kuni/sisho/domain/service/knowledgePathNormalize"
 	"github.com/t-kuni/sisho/domain/service/knowledgeScan"
+	"github.com/t-kuni/sisho/domain/service/llmSelect"
 	makeService "github.com/t-kuni/sisho/domain/service/make"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/service/systemPrompt"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"github.com/t-kuni/sisho/domain/service/usageRecord"
+	"github.com/t-kuni/sisho/domain/system/credential"
 	"github.com/t-kuni/sisho/domain/system/ksuid"
+	"github.com/t-kuni/sisho/domain/system/terminal"
 	"github.com/t-kuni/sisho/domain/system/timer"
 	config2 "github.com/t-kuni/sisho/infrastructure/repository/config"
 	"github.com/t-kuni/sisho/infrastructure/repository/depsGraph"
 	knowledge2 "github.com/t-kuni/sisho/infrastructure/repository/knowledge"
+	snapshot2 "github.com/t-kuni/sisho/infrastructure/repository/snapshot"
+	"github.com/t-kuni/sisho/infrastructure/repository/usage"
+	credential2 "github.com/t-kuni/sisho/infrastructure/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/git"
 	"github.com/t-kuni/sisho/testUtil"
 	"go.uber.org/mock/gomock"
+	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestMakeCommand(t *testing.T) {
 	type Mocks struct {
-		Timer          *timer.MockITimer
-		ClaudeClient   *claude.MockClient
-		OpenAiClient   *openAi.MockClient
-		FileRepository *file.MockRepository
-		KsuidGenerator *ksuid.MockIKsuid
+		Timer                         *timer.MockITimer
+		ClaudeClient                  *claude.MockClient
+		OpenAiClient                  *openAi.MockClient
+		FileRepository                *file.MockRepository
+		KsuidGenerator                *ksuid.MockIKsuid
+		OpenAiCompatibleClientFactory *openAi.MockCompatibleClientFactory
+		Terminal                      *terminal.MockTerminal
 	}
 
 	factory := func(
@@ -57,14 +84,18 @@ func TestMakeCommand(t *testing.T) {
 		mockKsuidGenerator := ksuid.NewMockIKsuid(mockCtrl)
 		folderStructureMakeSvc := folderStructureMake.NewFolderStructureMakeService()
 		extractCodeBlockSvc := extractCodeBlock.NewCodeBlockExtractService()
-		chatFactory := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient)
+		mockOpenAiCompatibleClientFactory := openAi.NewMockCompatibleClientFactory(mockCtrl)
+		mockTerminal := terminal.NewMockTerminal(mockCtrl)
+		chatFactory := chatFactory.NewChatFactory(mockOpenAiClient, mockClaudeClient, mockOpenAiCompatibleClientFactory, responseCache.NewResponseCacheService(mockTimer), replayFixture.NewReplayFixtureService(), config2.NewConfigRepository(), credential2.NewProvider())
 
 		customizeMocks(Mocks{
-			ClaudeClient:   mockClaudeClient,
-			OpenAiClient:   mockOpenAiClient,
-			FileRepository: mockFileRepo,
-			Timer:          mockTimer,
-			KsuidGenerator: mockKsuidGenerator,
+			ClaudeClient:                  mockClaudeClient,
+			OpenAiClient:                  mockOpenAiClient,
+			FileRepository:                mockFileRepo,
+			Timer:                         mockTimer,
+			KsuidGenerator:                mockKsuidGenerator,
+			OpenAiCompatibleClientFactory: mockOpenAiCompatibleClientFactory,
+			Terminal:                      mockTerminal,
 		})
 
 		return makeService.NewMakeService(
@@ -78,6 +109,16 @@ func TestMakeCommand(t *testing.T) {
 			folderStructureMakeSvc,
 			extractCodeBlockSvc,
 			chatFactory,
+			tokenBudget.NewTokenBudgetService(),
+			usageRecord.NewUsageRecordService(usage.NewRepository(), mockTimer),
+			systemPrompt.NewSystemPromptService(),
+			llmSelect.NewLLMSelectService(),
+			fileTools.NewFileToolsService(knowledgeRepo),
+			hunkReview.NewHunkReviewService(mockTerminal),
+			snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer),
+			git.NewGit(),
+			taskRun.NewTaskRunService(),
+			conflictResolve.NewConflictResolveService(mockTerminal),
 		)
 	}
 
@@ -108,8 +149,8 @@ dummy text
 
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					assert.NotContains(t, messages[0].Content, space.Dir)
 					assert.Contains(t, messages[0].Content, "aaa/bbb/ccc/ddd.txt")
 					assert.Contains(t, messages[0].Content, "CURRENT_CONTENT")
@@ -121,16 +162,1535 @@ dummy text
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 
 		// Assert
 		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
 			assert.Equal(t, "UPDATED_CONTENT", string(actual))
 		})
+		// undoで元に戻せるよう、書き換える前の内容が保存されていること
+		space.AssertFile(".sisho/history/test-ksuid/snapshots/0001.before", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/snapshots.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "path: aaa/bbb/ccc/ddd.txt")
+		})
+	})
+
+	t.Run("dryRunフラグがtrueの場合LLMによるファイル生成が行われないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true, DryRun: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("トークンの使用量が履歴フォルダに記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("bbb.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+					TerminationReason: "end_turn",
+					Usage:             claude.Usage{InputTokens: 100, OutputTokens: 20},
+				}, nil)
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```bbb.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+					TerminationReason: "end_turn",
+					Usage:             claude.Usage{InputTokens: 200, OutputTokens: 30},
+				}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt", "bbb.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid/usage.yml", func(actual []byte) {
+			expected := `
+command: make
+driver: anthropic
+model: claude-3-5-sonnet-20240620
+time: 2022-01-01T00:00:00Z
+input-tokens: 300
+output-tokens: 50
+`
+			assert.YAMLEq(t, expected, string(actual))
+		})
+	})
+
+	t.Run("プロンプトキャッシュが有効な場合、共通する接頭辞がキャッシュ対象のブロックで送信され、キャッシュのトークン数が記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    prompt-caching: true
+additional-knowledge:
+    folder-structure: true
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("bbb.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("aaa.txt.know.yml", []byte(`
+knowledge:
+  - path: README.md
+    kind: specifications
+`))
+		space.WriteFile("bbb.txt.know.yml", []byte(`
+knowledge:
+  - path: README.md
+    kind: specifications
+`))
+		space.WriteFile("README.md", []byte("README_CONTENT"))
+
+		var sharedBlocks []string
+		sendMessage := func(path string, usage claude.Usage) func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+			return func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+				message := messages[len(messages)-1]
+				blocks := message.Blocks
+				assert.Len(t, blocks, 3)
+				assert.True(t, blocks[0].Cache)
+				assert.Contains(t, blocks[0].Text, "# Folder Structure")
+				assert.True(t, blocks[1].Cache)
+				assert.Contains(t, blocks[1].Text, "README_CONTENT")
+				assert.False(t, blocks[2].Cache)
+				assert.Contains(t, blocks[2].Text, "## "+path)
+				assert.Equal(t, message.Content, blocks[0].Text+blocks[1].Text+blocks[2].Text)
+				if sharedBlocks == nil {
+					sharedBlocks = []string{blocks[0].Text, blocks[1].Text}
+				} else {
+					assert.Equal(t, sharedBlocks, []string{blocks[0].Text, blocks[1].Text})
+				}
+				return claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```" + path + "\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+					TerminationReason: "end_turn",
+					Usage:             usage,
+				}, nil
+			}
+		}
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			gomock.InOrder(
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(sendMessage("aaa.txt", claude.Usage{InputTokens: 50, OutputTokens: 20, CacheCreationInputTokens: 1000})),
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(sendMessage("bbb.txt", claude.Usage{InputTokens: 60, OutputTokens: 30, CacheReadInputTokens: 1000})),
+			)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt", "bbb.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid/usage.yml", func(actual []byte) {
+			expected := `
+command: make
+driver: anthropic
+model: claude-3-5-sonnet-20240620
+time: 2022-01-01T00:00:00Z
+input-tokens: 110
+output-tokens: 50
+cache-read-tokens: 1000
+cache-write-tokens: 1000
+`
+			assert.YAMLEq(t, expected, string(actual))
+		})
+	})
+
+	t.Run("プロンプトキャッシュが有効な場合、同じ会話の続きでも最初のメッセージがキャッシュ対象のブロックで送信されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    prompt-caching: true
+additional-knowledge:
+    folder-structure: true
+tasks:
+    - name: check
+      run: grep -q FIXED aaa.txt || (echo "aaa.txt is not fixed" >&2; exit 1)
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		var firstBlocks []claude.ContentBlock
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			gomock.InOrder(
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						firstBlocks = messages[0].Blocks
+						return claude.GenerationResult{
+							Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+							TerminationReason: "end_turn",
+						}, nil
+					}),
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						assert.Len(t, messages, 3)
+						// 最初のメッセージは送信した時点と同じブロックで送信されること
+						assert.Len(t, firstBlocks, 2)
+						assert.Equal(t, firstBlocks, messages[0].Blocks)
+						assert.True(t, messages[0].Blocks[0].Cache)
+						assert.Contains(t, messages[0].Blocks[0].Text, "# Folder Structure")
+						return claude.GenerationResult{
+							Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nFIXED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+							TerminationReason: "end_turn",
+						}, nil
+					}),
+			)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"check"}})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "FIXED_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("ツールが有効な場合、モデルが要求したファイルを返し、読み込んだファイルが履歴フォルダに記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("lib/util.go", []byte("UTIL_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			gomock.InOrder(
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						assert.Len(t, messages, 1)
+						var names []string
+						for _, tool := range options.Tools {
+							names = append(names, tool.Name)
+						}
+						assert.Equal(t, []string{"read_file", "list_dir", "grep"}, names)
+						return claude.GenerationResult{
+							TerminationReason: "tool_use",
+							ToolUses:          []claude.ToolUse{{ID: "toolu_01", Name: "read_file", Input: `{"path":"lib/util.go"}`}},
+							Usage:             claude.Usage{InputTokens: 100, OutputTokens: 10},
+						}, nil
+					}),
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						assert.Len(t, messages, 3)
+						assert.Equal(t, "toolu_01", messages[1].Blocks[0].ToolUse.ID)
+						assert.Equal(t, &claude.ToolResult{ToolUseID: "toolu_01", Content: "UTIL_CONTENT"}, messages[2].Blocks[0].ToolResult)
+						return claude.GenerationResult{
+							Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+							TerminationReason: "end_turn",
+							Usage:             claude.Usage{InputTokens: 150, OutputTokens: 20},
+						}, nil
+					}),
+			)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Tools: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/tools_01.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z Tool: read_file {\"path\":\"lib/util.go\"}\n", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/fetched_01.know.yml", func(actual []byte) {
+			assert.Equal(t, "knowledge:\n    - path: '@/lib/util.go'\n      kind: implementations\n", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/usage.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "input-tokens: 250")
+		})
+	})
+
+	t.Run("レスポンスキャッシュが有効な場合、同じプロンプトはLLMに再送信されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+cache:
+    enabled: true
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+					TerminationReason: "end_turn",
+					Usage:             claude.Usage{InputTokens: 100, OutputTokens: 20},
+				}, nil).Times(1)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-1")
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-2")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{})
+		assert.NoError(t, err)
+		err = testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid-2/answer_01.md", func(actual []byte) {
+			assert.Contains(t, string(actual), "UPDATED_CONTENT")
+		})
+		space.AssertFile(".sisho/history/test-ksuid-2/usage.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "input-tokens: 0")
+		})
+	})
+
+	t.Run("NoCacheオプションが指定された場合、レスポンスキャッシュが使われないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+cache:
+    enabled: true
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+					TerminationReason: "end_turn",
+				}, nil).Times(2)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-1")
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-2")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{})
+		assert.NoError(t, err)
+		err = testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{NoCache: true})
+		assert.NoError(t, err)
+	})
+
+	t.Run("replayドライバーの場合、記録済みの回答が生成対象のパス毎に使われること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: replay
+    model: claude-3-5-sonnet-20240620
+    replay:
+        dir: testdata/replay
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("bbb.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("testdata/replay/recorded/prompt_01.md", []byte("RECORDED PROMPT\n\n## aaa.txt\n\n"))
+		space.WriteFile("testdata/replay/recorded/answer_01.md", []byte("<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nREPLAYED_A\n```<!-- CODE_BLOCK_END -->"))
+		space.WriteFile("testdata/replay/recorded/prompt_02.md", []byte("RECORDED PROMPT\n\n## bbb.txt\n\n"))
+		space.WriteFile("testdata/replay/recorded/answer_02.md", []byte("<!-- CODE_BLOCK_BEGIN -->```bbb.txt\nREPLAYED_B\n```<!-- CODE_BLOCK_END -->"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"bbb.txt", "aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "REPLAYED_A", string(actual))
+		})
+		space.AssertFile("bbb.txt", func(actual []byte) {
+			assert.Equal(t, "REPLAYED_B", string(actual))
+		})
+	})
+
+	t.Run("replayドライバーのrecordモードの場合、実際のドライバーの回答が記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: replay
+    model: claude-3-5-sonnet-20240620
+    replay:
+        dir: testdata/replay
+        mode: record
+        driver: anthropic
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		generated := "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->"
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           generated,
+					TerminationReason: "end_turn",
+				}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("testdata/replay/prompt_01.md", func(actual []byte) {
+			assert.Contains(t, string(actual), "## aaa.txt")
+		})
+		space.AssertFile("testdata/replay/answer_01.md", func(actual []byte) {
+			assert.Equal(t, generated, string(actual))
+		})
+	})
+
+	t.Run("システムプロンプトがLLMに送信され、履歴に保存されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+system-prompt:
+    file: docs/rules.md
+    commands:
+        q:
+            text: QUESTION_RULES
+`))
+		space.WriteFile("docs/rules.md", []byte("HOUSE_RULES\n"))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, "HOUSE_RULES", options.System)
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid/system.md", func(actual []byte) {
+			assert.Equal(t, "HOUSE_RULES", string(actual))
+		})
+	})
+
+	t.Run("コンテキストウィンドウが小さいモデルで出力トークン数を指定しない場合、ウィンドウの一部を出力用に確保して知識を削ること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: open-ai
+    model: gpt-4
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("aaa.txt.know.yml", []byte(`
+knowledge:
+  - path: README.md
+    kind: specifications
+`))
+		// gpt-4のコンテキストウィンドウ（8192トークン）に収まらない知識
+		space.WriteFile("README.md", []byte(strings.Repeat("README_CONTENT ", 4000)))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					prompt := messages[len(messages)-1].Content
+					assert.Contains(t, prompt, "## aaa.txt")
+					// 出力用の2048トークンを残してウィンドウに収まること
+					assert.LessOrEqual(t, tokens.Estimate(prompt), 8192-2048)
+					return openAi.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "stop",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("出力用のトークン数でコンテキストウィンドウを使い切る場合は、LLMに送信せずにエラーを返すこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    context-window: 8192
+    max-tokens: 8192
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+
+		// Assert
+		assert.ErrorContains(t, err, "no room is left for the prompt in the context window of claude-3-5-sonnet-20240620 (8192 tokens)")
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("make用のLLMの設定と生成パラメータが使われ、オプションのモデルで上書きできること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-haiku-20240307
+    temperature: 0.2
+    commands:
+        make:
+            model: claude-3-5-sonnet-20240620
+            max-tokens: 4096
+            stop: ["END"]
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		generated := claude.GenerationResult{
+			Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+			TerminationReason: "end_turn",
+		}
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "claude-3-5-sonnet-20240620", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, 4096, options.MaxTokens)
+					assert.Equal(t, 0.2, *options.Temperature)
+					assert.Nil(t, options.TopP)
+					assert.Equal(t, []string{"END"}, options.Stop)
+					return generated, nil
+				})
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "claude-3-opus-20240229", gomock.Any()).
+				Return(generated, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-1")
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-2")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+		err = testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Model: "claude-3-opus-20240229"})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid-2/usage.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "model: claude-3-opus-20240229")
+		})
+	})
+
+	t.Run("上書きでドライバーが変わる場合、元のドライバー向けのモデル・接続先・APIキーが引き継がれないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+		t.Setenv("XDG_CONFIG_HOME", filepath.Join(space.Dir, "user-config"))
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: open-ai-compatible
+    model: llama3
+    base-url: http://localhost:11434/v1
+    api-key-env: LOCAL_LLM_API_KEY
+    headers:
+        X-Team: sisho
+    commands:
+        make:
+            driver: open-ai
+            model: gpt-4o
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4o", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					assert.Equal(t, credential.Source{Env: "OPENAI_API_KEY"}, options.Credential.Source())
+					return openAi.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "stop",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+	})
+
+	t.Run("オプションでモデルを指定せずにドライバーを変える場合はエラーになること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Driver: "open-ai"})
+
+		// Assert
+		assert.ErrorContains(t, err, "--model is required because --driver changes the driver from anthropic to open-ai")
+	})
+
+	t.Run("open-ai-compatibleドライバーの場合、設定したエンドポイントのクライアントが使われること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: open-ai-compatible
+    model: llama3
+    base-url: http://localhost:11434/v1
+    api-key-env: LOCAL_LLM_API_KEY
+    headers:
+        X-Team: sisho
+`))
+		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `aaa/bbb/ccc/ddd.txt
+UPDATED_CONTENT
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.OpenAiCompatibleClientFactory.EXPECT().NewCompatibleClient(openAi.CompatibleSetting{
+				BaseURL: "http://localhost:11434/v1",
+				Headers: map[string]string{"X-Team": "sisho"},
+			}).Return(mocks.OpenAiClient, nil)
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "llama3", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					assert.Equal(t, credential.Source{Env: "LOCAL_LLM_API_KEY"}, options.Credential.Source())
+					return openAi.GenerationResult{
+						Content:           generated,
+						TerminationReason: "stop",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("llmにAPIキーの取得元が無い場合、ユーザーコンフィグのcredentialsのコマンドの出力がAPIキーとして使われること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+		t.Setenv("XDG_CONFIG_HOME", filepath.Join(space.Dir, "user-config"))
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("user-config/sisho/config.yml", []byte(`
+credentials:
+    anthropic:
+        api-key-command: echo USER_API_KEY
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					apiKey, err := options.Credential.APIKey(ctx)
+					assert.NoError(t, err)
+					assert.Equal(t, "USER_API_KEY", apiKey)
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+	})
+
+	t.Run("APIキーの取得元の指定が無い場合、ドライバーの既定の環境変数が使われること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+		t.Setenv("XDG_CONFIG_HOME", filepath.Join(space.Dir, "user-config"))
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: open-ai
+    model: gpt-4o
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []openAi.Message, model string, options openAi.SendOptions) (openAi.GenerationResult, error) {
+					assert.Equal(t, credential.Source{Env: "OPENAI_API_KEY"}, options.Credential.Source())
+					return openAi.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "stop",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+	})
+
+	t.Run("llmにAPIキーの取得元が複数指定されている場合はエラーになること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    api-key-env: MY_KEY
+    api-key-file: ~/.anthropic-key
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid").AnyTimes()
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.ErrorContains(t, err, "only one of api-key-env, api-key-file and api-key-command can be specified")
+	})
+
+	t.Run("jオプションを指定した場合、依存しているターゲットの完了後に、独立したターゲットが並行して生成されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("base.go", []byte("BASE"))
+		space.WriteFile("a.go", []byte("A"))
+		space.WriteFile("b.go", []byte("B"))
+		space.WriteFile(".sisho/deps-graph.json", []byte(`
+{
+  "base.go": [ "a.go", "b.go" ]
+}
+`))
+
+		var mu sync.Mutex
+		var finished []string
+		// a.goとb.goが同時に送信中になるまで待つ（並行して生成されていなければタイムアウトする）
+		var independents sync.WaitGroup
+		independents.Add(2)
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(3).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					path := prompts.GeneratePath(messages[0].Content)
+					if path != "base.go" {
+						mu.Lock()
+						assert.Equal(t, []string{"base.go"}, finished)
+						mu.Unlock()
+						assert.Contains(t, messages[0].Content, "UPDATED_base.go")
+
+						independents.Done()
+						waited := make(chan struct{})
+						go func() {
+							independents.Wait()
+							close(waited)
+						}()
+						select {
+						case <-waited:
+						case <-time.After(5 * time.Second):
+							t.Error("targets were not generated in parallel")
+						}
+					}
+
+					mu.Lock()
+					finished = append(finished, path)
+					mu.Unlock()
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```" + path + "\nUPDATED_" + path + "\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+						Usage:             claude.Usage{InputTokens: 10, OutputTokens: 1},
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"a.go", "base.go", "b.go"}, makeService.Options{Apply: true, Jobs: 3})
+		assert.NoError(t, err)
+
+		// Assert
+		for _, path := range []string{"base.go", "a.go", "b.go"} {
+			space.AssertFile(path, func(actual []byte) {
+				assert.Equal(t, "UPDATED_"+path, string(actual))
+			})
+		}
+		space.AssertFile(".sisho/history/test-ksuid/prompt_01.md", func(actual []byte) {
+			assert.Equal(t, "a.go", prompts.GeneratePath(string(actual)))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/usage.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "input-tokens: 30")
+			assert.Contains(t, string(actual), "output-tokens: 3")
+		})
+	})
+
+	t.Run("jオプションを指定した場合でも、llm.max-concurrencyを超えて同時に送信されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    max-concurrency: 1
+`))
+		paths := []string{"a.go", "b.go", "c.go"}
+		for _, path := range paths {
+			space.WriteFile(path, []byte("CURRENT"))
+		}
+
+		var mu sync.Mutex
+		inFlight := 0
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(3).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					mu.Lock()
+					inFlight++
+					assert.Equal(t, 1, inFlight)
+					mu.Unlock()
+
+					time.Sleep(20 * time.Millisecond)
+
+					mu.Lock()
+					inFlight--
+					mu.Unlock()
+
+					path := prompts.GeneratePath(messages[0].Content)
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```" + path + "\nUPDATED\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), paths, makeService.Options{Apply: true, Jobs: 3})
+		assert.NoError(t, err)
+	})
+
+	t.Run("jオプションを指定した場合、失敗したターゲットに依存するターゲットは生成されずにエラーになること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("base.go", []byte("BASE"))
+		space.WriteFile("a.go", []byte("A"))
+		space.WriteFile(".sisho/deps-graph.json", []byte(`
+{
+  "base.go": [ "a.go" ]
+}
+`))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1).
+				Return(claude.GenerationResult{}, errors.New("invalid_request_error"))
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"base.go", "a.go"}, makeService.Options{Apply: true, Jobs: 2})
+		assert.ErrorContains(t, err, "failed to make base.go")
+		assert.ErrorContains(t, err, "invalid_request_error")
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "A", string(actual))
+		})
+	})
+
+	t.Run("togetherオプションを指定した場合、全てのターゲットが1回の問い合わせで生成されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("a.go", []byte("A"))
+		space.WriteFile("b.go", []byte("B"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `a.go
+UPDATED_A
+` + "```" + `<!-- CODE_BLOCK_END -->
+
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `b.go
+UPDATED_B
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Contains(t, messages[0].Content, "  * a.go\n")
+					assert.Contains(t, messages[0].Content, "  * b.go\n")
+					return claude.GenerationResult{
+						Content:           generated,
+						TerminationReason: "success",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"a.go", "b.go"}, makeService.Options{Apply: true, Together: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "UPDATED_A", string(actual))
+		})
+		space.AssertFile("b.go", func(actual []byte) {
+			assert.Equal(t, "UPDATED_B", string(actual))
+		})
+		space.AssertExistPath(".sisho/history/test-ksuid/prompt_01.md")
+		space.AssertExistPath(".sisho/history/test-ksuid/answer_01.md")
+	})
+
+	t.Run("togetherオプションを指定した場合、回答に含まれていないターゲットが報告され、含まれていたターゲットは反映されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("a.go", []byte("A"))
+		space.WriteFile("b.go", []byte("B"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `a.go
+UPDATED_A
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(1).
+				Return(claude.GenerationResult{
+					Content:           generated,
+					TerminationReason: "success",
+				}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"a.go", "b.go"}, makeService.Options{Apply: true, Together: true})
+		assert.ErrorContains(t, err, "the answer did not include 1 of 2 targets: b.go")
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "UPDATED_A", string(actual))
+		})
+		space.AssertFile("b.go", func(actual []byte) {
+			assert.Equal(t, "B", string(actual))
+		})
+	})
+
+	t.Run("edit.formatがsearch-replaceの場合、回答の変更箇所だけがファイルに反映されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+edit:
+    format: search-replace
+`))
+		space.WriteFile("a.go", []byte("line1\nline2\nline3\n"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `a.go
+<<<<<<< SEARCH
+line2
+=======
+LINE2
+>>>>>>> REPLACE
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Contains(t, messages[0].Content, "SEARCH/REPLACEブロック")
+					assert.NotContains(t, messages[0].Content, "コードブロックにはファイル全体を記載します。")
+					return claude.GenerationResult{
+						Content:           generated,
+						TerminationReason: "success",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"a.go"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "line1\nLINE2\nline3\n", string(actual))
+		})
+	})
+
+	t.Run("変更箇所の形式で、一致しない変更箇所がある場合はファイルに反映されずにエラーになること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("a.go", []byte("line1\nline2\n"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `a.go
+@@ -1,2 +1,2 @@
+ line1
+-line2
++LINE2
+@@ -5,1 +5,1 @@
+-unknown
++UNKNOWN
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           generated,
+					TerminationReason: "success",
+				}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"a.go"}, makeService.Options{Apply: true, EditFormat: "udiff"})
+		assert.ErrorContains(t, err, "hunk 2 of 2 did not match")
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "line1\nline2\n", string(actual))
+		})
+	})
+
+	t.Run("interactiveオプションを指定した場合、確認した変更箇所だけが反映され、判断が履歴に記録されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("a.go", []byte("1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `a.go
+ONE
+2
+3
+4
+5
+6
+7
+8
+9
+TEN
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(claude.GenerationResult{
+					Content:           generated,
+					TerminationReason: "success",
+				}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+			gomock.InOrder(
+				mocks.Terminal.EXPECT().ReadLine().Return("y", nil),
+				mocks.Terminal.EXPECT().ReadLine().Return("n", nil),
+			)
+		})
+		err := testee.Make(context.Background(), []string{"a.go"}, makeService.Options{Interactive: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("a.go", func(actual []byte) {
+			assert.Equal(t, "ONE\n2\n3\n4\n5\n6\n7\n8\n9\n10\n", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/review_01.log", func(actual []byte) {
+			assert.Equal(t, "a.go @@ -1,4 +1,4 @@ accepted\na.go @@ -7,4 +7,4 @@ rejected\n", string(actual))
+		})
+	})
+
+	t.Run("画像・PDFの知識は、プロンプトに埋め込まず添付ファイルとして送信されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("aaa.txt.know.yml", []byte(`
+knowledge:
+  - path: mockup.png
+    kind: specifications
+  - path: design.pdf
+    kind: specifications
+`))
+		png := []byte("\x89PNG\r\n\x1a\nPNG_CONTENT")
+		pdf := []byte("%PDF-1.4\nPDF_CONTENT")
+		space.WriteFile("mockup.png", png)
+		space.WriteFile("design.pdf", pdf)
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					message := messages[0]
+					assert.Contains(t, message.Content, "```mockup.png\n（image/pngのファイルを添付しています）\n```")
+					assert.Contains(t, message.Content, "```design.pdf\n（application/pdfのファイルを添付しています）\n```")
+					assert.NotContains(t, message.Content, "PNG_CONTENT")
+					assert.NotContains(t, message.Content, "PDF_CONTENT")
+					assert.Equal(t, []claude.ContentBlock{
+						{Text: "design.pdf"},
+						{Attachment: &claude.Attachment{MediaType: "application/pdf", Data: pdf}},
+						{Text: "mockup.png"},
+						{Attachment: &claude.Attachment{MediaType: "image/png", Data: png}},
+						{Text: message.Content},
+					}, message.Blocks)
+					return claude.GenerationResult{
+						Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->",
+						TerminationReason: "end_turn",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("添付ファイルを受け付けないドライバーの場合、LLMに送信せずにエラーになること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: open-ai-compatible
+    model: llava
+    base-url: http://localhost:11434/v1
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("aaa.txt.know.yml", []byte(`
+knowledge:
+  - path: design.pdf
+    kind: specifications
+`))
+		space.WriteFile("design.pdf", []byte("%PDF-1.4\nPDF_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.OpenAiCompatibleClientFactory.EXPECT().NewCompatibleClient(gomock.Any()).Return(mocks.OpenAiClient, nil)
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Times(0)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+		if assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "design.pdf (application/pdf) cannot be sent: the driver only accepts image/png, image/jpeg, image/gif, image/webp")
+		}
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("llmがリストで指定された場合、失敗したプロバイダーから次のプロバイダーに切り替わり、回答したプロバイダーが履歴に保存されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    - driver: anthropic
+      model: claude-3-5-sonnet-20240620
+    - driver: open-ai
+      model: gpt-4o
+`))
+		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `aaa/bbb/ccc/ddd.txt
+UPDATED_CONTENT
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "claude-3-5-sonnet-20240620", gomock.Any()).
+				Return(claude.GenerationResult{}, errors.New("API request failed with status code: 400"))
+			mocks.OpenAiClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), "gpt-4o", gomock.Any()).Return(openAi.GenerationResult{
+				Content:           generated,
+				TerminationReason: "stop",
+				Usage:             openAi.Usage{InputTokens: 100, OutputTokens: 20},
+			}, nil)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid/provider_01.log", func(actual []byte) {
+			expected := `2022-01-01T00:00:00Z Fallback: anthropic/claude-3-5-sonnet-20240620 failed, falling back to open-ai/gpt-4o: API request failed with status code: 400
+2022-01-01T00:00:00Z Answered by: open-ai/gpt-4o
+`
+			assert.Equal(t, expected, string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/usage.yml", func(actual []byte) {
+			assert.Contains(t, string(actual), "driver: open-ai\nmodel: gpt-4o\n")
+		})
+		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+	})
+
+	t.Run("中断された場合、ファイルに反映されず中断した記録が履歴に保存されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`))
+		space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+		space.WriteFile("bbb.txt", []byte("CURRENT_CONTENT"))
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					// 受信中にCtrl-Cが押されたことを再現する
+					cancel()
+					return claude.GenerationResult{}, ctx.Err()
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(ctx, []string{"aaa.txt", "bbb.txt"}, makeService.Options{Apply: true})
+		assert.ErrorIs(t, err, context.Canceled)
+
+		// Assert
+		space.AssertFile("aaa.txt", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+		space.AssertFile("bbb.txt", func(actual []byte) {
+			assert.Equal(t, "CURRENT_CONTENT", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/aborted.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z Aborted while processing aaa.txt: context canceled\n", string(actual))
+		})
+		assert.NoFileExists(t, filepath.Join(space.Dir, ".sisho/history/test-ksuid/answer_01.md"))
+	})
+
+	t.Run("再試行の設定がLLMに渡され、再試行が履歴に保存されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    retry:
+        max-attempts: 6
+        max-wait: 30s
+`))
+		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
+
+		generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `aaa/bbb/ccc/ddd.txt
+UPDATED_CONTENT
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+					assert.Equal(t, 6, options.Retry.MaxAttempts)
+					assert.Equal(t, 30*time.Second, options.Retry.MaxWait)
+					options.OnRetry(retry.Event{
+						Attempt:     1,
+						MaxAttempts: 6,
+						Wait:        2 * time.Second,
+						Err:         errors.New("API request failed with status code: 529"),
+					})
+					return claude.GenerationResult{
+						Content:           generated,
+						TerminationReason: "success",
+					}, nil
+				})
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile(".sisho/history/test-ksuid/retry_01.log", func(actual []byte) {
+			assert.Equal(t, "2022-01-01T00:00:00Z attempt 1/6 failed, retrying in 2s: API request failed with status code: 529\n", string(actual))
+		})
+		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
 	})
 
-	t.Run("dryRunフラグがtrueの場合LLMによるファイル生成が行われないこと", func(t *testing.T) {
+	t.Run("出力トークン数の上限で生成が途切れた場合、続きの生成が依頼され回答が連結されること", func(t *testing.T) {
 		mockCtrl := gomock.NewController(t)
 		defer mockCtrl.Finish()
 
@@ -142,17 +1702,71 @@ dummy text
 llm:
     driver: anthropic
     model: claude-3-5-sonnet-20240620
+    max-continuations: 2
 `))
 		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
 
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			gomock.InOrder(
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
+					Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb/ccc/ddd.txt\nUPDATED",
+					TerminationReason: "max_tokens",
+				}, nil),
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						assert.Len(t, messages, 3)
+						assert.Equal(t, "assistant", messages[1].Role)
+						assert.Contains(t, messages[2].Content, "続きを")
+						return claude.GenerationResult{
+							Content:           "_CONTENT\n```<!-- CODE_BLOCK_END -->",
+							TerminationReason: "end_turn",
+						}, nil
+					}),
+			)
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", true)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 
+		// Assert
+		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
+			assert.Equal(t, "UPDATED_CONTENT", string(actual))
+		})
+		space.AssertFile(".sisho/history/test-ksuid/answer_01.md", func(actual []byte) {
+			assert.Equal(t, "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb/ccc/ddd.txt\nUPDATED_CONTENT\n```<!-- CODE_BLOCK_END -->", string(actual))
+		})
+	})
+
+	t.Run("継続回数の上限に達した場合、それ以上続きの生成が依頼されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		// Setup Files
+		space.WriteFile("sisho.yml", []byte(`
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+    max-continuations: 1
+`))
+		space.WriteFile("aaa/bbb/ccc/ddd.txt", []byte("CURRENT_CONTENT"))
+
+		testee := factory(mockCtrl, func(mocks Mocks) {
+			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(claude.GenerationResult{
+				Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa/bbb/ccc/ddd.txt\nUPDATED",
+				TerminationReason: "max_tokens",
+			}, nil).Times(2)
+			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+		})
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
+		assert.Error(t, err)
+
 		// Assert
 		space.AssertFile("aaa/bbb/ccc/ddd.txt", func(actual []byte) {
 			assert.Equal(t, "CURRENT_CONTENT", string(actual))
@@ -188,14 +1802,14 @@ UPDATED_CONTENT
 `
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).Return(
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(
 				claude.GenerationResult{
 					Content:           fmt.Sprintf(generatedTmpl, "aaa/bbb/ccc/ddd.txt"),
 					TerminationReason: "success",
 				},
 				nil,
 			)
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).Return(
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).Return(
 				claude.GenerationResult{
 					Content:           fmt.Sprintf(generatedTmpl, "aaa/bbb/ccc/eee.txt"),
 					TerminationReason: "success",
@@ -205,7 +1819,7 @@ UPDATED_CONTENT
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt", "aaa/bbb/ccc/eee.txt"}, true, false, "", false)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt", "aaa/bbb/ccc/eee.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 
 		space.AssertExistPath(filepath.Join(".sisho", "history", "test-ksuid", "2022-01-01T00-00-00"))
@@ -252,8 +1866,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						// Check if knowledge from .knowledge.yml is included
@@ -269,7 +1883,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -302,8 +1916,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						// Check if knowledge from .knowledge.yml is included
@@ -317,7 +1931,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -350,8 +1964,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						// Check if knowledge from .knowledge.yml is included
@@ -365,7 +1979,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -403,8 +2017,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, "aaa/bbb/.knowledge.yml")
 						assert.NotContains(t, content, "knowledge-list")
@@ -420,7 +2034,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 	})
@@ -455,8 +2069,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						assert.Contains(t, content, "aaa/bbb/SPEC.md")
@@ -469,7 +2083,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -502,8 +2116,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						assert.Contains(t, content, "aaa/bbb/SPEC.md")
@@ -516,7 +2130,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -549,8 +2163,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						assert.Contains(t, content, "aaa/bbb/SPEC.md")
@@ -563,7 +2177,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -601,8 +2215,8 @@ UPDATED_CONTENT
 `
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, "aaa/bbb/.knowledge.yml")
 						assert.NotContains(t, content, "knowledge-list")
@@ -617,7 +2231,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 	})
@@ -662,8 +2276,8 @@ UPDATED_CONTENT
 `
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					content := messages[0].Content
 					assert.NotContains(t, content, space.Dir)
 					assert.Equal(t, 1, strings.Count(content, "aaa/bbb/ccc/ddd.txt.md"), "aaa/bbb/ccc/ddd.txt.md should be included only once")
@@ -676,7 +2290,7 @@ UPDATED_CONTENT
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 	})
 
@@ -709,8 +2323,8 @@ UPDATED_CONTENT
 `
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					content := messages[0].Content
 					assert.NotContains(t, content, space.Dir)
 					assert.Contains(t, content, "aaa/bbb/ccc/ddd.txt.md")
@@ -723,7 +2337,7 @@ UPDATED_CONTENT
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 	})
 
@@ -756,8 +2370,8 @@ UPDATED_CONTENT
 `
 		testee := factory(mockCtrl, func(mocks Mocks) {
 			mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-				DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+			mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 					content := messages[0].Content
 					assert.NotContains(t, content, space.Dir)
 					assert.NotContains(t, content, "aaa/bbb/ddd.txt.md")
@@ -770,10 +2384,375 @@ UPDATED_CONTENT
 			mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 		})
-		err := testee.Make([]string{"aaa/bbb/ccc/ddd.txt"}, true, false, "", false)
+		err := testee.Make(context.Background(), []string{"aaa/bbb/ccc/ddd.txt"}, makeService.Options{Apply: true})
 		assert.NoError(t, err)
 	})
 
+	t.Run("git連携について", func(t *testing.T) {
+		sishoYml := `
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+git:
+    enabled: true
+    auto-branch: true
+    auto-commit: true
+`
+
+		t.Run("Target Codeにコミットされていない変更がある場合はエラーを返すこと", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+			runGit(t, space.Dir, "init", "-q", "-b", "main")
+			runGit(t, space.Dir, "config", "user.name", "test")
+			runGit(t, space.Dir, "config", "user.email", "test@example.com")
+			runGit(t, space.Dir, "add", "-A")
+			runGit(t, space.Dir, "commit", "-q", "-m", "initial")
+			space.WriteFile("aaa.txt", []byte("EDITED_BY_USER"))
+
+			testee := factory(mockCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+
+			// Assert
+			assert.ErrorContains(t, err, "the targets have uncommitted changes: aaa.txt")
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "EDITED_BY_USER", string(actual))
+			})
+		})
+
+		t.Run("ブランチを作成し、反映したファイルがコミットされること", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+			space.WriteFile("bbb.txt", []byte("UNRELATED_CONTENT"))
+			runGit(t, space.Dir, "init", "-q", "-b", "main")
+			runGit(t, space.Dir, "config", "user.name", "test")
+			runGit(t, space.Dir, "config", "user.email", "test@example.com")
+			runGit(t, space.Dir, "add", "-A")
+			runGit(t, space.Dir, "commit", "-q", "-m", "initial")
+			space.WriteFile("bbb.txt", []byte("EDITED_BY_USER"))
+
+			generated := `
+<!-- CODE_BLOCK_BEGIN -->` + "```" + `aaa.txt
+UPDATED_CONTENT
+` + "```" + `<!-- CODE_BLOCK_END -->
+`
+
+			testee := factory(mockCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					Return(claude.GenerationResult{
+						Content:           generated,
+						TerminationReason: "success",
+					}, nil)
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Instructions: "Use upper case"})
+			assert.NoError(t, err)
+
+			// Assert
+			assert.Equal(t, "sisho/test-ksuid\n", runGit(t, space.Dir, "branch", "--show-current"))
+			assert.Equal(t, "aaa.txt\n", runGit(t, space.Dir, "show", "--name-only", "--format=", "HEAD"))
+			message := runGit(t, space.Dir, "log", "-1", "--format=%B")
+			assert.Contains(t, message, "- aaa.txt")
+			assert.Contains(t, message, "History: test-ksuid")
+			assert.Contains(t, message, "Use upper case")
+			// 生成ターゲット以外の変更はコミットされないこと
+			assert.Equal(t, " M bbb.txt\n", runGit(t, space.Dir, "status", "--porcelain", "--untracked-files=no"))
+		})
+	})
+
+	t.Run("verifyオプションについて", func(t *testing.T) {
+		sishoYml := `
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+tasks:
+    - name: check
+      run: grep -q FIXED aaa.txt || (echo "aaa.txt is not fixed" >&2; exit 1)
+`
+		answer := func(content string) claude.GenerationResult {
+			return claude.GenerationResult{
+				Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\n" + content + "\n```<!-- CODE_BLOCK_END -->",
+				TerminationReason: "success",
+			}
+		}
+
+		t.Run("検証が失敗した場合は同じ会話でエラーを渡して修正を依頼し、反映した後に再び検証すること", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+			testee := factory(mockCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				gomock.InOrder(
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						Return(answer("UPDATED_CONTENT"), nil),
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+							// 生成した会話の続きとして、タスクのエラーと現在の内容が渡されること
+							assert.Len(t, messages, 3)
+							assert.Contains(t, messages[1].Content, "UPDATED_CONTENT")
+							assert.Contains(t, messages[2].Content, "aaa.txt is not fixed")
+							assert.Contains(t, messages[2].Content, "```aaa.txt\nUPDATED_CONTENT\n```")
+							return answer("FIXED_CONTENT"), nil
+						}),
+				)
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"check"}})
+			assert.NoError(t, err)
+
+			// Assert
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "FIXED_CONTENT", string(actual))
+			})
+			space.AssertFile(".sisho/history/test-ksuid/verify_01.log", func(actual []byte) {
+				assert.Contains(t, string(actual), "## check\n\nfailed")
+			})
+			space.AssertFile(".sisho/history/test-ksuid/verify_02.log", func(actual []byte) {
+				assert.Equal(t, "## check\n\npassed\n\n", string(actual))
+			})
+			space.AssertExistPath(".sisho/history/test-ksuid/verify_prompt_01_01.md")
+			space.AssertExistPath(".sisho/history/test-ksuid/verify_answer_01_01.md")
+		})
+
+		t.Run("修正を依頼する回数の上限に達しても検証が成功しない場合は、書き換えたファイルを元に戻すこと", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+			testee := factory(mockCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				gomock.InOrder(
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						Return(answer("UPDATED_CONTENT"), nil),
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						Return(answer("STILL_BROKEN_CONTENT"), nil),
+				)
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"check"}, VerifyRounds: 1})
+
+			// Assert
+			assert.ErrorContains(t, err, "verification did not pass after 1 round(s) of fixes: check")
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "CURRENT_CONTENT", string(actual))
+			})
+		})
+
+		t.Run("replayドライバーの場合、recordモードで記録した修正依頼を含む会話を再生できること", func(t *testing.T) {
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			replayYml := func(mode string) []byte {
+				return []byte(`
+llm:
+    driver: replay
+    model: claude-3-5-sonnet-20240620
+    replay:
+        dir: testdata/replay
+        mode: ` + mode + `
+        driver: anthropic
+tasks:
+    - name: check
+      run: grep -q FIXED aaa.txt || (echo "aaa.txt is not fixed" >&2; exit 1)
+`)
+			}
+
+			// 記録する
+			space.WriteFile("sisho.yml", replayYml("record"))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+			recordCtrl := gomock.NewController(t)
+			defer recordCtrl.Finish()
+			testee := factory(recordCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				gomock.InOrder(
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						Return(answer("UPDATED_CONTENT"), nil),
+					mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+						DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+							// 記録に使うドライバーにも会話の履歴が渡されること
+							assert.Len(t, messages, 3)
+							assert.Contains(t, messages[2].Content, "aaa.txt is not fixed")
+							return answer("FIXED_CONTENT"), nil
+						}),
+				)
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-1")
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"check"}})
+			assert.NoError(t, err)
+			space.AssertExistPath("testdata/replay/prompt_02.md")
+			space.AssertExistPath("testdata/replay/answer_02.md")
+
+			// 再生する（LLMには送信しない）
+			space.WriteFile("sisho.yml", replayYml("replay"))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+			replayCtrl := gomock.NewController(t)
+			defer replayCtrl.Finish()
+			testee = factory(replayCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid-2")
+			})
+			err = testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"check"}})
+			assert.NoError(t, err)
+
+			// Assert
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "FIXED_CONTENT", string(actual))
+			})
+			space.AssertExistPath(".sisho/history/test-ksuid-2/verify_answer_01_01.md")
+		})
+
+		t.Run("tasksに存在しないタスクを指定した場合は生成の前にエラーを返すこと", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("CURRENT_CONTENT"))
+
+			testee := factory(mockCtrl, func(mocks Mocks) {
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, Verify: []string{"lint"}})
+
+			// Assert
+			assert.ErrorContains(t, err, "task not found: lint")
+		})
+	})
+
+	t.Run("生成中にTarget Codeが変更された場合について", func(t *testing.T) {
+		sishoYml := `
+llm:
+    driver: anthropic
+    model: claude-3-5-sonnet-20240620
+`
+		// 利用者がbをBに、LLMがfをFに変更する
+		factoryEditing := func(mockCtrl *gomock.Controller, space testUtil.Space, customizeMocks func(mocks Mocks)) *makeService.MakeService {
+			return factory(mockCtrl, func(mocks Mocks) {
+				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+						// 回答を待つ間にエディタで変更する
+						space.WriteFile("aaa.txt", []byte("a\nB\nc\nd\ne\nf\ng"))
+						return claude.GenerationResult{
+							Content:           "<!-- CODE_BLOCK_BEGIN -->```aaa.txt\na\nb\nc\nd\ne\nF\ng\n```<!-- CODE_BLOCK_END -->",
+							TerminationReason: "success",
+						}, nil
+					})
+				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
+				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
+				customizeMocks(mocks)
+			})
+		}
+
+		t.Run("確認でmergeを選んだ場合は、変更と生成結果が3-way mergeされて反映されること", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("a\nb\nc\nd\ne\nf\ng"))
+
+			testee := factoryEditing(mockCtrl, space, func(mocks Mocks) {
+				mocks.Terminal.EXPECT().ReadLine().Return("m", nil)
+			})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true})
+			assert.NoError(t, err)
+
+			// Assert
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "a\nB\nc\nd\ne\nF\ng", string(actual))
+			})
+		})
+
+		t.Run("on-conflictにnewを指定した場合は、ファイルを書き換えずに生成結果を.sisho-newに保存すること", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("a\nb\nc\nd\ne\nf\ng"))
+
+			testee := factoryEditing(mockCtrl, space, func(mocks Mocks) {})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, OnConflict: "new"})
+			assert.NoError(t, err)
+
+			// Assert
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "a\nB\nc\nd\ne\nf\ng", string(actual))
+			})
+			space.AssertFile("aaa.txt.sisho-new", func(actual []byte) {
+				assert.Equal(t, "a\nb\nc\nd\ne\nF\ng", string(actual))
+			})
+		})
+
+		t.Run("on-conflictにabortを指定した場合は、ファイルを書き換えずにエラーを返すこと", func(t *testing.T) {
+			mockCtrl := gomock.NewController(t)
+			defer mockCtrl.Finish()
+
+			space := testUtil.BeginTestSpace(t)
+			defer space.CleanUp()
+
+			// Setup Files
+			space.WriteFile("sisho.yml", []byte(sishoYml))
+			space.WriteFile("aaa.txt", []byte("a\nb\nc\nd\ne\nf\ng"))
+
+			testee := factoryEditing(mockCtrl, space, func(mocks Mocks) {})
+			err := testee.Make(context.Background(), []string{"aaa.txt"}, makeService.Options{Apply: true, OnConflict: "abort"})
+
+			// Assert
+			assert.ErrorContains(t, err, "aaa.txt was changed on disk during generation; it was not overwritten")
+			space.AssertFile("aaa.txt", func(actual []byte) {
+				assert.Equal(t, "a\nB\nc\nd\ne\nf\ng", string(actual))
+			})
+		})
+	})
+
 	t.Run("連鎖的生成について", func(t *testing.T) {
 		t.Run("連鎖的生成が正常に動作すること", func(t *testing.T) {
 			mockCtrl := gomock.NewController(t)
@@ -812,8 +2791,8 @@ UPDATED_CONTENT%d
 
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						assert.NotContains(t, messages[0].Content, space.Dir)
 						//assert.Contains(t, messages[0].Content, "FILE3_CONTENT")
 						return claude.GenerationResult{
@@ -821,8 +2800,8 @@ UPDATED_CONTENT%d
 							TerminationReason: "success",
 						}, nil
 					})
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						assert.NotContains(t, messages[0].Content, space.Dir)
 						//assert.Contains(t, messages[0].Content, "FILE2_CONTENT")
 						return claude.GenerationResult{
@@ -830,8 +2809,8 @@ UPDATED_CONTENT%d
 							TerminationReason: "success",
 						}, nil
 					})
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						assert.NotContains(t, messages[0].Content, space.Dir)
 						//assert.Contains(t, messages[0].Content, "FILE1_CONTENT")
 						return claude.GenerationResult{
@@ -842,7 +2821,7 @@ UPDATED_CONTENT%d
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"file3.go"}, true, true, "", false)
+			err := testee.Make(context.Background(), []string{"file3.go"}, makeService.Options{Apply: true, Chain: true})
 			assert.NoError(t, err)
 
 			// Assert
@@ -881,7 +2860,7 @@ additional-knowledge:
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 			})
-			err := testee.Make([]string{"file1..go"}, false, true, "", false)
+			err := testee.Make(context.Background(), []string{"file1..go"}, makeService.Options{Chain: true})
 
 			assert.Error(t, err)
 			assert.Contains(t, err.Error(), "failed to read deps-graph.json")
@@ -923,8 +2902,8 @@ UPDATED_CONTENT%d
 
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						assert.NotContains(t, messages[0].Content, space.Dir)
 						return claude.GenerationResult{
 							Content:           fmt.Sprintf(generatedFormat, "file3.go", 1),
@@ -934,7 +2913,7 @@ UPDATED_CONTENT%d
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"file3.go"}, true, true, "", false)
+			err := testee.Make(context.Background(), []string{"file3.go"}, makeService.Options{Apply: true, Chain: true})
 			assert.NoError(t, err)
 
 			// Assert
@@ -976,8 +2955,8 @@ UPDATED_CONTENT
 
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						assert.Contains(t, content, "# Folder Structure")
@@ -994,7 +2973,7 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"file1.go"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"file1.go"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 
@@ -1031,8 +3010,8 @@ UPDATED_CONTENT
 
 			testee := factory(mockCtrl, func(mocks Mocks) {
 				mocks.Timer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
-				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any()).
-					DoAndReturn(func(messages []claude.Message, model string) (claude.GenerationResult, error) {
+				mocks.ClaudeClient.EXPECT().SendMessage(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+					DoAndReturn(func(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
 						content := messages[0].Content
 						assert.NotContains(t, content, space.Dir)
 						assert.Contains(t, content, "# Folder Structure")
@@ -1050,8 +3029,17 @@ UPDATED_CONTENT
 				mocks.FileRepository.EXPECT().Getwd().Return(space.Dir, nil).AnyTimes()
 				mocks.KsuidGenerator.EXPECT().New().Return("test-ksuid")
 			})
-			err := testee.Make([]string{"file1.go"}, true, false, "", false)
+			err := testee.Make(context.Background(), []string{"file1.go"}, makeService.Options{Apply: true})
 			assert.NoError(t, err)
 		})
 	})
 }
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	return string(out)
+}
@@ -0,0 +1,205 @@
+package replayFixture
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat/replay"
+	"github.com/t-kuni/sisho/domain/model/prompts"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// promptFileRegex は記録済みのプロンプトのファイル名にマッチします。
+// makeやfix:taskの履歴（prompt_NN.md）とq, extractの履歴（prompt.md）の両方に対応します。
+var promptFileRegex = regexp.MustCompile(`^prompt(_(\d+))?\.md$`)
+
+type ReplayFixtureService struct {
+	mu       sync.Mutex
+	fixtures map[string]*fileFixtures
+}
+
+func NewReplayFixtureService() *ReplayFixtureService {
+	return &ReplayFixtureService{
+		fixtures: map[string]*fileFixtures{},
+	}
+}
+
+// Open はdir配下に記録されたプロンプトと回答の組を読み込み、replay.Fixturesとして返します。
+// 同じdirに対しては同じFixturesを返すため、どの組を使用済みかは1回の実行の中で共有されます。
+func (s *ReplayFixtureService) Open(dir string) (replay.Fixtures, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if f, ok := s.fixtures[dir]; ok {
+		return f, nil
+	}
+
+	f, err := load(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.fixtures[dir] = f
+
+	return f, nil
+}
+
+type pair struct {
+	dir        string
+	number     int
+	answerPath string
+	hash       string
+	target     string
+	used       bool
+}
+
+type fileFixtures struct {
+	mu    sync.Mutex
+	dir   string
+	pairs []*pair
+}
+
+func load(dir string) (*fileFixtures, error) {
+	f := &fileFixtures{dir: dir}
+
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		matched := promptFileRegex.FindStringSubmatch(d.Name())
+		if matched == nil {
+			return nil
+		}
+
+		answerPath := filepath.Join(filepath.Dir(path), "answer"+matched[1]+".md")
+		if _, err := os.Stat(answerPath); err != nil {
+			// 回答が無いプロンプト（生成の途中で終了した履歴など）は使わない
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return eris.Wrapf(err, "failed to read prompt: %s", path)
+		}
+
+		number, _ := strconv.Atoi(matched[2])
+		f.pairs = append(f.pairs, &pair{
+			dir:        filepath.Dir(path),
+			number:     number,
+			answerPath: answerPath,
+			hash:       hash(string(content)),
+			target:     prompts.GeneratePath(string(content)),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, eris.Wrapf(err, "failed to load replay fixtures: %s", dir)
+	}
+
+	// 記録した順に使われるように、フォルダ、連番の順に並べる
+	sort.SliceStable(f.pairs, func(i, j int) bool {
+		if f.pairs[i].dir != f.pairs[j].dir {
+			return f.pairs[i].dir < f.pairs[j].dir
+		}
+		return f.pairs[i].number < f.pairs[j].number
+	})
+
+	return f, nil
+}
+
+// Find はpromptに対応する回答を返します。
+// プロンプトのハッシュが一致する組を優先し、無ければ生成対象のパスが一致する組を使います。
+// 一致する組が複数ある場合は、まだ使っていない組を記録した順に使います。
+func (f *fileFixtures) Find(prompt string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	h := hash(prompt)
+	p := f.next(func(p *pair) bool { return p.hash == h })
+
+	target := prompts.GeneratePath(prompt)
+	if p == nil && target != "" {
+		p = f.next(func(p *pair) bool { return p.target == target })
+	}
+
+	if p == nil {
+		return "", eris.Errorf("no recorded answer found in %s (prompt hash: %s, target: %s)", f.dir, h, target)
+	}
+
+	answer, err := os.ReadFile(p.answerPath)
+	if err != nil {
+		return "", eris.Wrapf(err, "failed to read answer: %s", p.answerPath)
+	}
+	p.used = true
+
+	return string(answer), nil
+}
+
+func (f *fileFixtures) next(match func(p *pair) bool) *pair {
+	for _, p := range f.pairs {
+		if !p.used && match(p) {
+			return p
+		}
+	}
+	return nil
+}
+
+// Record はpromptと回答の組をdir直下にprompt_NN.md, answer_NN.mdとして保存します。
+func (f *fileFixtures) Record(prompt string, answer string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	err := os.MkdirAll(f.dir, 0755)
+	if err != nil {
+		return eris.Wrapf(err, "failed to create replay directory: %s", f.dir)
+	}
+
+	number := 1
+	for _, p := range f.pairs {
+		if p.dir == f.dir && p.number >= number {
+			number = p.number + 1
+		}
+	}
+
+	promptPath := filepath.Join(f.dir, fmt.Sprintf("prompt_%02d.md", number))
+	answerPath := filepath.Join(f.dir, fmt.Sprintf("answer_%02d.md", number))
+
+	err = os.WriteFile(promptPath, []byte(prompt), 0644)
+	if err != nil {
+		return eris.Wrapf(err, "failed to write prompt: %s", promptPath)
+	}
+	err = os.WriteFile(answerPath, []byte(answer), 0644)
+	if err != nil {
+		return eris.Wrapf(err, "failed to write answer: %s", answerPath)
+	}
+
+	// 記録した組は同じ実行の中では使わない
+	f.pairs = append(f.pairs, &pair{
+		dir:        f.dir,
+		number:     number,
+		answerPath: answerPath,
+		hash:       hash(prompt),
+		target:     prompts.GeneratePath(prompt),
+		used:       true,
+	})
+
+	return nil
+}
+
+func hash(prompt string) string {
+	sum := sha256.Sum256([]byte(prompt))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,97 @@
+package replayFixture_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/replayFixture"
+	"github.com/t-kuni/sisho/testUtil"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplayFixtureService(t *testing.T) {
+	t.Run("プロンプトが一致する回答が返ること", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		space.WriteFile("fixtures/aaa/prompt.md", []byte("PROMPT_A"))
+		space.WriteFile("fixtures/aaa/answer.md", []byte("ANSWER_A"))
+		space.WriteFile("fixtures/bbb/prompt_01.md", []byte("PROMPT_B"))
+		space.WriteFile("fixtures/bbb/answer_01.md", []byte("ANSWER_B"))
+
+		fixtures, err := replayFixture.NewReplayFixtureService().Open(filepath.Join(space.Dir, "fixtures"))
+		assert.NoError(t, err)
+
+		answer, err := fixtures.Find("PROMPT_B")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_B", answer)
+
+		answer, err = fixtures.Find("PROMPT_A")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_A", answer)
+
+		_, err = fixtures.Find("PROMPT_C")
+		assert.Error(t, err)
+	})
+
+	t.Run("プロンプトが一致しない場合、生成対象のパスが一致する回答が記録した順に返ること", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		space.WriteFile("fixtures/01/prompt_01.md", []byte("OLD CONTENT\n\n## aaa.txt\n\n"))
+		space.WriteFile("fixtures/01/answer_01.md", []byte("ANSWER_1"))
+		space.WriteFile("fixtures/01/prompt_02.md", []byte("OLD CONTENT\n\n## bbb.txt\n\n"))
+		space.WriteFile("fixtures/01/answer_02.md", []byte("ANSWER_2"))
+		space.WriteFile("fixtures/02/prompt_01.md", []byte("OLD CONTENT\n\n## aaa.txt\n\n"))
+		space.WriteFile("fixtures/02/answer_01.md", []byte("ANSWER_3"))
+
+		testee := replayFixture.NewReplayFixtureService()
+		fixtures, err := testee.Open(filepath.Join(space.Dir, "fixtures"))
+		assert.NoError(t, err)
+
+		answer, err := fixtures.Find("NEW CONTENT\n\n## aaa.txt\n\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_1", answer)
+
+		// 同じフォルダを開き直しても使用済みの回答は共有される
+		fixtures, err = testee.Open(filepath.Join(space.Dir, "fixtures"))
+		assert.NoError(t, err)
+
+		answer, err = fixtures.Find("NEW CONTENT\n\n## aaa.txt\n\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_3", answer)
+
+		answer, err = fixtures.Find("NEW CONTENT\n\n## bbb.txt\n\n")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_2", answer)
+
+		_, err = fixtures.Find("NEW CONTENT\n\n## aaa.txt\n\n")
+		assert.Error(t, err)
+	})
+
+	t.Run("記録した組が連番のファイルとして保存されること", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		space.WriteFile("fixtures/prompt_01.md", []byte("PROMPT_1"))
+		space.WriteFile("fixtures/answer_01.md", []byte("ANSWER_1"))
+
+		fixtures, err := replayFixture.NewReplayFixtureService().Open(filepath.Join(space.Dir, "fixtures"))
+		assert.NoError(t, err)
+
+		err = fixtures.Record("PROMPT_2", "ANSWER_2")
+		assert.NoError(t, err)
+
+		space.AssertFile("fixtures/prompt_02.md", func(actual []byte) {
+			assert.Equal(t, "PROMPT_2", string(actual))
+		})
+		space.AssertFile("fixtures/answer_02.md", func(actual []byte) {
+			assert.Equal(t, "ANSWER_2", string(actual))
+		})
+
+		answer, err := replayFixture.NewReplayFixtureService().Open(filepath.Join(space.Dir, "fixtures"))
+		assert.NoError(t, err)
+		actual, err := answer.Find("PROMPT_2")
+		assert.NoError(t, err)
+		assert.Equal(t, "ANSWER_2", actual)
+	})
+}
@@ -0,0 +1,237 @@
+package responseCache
+
+import (
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/chat/cache"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultMaxAge はキャッシュの有効期間のデフォルト値です。
+const defaultMaxAge = 7 * 24 * time.Hour
+
+// defaultMaxSizeMB はキャッシュの合計サイズの上限のデフォルト値です。
+const defaultMaxSizeMB = 100
+
+const entryExt = ".yml"
+
+type ResponseCacheService struct {
+	timer timer.ITimer
+}
+
+func NewResponseCacheService(timer timer.ITimer) *ResponseCacheService {
+	return &ResponseCacheService{
+		timer: timer,
+	}
+}
+
+// entry はキャッシュファイルの内容です。
+type entry struct {
+	CreatedAt    time.Time `yaml:"created-at"`
+	Content      string    `yaml:"content"`
+	FinishReason string    `yaml:"finish-reason"`
+}
+
+// Open はプロジェクトルートの.sisho/cacheにレスポンスを保存するStoreを返します。
+func (s *ResponseCacheService) Open(rootDir string, setting config.Cache) cache.Store {
+	maxAge := setting.MaxAge
+	if maxAge <= 0 {
+		maxAge = defaultMaxAge
+	}
+	maxSizeMB := setting.MaxSizeMB
+	if maxSizeMB <= 0 {
+		maxSizeMB = defaultMaxSizeMB
+	}
+
+	return &fileStore{
+		dir:     cacheDir(rootDir),
+		maxAge:  maxAge,
+		maxSize: int64(maxSizeMB) * 1024 * 1024,
+		timer:   s.timer,
+	}
+}
+
+// Clear はプロジェクトルートの.sisho/cacheにある全てのキャッシュを削除し、削除した件数を返します。
+func (s *ResponseCacheService) Clear(rootDir string) (int, error) {
+	files, err := listEntries(cacheDir(rootDir))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, f := range files {
+		err := os.Remove(f.path)
+		if err != nil {
+			return 0, eris.Wrapf(err, "failed to remove cache: %s", f.path)
+		}
+	}
+
+	return len(files), nil
+}
+
+type fileStore struct {
+	dir     string
+	maxAge  time.Duration
+	maxSize int64
+	timer   timer.ITimer
+}
+
+func (s *fileStore) Get(key string) (chat.SendResult, bool) {
+	path := filepath.Join(s.dir, key+entryExt)
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: failed to read response cache: %v\n", err)
+		}
+		return chat.SendResult{}, false
+	}
+
+	var e entry
+	err = yaml.Unmarshal(content, &e)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to parse response cache %s: %v\n", path, err)
+		return chat.SendResult{}, false
+	}
+
+	if s.timer.Now().Sub(e.CreatedAt) > s.maxAge {
+		_ = os.Remove(path)
+		return chat.SendResult{}, false
+	}
+
+	return chat.SendResult{
+		Content:      e.Content,
+		FinishReason: e.FinishReason,
+	}, true
+}
+
+func (s *fileStore) Put(key string, result chat.SendResult) {
+	err := s.put(key, result)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to save response cache: %v\n", err)
+		return
+	}
+
+	err = s.prune()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to prune response cache: %v\n", err)
+	}
+}
+
+func (s *fileStore) put(key string, result chat.SendResult) error {
+	err := os.MkdirAll(s.dir, 0755)
+	if err != nil {
+		return eris.Wrap(err, "failed to create cache directory")
+	}
+
+	content, err := yaml.Marshal(entry{
+		CreatedAt:    s.timer.Now(),
+		Content:      result.Content,
+		FinishReason: result.FinishReason,
+	})
+	if err != nil {
+		return eris.Wrap(err, "failed to marshal cache")
+	}
+
+	return eris.Wrap(writeAtomic(filepath.Join(s.dir, key+entryExt), content), "failed to write cache")
+}
+
+// writeAtomic は一時ファイルに書き込んでからリネームすることで、pathを原子的に置き換えます。
+// 並行して生成している他のターゲットや中断によって、書きかけのキャッシュが読まれないようにするためです。
+// 一時ファイルの名前はentryExtで終わらないため、キャッシュの一覧には含まれません。
+func writeAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(0644)
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// prune は有効期間を過ぎたキャッシュを削除し、合計サイズが上限を超えている場合は古い順に削除します。
+func (s *fileStore) prune() error {
+	files, err := listEntries(s.dir)
+	if err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].modTime.Before(files[j].modTime)
+	})
+
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+
+	now := s.timer.Now()
+	for _, f := range files {
+		if now.Sub(f.modTime) <= s.maxAge && total <= s.maxSize {
+			continue
+		}
+		err := os.Remove(f.path)
+		// 並行して生成している他のターゲットが先に削除した場合は無視する
+		if err != nil && !os.IsNotExist(err) {
+			return eris.Wrapf(err, "failed to remove cache: %s", f.path)
+		}
+		total -= f.size
+	}
+
+	return nil
+}
+
+type entryFile struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+func listEntries(dir string) ([]entryFile, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, eris.Wrap(err, "failed to read cache directory")
+	}
+
+	var files []entryFile
+	for _, d := range dirEntries {
+		if d.IsDir() || !strings.HasSuffix(d.Name(), entryExt) {
+			continue
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil, eris.Wrapf(err, "failed to stat cache: %s", d.Name())
+		}
+		files = append(files, entryFile{
+			path:    filepath.Join(dir, d.Name()),
+			size:    info.Size(),
+			modTime: info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
+
+func cacheDir(rootDir string) string {
+	return filepath.Join(rootDir, ".sisho", "cache")
+}
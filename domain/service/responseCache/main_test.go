@@ -0,0 +1,116 @@
+package responseCache_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/service/responseCache"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"github.com/t-kuni/sisho/testUtil"
+	"go.uber.org/mock/gomock"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestResponseCacheService(t *testing.T) {
+	t.Run("保存したレスポンスを取得できること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+
+		store := responseCache.NewResponseCacheService(mockTimer).Open(space.Dir, config.Cache{Enabled: true})
+		store.Put("key1", chat.SendResult{Content: "ANSWER", FinishReason: chat.FinishReasonStop})
+
+		actual, ok := store.Get("key1")
+		assert.True(t, ok)
+		assert.Equal(t, "ANSWER", actual.Content)
+		assert.Equal(t, chat.FinishReasonStop, actual.FinishReason)
+
+		_, ok = store.Get("key2")
+		assert.False(t, ok)
+
+		// 一時ファイルが残らないこと
+		entries, err := os.ReadDir(filepath.Join(space.Dir, ".sisho", "cache"))
+		assert.NoError(t, err)
+		assert.Len(t, entries, 1)
+		assert.Equal(t, "key1.yml", entries[0].Name())
+	})
+
+	t.Run("有効期間を過ぎたレスポンスは取得できないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		now := testUtil.NewTime("2022-01-01T00:00:00Z")
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().DoAndReturn(func() time.Time { return now }).AnyTimes()
+
+		store := responseCache.NewResponseCacheService(mockTimer).Open(space.Dir, config.Cache{Enabled: true, MaxAge: time.Hour})
+		store.Put("key1", chat.SendResult{Content: "ANSWER"})
+
+		now = now.Add(2 * time.Hour)
+		_, ok := store.Get("key1")
+		assert.False(t, ok)
+		assert.NoFileExists(t, filepath.Join(space.Dir, ".sisho", "cache", "key1.yml"))
+	})
+
+	t.Run("合計サイズが上限を超えた場合、古いレスポンスから削除されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+
+		store := responseCache.NewResponseCacheService(mockTimer).Open(space.Dir, config.Cache{Enabled: true, MaxSizeMB: 1})
+		large := strings.Repeat("a", 600*1024)
+		store.Put("key1", chat.SendResult{Content: large})
+
+		// 更新日時で古い順を判定するため、1件目の更新日時をずらす
+		past := time.Now().Add(-time.Minute)
+		err := os.Chtimes(filepath.Join(space.Dir, ".sisho", "cache", "key1.yml"), past, past)
+		assert.NoError(t, err)
+
+		store.Put("key2", chat.SendResult{Content: large})
+
+		_, ok := store.Get("key1")
+		assert.False(t, ok)
+		_, ok = store.Get("key2")
+		assert.True(t, ok)
+	})
+
+	t.Run("Clearで全てのレスポンスが削除されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+
+		testee := responseCache.NewResponseCacheService(mockTimer)
+		store := testee.Open(space.Dir, config.Cache{Enabled: true})
+		store.Put("key1", chat.SendResult{Content: "ANSWER1"})
+		store.Put("key2", chat.SendResult{Content: "ANSWER2"})
+
+		count, err := testee.Clear(space.Dir)
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+
+		_, ok := store.Get("key1")
+		assert.False(t, ok)
+	})
+}
@@ -0,0 +1,233 @@
+package snapshot
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/repository/snapshot"
+	"github.com/t-kuni/sisho/domain/service/hunkReview"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+type SnapshotService struct {
+	snapshotRepository snapshot.Repository
+	timer              timer.ITimer
+
+	// mu は並行して生成する場合にsnapshots.ymlへの追記を排他します
+	mu sync.Mutex
+}
+
+func NewSnapshotService(snapshotRepository snapshot.Repository, timer timer.ITimer) *SnapshotService {
+	return &SnapshotService{
+		snapshotRepository: snapshotRepository,
+		timer:              timer,
+	}
+}
+
+// Record はpathを書き換える前の内容と書き込む内容を履歴フォルダに保存します。ファイルを書き換える前に呼び出します。
+// existedがfalseの場合は、書き換える前はファイルが存在しなかったことを記録します。
+func (s *SnapshotService) Record(historyDir, rootDir, path string, existed bool, before, after []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return eris.Wrapf(err, "failed to resolve path: %s", path)
+	}
+	relPath, err := filepath.Rel(rootDir, absPath)
+	if err != nil {
+		return eris.Wrapf(err, "failed to resolve path from the project root: %s", path)
+	}
+
+	listPath := filepath.Join(historyDir, snapshot.FileName)
+	snapshots, err := s.snapshotRepository.Read(listPath)
+	if err != nil && !os.IsNotExist(err) {
+		return eris.Wrap(err, "failed to read snapshots")
+	}
+
+	dir := filepath.Join(historyDir, snapshot.DirName)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return eris.Wrap(err, "failed to create snapshot directory")
+	}
+
+	number := len(snapshots.Files) + 1
+	file := snapshot.File{
+		Path:      filepath.ToSlash(relPath),
+		Existed:   existed,
+		After:     fmt.Sprintf("%04d.after", number),
+		AfterHash: hash(after),
+	}
+	if existed {
+		file.Before = fmt.Sprintf("%04d.before", number)
+		err = os.WriteFile(filepath.Join(dir, file.Before), before, 0644)
+		if err != nil {
+			return eris.Wrap(err, "failed to save the content before writing")
+		}
+	}
+	err = os.WriteFile(filepath.Join(dir, file.After), after, 0644)
+	if err != nil {
+		return eris.Wrap(err, "failed to save the content to write")
+	}
+
+	snapshots.Files = append(snapshots.Files, file)
+	err = s.snapshotRepository.Write(listPath, snapshots)
+	if err != nil {
+		return eris.Wrap(err, "failed to write snapshots")
+	}
+	return nil
+}
+
+// Latest は元に戻していない最新の実行の履歴IDを返します。
+func (s *SnapshotService) Latest(rootDir string) (string, error) {
+	baseDir := filepath.Join(rootDir, ".sisho", "history")
+	entries, err := os.ReadDir(baseDir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", eris.Wrap(err, "failed to read history directory")
+	}
+
+	// 履歴IDはKSUIDなので名前の順が実行の順になる
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() > entries[j].Name()
+	})
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		snapshots, err := s.snapshotRepository.Read(filepath.Join(baseDir, entry.Name(), snapshot.FileName))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return "", eris.Wrapf(err, "failed to read snapshots of %s", entry.Name())
+		}
+		if snapshots.UndoneAt == nil {
+			return entry.Name(), nil
+		}
+	}
+	return "", eris.New("there are no changes to undo")
+}
+
+// Undo は履歴IDがhistoryIDの実行で書き換えたファイルを、書き換える前の状態に戻します。
+// 書き換えた後にさらに変更されたファイルがある場合は、差分を出力して何も戻さずにエラーを返します。forceがtrueの場合は変更を破棄して戻します。
+func (s *SnapshotService) Undo(out io.Writer, rootDir, historyID string, force bool) error {
+	historyDir := filepath.Join(rootDir, ".sisho", "history", historyID)
+	listPath := filepath.Join(historyDir, snapshot.FileName)
+	snapshots, err := s.snapshotRepository.Read(listPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return eris.Errorf("history %s has no changes to undo", historyID)
+		}
+		return eris.Wrap(err, "failed to read snapshots")
+	}
+	if snapshots.UndoneAt != nil {
+		return eris.Errorf("history %s was already undone at %s", historyID, snapshots.UndoneAt.Format(time.RFC3339))
+	}
+
+	dir := filepath.Join(historyDir, snapshot.DirName)
+
+	// 同じファイルを複数回書き換えた場合は、最後に書き込んだ内容と比べる
+	var changed []string
+	checked := map[string]bool{}
+	for i := len(snapshots.Files) - 1; i >= 0; i-- {
+		file := snapshots.Files[i]
+		if checked[file.Path] {
+			continue
+		}
+		checked[file.Path] = true
+
+		current, err := os.ReadFile(filepath.Join(rootDir, file.Path))
+		if err != nil && !os.IsNotExist(err) {
+			return eris.Wrapf(err, "failed to read file: %s", file.Path)
+		}
+		if err == nil && hash(current) == file.AfterHash {
+			continue
+		}
+
+		changed = append(changed, file.Path)
+		if os.IsNotExist(err) {
+			fmt.Fprintf(out, "%s was removed after sisho wrote it\n", file.Path)
+			continue
+		}
+		after, err := os.ReadFile(filepath.Join(dir, file.After))
+		if err != nil {
+			return eris.Wrapf(err, "failed to read the snapshot of %s", file.Path)
+		}
+		fmt.Fprintf(out, "%s was changed after sisho wrote it:\n", file.Path)
+		for _, hunk := range hunkReview.Diff(string(after), string(current)) {
+			fmt.Fprint(out, hunkReview.Format(hunk))
+		}
+	}
+	if len(changed) > 0 && !force {
+		return eris.Errorf("%d file(s) were changed after sisho wrote them; pass --force to discard the changes and undo anyway", len(changed))
+	}
+
+	// 同じファイルを複数回書き換えた場合は、最初に書き換える前の内容に戻す
+	first := map[string]int{}
+	for i := len(snapshots.Files) - 1; i >= 0; i-- {
+		first[snapshots.Files[i].Path] = i
+	}
+	for i := len(snapshots.Files) - 1; i >= 0; i-- {
+		file := snapshots.Files[i]
+		if first[file.Path] != i {
+			continue
+		}
+		path := filepath.Join(rootDir, file.Path)
+		if !file.Existed {
+			err = os.Remove(path)
+			if err != nil && !os.IsNotExist(err) {
+				return eris.Wrapf(err, "failed to remove file: %s", file.Path)
+			}
+			fmt.Fprintf(out, "Removed %s\n", file.Path)
+			continue
+		}
+
+		before, err := os.ReadFile(filepath.Join(dir, file.Before))
+		if err != nil {
+			return eris.Wrapf(err, "failed to read the snapshot of %s", file.Path)
+		}
+		err = restore(path, before)
+		if err != nil {
+			return eris.Wrapf(err, "failed to restore file: %s", file.Path)
+		}
+		fmt.Fprintf(out, "Restored %s\n", file.Path)
+	}
+
+	now := s.timer.Now()
+	snapshots.UndoneAt = &now
+	err = s.snapshotRepository.Write(listPath, snapshots)
+	if err != nil {
+		return eris.Wrap(err, "failed to write snapshots")
+	}
+	return nil
+}
+
+// restore はpathの内容をcontentに戻します。ファイルが存在する場合はパーミッションを維持します。
+func restore(path string, content []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		if current, err := os.ReadFile(path); err == nil && bytes.Equal(current, content) {
+			return nil
+		}
+		mode = info.Mode().Perm()
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, content, mode)
+}
+
+func hash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
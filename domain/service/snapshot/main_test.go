@@ -0,0 +1,113 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/service/snapshot"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	snapshot2 "github.com/t-kuni/sisho/infrastructure/repository/snapshot"
+	"github.com/t-kuni/sisho/testUtil"
+	"go.uber.org/mock/gomock"
+	"os"
+	"testing"
+)
+
+func TestUndo(t *testing.T) {
+	// setup はmakeがold.txtを書き換え、new.txtを作成した状態を作ります
+	setup := func(t *testing.T, space testUtil.Space, testee *snapshot.SnapshotService) {
+		space.WriteFile("sisho.yml", []byte(""))
+		space.MkDir(".sisho/history/run1")
+		space.WriteFile("old.txt", []byte("BEFORE"))
+
+		assert.NoError(t, testee.Record(".sisho/history/run1", space.Dir, "old.txt", true, []byte("BEFORE"), []byte("AFTER")))
+		space.WriteFile("old.txt", []byte("AFTER"))
+		assert.NoError(t, testee.Record(".sisho/history/run1", space.Dir, "new.txt", false, nil, []byte("NEW")))
+		space.WriteFile("new.txt", []byte("NEW"))
+	}
+
+	t.Run("書き換えたファイルが元に戻り、作成したファイルは削除されること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+		testee := snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer)
+		setup(t, space, testee)
+
+		id, err := testee.Latest(space.Dir)
+		assert.NoError(t, err)
+		assert.Equal(t, "run1", id)
+
+		var out bytes.Buffer
+		err = testee.Undo(&out, space.Dir, id, false)
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("old.txt", func(actual []byte) {
+			assert.Equal(t, "BEFORE", string(actual))
+		})
+		_, err = os.Stat("new.txt")
+		assert.True(t, os.IsNotExist(err))
+		assert.Equal(t, "Removed new.txt\nRestored old.txt\n", out.String())
+
+		// 元に戻した実行は対象にならないこと
+		_, err = testee.Latest(space.Dir)
+		assert.ErrorContains(t, err, "there are no changes to undo")
+		err = testee.Undo(&out, space.Dir, id, false)
+		assert.ErrorContains(t, err, "history run1 was already undone at 2022-01-01T00:00:00Z")
+	})
+
+	t.Run("書き換えた後に変更されたファイルがある場合は、差分を出力して何も戻さないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		testee := snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer)
+		setup(t, space, testee)
+		space.WriteFile("old.txt", []byte("EDITED"))
+
+		var out bytes.Buffer
+		err := testee.Undo(&out, space.Dir, "run1", false)
+		assert.ErrorContains(t, err, "1 file(s) were changed after sisho wrote them")
+
+		// Assert
+		assert.Contains(t, out.String(), "old.txt was changed after sisho wrote it:")
+		assert.Contains(t, out.String(), "-AFTER")
+		assert.Contains(t, out.String(), "+EDITED")
+		space.AssertFile("old.txt", func(actual []byte) {
+			assert.Equal(t, "EDITED", string(actual))
+		})
+		space.AssertFile("new.txt", func(actual []byte) {
+			assert.Equal(t, "NEW", string(actual))
+		})
+	})
+
+	t.Run("forceがtrueの場合は、書き換えた後の変更を破棄して元に戻すこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		mockTimer := timer.NewMockITimer(mockCtrl)
+		mockTimer.EXPECT().Now().Return(testUtil.NewTime("2022-01-01T00:00:00Z")).AnyTimes()
+		testee := snapshot.NewSnapshotService(snapshot2.NewRepository(), mockTimer)
+		setup(t, space, testee)
+		space.WriteFile("old.txt", []byte("EDITED"))
+
+		var out bytes.Buffer
+		err := testee.Undo(&out, space.Dir, "run1", true)
+		assert.NoError(t, err)
+
+		// Assert
+		space.AssertFile("old.txt", func(actual []byte) {
+			assert.Equal(t, "BEFORE", string(actual))
+		})
+	})
+}
@@ -0,0 +1,242 @@
+package structuredOutput
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/prompts/repair"
+	"sort"
+	"strings"
+)
+
+type StructuredOutputService struct{}
+
+func NewStructuredOutputService() *StructuredOutputService {
+	return &StructuredOutputService{}
+}
+
+// Send はschemaに従うJSONでの回答を依頼し、検証した回答をoutにデコードします。
+// 回答がschemaに従わない場合は、エラーの内容を伝えて1度だけ回答の修正を依頼します。
+// 返り値は最後の回答で、Usageは全ての送信の合計です。修正後も回答が不正な場合は、最後の回答とエラーを返します。
+func (s *StructuredOutputService) Send(
+	ctx context.Context,
+	chatClient chat.Chat,
+	prompt string,
+	model string,
+	options chat.SendOptions,
+	schema chat.ResponseSchema,
+	out interface{},
+) (chat.SendResult, error) {
+	options.ResponseSchema = &schema
+	options.ValidateAnswer = func(content string) error {
+		_, err := validateAnswer(content, schema)
+		return err
+	}
+
+	result, err := chatClient.Send(ctx, prompt, model, options)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+	validationErr := Decode(result.Content, schema, out)
+	if validationErr == nil {
+		return result, nil
+	}
+
+	fmt.Printf("Invalid structured answer, asking the LLM to repair it: %v\n", validationErr)
+
+	repairPrompt, err := s.buildRepairPrompt(validationErr, schema)
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+	if _, ok := chatClient.(chat.ChatWithHistory); !ok {
+		// 履歴を保持しないチャットモデルの場合は、元のプロンプトに修正の依頼を付け加える
+		repairPrompt = prompt + "\n\n" + repairPrompt
+	}
+
+	usage := result.Usage
+	result, err = chatClient.Send(ctx, repairPrompt, model, options)
+	if err != nil {
+		return chat.SendResult{}, eris.Wrap(err, "failed to repair the structured answer")
+	}
+	result.Usage = usage.Add(result.Usage)
+
+	err = Decode(result.Content, schema, out)
+	if err != nil {
+		return result, eris.Wrap(err, "the structured answer is invalid after the repair")
+	}
+	return result, nil
+}
+
+func (s *StructuredOutputService) buildRepairPrompt(validationErr error, schema chat.ResponseSchema) (string, error) {
+	schemaJSON, err := json.MarshalIndent(schema.Schema, "", "  ")
+	if err != nil {
+		return "", eris.Wrap(err, "failed to marshal schema")
+	}
+
+	prompt, err := repair.BuildPrompt(repair.PromptParam{
+		Error:  validationErr.Error(),
+		Schema: string(schemaJSON),
+	})
+	if err != nil {
+		return "", eris.Wrap(err, "failed to build repair prompt")
+	}
+	return prompt, nil
+}
+
+// Decode は回答からJSONを取り出し、schemaで検証してからoutにデコードします。
+// 構造化出力に対応していないドライバーの回答にも対応するため、JSONの前後の説明やコードブロックは無視します。
+func Decode(content string, schema chat.ResponseSchema, out interface{}) error {
+	document, err := validateAnswer(content, schema)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal([]byte(document), out)
+	if err != nil {
+		return fmt.Errorf("failed to decode the answer: %v", err)
+	}
+	return nil
+}
+
+// validateAnswer は回答からJSONを取り出し、schemaで検証します。返り値は取り出したJSONです。
+func validateAnswer(content string, schema chat.ResponseSchema) (string, error) {
+	start := strings.Index(content, "{")
+	end := strings.LastIndex(content, "}")
+	if start < 0 || end < start {
+		return "", fmt.Errorf("the answer does not contain a JSON object")
+	}
+	document := content[start : end+1]
+
+	var value interface{}
+	err := json.Unmarshal([]byte(document), &value)
+	if err != nil {
+		return "", fmt.Errorf("the answer is not valid JSON: %v", err)
+	}
+
+	err = validate(schema.Schema, value, "$")
+	if err != nil {
+		return "", err
+	}
+	return document, nil
+}
+
+// validate はvalueがschemaに従うかを検証します。
+// 対応するキーワードは type, properties, required, additionalProperties(false), items, enum です。
+func validate(schema map[string]interface{}, value interface{}, path string) error {
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		if !containsValue(enum, value) {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+	if enum, ok := schema["enum"].([]string); ok {
+		s, isString := value.(string)
+		if !isString || !containsString(enum, s) {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an object", path)
+		}
+		return validateObject(schema, object, path)
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected an array", path)
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range array {
+				if err := validate(items, item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+					return err
+				}
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected a string", path)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected a boolean", path)
+		}
+	case "number":
+		if _, ok := value.(float64); !ok {
+			return fmt.Errorf("%s: expected a number", path)
+		}
+	case "integer":
+		n, ok := value.(float64)
+		if !ok || n != float64(int64(n)) {
+			return fmt.Errorf("%s: expected an integer", path)
+		}
+	}
+	return nil
+}
+
+func validateObject(schema map[string]interface{}, object map[string]interface{}, path string) error {
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	for _, name := range requiredProperties(schema) {
+		if _, ok := object[name]; !ok {
+			return fmt.Errorf("%s: missing required property %q", path, name)
+		}
+	}
+
+	names := make([]string, 0, len(object))
+	for name := range object {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		propertySchema, ok := properties[name].(map[string]interface{})
+		if !ok {
+			if additional, ok := schema["additionalProperties"].(bool); ok && !additional {
+				return fmt.Errorf("%s: unknown property %q", path, name)
+			}
+			continue
+		}
+		if err := validate(propertySchema, object[name], path+"."+name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func requiredProperties(schema map[string]interface{}) []string {
+	switch required := schema["required"].(type) {
+	case []string:
+		return required
+	case []interface{}:
+		var names []string
+		for _, name := range required {
+			if s, ok := name.(string); ok {
+				names = append(names, s)
+			}
+		}
+		return names
+	}
+	return nil
+}
+
+func containsValue(values []interface{}, value interface{}) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,182 @@
+package structuredOutput_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/model/chat/cache"
+	"github.com/t-kuni/sisho/domain/service/structuredOutput"
+	"go.uber.org/mock/gomock"
+	"testing"
+)
+
+var testSchema = chat.ResponseSchema{
+	Name: "test_result",
+	Schema: map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"paths": map[string]interface{}{
+				"type":  "array",
+				"items": map[string]interface{}{"type": "string"},
+			},
+			"kind": map[string]interface{}{
+				"type": "string",
+				"enum": []string{"examples", "implementations"},
+			},
+		},
+		"required":             []string{"paths"},
+		"additionalProperties": false,
+	},
+}
+
+type testResult struct {
+	Paths []string `json:"paths"`
+	Kind  string   `json:"kind"`
+}
+
+func TestDecode(t *testing.T) {
+	t.Run("スキーマに従うJSONをデコードできること", func(t *testing.T) {
+		var out testResult
+		err := structuredOutput.Decode(`{"paths":["a.go","b.go"],"kind":"examples"}`, testSchema, &out)
+
+		assert.NoError(t, err)
+		assert.Equal(t, testResult{Paths: []string{"a.go", "b.go"}, Kind: "examples"}, out)
+	})
+
+	t.Run("JSONの前後の説明やコードブロックは無視すること", func(t *testing.T) {
+		var out testResult
+		err := structuredOutput.Decode("以下の通りです。\n```json\n{\"paths\":[\"a.go\"]}\n```\n", testSchema, &out)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.go"}, out.Paths)
+	})
+
+	t.Run("スキーマに従わない場合はエラーになること", func(t *testing.T) {
+		cases := map[string]struct {
+			content  string
+			expected string
+		}{
+			"JSONが無い":      {`パスはありません`, "does not contain a JSON object"},
+			"JSONが不正":      {`{"paths": [}`, "not valid JSON"},
+			"必須のプロパティが無い":  {`{"kind":"examples"}`, `$: missing required property "paths"`},
+			"型が異なる":        {`{"paths":"a.go"}`, "$.paths: expected an array"},
+			"配列の要素の型が異なる":  {`{"paths":["a.go",1]}`, "$.paths[1]: expected a string"},
+			"enumに含まれない":   {`{"paths":[],"kind":"unknown"}`, "$.kind: unknown is not one of"},
+			"未定義のプロパティがある": {`{"paths":[],"extra":true}`, `$: unknown property "extra"`},
+		}
+		for name, c := range cases {
+			t.Run(name, func(t *testing.T) {
+				var out testResult
+				err := structuredOutput.Decode(c.content, testSchema, &out)
+
+				if assert.Error(t, err) {
+					assert.Contains(t, err.Error(), c.expected)
+				}
+			})
+		}
+	})
+}
+
+func TestStructuredOutputService_Send(t *testing.T) {
+	t.Run("スキーマを指定して送信し、回答をデコードすること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockChat := chat.NewMockChat(mockCtrl)
+		mockChat.EXPECT().Send(gomock.Any(), "PROMPT", "MODEL", gomock.Any()).
+			DoAndReturn(func(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+				assert.Equal(t, "test_result", options.ResponseSchema.Name)
+				return chat.SendResult{Content: `{"paths":["a.go"]}`, Usage: chat.Usage{InputTokens: 10, OutputTokens: 5}}, nil
+			})
+
+		var out testResult
+		result, err := structuredOutput.NewStructuredOutputService().Send(context.Background(), mockChat, "PROMPT", "MODEL", chat.SendOptions{}, testSchema, &out)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.go"}, out.Paths)
+		assert.Equal(t, chat.Usage{InputTokens: 10, OutputTokens: 5}, result.Usage)
+	})
+
+	t.Run("回答が不正な場合は1度だけ修正を依頼すること", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockChat := chat.NewMockChat(mockCtrl)
+		gomock.InOrder(
+			mockChat.EXPECT().Send(gomock.Any(), "PROMPT", "MODEL", gomock.Any()).
+				Return(chat.SendResult{Content: `{"files":["a.go"]}`, Usage: chat.Usage{InputTokens: 10, OutputTokens: 5}}, nil),
+			mockChat.EXPECT().Send(gomock.Any(), gomock.Any(), "MODEL", gomock.Any()).
+				DoAndReturn(func(ctx context.Context, prompt string, model string, options chat.SendOptions) (chat.SendResult, error) {
+					// 履歴を保持しないチャットモデルのため、元のプロンプトに修正の依頼が付け加えられる
+					assert.Contains(t, prompt, "PROMPT")
+					assert.Contains(t, prompt, `missing required property "paths"`)
+					assert.NotNil(t, options.ResponseSchema)
+					return chat.SendResult{Content: `{"paths":["a.go"]}`, Usage: chat.Usage{InputTokens: 20, OutputTokens: 5}}, nil
+				}),
+		)
+
+		var out testResult
+		result, err := structuredOutput.NewStructuredOutputService().Send(context.Background(), mockChat, "PROMPT", "MODEL", chat.SendOptions{}, testSchema, &out)
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"a.go"}, out.Paths)
+		assert.Equal(t, chat.Usage{InputTokens: 30, OutputTokens: 10}, result.Usage)
+	})
+
+	t.Run("修正後も回答が不正な場合は最後の回答とエラーを返すこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		mockChat := chat.NewMockChat(mockCtrl)
+		mockChat.EXPECT().Send(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+			Return(chat.SendResult{Content: "パスはありません"}, nil).Times(2)
+
+		var out testResult
+		result, err := structuredOutput.NewStructuredOutputService().Send(context.Background(), mockChat, "PROMPT", "MODEL", chat.SendOptions{}, testSchema, &out)
+
+		assert.Error(t, err)
+		assert.Equal(t, "パスはありません", result.Content)
+	})
+	t.Run("スキーマに従わない回答はレスポンスキャッシュから再び返されないこと", func(t *testing.T) {
+		mockCtrl := gomock.NewController(t)
+		defer mockCtrl.Finish()
+
+		store := &memoryStore{results: map[string]chat.SendResult{}}
+		mockChat := chat.NewMockChatWithHistory(mockCtrl)
+		mockChat.EXPECT().GetHistory().Return(nil).AnyTimes()
+		mockChat.EXPECT().SetHistory(gomock.Any()).AnyTimes()
+		gomock.InOrder(
+			// 1回目の実行：修正後も不正な回答
+			mockChat.EXPECT().Send(gomock.Any(), gomock.Any(), gomock.Any(), gomock.Any()).
+				Return(chat.SendResult{Content: "パスはありません"}, nil).Times(2),
+			// 2回目の実行：キャッシュから不正な回答を返さずに送信する
+			mockChat.EXPECT().Send(gomock.Any(), "PROMPT", gomock.Any(), gomock.Any()).
+				Return(chat.SendResult{Content: `{"paths":["a.go"]}`}, nil),
+		)
+
+		var out testResult
+		_, err := structuredOutput.NewStructuredOutputService().Send(context.Background(), cache.NewCachedChat(mockChat, store, cache.KeyParams{}), "PROMPT", "MODEL", chat.SendOptions{}, testSchema, &out)
+		assert.Error(t, err)
+		assert.Empty(t, store.results)
+
+		result, err := structuredOutput.NewStructuredOutputService().Send(context.Background(), cache.NewCachedChat(mockChat, store, cache.KeyParams{}), "PROMPT", "MODEL", chat.SendOptions{}, testSchema, &out)
+		assert.NoError(t, err)
+		assert.False(t, result.Cached)
+		assert.Equal(t, []string{"a.go"}, out.Paths)
+		assert.Len(t, store.results, 1)
+	})
+}
+
+// memoryStore はレスポンスキャッシュをメモリに保存するcache.Storeです。
+type memoryStore struct {
+	results map[string]chat.SendResult
+}
+
+func (s *memoryStore) Get(key string) (chat.SendResult, bool) {
+	result, ok := s.results[key]
+	return result, ok
+}
+
+func (s *memoryStore) Put(key string, result chat.SendResult) {
+	s.results[key] = result
+}
@@ -0,0 +1,62 @@
+package systemPrompt
+
+import (
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HistoryFileName は履歴フォルダに保存するシステムプロンプトのファイル名です。
+const HistoryFileName = "system.md"
+
+type SystemPromptService struct {
+}
+
+func NewSystemPromptService() *SystemPromptService {
+	return &SystemPromptService{}
+}
+
+// Resolve はcommandで使うシステムプロンプトを返します。
+// プロジェクトコンフィグのsystem-prompt.commandsにcommandの指定があればそれを使い、無ければプロジェクト全体の指定を使います。
+// 指定が無い場合は空文字を返します。
+func (s *SystemPromptService) Resolve(rootDir string, cfg *config.Config, command string) (string, error) {
+	setting := cfg.SystemPrompt.SystemPrompt
+	if override, ok := cfg.SystemPrompt.Commands[command]; ok {
+		setting = override
+	}
+
+	if setting.Text != "" && setting.File != "" {
+		return "", eris.Errorf("system-prompt for %s cannot have both text and file", command)
+	}
+
+	if setting.File == "" {
+		return strings.TrimSpace(setting.Text), nil
+	}
+
+	path := setting.File
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(rootDir, path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", eris.Wrapf(err, "failed to read system prompt file: %s", path)
+	}
+
+	return strings.TrimSpace(string(content)), nil
+}
+
+// SaveHistory はシステムプロンプトを履歴フォルダに保存します。システムプロンプトが空の場合は何もしません。
+func (s *SystemPromptService) SaveHistory(historyDir string, system string) error {
+	if system == "" {
+		return nil
+	}
+
+	err := os.WriteFile(filepath.Join(historyDir, HistoryFileName), []byte(system), 0644)
+	if err != nil {
+		return eris.Wrap(err, "failed to write system prompt to history")
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package taskRun
+
+import (
+	"context"
+	"fmt"
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"os/exec"
+	"strings"
+)
+
+type TaskRunService struct{}
+
+func NewTaskRunService() *TaskRunService {
+	return &TaskRunService{}
+}
+
+// Find はプロジェクトコンフィグのtasksからnameのタスクを探します。
+func (s *TaskRunService) Find(cfg *config.Config, name string) (*config.Task, error) {
+	for _, t := range cfg.Tasks {
+		if t.Name == name {
+			return &t, nil
+		}
+	}
+	return nil, eris.Errorf("task not found: %s", name)
+}
+
+// Run はタスクのrunをプロジェクトルートで実行し、標準出力、標準エラー出力、エラーを返します。
+// ctxが終了した場合はタスクを停止します。
+func (s *TaskRunService) Run(ctx context.Context, task *config.Task, rootDir string) (string, string, error) {
+	cmd := exec.CommandContext(ctx, "sh", "-c", task.Run)
+	cmd.Dir = rootDir
+
+	var stdout, stderr strings.Builder
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	return stdout.String(), stderr.String(), err
+}
+
+// ErrorMessage はLLMに渡すタスクのエラーメッセージを組み立てます。
+func ErrorMessage(stdout, stderr string, err error) string {
+	return fmt.Sprintf("Stdout:\n%s\nStderr:\n%s\nError:\n%s", stdout, stderr, err.Error())
+}
@@ -0,0 +1,53 @@
+package taskRun_test
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/service/taskRun"
+	"github.com/t-kuni/sisho/testUtil"
+	"testing"
+)
+
+func TestTaskRunService(t *testing.T) {
+	cfg := &config.Config{
+		Tasks: []config.Task{
+			{Name: "build", Run: "cat aaa.txt"},
+			{Name: "test", Run: "echo FAILED >&2; exit 1"},
+		},
+	}
+
+	t.Run("プロジェクトルートでタスクを実行し、出力を返すこと", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+		space.WriteFile("aaa.txt", []byte("CONTENT"))
+
+		testee := taskRun.NewTaskRunService()
+		task, err := testee.Find(cfg, "build")
+		assert.NoError(t, err)
+
+		stdout, stderr, err := testee.Run(context.Background(), task, space.Dir)
+		assert.NoError(t, err)
+		assert.Equal(t, "CONTENT", stdout)
+		assert.Equal(t, "", stderr)
+	})
+
+	t.Run("タスクが失敗した場合は出力とエラーを返すこと", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		testee := taskRun.NewTaskRunService()
+		task, err := testee.Find(cfg, "test")
+		assert.NoError(t, err)
+
+		stdout, stderr, err := testee.Run(context.Background(), task, space.Dir)
+		assert.Error(t, err)
+		assert.Equal(t, "Stdout:\n\nStderr:\nFAILED\n\nError:\nexit status 1", taskRun.ErrorMessage(stdout, stderr, err))
+	})
+
+	t.Run("存在しないタスクの場合はエラーを返すこと", func(t *testing.T) {
+		testee := taskRun.NewTaskRunService()
+		_, err := testee.Find(cfg, "lint")
+		assert.ErrorContains(t, err, "task not found: lint")
+	})
+}
@@ -0,0 +1,226 @@
+package tokenBudget
+
+import (
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/kinds"
+	"github.com/t-kuni/sisho/domain/model/prompts"
+	"github.com/t-kuni/sisho/domain/model/tokens"
+	"sort"
+	"strings"
+)
+
+// truncatedMarker は切り詰めた知識の末尾に付与する文字列です。
+const truncatedMarker = "\n... (truncated by sisho)"
+
+// minKeepTokens は知識を切り詰める場合に最低限残すトークン数です。これを下回る場合は知識全体を削除します。
+const minKeepTokens = 200
+
+// dropOrder は知識を削除する順番です。先頭のkindから削除します。ここに無いkindは最初に削除します。
+var dropOrder = []kinds.KindName{
+	kinds.KindNameExamples,
+	kinds.KindNameImplementations,
+	kinds.KindNameDependencies,
+	kinds.KindNameSpecifications,
+}
+
+type TokenBudgetService struct{}
+
+func NewTokenBudgetService() *TokenBudgetService {
+	return &TokenBudgetService{}
+}
+
+// Cut は予算に収めるために削除または切り詰めた知識を表します。
+type Cut struct {
+	Path string
+	Kind string
+	// Tokens は削減した推定トークン数です
+	Tokens int
+	// Truncated がtrueの場合は末尾を切り詰めたこと、falseの場合は全体を削除したことを表します
+	Truncated bool
+}
+
+// Section はプロンプトの区分毎の推定トークン数を表します。
+type Section struct {
+	Name   string
+	Tokens int
+}
+
+// Fit はプロンプトの推定トークン数がbudgetに収まるように知識を削除または切り詰めます。
+// 削除する順番はdropOrderに従い、同じkindの中では推定トークン数の大きい順です。
+// budgetが0以下の場合は何もしません。
+// 知識を全て削除しても収まらない場合はエラーを返します。
+func (s *TokenBudgetService) Fit(param prompts.PromptParam, budget int) (prompts.PromptParam, []Cut, error) {
+	total, err := estimatePrompt(param)
+	if err != nil {
+		return prompts.PromptParam{}, nil, err
+	}
+	if budget <= 0 || total <= budget {
+		return param, nil, nil
+	}
+
+	type candidate struct {
+		set    int
+		index  int
+		rank   int
+		tokens int
+	}
+
+	var candidates []candidate
+	for i, set := range param.KnowledgeSets {
+		for j, k := range set.Knowledge {
+			if k.MediaType != "" {
+				// 添付ファイルはトークン数を推定できないため、削除・切り詰めの対象にしない
+				continue
+			}
+			candidates = append(candidates, candidate{
+				set:    i,
+				index:  j,
+				rank:   dropRank(set.Kind),
+				tokens: tokens.Estimate(k.Content),
+			})
+		}
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		if candidates[i].rank != candidates[j].rank {
+			return candidates[i].rank < candidates[j].rank
+		}
+		return candidates[i].tokens > candidates[j].tokens
+	})
+
+	contents := make([][]*string, len(param.KnowledgeSets))
+	for i, set := range param.KnowledgeSets {
+		contents[i] = make([]*string, len(set.Knowledge))
+		for j := range set.Knowledge {
+			content := set.Knowledge[j].Content
+			contents[i][j] = &content
+		}
+	}
+
+	var cuts []Cut
+	excess := total - budget
+	for _, c := range candidates {
+		if excess <= 0 {
+			break
+		}
+
+		k := param.KnowledgeSets[c.set].Knowledge[c.index]
+		keep := c.tokens - excess - tokens.Estimate(truncatedMarker)
+		if keep < minKeepTokens {
+			contents[c.set][c.index] = nil
+			excess -= c.tokens + tokens.Estimate(k.Path)
+			cuts = append(cuts, Cut{Path: k.Path, Kind: param.KnowledgeSets[c.set].Kind, Tokens: c.tokens})
+			continue
+		}
+
+		truncated := truncate(k.Content, keep) + truncatedMarker
+		reduced := c.tokens - tokens.Estimate(truncated)
+		contents[c.set][c.index] = &truncated
+		excess -= reduced
+		cuts = append(cuts, Cut{Path: k.Path, Kind: param.KnowledgeSets[c.set].Kind, Tokens: reduced, Truncated: true})
+	}
+
+	var knowledgeSets []prompts.KnowledgeSet
+	for i, set := range param.KnowledgeSets {
+		var knowledge []prompts.Knowledge
+		for j, k := range set.Knowledge {
+			if contents[i][j] == nil {
+				continue
+			}
+			k.Content = *contents[i][j]
+			knowledge = append(knowledge, k)
+		}
+		if len(knowledge) > 0 {
+			knowledgeSets = append(knowledgeSets, prompts.KnowledgeSet{Kind: set.Kind, Knowledge: knowledge})
+		}
+	}
+	param.KnowledgeSets = knowledgeSets
+
+	total, err = estimatePrompt(param)
+	if err != nil {
+		return prompts.PromptParam{}, nil, err
+	}
+	if total > budget {
+		return prompts.PromptParam{}, nil, eris.Errorf("prompt does not fit into the context window even after trimming knowledge (estimated %d tokens, budget %d tokens)", total, budget)
+	}
+
+	return param, cuts, nil
+}
+
+// EstimateSections はプロンプトの区分毎の推定トークン数と、プロンプト全体の推定トークン数を返します。
+// テンプレートの固定文言などは"Template"として計上します。
+func (s *TokenBudgetService) EstimateSections(param prompts.PromptParam) ([]Section, int, error) {
+	total, err := estimatePrompt(param)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	sections := []Section{
+		{Name: "Instructions", Tokens: tokens.Estimate(param.Instructions)},
+		{Name: "Folder Structure", Tokens: tokens.Estimate(param.FolderStructure)},
+	}
+	for _, set := range param.KnowledgeSets {
+		n := 0
+		for _, k := range set.Knowledge {
+			n += tokens.Estimate(k.Path) + tokens.Estimate(k.Content)
+		}
+		sections = append(sections, Section{Name: "Knowledge (" + set.Kind + ")", Tokens: n})
+	}
+	n := 0
+	for _, t := range param.Targets {
+		n += tokens.Estimate(t.Path) + tokens.Estimate(t.Content)
+	}
+	sections = append(sections, Section{Name: "Targets", Tokens: n})
+
+	rest := total
+	for _, section := range sections {
+		rest -= section.Tokens
+	}
+	if rest < 0 {
+		rest = 0
+	}
+	sections = append(sections, Section{Name: "Template", Tokens: rest})
+
+	return sections, total, nil
+}
+
+func estimatePrompt(param prompts.PromptParam) (int, error) {
+	prompt, err := prompts.BuildPrompt(param)
+	if err != nil {
+		return 0, eris.Wrap(err, "failed to build prompt")
+	}
+	return tokens.Estimate(prompt), nil
+}
+
+func dropRank(kind string) int {
+	for i, k := range dropOrder {
+		if string(k) == kind {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// truncate はcontentの先頭から推定トークン数がkeepTokensを超えない範囲を返します。
+// 可能な場合は行の区切りで切り詰めます。
+func truncate(content string, keepTokens int) string {
+	ascii := 0
+	other := 0
+	end := len(content)
+	for i, r := range content {
+		if r < 0x80 {
+			ascii++
+		} else {
+			other++
+		}
+		if (ascii+3)/4+other > keepTokens {
+			end = i
+			break
+		}
+	}
+
+	head := content[:end]
+	if idx := strings.LastIndex(head, "\n"); idx > 0 {
+		head = head[:idx]
+	}
+	return head
+}
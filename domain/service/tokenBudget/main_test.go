@@ -0,0 +1,153 @@
+package tokenBudget_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/model/prompts"
+	"github.com/t-kuni/sisho/domain/model/tokens"
+	"github.com/t-kuni/sisho/domain/service/tokenBudget"
+	"strings"
+	"testing"
+)
+
+func TestTokenBudgetService_Fit(t *testing.T) {
+	testee := tokenBudget.NewTokenBudgetService()
+
+	// 1行40文字（約10トークン）の行を指定した行数分並べたテキストを返す
+	text := func(lines int) string {
+		return strings.Repeat(strings.Repeat("a", 39)+"\n", lines)
+	}
+
+	param := func() prompts.PromptParam {
+		return prompts.PromptParam{
+			KnowledgeSets: []prompts.KnowledgeSet{
+				{
+					Kind: "specifications",
+					Knowledge: []prompts.Knowledge{
+						{Path: "spec.md", Content: text(100)},
+					},
+				},
+				{
+					Kind: "examples",
+					Knowledge: []prompts.Knowledge{
+						{Path: "small_example.go", Content: text(50)},
+						{Path: "large_example.go", Content: text(300)},
+					},
+				},
+			},
+			Targets: []prompts.Target{
+				{Path: "main.go", Content: "package main"},
+			},
+			GeneratePath: "main.go",
+		}
+	}
+
+	estimate := func(p prompts.PromptParam) int {
+		prompt, err := prompts.BuildPrompt(p)
+		assert.NoError(t, err)
+		return tokens.Estimate(prompt)
+	}
+
+	t.Run("予算に収まる場合は何も削除しないこと", func(t *testing.T) {
+		actual, cuts, err := testee.Fit(param(), estimate(param()))
+
+		assert.NoError(t, err)
+		assert.Empty(t, cuts)
+		assert.Equal(t, param(), actual)
+	})
+
+	t.Run("予算が0の場合は何も削除しないこと", func(t *testing.T) {
+		actual, cuts, err := testee.Fit(param(), 0)
+
+		assert.NoError(t, err)
+		assert.Empty(t, cuts)
+		assert.Equal(t, param(), actual)
+	})
+
+	t.Run("examplesの大きい知識から削除されること", func(t *testing.T) {
+		budget := estimate(param()) - 2900
+
+		actual, cuts, err := testee.Fit(param(), budget)
+
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, estimate(actual), budget)
+		assert.Len(t, cuts, 1)
+		assert.Equal(t, "large_example.go", cuts[0].Path)
+		assert.Equal(t, "examples", cuts[0].Kind)
+		assert.False(t, cuts[0].Truncated)
+		assert.Len(t, actual.KnowledgeSets, 2)
+		assert.Equal(t, "spec.md", actual.KnowledgeSets[0].Knowledge[0].Path)
+		assert.Equal(t, []prompts.Knowledge{{Path: "small_example.go", Content: text(50)}}, actual.KnowledgeSets[1].Knowledge)
+	})
+
+	t.Run("一部を削れば収まる場合は切り詰められること", func(t *testing.T) {
+		budget := estimate(param()) - 1000
+
+		actual, cuts, err := testee.Fit(param(), budget)
+
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, estimate(actual), budget)
+		assert.Len(t, cuts, 1)
+		assert.Equal(t, "large_example.go", cuts[0].Path)
+		assert.True(t, cuts[0].Truncated)
+		assert.Contains(t, actual.KnowledgeSets[1].Knowledge[1].Content, "(truncated by sisho)")
+	})
+
+	t.Run("examplesを削除しても収まらない場合はspecificationsも削除されること", func(t *testing.T) {
+		budget := estimate(param()) - 4400
+
+		actual, cuts, err := testee.Fit(param(), budget)
+
+		assert.NoError(t, err)
+		assert.LessOrEqual(t, estimate(actual), budget)
+		assert.Len(t, cuts, 3)
+		assert.Equal(t, "large_example.go", cuts[0].Path)
+		assert.Equal(t, "small_example.go", cuts[1].Path)
+		assert.Equal(t, "spec.md", cuts[2].Path)
+		assert.Empty(t, actual.KnowledgeSets)
+	})
+
+	t.Run("添付ファイルの知識は削除されないこと", func(t *testing.T) {
+		withAttachment := param()
+		mockup := prompts.Knowledge{Path: "mockup.png", MediaType: "image/png", Data: []byte("PNG")}
+		withAttachment.KnowledgeSets[1].Knowledge = append([]prompts.Knowledge{mockup}, withAttachment.KnowledgeSets[1].Knowledge...)
+		budget := estimate(withAttachment) - 2900
+
+		actual, cuts, err := testee.Fit(withAttachment, budget)
+
+		assert.NoError(t, err)
+		assert.Len(t, cuts, 1)
+		assert.Equal(t, "large_example.go", cuts[0].Path)
+		assert.Equal(t, []prompts.Knowledge{mockup, {Path: "small_example.go", Content: text(50)}}, actual.KnowledgeSets[1].Knowledge)
+	})
+
+	t.Run("知識を全て削除しても収まらない場合はエラーになること", func(t *testing.T) {
+		_, _, err := testee.Fit(param(), 10)
+
+		assert.Error(t, err)
+	})
+}
+
+func TestTokenBudgetService_EstimateSections(t *testing.T) {
+	testee := tokenBudget.NewTokenBudgetService()
+
+	param := prompts.PromptParam{
+		Instructions:    "instructions",
+		FolderStructure: "folder",
+		KnowledgeSets: []prompts.KnowledgeSet{
+			{Kind: "examples", Knowledge: []prompts.Knowledge{{Path: "a.go", Content: "aaaa"}}},
+		},
+		Targets: []prompts.Target{{Path: "main.go", Content: "package main"}},
+	}
+
+	sections, total, err := testee.EstimateSections(param)
+
+	assert.NoError(t, err)
+	var names []string
+	sum := 0
+	for _, section := range sections {
+		names = append(names, section.Name)
+		sum += section.Tokens
+	}
+	assert.Equal(t, []string{"Instructions", "Folder Structure", "Knowledge (examples)", "Targets", "Template"}, names)
+	assert.Equal(t, total, sum)
+}
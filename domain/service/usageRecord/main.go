@@ -0,0 +1,66 @@
+package usageRecord
+
+import (
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/model/chat"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/repository/usage"
+	"github.com/t-kuni/sisho/domain/system/timer"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+type UsageRecordService struct {
+	usageRepository usage.Repository
+	timer           timer.ITimer
+	// mu は並行して生成する場合に、usage.ymlの読み込みから書き込みまでを排他します
+	mu sync.Mutex
+}
+
+func NewUsageRecordService(usageRepository usage.Repository, timer timer.ITimer) *UsageRecordService {
+	return &UsageRecordService{
+		usageRepository: usageRepository,
+		timer:           timer,
+	}
+}
+
+// Record は履歴フォルダのusage.ymlにトークンの使用量を加算します。
+// usage.ymlが存在しない場合は、コマンド名・ドライバ・モデル・現在時刻と共に新規作成します。
+// フォールバックチェーンで回答した場合は、実際に回答したプロバイダーのドライバ・モデルを記録します。
+// 並行して呼び出しても加算が失われないよう、読み込みから書き込みまでを排他します。
+func (s *UsageRecordService) Record(historyDir string, command string, cfg *config.Config, result chat.SendResult) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	path := filepath.Join(historyDir, usage.FileName)
+
+	record := usage.Usage{
+		Command: command,
+		Driver:  cfg.LLM.Driver,
+		Model:   cfg.LLM.Model,
+		Time:    s.timer.Now(),
+	}
+	if result.Provider.Driver != "" {
+		record.Driver = result.Provider.Driver
+		record.Model = result.Provider.Model
+	}
+	if _, err := os.Stat(path); err == nil {
+		record, err = s.usageRepository.Read(path)
+		if err != nil {
+			return eris.Wrapf(err, "failed to read usage: %s", path)
+		}
+	}
+
+	record.InputTokens += result.Usage.InputTokens
+	record.OutputTokens += result.Usage.OutputTokens
+	record.CacheReadTokens += result.Usage.CacheReadTokens
+	record.CacheWriteTokens += result.Usage.CacheWriteTokens
+
+	err := s.usageRepository.Write(path, record)
+	if err != nil {
+		return eris.Wrapf(err, "failed to write usage: %s", path)
+	}
+
+	return nil
+}
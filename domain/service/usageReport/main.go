@@ -0,0 +1,202 @@
+package usageReport
+
+import (
+	"github.com/rotisserie/eris"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/repository/usage"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultPrices は組み込みの料金表です（USD / 1Mトークン）。
+// 同じモデルに複数の行が一致する場合は、Modelが最も長い行を使います。
+var DefaultPrices = []config.Price{
+	{Model: "claude-3-5-sonnet", Input: 3, Output: 15},
+	{Model: "claude-3-5-haiku", Input: 0.8, Output: 4},
+	{Model: "claude-3-opus", Input: 15, Output: 75},
+	{Model: "claude-3-sonnet", Input: 3, Output: 15},
+	{Model: "claude-3-haiku", Input: 0.25, Output: 1.25},
+	{Model: "gpt-4o-mini", Input: 0.15, Output: 0.6},
+	{Model: "gpt-4o", Input: 2.5, Output: 10},
+	{Model: "gpt-4-turbo", Input: 10, Output: 30},
+	{Model: "gpt-4", Input: 30, Output: 60},
+	{Model: "gpt-3.5-turbo", Input: 0.5, Output: 1.5},
+	{Model: "o1-mini", Input: 3, Output: 12},
+	{Model: "o1", Input: 15, Output: 60},
+}
+
+// デフォルトのプロンプトキャッシュの単価の、入力の単価に対する倍率です（Anthropicの料金体系）。
+const (
+	defaultCacheReadRate  = 0.1
+	defaultCacheWriteRate = 1.25
+)
+
+type UsageReportService struct {
+	usageRepository usage.Repository
+}
+
+func NewUsageReportService(usageRepository usage.Repository) *UsageReportService {
+	return &UsageReportService{
+		usageRepository: usageRepository,
+	}
+}
+
+// Report は集計結果を表します。
+type Report struct {
+	Days     []Row
+	Commands []Row
+	Models   []Row
+	Total    Row
+}
+
+// Row は集計の1行を表します。
+type Row struct {
+	Key          string
+	Runs         int
+	InputTokens  int
+	OutputTokens int
+	// CacheReadTokens, CacheWriteTokens はプロンプトキャッシュの読み込み・書き込みトークン数です（InputTokensには含みません）
+	CacheReadTokens  int
+	CacheWriteTokens int
+	// Cost は推定料金（USD）です。料金表に無いモデルの分は含みません。
+	Cost float64
+	// CostUnknown は料金表に無いモデルの記録が含まれる場合にtrueになります。
+	CostUnknown bool
+}
+
+// Collect はプロジェクトルートの.sishoフォルダ配下にある全てのusage.ymlを読み込みます。
+// sinceがゼロ値でない場合は、sinceより前の記録を除外します。
+func (s *UsageReportService) Collect(rootDir string, since time.Time) ([]usage.Usage, error) {
+	baseDir := filepath.Join(rootDir, ".sisho")
+	if _, err := os.Stat(baseDir); os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var records []usage.Usage
+	err := filepath.WalkDir(baseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || d.Name() != usage.FileName {
+			return nil
+		}
+
+		record, err := s.usageRepository.Read(path)
+		if err != nil {
+			return eris.Wrapf(err, "failed to read usage: %s", path)
+		}
+		if !since.IsZero() && record.Time.Before(since) {
+			return nil
+		}
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		return nil, eris.Wrap(err, "failed to collect usage")
+	}
+
+	return records, nil
+}
+
+// Summarize は記録を日別・コマンド別・モデル別に集計します。
+// 料金はpricesを優先し、一致しない場合はDefaultPricesを使います。
+func (s *UsageReportService) Summarize(records []usage.Usage, prices []config.Price) Report {
+	days := map[string]*Row{}
+	commands := map[string]*Row{}
+	models := map[string]*Row{}
+	total := Row{Key: "Total"}
+
+	for _, record := range records {
+		cost, known := estimateCost(record, prices)
+		for _, group := range []struct {
+			rows map[string]*Row
+			key  string
+		}{
+			{days, record.Time.Format("2006-01-02")},
+			{commands, record.Command},
+			{models, record.Model},
+		} {
+			row, ok := group.rows[group.key]
+			if !ok {
+				row = &Row{Key: group.key}
+				group.rows[group.key] = row
+			}
+			add(row, record, cost, known)
+		}
+		add(&total, record, cost, known)
+	}
+
+	return Report{
+		Days:     sortedRows(days),
+		Commands: sortedRows(commands),
+		Models:   sortedRows(models),
+		Total:    total,
+	}
+}
+
+// LookupPrice はモデルの料金を返します。pricesを優先し、一致しない場合はDefaultPricesから探します。
+func LookupPrice(prices []config.Price, model string) (config.Price, bool) {
+	if price, ok := lookup(prices, model); ok {
+		return price, true
+	}
+	return lookup(DefaultPrices, model)
+}
+
+func lookup(prices []config.Price, model string) (config.Price, bool) {
+	var found config.Price
+	ok := false
+	for _, price := range prices {
+		if strings.HasPrefix(model, price.Model) && len(price.Model) >= len(found.Model) {
+			found = price
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+func estimateCost(record usage.Usage, prices []config.Price) (float64, bool) {
+	price, ok := LookupPrice(prices, record.Model)
+	if !ok {
+		return 0, false
+	}
+	cacheRead := price.Input * defaultCacheReadRate
+	if price.CacheRead != nil {
+		cacheRead = *price.CacheRead
+	}
+	cacheWrite := price.Input * defaultCacheWriteRate
+	if price.CacheWrite != nil {
+		cacheWrite = *price.CacheWrite
+	}
+	cost := float64(record.InputTokens)*price.Input +
+		float64(record.OutputTokens)*price.Output +
+		float64(record.CacheReadTokens)*cacheRead +
+		float64(record.CacheWriteTokens)*cacheWrite
+	return cost / 1_000_000, true
+}
+
+func add(row *Row, record usage.Usage, cost float64, known bool) {
+	row.Runs++
+	row.InputTokens += record.InputTokens
+	row.OutputTokens += record.OutputTokens
+	row.CacheReadTokens += record.CacheReadTokens
+	row.CacheWriteTokens += record.CacheWriteTokens
+	row.Cost += cost
+	if !known {
+		row.CostUnknown = true
+	}
+}
+
+func sortedRows(rows map[string]*Row) []Row {
+	result := make([]Row, 0, len(rows))
+	for _, row := range rows {
+		result = append(result, *row)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
@@ -0,0 +1,54 @@
+package usageReport_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/repository/config"
+	"github.com/t-kuni/sisho/domain/repository/usage"
+	"github.com/t-kuni/sisho/domain/service/usageReport"
+	"github.com/t-kuni/sisho/testUtil"
+	"testing"
+)
+
+func TestUsageReportService_Summarize(t *testing.T) {
+	t.Run("プロンプトキャッシュの読み込み・書き込みトークン数が集計され、入力の単価の倍率で料金に含まれること", func(t *testing.T) {
+		records := []usage.Usage{
+			{
+				Command:          "make",
+				Model:            "claude-3-5-sonnet-20240620",
+				Time:             testUtil.NewTime("2022-01-01T10:00:00Z"),
+				InputTokens:      1000000,
+				OutputTokens:     100000,
+				CacheReadTokens:  2000000,
+				CacheWriteTokens: 1000000,
+			},
+		}
+
+		report := usageReport.NewUsageReportService(nil).Summarize(records, nil)
+
+		assert.Equal(t, 2000000, report.Total.CacheReadTokens)
+		assert.Equal(t, 1000000, report.Total.CacheWriteTokens)
+		// 入力3 + 出力1.5 + 読み込み2*0.3 + 書き込み1*3.75
+		assert.InDelta(t, 8.85, report.Total.Cost, 1e-9)
+		assert.Equal(t, report.Total.CacheReadTokens, report.Models[0].CacheReadTokens)
+	})
+
+	t.Run("料金表にキャッシュの単価がある場合はその単価が使われること", func(t *testing.T) {
+		cacheRead := 0.5
+		cacheWrite := 2.0
+		records := []usage.Usage{
+			{
+				Command:          "q",
+				Model:            "claude-3-5-sonnet-20240620",
+				Time:             testUtil.NewTime("2022-01-01T10:00:00Z"),
+				CacheReadTokens:  1000000,
+				CacheWriteTokens: 1000000,
+			},
+		}
+
+		report := usageReport.NewUsageReportService(nil).Summarize(records, []config.Price{
+			{Model: "claude-3-5-sonnet", Input: 3, Output: 15, CacheRead: &cacheRead, CacheWrite: &cacheWrite},
+		})
+
+		assert.InDelta(t, 2.5, report.Total.Cost, 1e-9)
+	})
+}
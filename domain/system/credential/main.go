@@ -0,0 +1,53 @@
+//go:generate mockgen -source=$GOFILE -destination=${GOFILE}_mock.go -package=$GOPACKAGE
+
+package credential
+
+import (
+	"context"
+	"fmt"
+)
+
+// Source はAPIキーの取得元です。Env、File、Commandのいずれか1つを指定します。
+type Source struct {
+	// Env はAPIキーを格納している環境変数名です。
+	Env string
+	// File はAPIキーを記載したファイルのパスです。`~/`で始まる場合はホームディレクトリからのパスです。
+	File string
+	// Command は標準出力にAPIキーを出力するコマンドです（パスワードマネージャー等）。シェルで実行します。
+	Command string
+}
+
+// IsZero は取得元が指定されていないかどうかを返します。
+func (s Source) IsZero() bool {
+	return s.Env == "" && s.File == "" && s.Command == ""
+}
+
+// String はエラーメッセージに含める取得元の説明を返します。APIキーそのものは含みません。
+func (s Source) String() string {
+	switch {
+	case s.Command != "":
+		return fmt.Sprintf("api-key-command `%s`", s.Command)
+	case s.File != "":
+		return fmt.Sprintf("file %s", s.File)
+	case s.Env != "":
+		return fmt.Sprintf("environment variable %s", s.Env)
+	default:
+		return "no source"
+	}
+}
+
+// Credential はAPIキーを必要になった時点で取得元から読み込みます。
+type Credential interface {
+	// APIKey はAPIキーを返します。最初の呼び出しで取得元から読み込み、以降は読み込んだ値を返します。
+	// 取得元から読み込めない場合、または空の場合はエラーを返します。
+	APIKey(ctx context.Context) (string, error)
+	// Source はAPIキーの取得元を返します。
+	Source() Source
+}
+
+// Provider はCredentialを生成するインターフェースです。
+type Provider interface {
+	// Credential はsourceからAPIキーを読み込むCredentialを返します。この時点ではAPIキーを読み込みません。
+	// 同じsourceには同じCredentialを返すため、APIキーを読み込むのは1回です。
+	Credential(source Source) Credential
+}
@@ -0,0 +1,15 @@
+//go:generate mockgen -source=$GOFILE -destination=${GOFILE}_mock.go -package=$GOPACKAGE
+
+package git
+
+// Git はローカルのgitコマンドでリポジトリを操作します。dirはリポジトリ内のフォルダ、pathsはdirからの相対パスまたは絶対パスです。
+type Git interface {
+	// IsRepository はdirがgitのワークツリーの中にあるかどうかを返します。
+	IsRepository(dir string) bool
+	// DirtyFiles はpathsのうち、コミットされていない変更があるファイル（未追跡のファイルを含む）を、リポジトリのルートからの相対パスで返します。
+	DirtyFiles(dir string, paths []string) ([]string, error)
+	// CreateBranch は現在のコミットからnameのブランチを作成して切り替えます。
+	CreateBranch(dir, name string) error
+	// Commit はpathsの変更だけをmessageでコミットします（既にステージされている他の変更はコミットしません）。
+	Commit(dir string, paths []string, message string) error
+}
@@ -0,0 +1,11 @@
+//go:generate mockgen -source=$GOFILE -destination=${GOFILE}_mock.go -package=$GOPACKAGE
+
+package terminal
+
+// Terminal は利用者に入力を求めるための端末です。
+type Terminal interface {
+	// ReadLine は利用者が入力した1行を、末尾の改行を除いて返します。
+	ReadLine() (string, error)
+	// Edit はtextをエディタで開き、編集後のテキストを返します。
+	Edit(text string) (string, error)
+}
@@ -3,37 +3,55 @@ package claude
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	"github.com/t-kuni/sisho/domain/external/claude"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/external/retry"
 	"io"
-	"os"
 	"strings"
 )
 
+const apiURL = "https://api.anthropic.com/v1/messages"
+
+// defaultMaxTokens is the max_tokens sent when options.MaxTokens is not specified.
+const defaultMaxTokens = 8192
+
 type ClaudeClient struct {
-	apiKey string
+	// apiKey is used when options.Credential is nil.
+	apiKey   string
+	endpoint string
 }
 
 // NewClaudeClient initializes a new client for Claude API with necessary settings.
+// The API key is resolved from options.Credential when a request is sent.
 func NewClaudeClient() *ClaudeClient {
-	apiKey := os.Getenv("ANTHROPIC_API_KEY")
-	if apiKey == "" {
-		panic("Anthropic APIキーが設定されていません")
-	}
-	return &ClaudeClient{apiKey: apiKey}
+	return &ClaudeClient{endpoint: apiURL}
 }
 
 // SendMessage sends an array of Message to Claude API and waits for a response.
-func (c *ClaudeClient) SendMessage(messages []claude.Message, model string) (claude.GenerationResult, error) {
-	client := resty.New()
+// Rate limits, overloaded errors, 5xx responses and overloaded_error/api_error events in the stream are retried according to options.Retry.
+// A failure after text has been passed to options.OnDelta is not retried.
+func (c *ClaudeClient) SendMessage(ctx context.Context, messages []claude.Message, model string, options claude.SendOptions) (claude.GenerationResult, error) {
+	maxTokens := options.MaxTokens
+	if maxTokens == 0 {
+		maxTokens = defaultMaxTokens
+	}
 
 	requestBody := ClaudeRequest{
-		Model:     model,
-		MaxTokens: 8192,
-		Messages:  convertMessages(messages),
-		Stream:    true,
+		Model:         model,
+		MaxTokens:     maxTokens,
+		System:        options.System,
+		Messages:      convertMessages(messages),
+		Temperature:   options.Temperature,
+		TopP:          options.TopP,
+		StopSequences: options.Stop,
+		Tools:         convertTools(options.Tools),
+		ToolChoice:    convertToolChoice(options.ToolChoice),
+		Stream:        true,
 	}
 
 	jsonBody, err := json.Marshal(requestBody)
@@ -41,28 +59,73 @@ func (c *ClaudeClient) SendMessage(messages []claude.Message, model string) (cla
 		return claude.GenerationResult{}, err
 	}
 
+	apiKey, source, err := c.resolveAPIKey(ctx, options.Credential)
+	if err != nil {
+		return claude.GenerationResult{}, err
+	}
+
+	var result claude.GenerationResult
+	err = retry.DoStream(ctx, options.Retry, options.OnRetry, options.OnDelta, func(ctx context.Context, onDelta func(delta string)) error {
+		var err error
+		result, err = c.send(ctx, apiKey, source, jsonBody, onDelta)
+		return err
+	})
+	if err != nil {
+		return claude.GenerationResult{}, err
+	}
+
+	return result, nil
+}
+
+// resolveAPIKey returns the API key used for the request and the description of its source.
+// The key is read from cred when it is not nil, otherwise the key set to the client is used.
+func (c *ClaudeClient) resolveAPIKey(ctx context.Context, cred credential.Credential) (string, string, error) {
+	if cred == nil {
+		if c.apiKey == "" {
+			return "", "", fmt.Errorf("Anthropic API key is not configured")
+		}
+		return c.apiKey, "the client setting", nil
+	}
+	apiKey, err := cred.APIKey(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the Anthropic API key: %w", err)
+	}
+	return apiKey, cred.Source().String(), nil
+}
+
+// send performs a single request to Claude API.
+// source is the description of where apiKey came from. It is included in the error when the authentication fails.
+func (c *ClaudeClient) send(ctx context.Context, apiKey string, source string, jsonBody []byte, onDelta func(delta string)) (claude.GenerationResult, error) {
+	client := resty.New()
+
 	resp, err := client.R().
-		SetHeader("x-api-key", c.apiKey).
+		SetContext(ctx).
+		SetHeader("x-api-key", apiKey).
 		SetHeader("anthropic-version", "2023-06-01").
 		SetHeader("Content-Type", "application/json").
 		SetBody(jsonBody).
 		SetDoNotParseResponse(true).
-		Post("https://api.anthropic.com/v1/messages")
+		Post(c.endpoint)
 
 	if err != nil {
-		return claude.GenerationResult{}, err
+		return claude.GenerationResult{}, retry.NewError(err, true, 0)
 	}
 	defer resp.RawBody().Close()
 
 	if resp.StatusCode() != 200 {
 		b, _ := io.ReadAll(resp.RawBody())
-		return claude.GenerationResult{}, fmt.Errorf("API request failed with status code: %d and response: %s", resp.StatusCode(), string(b))
+		err := fmt.Errorf("API request failed with status code: %d and response: %s", resp.StatusCode(), string(b))
+		if retry.IsAuthStatus(resp.StatusCode()) {
+			err = fmt.Errorf("authentication failed with the API key from %s: %w", source, err)
+		}
+		return claude.GenerationResult{}, retry.NewError(err, retry.IsRetryableStatus(resp.StatusCode()), retry.ParseRetryAfter(resp.Header().Get("retry-after")))
 	}
 
-	return processStreamResponse(resp.RawBody())
+	return processStreamResponse(resp.RawBody(), onDelta)
 }
 
 // convertMessages converts domain messages to infrastructure layer messages.
+// A message with blocks is sent as an array of text content blocks, otherwise as a plain string.
 func convertMessages(messages []claude.Message) []Message {
 	converted := make([]Message, len(messages))
 	for i, msg := range messages {
@@ -70,15 +133,79 @@ func convertMessages(messages []claude.Message) []Message {
 			Role:    msg.Role,
 			Content: msg.Content,
 		}
+		if len(msg.Blocks) > 0 {
+			blocks := make([]ContentBlock, len(msg.Blocks))
+			for j, block := range msg.Blocks {
+				blocks[j] = convertBlock(block)
+			}
+			converted[i].Content = blocks
+		}
+	}
+	return converted
+}
+
+// convertBlock converts a domain content block to a text, tool_use or tool_result block.
+func convertBlock(block claude.ContentBlock) ContentBlock {
+	var converted ContentBlock
+	switch {
+	case block.ToolUse != nil:
+		input := json.RawMessage(block.ToolUse.Input)
+		if !json.Valid(input) {
+			input = json.RawMessage("{}")
+		}
+		converted = ContentBlock{Type: "tool_use", ID: block.ToolUse.ID, Name: block.ToolUse.Name, Input: &input}
+	case block.ToolResult != nil:
+		converted = ContentBlock{Type: "tool_result", ToolUseID: block.ToolResult.ToolUseID, Content: block.ToolResult.Content}
+	case block.Attachment != nil:
+		blockType := "document"
+		if strings.HasPrefix(block.Attachment.MediaType, "image/") {
+			blockType = "image"
+		}
+		converted = ContentBlock{Type: blockType, Source: &Source{
+			Type:      "base64",
+			MediaType: block.Attachment.MediaType,
+			Data:      base64.StdEncoding.EncodeToString(block.Attachment.Data),
+		}}
+	default:
+		converted = ContentBlock{Type: "text", Text: &block.Text}
+	}
+	if block.Cache {
+		converted.CacheControl = &CacheControl{Type: "ephemeral"}
+	}
+	return converted
+}
+
+// convertToolChoice forces the model to call the named tool. It returns nil if name is empty.
+func convertToolChoice(name string) *ToolChoice {
+	if name == "" {
+		return nil
+	}
+	return &ToolChoice{Type: "tool", Name: name}
+}
+
+// convertTools converts domain tools to the tools of the request.
+func convertTools(tools []claude.Tool) []Tool {
+	var converted []Tool
+	for _, tool := range tools {
+		converted = append(converted, Tool{
+			Name:        tool.Name,
+			Description: tool.Description,
+			InputSchema: tool.InputSchema,
+		})
 	}
 	return converted
 }
 
 // processStreamResponse handles the streaming response from Claude API.
-func processStreamResponse(body io.ReadCloser) (claude.GenerationResult, error) {
+// onDelta is called with each text delta as it arrives, if not nil.
+func processStreamResponse(body io.Reader, onDelta func(delta string)) (claude.GenerationResult, error) {
 	reader := bufio.NewReader(body)
 	var fullResponse strings.Builder
 	var terminationReason string
+	var usage claude.Usage
+	var toolUses []claude.ToolUse
+	// toolUseIndexes maps the index of a tool_use content block to the position in toolUses
+	toolUseIndexes := map[int]int{}
 
 	for {
 		line, err := reader.ReadBytes('\n')
@@ -86,7 +213,7 @@ func processStreamResponse(body io.ReadCloser) (claude.GenerationResult, error)
 			if err == io.EOF {
 				break
 			}
-			return claude.GenerationResult{}, err
+			return claude.GenerationResult{}, retry.NewError(err, true, 0)
 		}
 
 		line = bytes.TrimSpace(line)
@@ -104,43 +231,145 @@ func processStreamResponse(body io.ReadCloser) (claude.GenerationResult, error)
 			return claude.GenerationResult{}, err
 		}
 
-		if streamResp.Type == "content_block_delta" {
+		if streamResp.Type == "error" {
+			err := fmt.Errorf("API returned an error event: %s: %s", streamResp.Error.Type, streamResp.Error.Message)
+			return claude.GenerationResult{}, retry.NewError(err, isRetryableErrorType(streamResp.Error.Type), 0)
+		}
+
+		if streamResp.Type == "message_start" {
+			usage.InputTokens = streamResp.Message.Usage.InputTokens
+			usage.OutputTokens = streamResp.Message.Usage.OutputTokens
+			usage.CacheCreationInputTokens = streamResp.Message.Usage.CacheCreationInputTokens
+			usage.CacheReadInputTokens = streamResp.Message.Usage.CacheReadInputTokens
+		} else if streamResp.Type == "content_block_start" && streamResp.ContentBlock.Type == "tool_use" {
+			toolUseIndexes[streamResp.Index] = len(toolUses)
+			toolUses = append(toolUses, claude.ToolUse{
+				ID:   streamResp.ContentBlock.ID,
+				Name: streamResp.ContentBlock.Name,
+			})
+		} else if streamResp.Type == "content_block_delta" && streamResp.Delta.Type == "input_json_delta" {
+			if i, ok := toolUseIndexes[streamResp.Index]; ok {
+				toolUses[i].Input += streamResp.Delta.PartialJSON
+			}
+		} else if streamResp.Type == "content_block_delta" {
 			fullResponse.WriteString(streamResp.Delta.Text)
-		} else if streamResp.Type == "message_delta" && streamResp.Delta.StopReason != "" {
-			terminationReason = streamResp.Delta.StopReason
+			if onDelta != nil && streamResp.Delta.Text != "" {
+				onDelta(streamResp.Delta.Text)
+			}
+		} else if streamResp.Type == "message_delta" {
+			if streamResp.Delta.StopReason != "" {
+				terminationReason = streamResp.Delta.StopReason
+			}
+			// message_deltaのoutput_tokensは累積値
+			if streamResp.Usage.OutputTokens > 0 {
+				usage.OutputTokens = streamResp.Usage.OutputTokens
+			}
 		}
 	}
 
 	return claude.GenerationResult{
 		Content:           fullResponse.String(),
 		TerminationReason: terminationReason,
+		Usage:             usage,
+		ToolUses:          toolUses,
 	}, nil
 }
 
+// isRetryableErrorType reports whether an error event in the stream should be retried.
+// Only temporary failures on the API side are retried. Other errors (invalid_request_error etc.) fail again on retry.
+func isRetryableErrorType(errorType string) bool {
+	return errorType == "overloaded_error" || errorType == "api_error"
+}
+
 type ClaudeRequest struct {
-	Model     string    `json:"model"`
-	Messages  []Message `json:"messages"`
-	MaxTokens int       `json:"max_tokens"`
-	Stream    bool      `json:"stream"`
+	Model         string      `json:"model"`
+	System        string      `json:"system,omitempty"`
+	Messages      []Message   `json:"messages"`
+	MaxTokens     int         `json:"max_tokens"`
+	Temperature   *float64    `json:"temperature,omitempty"`
+	TopP          *float64    `json:"top_p,omitempty"`
+	StopSequences []string    `json:"stop_sequences,omitempty"`
+	Tools         []Tool      `json:"tools,omitempty"`
+	ToolChoice    *ToolChoice `json:"tool_choice,omitempty"`
+	Stream        bool        `json:"stream"`
+}
+
+type ToolChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name,omitempty"`
+}
+
+type Tool struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	InputSchema map[string]interface{} `json:"input_schema"`
 }
 
 type Message struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role string `json:"role"`
+	// Content is either a string or []ContentBlock.
+	Content interface{} `json:"content"`
+}
+
+type ContentBlock struct {
+	Type string `json:"type"`
+	// Text is set for a text block
+	Text *string `json:"text,omitempty"`
+	// ID, Name and Input are set for a tool_use block
+	ID    string           `json:"id,omitempty"`
+	Name  string           `json:"name,omitempty"`
+	Input *json.RawMessage `json:"input,omitempty"`
+	// ToolUseID and Content are set for a tool_result block
+	ToolUseID string `json:"tool_use_id,omitempty"`
+	Content   string `json:"content,omitempty"`
+	// Source is set for an image or document block
+	Source       *Source       `json:"source,omitempty"`
+	CacheControl *CacheControl `json:"cache_control,omitempty"`
+}
+
+type Source struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type CacheControl struct {
+	Type string `json:"type"`
 }
 
 type StreamResponse struct {
-	Type    string `json:"type"`
+	Type  string `json:"type"`
+	Index int    `json:"index"`
+	// ContentBlock is sent with content_block_start
+	ContentBlock struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"content_block"`
 	Message struct {
 		Content []struct {
 			Text string `json:"text"`
 			Type string `json:"type"`
 		} `json:"content"`
-		Role string `json:"role"`
+		Role  string `json:"role"`
+		Usage Usage  `json:"usage"`
 	} `json:"message"`
 	Delta struct {
-		Type       string `json:"type"`
-		Text       string `json:"text"`
-		StopReason string `json:"stop_reason"`
+		Type        string `json:"type"`
+		Text        string `json:"text"`
+		PartialJSON string `json:"partial_json"`
+		StopReason  string `json:"stop_reason"`
 	}
+	Usage Usage `json:"usage"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+type Usage struct {
+	InputTokens              int `json:"input_tokens"`
+	OutputTokens             int `json:"output_tokens"`
+	CacheCreationInputTokens int `json:"cache_creation_input_tokens"`
+	CacheReadInputTokens     int `json:"cache_read_input_tokens"`
 }
@@ -1,13 +1,23 @@
 package claude
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/domain/external/claude"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	domainCredential "github.com/t-kuni/sisho/domain/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestClaudeClient_SendMessage_Integration(t *testing.T) {
@@ -31,9 +41,521 @@ func TestClaudeClient_SendMessage_Integration(t *testing.T) {
 	model := "claude-3-5-sonnet-20240620"
 
 	client := NewClaudeClient()
-	result, err := client.SendMessage(messages, model)
+	result, err := client.SendMessage(context.Background(), messages, model, claude.SendOptions{
+		Credential: credential.NewProvider().Credential(domainCredential.Source{Env: "ANTHROPIC_API_KEY"}),
+	})
 
 	assert.NoError(t, err)
 	assert.NotEmpty(t, result.Content)
 	assert.NotEmpty(t, result.TerminationReason)
 }
+
+func TestProcessStreamResponse(t *testing.T) {
+	t.Run("受信したテキストの断片がOnDeltaに渡されること", func(t *testing.T) {
+		body := strings.NewReader(`event: message_start
+data: {"type":"message_start","message":{"content":[],"role":"assistant"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":" World"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"}}
+
+event: message_stop
+data: {"type":"message_stop"}
+`)
+
+		var deltas []string
+		result, err := processStreamResponse(body, func(delta string) {
+			deltas = append(deltas, delta)
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Hello", " World"}, deltas)
+		assert.Equal(t, "Hello World", result.Content)
+		assert.Equal(t, "end_turn", result.TerminationReason)
+	})
+
+	t.Run("トークンの使用量が取得できること", func(t *testing.T) {
+		body := strings.NewReader(`event: message_start
+data: {"type":"message_start","message":{"content":[],"role":"assistant","usage":{"input_tokens":25,"output_tokens":1}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Hello"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}
+`)
+
+		result, err := processStreamResponse(body, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, claude.Usage{InputTokens: 25, OutputTokens: 15}, result.Usage)
+	})
+
+	t.Run("プロンプトキャッシュのトークン数が取得できること", func(t *testing.T) {
+		body := strings.NewReader(`event: message_start
+data: {"type":"message_start","message":{"content":[],"role":"assistant","usage":{"input_tokens":25,"output_tokens":1,"cache_creation_input_tokens":1000,"cache_read_input_tokens":3000}}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"end_turn"},"usage":{"output_tokens":15}}
+`)
+
+		result, err := processStreamResponse(body, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, claude.Usage{
+			InputTokens:              25,
+			OutputTokens:             15,
+			CacheCreationInputTokens: 1000,
+			CacheReadInputTokens:     3000,
+		}, result.Usage)
+	})
+
+	t.Run("ツールの呼び出しが取得できること", func(t *testing.T) {
+		body := strings.NewReader(`event: content_block_start
+data: {"type":"content_block_start","index":0,"content_block":{"type":"text","text":""}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":0,"delta":{"type":"text_delta","text":"Let me check."}}
+
+event: content_block_start
+data: {"type":"content_block_start","index":1,"content_block":{"type":"tool_use","id":"toolu_01","name":"read_file","input":{}}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":"{\"path\":"}}
+
+event: content_block_delta
+data: {"type":"content_block_delta","index":1,"delta":{"type":"input_json_delta","partial_json":" \"main.go\"}"}}
+
+event: message_delta
+data: {"type":"message_delta","delta":{"stop_reason":"tool_use"}}
+`)
+
+		result, err := processStreamResponse(body, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Let me check.", result.Content)
+		assert.Equal(t, "tool_use", result.TerminationReason)
+		assert.Equal(t, []claude.ToolUse{
+			{ID: "toolu_01", Name: "read_file", Input: `{"path": "main.go"}`},
+		}, result.ToolUses)
+	})
+}
+
+func TestClaudeClient_SendMessage(t *testing.T) {
+	t.Run("システムプロンプトがsystemフィールドで送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req ClaudeRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.Equal(t, "日本語で回答してください", req.System)
+			assert.Equal(t, "user", req.Messages[0].Role)
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{System: "日本語で回答してください"})
+
+		assert.NoError(t, err)
+	})
+}
+
+func TestClaudeClient_SendMessage_ContentBlocks(t *testing.T) {
+	t.Run("Blocksが指定されたメッセージはコンテンツブロックの配列で送信され、キャッシュするブロックにcache_controlが付与されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{
+				"model": "claude-3-5-sonnet-20240620",
+				"max_tokens": 8192,
+				"stream": true,
+				"messages": [
+					{"role": "user", "content": "PREVIOUS"},
+					{"role": "assistant", "content": "ANSWER"},
+					{"role": "user", "content": [
+						{"type": "text", "text": "SHARED", "cache_control": {"type": "ephemeral"}},
+						{"type": "text", "text": "TARGET"}
+					]}
+				]
+			}`, string(b))
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "PREVIOUS"},
+			{Role: "assistant", Content: "ANSWER"},
+			{Role: "user", Content: "SHAREDTARGET", Blocks: []claude.ContentBlock{
+				{Text: "SHARED", Cache: true},
+				{Text: "TARGET"},
+			}},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{})
+
+		assert.NoError(t, err)
+	})
+	t.Run("添付ファイルは画像の場合imageブロック、PDFの場合documentブロックでbase64エンコードして送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{
+				"model": "claude-3-5-sonnet-20240620",
+				"max_tokens": 8192,
+				"stream": true,
+				"messages": [
+					{"role": "user", "content": [
+						{"type": "text", "text": "mockup.png"},
+						{"type": "image", "source": {"type": "base64", "media_type": "image/png", "data": "UE5H"}},
+						{"type": "text", "text": "design.pdf"},
+						{"type": "document", "source": {"type": "base64", "media_type": "application/pdf", "data": "UERG"}},
+						{"type": "text", "text": "PROMPT"}
+					]}
+				]
+			}`, string(b))
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "PROMPT", Blocks: []claude.ContentBlock{
+				{Text: "mockup.png"},
+				{Attachment: &claude.Attachment{MediaType: "image/png", Data: []byte("PNG")}},
+				{Text: "design.pdf"},
+				{Attachment: &claude.Attachment{MediaType: "application/pdf", Data: []byte("PDF")}},
+				{Text: "PROMPT"},
+			}},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{})
+
+		assert.NoError(t, err)
+	})
+}
+
+func TestClaudeClient_SendMessage_Tools(t *testing.T) {
+	t.Run("ツールの定義とツールの呼び出し、その結果がコンテンツブロックで送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			b, err := io.ReadAll(r.Body)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{
+				"model": "claude-3-5-sonnet-20240620",
+				"max_tokens": 8192,
+				"stream": true,
+				"tools": [
+					{"name": "read_file", "description": "Read a file", "input_schema": {"type": "object"}}
+				],
+				"messages": [
+					{"role": "user", "content": "PROMPT"},
+					{"role": "assistant", "content": [
+						{"type": "text", "text": "Let me check."},
+						{"type": "tool_use", "id": "toolu_01", "name": "read_file", "input": {"path": "main.go"}}
+					]},
+					{"role": "user", "content": [
+						{"type": "tool_result", "tool_use_id": "toolu_01", "content": "package main"}
+					]}
+				]
+			}`, string(b))
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "PROMPT"},
+			{Role: "assistant", Blocks: []claude.ContentBlock{
+				{Text: "Let me check."},
+				{ToolUse: &claude.ToolUse{ID: "toolu_01", Name: "read_file", Input: `{"path":"main.go"}`}},
+			}},
+			{Role: "user", Blocks: []claude.ContentBlock{
+				{ToolResult: &claude.ToolResult{ToolUseID: "toolu_01", Content: "package main"}},
+			}},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Tools: []claude.Tool{
+				{Name: "read_file", Description: "Read a file", InputSchema: map[string]interface{}{"type": "object"}},
+			},
+		})
+
+		assert.NoError(t, err)
+	})
+	t.Run("ToolChoiceが指定された場合、tool_choiceでツールの呼び出しが強制されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req ClaudeRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			if assert.NotNil(t, req.ToolChoice) {
+				assert.Equal(t, ToolChoice{Type: "tool", Name: "extract_paths"}, *req.ToolChoice)
+			}
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"tool_use\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "PROMPT"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Tools: []claude.Tool{
+				{Name: "extract_paths", InputSchema: map[string]interface{}{"type": "object"}},
+			},
+			ToolChoice: "extract_paths",
+		})
+
+		assert.NoError(t, err)
+	})
+}
+
+func TestClaudeClient_SendMessage_GenerationParams(t *testing.T) {
+	t.Run("生成パラメータが指定されていない場合、max_tokensはデフォルト値が送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			assert.Equal(t, float64(8192), body["max_tokens"])
+			assert.NotContains(t, body, "temperature")
+			assert.NotContains(t, body, "top_p")
+			assert.NotContains(t, body, "stop_sequences")
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("指定した生成パラメータが送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req ClaudeRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.Equal(t, 1024, req.MaxTokens)
+			assert.Equal(t, 0.5, *req.Temperature)
+			assert.Equal(t, 0.9, *req.TopP)
+			assert.Equal(t, []string{"END"}, req.StopSequences)
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		temperature := 0.5
+		topP := 0.9
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			MaxTokens:   1024,
+			Temperature: &temperature,
+			TopP:        &topP,
+			Stop:        []string{"END"},
+		})
+
+		assert.NoError(t, err)
+	})
+}
+
+func TestClaudeClient_SendMessage_Retry(t *testing.T) {
+	policy := retry.Policy{
+		MaxAttempts: 3,
+		InitialWait: time.Millisecond,
+		MaxWait:     5 * time.Millisecond,
+	}
+
+	t.Run("overloadedエラーの場合、再試行されること", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.WriteHeader(529)
+				w.Write([]byte(`{"type":"error","error":{"type":"overloaded_error","message":"Overloaded"}}`))
+				return
+			}
+			w.Write([]byte("data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n"))
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		var events []retry.Event
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		result, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Retry: policy,
+			OnRetry: func(event retry.Event) {
+				events = append(events, event)
+			},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, 2, calls)
+		assert.Len(t, events, 1)
+		assert.ErrorContains(t, events[0].Err, "529")
+	})
+
+	t.Run("Stream中にerrorイベントを受信した場合、再試行されること", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Write([]byte("data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n"))
+				w.Write([]byte("data: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n"))
+				return
+			}
+			w.Write([]byte("data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		result, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{Retry: policy})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("Stream中に再試行しても成功しないerrorイベントを受信した場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Write([]byte("data: {\"type\":\"error\",\"error\":{\"type\":\"invalid_request_error\",\"message\":\"prompt is too long\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{Retry: policy})
+
+		assert.ErrorContains(t, err, "invalid_request_error: prompt is too long")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("OnDeltaにテキストを渡した後にStreamが失敗した場合、テキストが重複しないように再試行されないこと", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Write([]byte("data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hel\"}}\n\n"))
+			w.Write([]byte("data: {\"type\":\"error\",\"error\":{\"type\":\"overloaded_error\",\"message\":\"Overloaded\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		var deltas []string
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Retry: policy,
+			OnDelta: func(delta string) {
+				deltas = append(deltas, delta)
+			},
+		})
+
+		assert.ErrorContains(t, err, "overloaded_error")
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, []string{"Hel"}, deltas)
+	})
+
+	t.Run("400エラーの場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type":"error","error":{"type":"invalid_request_error","message":"invalid"}}`))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{Retry: policy})
+
+		assert.ErrorContains(t, err, "invalid_request_error")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("認証に失敗した場合、APIキーの取得元がエラーメッセージに含まれ、再試行されないこと", func(t *testing.T) {
+		t.Setenv("TEST_ANTHROPIC_KEY", "wrong-key")
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			assert.Equal(t, "wrong-key", r.Header.Get("x-api-key"))
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"type":"error","error":{"type":"authentication_error","message":"invalid x-api-key"}}`))
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Retry:      policy,
+			Credential: credential.NewProvider().Credential(domainCredential.Source{Env: "TEST_ANTHROPIC_KEY"}),
+		})
+
+		assert.ErrorContains(t, err, "authentication failed with the API key from environment variable TEST_ANTHROPIC_KEY")
+		assert.ErrorContains(t, err, "authentication_error")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("APIキーが読み込めない場合、送信せずにエラーになること", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+		}))
+		defer server.Close()
+
+		client := &ClaudeClient{endpoint: server.URL}
+		_, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Credential: credential.NewProvider().Credential(domainCredential.Source{Env: "SISHO_TEST_UNSET_KEY"}),
+		})
+
+		assert.ErrorContains(t, err, "environment variable SISHO_TEST_UNSET_KEY is not set")
+		assert.Equal(t, 0, calls)
+	})
+
+	t.Run("Streamの途中で制限時間を超えた場合、受信を中止して再試行されること", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Write([]byte("data: {\"type\":\"content_block_delta\",\"delta\":{\"type\":\"text_delta\",\"text\":\"Hello\"}}\n\n"))
+			if calls == 1 {
+				// 応答が止まったStreamを再現する
+				w.(http.Flusher).Flush()
+				<-r.Context().Done()
+				return
+			}
+			w.Write([]byte("data: {\"type\":\"message_delta\",\"delta\":{\"stop_reason\":\"end_turn\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		timeoutPolicy := policy
+		timeoutPolicy.Timeout = 50 * time.Millisecond
+		var events []retry.Event
+		client := &ClaudeClient{apiKey: "test-key", endpoint: server.URL}
+		result, err := client.SendMessage(context.Background(), []claude.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "claude-3-5-sonnet-20240620", claude.SendOptions{
+			Retry: timeoutPolicy,
+			OnRetry: func(event retry.Event) {
+				events = append(events, event)
+			},
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, 2, calls)
+		assert.Len(t, events, 1)
+		assert.ErrorContains(t, events[0].Err, "request timed out")
+	})
+}
@@ -3,12 +3,15 @@ package openAi
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"github.com/go-resty/resty/v2"
 	domainOpenAI "github.com/t-kuni/sisho/domain/external/openAi"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/external/retry"
 	"io"
-	"os"
 	"strings"
 )
 
@@ -16,51 +19,234 @@ const apiURL = "https://api.openai.com/v1/chat/completions"
 
 type OpenAIClient struct {
 	httpClient *resty.Client
+	endpoint   string
+	// apiKey is used when options.Credential is nil. The Authorization header is omitted if both are empty.
+	apiKey string
+	// includeUsage requests the token usage in the last chunk with stream_options.
+	// It is set only for OpenAI API because some compatible servers reject the unknown field.
+	includeUsage bool
+	// maxCompletionTokens sends max_completion_tokens instead of max_tokens for the models that reject max_tokens.
+	// It is set only for OpenAI API because compatible servers only know max_tokens.
+	maxCompletionTokens bool
 }
 
+// maxCompletionTokensModelPrefixes are the OpenAI models (reasoning models) that reject max_tokens and require max_completion_tokens.
+var maxCompletionTokensModelPrefixes = []string{"o1", "o3", "o4", "gpt-5"}
+
 type apiRequest struct {
-	Model    string           `json:"model"`
-	Messages []apiMessageItem `json:"messages"`
-	Stream   bool             `json:"stream"`
+	Model               string             `json:"model"`
+	Messages            []apiMessageItem   `json:"messages"`
+	MaxTokens           int                `json:"max_tokens,omitempty"`
+	MaxCompletionTokens int                `json:"max_completion_tokens,omitempty"`
+	Temperature         *float64           `json:"temperature,omitempty"`
+	TopP                *float64           `json:"top_p,omitempty"`
+	Stop                []string           `json:"stop,omitempty"`
+	Tools               []apiTool          `json:"tools,omitempty"`
+	ResponseFormat      *apiResponseFormat `json:"response_format,omitempty"`
+	Stream              bool               `json:"stream"`
+	StreamOptions       *apiStreamOptions  `json:"stream_options,omitempty"`
+}
+
+type apiStreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
 }
 
 type apiMessageItem struct {
-	Role    string `json:"role"`
-	Content string `json:"content"`
+	Role string `json:"role"`
+	// Content is a string or an array of apiContentPart
+	Content    interface{}   `json:"content"`
+	ToolCalls  []apiToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string        `json:"tool_call_id,omitempty"`
+}
+
+type apiContentPart struct {
+	Type     string       `json:"type"`
+	Text     *string      `json:"text,omitempty"`
+	ImageURL *apiImageURL `json:"image_url,omitempty"`
+	File     *apiFile     `json:"file,omitempty"`
+}
+
+type apiImageURL struct {
+	URL string `json:"url"`
+}
+
+type apiFile struct {
+	Filename string `json:"filename"`
+	FileData string `json:"file_data"`
+}
+
+type apiResponseFormat struct {
+	Type       string        `json:"type"`
+	JSONSchema apiJSONSchema `json:"json_schema"`
+}
+
+type apiJSONSchema struct {
+	Name   string                 `json:"name"`
+	Schema map[string]interface{} `json:"schema"`
+	Strict bool                   `json:"strict"`
+}
+
+type apiTool struct {
+	Type     string          `json:"type"`
+	Function apiToolFunction `json:"function"`
+}
+
+type apiToolFunction struct {
+	Name        string                 `json:"name"`
+	Description string                 `json:"description"`
+	Parameters  map[string]interface{} `json:"parameters"`
+}
+
+type apiToolCall struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Function struct {
+		Name      string `json:"name"`
+		Arguments string `json:"arguments"`
+	} `json:"function"`
 }
 
 type apiResponse struct {
 	Choices []struct {
 		Delta struct {
-			Content string `json:"content"`
+			Content   string `json:"content"`
+			ToolCalls []struct {
+				Index    int    `json:"index"`
+				ID       string `json:"id"`
+				Function struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function"`
+			} `json:"tool_calls"`
 		} `json:"delta"`
 		FinishReason string `json:"finish_reason"`
 	} `json:"choices"`
+	// Usage is sent in the last chunk when stream_options.include_usage is true
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+	Error *struct {
+		Type    string `json:"type"`
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
 }
 
 func NewOpenAIClient() *OpenAIClient {
 	client := resty.New()
 	client.SetHeader("Content-Type", "application/json")
-	client.SetHeader("Authorization", "Bearer "+os.Getenv("OPENAI_API_KEY"))
+
+	// The API key is resolved from options.Credential when a request is sent
+	return &OpenAIClient{
+		httpClient:          client,
+		endpoint:            apiURL,
+		includeUsage:        true,
+		maxCompletionTokens: true,
+	}
+}
+
+// NewOpenAICompatibleClient initializes a client for an OpenAI compatible API (Ollama, vLLM, llama.cpp, etc.).
+// Requests are sent to baseURL + "/chat/completions". The Authorization header is omitted if apiKey is empty.
+// stream_options is not sent, so the token usage is not reported.
+func NewOpenAICompatibleClient(baseURL string, apiKey string, headers map[string]string) *OpenAIClient {
+	client := resty.New()
+	client.SetHeader("Content-Type", "application/json")
+	client.SetHeaders(headers)
 
 	return &OpenAIClient{
 		httpClient: client,
+		endpoint:   strings.TrimSuffix(baseURL, "/") + "/chat/completions",
+		apiKey:     apiKey,
+	}
+}
+
+// requiresMaxCompletionTokens reports whether the OpenAI model rejects max_tokens and requires max_completion_tokens.
+func requiresMaxCompletionTokens(model string) bool {
+	for _, prefix := range maxCompletionTokensModelPrefixes {
+		if model == prefix || strings.HasPrefix(model, prefix+"-") {
+			return true
+		}
+	}
+	return false
+}
+
+// CompatibleClientFactory creates clients for OpenAI compatible APIs.
+type CompatibleClientFactory struct{}
+
+func NewCompatibleClientFactory() *CompatibleClientFactory {
+	return &CompatibleClientFactory{}
+}
+
+// NewCompatibleClient creates a client that sends requests to the endpoint specified by setting.
+// The API key is resolved from options.Credential when a request is sent.
+func (f *CompatibleClientFactory) NewCompatibleClient(setting domainOpenAI.CompatibleSetting) (domainOpenAI.Client, error) {
+	if setting.BaseURL == "" {
+		return nil, fmt.Errorf("base-url is required for OpenAI compatible API")
 	}
+
+	return NewOpenAICompatibleClient(setting.BaseURL, "", setting.Headers), nil
 }
 
-func (c *OpenAIClient) SendMessage(messages []domainOpenAI.Message, model string) (domainOpenAI.GenerationResult, error) {
-	apiMessages := make([]apiMessageItem, len(messages))
-	for i, msg := range messages {
-		apiMessages[i] = apiMessageItem{
-			Role:    msg.Role,
-			Content: msg.Content,
+// SendMessage sends messages to the chat completions endpoint and waits for the streamed response.
+// Rate limits, 5xx responses and server_error/rate limit errors in the stream are retried according to options.Retry.
+// A failure after text has been passed to options.OnDelta is not retried.
+func (c *OpenAIClient) SendMessage(ctx context.Context, messages []domainOpenAI.Message, model string, options domainOpenAI.SendOptions) (domainOpenAI.GenerationResult, error) {
+	apiMessages := make([]apiMessageItem, 0, len(messages)+1)
+	if options.System != "" {
+		// システムプロンプトはsystemロールのメッセージとして先頭に置く
+		apiMessages = append(apiMessages, apiMessageItem{
+			Role:    "system",
+			Content: options.System,
+		})
+	}
+	for _, msg := range messages {
+		item := apiMessageItem{
+			Role:       msg.Role,
+			Content:    msg.Content,
+			ToolCallID: msg.ToolCallID,
+		}
+		if len(msg.Parts) > 0 {
+			item.Content = convertParts(msg.Parts)
 		}
+		for _, call := range msg.ToolCalls {
+			apiCall := apiToolCall{ID: call.ID, Type: "function"}
+			apiCall.Function.Name = call.Name
+			apiCall.Function.Arguments = call.Arguments
+			item.ToolCalls = append(item.ToolCalls, apiCall)
+		}
+		apiMessages = append(apiMessages, item)
+	}
+
+	var tools []apiTool
+	for _, tool := range options.Tools {
+		tools = append(tools, apiTool{
+			Type: "function",
+			Function: apiToolFunction{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		})
 	}
 
 	reqBody := apiRequest{
-		Model:    model,
-		Messages: apiMessages,
-		Stream:   true,
+		Model:          model,
+		Messages:       apiMessages,
+		MaxTokens:      options.MaxTokens,
+		Temperature:    options.Temperature,
+		TopP:           options.TopP,
+		Stop:           options.Stop,
+		Tools:          tools,
+		ResponseFormat: convertResponseFormat(options.ResponseFormat),
+		Stream:         true,
+	}
+	if c.includeUsage {
+		reqBody.StreamOptions = &apiStreamOptions{IncludeUsage: true}
+	}
+	if c.maxCompletionTokens && requiresMaxCompletionTokens(model) {
+		reqBody.MaxCompletionTokens = reqBody.MaxTokens
+		reqBody.MaxTokens = 0
 	}
 
 	jsonBody, err := json.Marshal(reqBody)
@@ -68,28 +254,128 @@ func (c *OpenAIClient) SendMessage(messages []domainOpenAI.Message, model string
 		return domainOpenAI.GenerationResult{}, fmt.Errorf("failed to marshal request body: %w", err)
 	}
 
-	resp, err := c.httpClient.R().
+	apiKey, source, err := c.resolveAPIKey(ctx, options.Credential)
+	if err != nil {
+		return domainOpenAI.GenerationResult{}, err
+	}
+
+	var result domainOpenAI.GenerationResult
+	err = retry.DoStream(ctx, options.Retry, options.OnRetry, options.OnDelta, func(ctx context.Context, onDelta func(delta string)) error {
+		var err error
+		result, err = c.send(ctx, apiKey, source, jsonBody, onDelta)
+		return err
+	})
+	if err != nil {
+		return domainOpenAI.GenerationResult{}, err
+	}
+
+	return result, nil
+}
+
+// resolveAPIKey returns the API key used for the request and the description of its source.
+// The key is read from cred when it is not nil, otherwise the key given to the constructor is used.
+func (c *OpenAIClient) resolveAPIKey(ctx context.Context, cred credential.Credential) (string, string, error) {
+	if cred == nil {
+		return c.apiKey, "the client setting", nil
+	}
+	apiKey, err := cred.APIKey(ctx)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get the OpenAI API key: %w", err)
+	}
+	return apiKey, cred.Source().String(), nil
+}
+
+// convertParts converts the content parts to the content array of the request. Attachments are sent as data URLs.
+func convertParts(parts []domainOpenAI.ContentPart) []apiContentPart {
+	converted := make([]apiContentPart, 0, len(parts))
+	for _, part := range parts {
+		part := part
+		if part.Attachment == nil {
+			converted = append(converted, apiContentPart{Type: "text", Text: &part.Text})
+			continue
+		}
+		dataURL := "data:" + part.Attachment.MediaType + ";base64," + base64.StdEncoding.EncodeToString(part.Attachment.Data)
+		if strings.HasPrefix(part.Attachment.MediaType, "image/") {
+			converted = append(converted, apiContentPart{Type: "image_url", ImageURL: &apiImageURL{URL: dataURL}})
+		} else {
+			converted = append(converted, apiContentPart{Type: "file", File: &apiFile{Filename: part.Attachment.Filename, FileData: dataURL}})
+		}
+	}
+	return converted
+}
+
+// convertResponseFormat converts the response format to a strict json_schema response_format. It returns nil if format is nil.
+func convertResponseFormat(format *domainOpenAI.ResponseFormat) *apiResponseFormat {
+	if format == nil {
+		return nil
+	}
+	return &apiResponseFormat{
+		Type: "json_schema",
+		JSONSchema: apiJSONSchema{
+			Name:   format.Name,
+			Schema: format.Schema,
+			Strict: true,
+		},
+	}
+}
+
+// send performs a single request to the chat completions endpoint.
+// source is the description of where apiKey came from. It is included in the error when the authentication fails.
+func (c *OpenAIClient) send(ctx context.Context, apiKey string, source string, jsonBody []byte, onDelta func(delta string)) (domainOpenAI.GenerationResult, error) {
+	req := c.httpClient.R()
+	if apiKey != "" {
+		req.SetHeader("Authorization", "Bearer "+apiKey)
+	}
+	resp, err := req.
+		SetContext(ctx).
 		SetBody(jsonBody).
 		SetDoNotParseResponse(true).
-		Post(apiURL)
+		Post(c.endpoint)
 
 	if err != nil {
-		return domainOpenAI.GenerationResult{}, fmt.Errorf("failed to send request: %w", err)
+		return domainOpenAI.GenerationResult{}, retry.NewError(fmt.Errorf("failed to send request: %w", err), true, 0)
 	}
 	defer resp.RawBody().Close()
 
 	if resp.StatusCode() != 200 {
 		bodyBytes, _ := io.ReadAll(resp.RawBody())
-		return domainOpenAI.GenerationResult{}, fmt.Errorf("API request failed with status code %d and response: %s", resp.StatusCode(), string(bodyBytes))
+		err := fmt.Errorf("API request failed with status code %d and response: %s", resp.StatusCode(), string(bodyBytes))
+		if retry.IsAuthStatus(resp.StatusCode()) {
+			err = fmt.Errorf("authentication failed with the API key from %s: %w", source, err)
+		}
+		return domainOpenAI.GenerationResult{}, retry.NewError(err, retry.IsRetryableStatus(resp.StatusCode()), retry.ParseRetryAfter(resp.Header().Get("retry-after")))
 	}
 
-	return processStreamResponse(resp.RawBody())
+	return processStreamResponse(resp.RawBody(), onDelta)
+}
+
+// rateLimitErrorTypes are the error types (and codes) OpenAI API uses for rate limits.
+var rateLimitErrorTypes = []string{"rate_limit_exceeded", "requests", "tokens"}
+
+// isRetryableError reports whether an error in the stream should be retried.
+// Only server errors and rate limits are retried. Other errors (invalid_request_error, context_length_exceeded etc.) fail again on retry.
+func isRetryableError(errorType string, code string) bool {
+	if errorType == "server_error" {
+		return true
+	}
+	for _, t := range rateLimitErrorTypes {
+		if errorType == t || code == t {
+			return true
+		}
+	}
+	return false
 }
 
-func processStreamResponse(body io.ReadCloser) (domainOpenAI.GenerationResult, error) {
+// processStreamResponse handles the streaming response from OpenAI API.
+// onDelta is called with each text delta as it arrives, if not nil.
+func processStreamResponse(body io.Reader, onDelta func(delta string)) (domainOpenAI.GenerationResult, error) {
 	reader := bufio.NewReader(body)
 	var fullResponse strings.Builder
 	var terminationReason string
+	var usage domainOpenAI.Usage
+	var toolCalls []domainOpenAI.ToolCall
+	// toolCallIndexes maps the index of a streamed tool call to the position in toolCalls
+	toolCallIndexes := map[int]int{}
 
 	for {
 		line, err := reader.ReadBytes('\n')
@@ -97,7 +383,7 @@ func processStreamResponse(body io.ReadCloser) (domainOpenAI.GenerationResult, e
 			if err == io.EOF {
 				break
 			}
-			return domainOpenAI.GenerationResult{}, fmt.Errorf("error reading stream: %w", err)
+			return domainOpenAI.GenerationResult{}, retry.NewError(fmt.Errorf("error reading stream: %w", err), true, 0)
 		}
 
 		line = bytes.TrimSpace(line)
@@ -115,8 +401,34 @@ func processStreamResponse(body io.ReadCloser) (domainOpenAI.GenerationResult, e
 			return domainOpenAI.GenerationResult{}, fmt.Errorf("failed to unmarshal stream data: %w", err)
 		}
 
+		if streamResp.Error != nil {
+			err := fmt.Errorf("API returned an error in the stream: %s: %s", streamResp.Error.Type, streamResp.Error.Message)
+			return domainOpenAI.GenerationResult{}, retry.NewError(err, isRetryableError(streamResp.Error.Type, streamResp.Error.Code), 0)
+		}
+
+		if streamResp.Usage != nil {
+			usage.InputTokens = streamResp.Usage.PromptTokens
+			usage.OutputTokens = streamResp.Usage.CompletionTokens
+		}
+
 		if len(streamResp.Choices) > 0 {
 			fullResponse.WriteString(streamResp.Choices[0].Delta.Content)
+			if onDelta != nil && streamResp.Choices[0].Delta.Content != "" {
+				onDelta(streamResp.Choices[0].Delta.Content)
+			}
+			for _, delta := range streamResp.Choices[0].Delta.ToolCalls {
+				i, ok := toolCallIndexes[delta.Index]
+				if !ok {
+					i = len(toolCalls)
+					toolCallIndexes[delta.Index] = i
+					toolCalls = append(toolCalls, domainOpenAI.ToolCall{})
+				}
+				if delta.ID != "" {
+					toolCalls[i].ID = delta.ID
+				}
+				toolCalls[i].Name += delta.Function.Name
+				toolCalls[i].Arguments += delta.Function.Arguments
+			}
 			if streamResp.Choices[0].FinishReason != "" {
 				terminationReason = streamResp.Choices[0].FinishReason
 			}
@@ -126,5 +438,7 @@ func processStreamResponse(body io.ReadCloser) (domainOpenAI.GenerationResult, e
 	return domainOpenAI.GenerationResult{
 		Content:           fullResponse.String(),
 		TerminationReason: terminationReason,
+		Usage:             usage,
+		ToolCalls:         toolCalls,
 	}, nil
 }
@@ -1,12 +1,20 @@
 package openAi
 
 import (
+	"context"
+	"encoding/json"
 	"github.com/joho/godotenv"
 	"github.com/stretchr/testify/assert"
 	"github.com/t-kuni/sisho/domain/external/openAi"
+	"github.com/t-kuni/sisho/domain/model/retry"
+	domainCredential "github.com/t-kuni/sisho/domain/system/credential"
+	"github.com/t-kuni/sisho/infrastructure/system/credential"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
 	"testing"
 )
 
@@ -31,9 +39,377 @@ func TestClaudeClient_SendMessage_Integration(t *testing.T) {
 	model := "gpt-4-turbo"
 
 	client := NewOpenAIClient()
-	result, err := client.SendMessage(messages, model)
+	result, err := client.SendMessage(context.Background(), messages, model, openAi.SendOptions{
+		Credential: credential.NewProvider().Credential(domainCredential.Source{Env: "OPENAI_API_KEY"}),
+	})
 
 	assert.NoError(t, err)
 	assert.NotEmpty(t, result.Content)
 	assert.NotEmpty(t, result.TerminationReason)
 }
+
+func TestProcessStreamResponse(t *testing.T) {
+	t.Run("受信したテキストの断片がOnDeltaに渡されること", func(t *testing.T) {
+		body := strings.NewReader(`data: {"choices":[{"delta":{"role":"assistant","content":""},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{"content":"Hello"},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{"content":" World"},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"stop"}]}
+
+data: [DONE]
+`)
+
+		var deltas []string
+		result, err := processStreamResponse(body, func(delta string) {
+			deltas = append(deltas, delta)
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"Hello", " World"}, deltas)
+		assert.Equal(t, "Hello World", result.Content)
+		assert.Equal(t, "stop", result.TerminationReason)
+	})
+
+	t.Run("最後のチャンクからトークンの使用量が取得できること", func(t *testing.T) {
+		body := strings.NewReader(`data: {"choices":[{"delta":{"content":"Hello"},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"stop"}]}
+
+data: {"choices":[],"usage":{"prompt_tokens":30,"completion_tokens":12,"total_tokens":42}}
+
+data: [DONE]
+`)
+
+		result, err := processStreamResponse(body, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, openAi.Usage{InputTokens: 30, OutputTokens: 12}, result.Usage)
+	})
+
+	t.Run("関数の呼び出しが取得できること", func(t *testing.T) {
+		body := strings.NewReader(`data: {"choices":[{"delta":{"role":"assistant","content":null,"tool_calls":[{"index":0,"id":"call_01","type":"function","function":{"name":"read_file","arguments":""}}]},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"{\"path\":"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"main.go\"}"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{"tool_calls":[{"index":1,"id":"call_02","type":"function","function":{"name":"list_dir","arguments":"{}"}}]},"finish_reason":null}]}
+
+data: {"choices":[{"delta":{},"finish_reason":"tool_calls"}]}
+
+data: [DONE]
+`)
+
+		result, err := processStreamResponse(body, nil)
+
+		assert.NoError(t, err)
+		assert.Equal(t, "tool_calls", result.TerminationReason)
+		assert.Equal(t, []openAi.ToolCall{
+			{ID: "call_01", Name: "read_file", Arguments: `{"path":"main.go"}`},
+			{ID: "call_02", Name: "list_dir", Arguments: `{}`},
+		}, result.ToolCalls)
+	})
+}
+
+func TestOpenAIClient_SendMessage(t *testing.T) {
+	t.Run("トークンの使用量を受け取るためにstream_options.include_usageが送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req apiRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.True(t, req.StreamOptions.IncludeUsage)
+
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[],\"usage\":{\"prompt_tokens\":10,\"completion_tokens\":5}}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAIClient()
+		client.endpoint = server.URL
+		result, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "gpt-4o", openAi.SendOptions{})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 10, result.Usage.InputTokens)
+		assert.Equal(t, 5, result.Usage.OutputTokens)
+	})
+
+	t.Run("推論モデルの場合、max_tokensの代わりにmax_completion_tokensが送信されること", func(t *testing.T) {
+		var bodies []map[string]interface{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var body map[string]interface{}
+			err := json.NewDecoder(r.Body).Decode(&body)
+			assert.NoError(t, err)
+			bodies = append(bodies, body)
+
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAIClient()
+		client.endpoint = server.URL
+		for _, model := range []string{"o1", "o3-mini", "o4-mini", "gpt-4o"} {
+			_, err := client.SendMessage(context.Background(), []openAi.Message{
+				{Role: "user", Content: "こんにちは"},
+			}, model, openAi.SendOptions{MaxTokens: 1024})
+			assert.NoError(t, err)
+		}
+
+		for i, model := range []string{"o1", "o3-mini", "o4-mini"} {
+			assert.Equal(t, float64(1024), bodies[i]["max_completion_tokens"], model)
+			assert.NotContains(t, bodies[i], "max_tokens", model)
+		}
+		assert.Equal(t, float64(1024), bodies[3]["max_tokens"])
+		assert.NotContains(t, bodies[3], "max_completion_tokens")
+	})
+}
+
+func TestOpenAICompatibleClient_SendMessage(t *testing.T) {
+	t.Run("base-urlで指定したエンドポイントにStream通信でリクエストが送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+			assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+			assert.Equal(t, "sisho", r.Header.Get("X-Team"))
+
+			var req apiRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.Equal(t, "llama3", req.Model)
+			assert.True(t, req.Stream)
+			// 未知のフィールドを拒否するサーバーがあるため、stream_optionsは送信しない
+			assert.Nil(t, req.StreamOptions)
+			assert.Equal(t, "こんにちは", req.Messages[0].Content)
+
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":null}]}\n\n"))
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL+"/v1/", "test-key", map[string]string{"X-Team": "sisho"})
+		result, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, "stop", result.TerminationReason)
+	})
+
+	t.Run("システムプロンプトがsystemロールのメッセージとして先頭に送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req apiRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.Len(t, req.Messages, 2)
+			assert.Equal(t, "system", req.Messages[0].Role)
+			assert.Equal(t, "日本語で回答してください", req.Messages[0].Content)
+			assert.Equal(t, "user", req.Messages[1].Role)
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{System: "日本語で回答してください"})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("ResponseFormatが指定された場合、json_schemaのresponse_formatが送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req apiRequest
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			actual, err := json.Marshal(req.ResponseFormat)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `{
+				"type": "json_schema",
+				"json_schema": {"name": "extract_paths", "schema": {"type": "object"}, "strict": true}
+			}`, string(actual))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "PROMPT"},
+		}, "gpt-4o", openAi.SendOptions{
+			ResponseFormat: &openAi.ResponseFormat{Name: "extract_paths", Schema: map[string]interface{}{"type": "object"}},
+		})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Partsが指定されたメッセージはコンテンツパートの配列で送信され、添付ファイルはdata URLで送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var req struct {
+				Messages []struct {
+					Content json.RawMessage `json:"content"`
+				} `json:"messages"`
+			}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			assert.NoError(t, err)
+			assert.JSONEq(t, `[
+				{"type": "text", "text": "mockup.png"},
+				{"type": "image_url", "image_url": {"url": "data:image/png;base64,UE5H"}},
+				{"type": "text", "text": "design.pdf"},
+				{"type": "file", "file": {"filename": "design.pdf", "file_data": "data:application/pdf;base64,UERG"}},
+				{"type": "text", "text": "PROMPT"}
+			]`, string(req.Messages[0].Content))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "PROMPT", Parts: []openAi.ContentPart{
+				{Text: "mockup.png"},
+				{Attachment: &openAi.Attachment{Filename: "mockup.png", MediaType: "image/png", Data: []byte("PNG")}},
+				{Text: "design.pdf"},
+				{Attachment: &openAi.Attachment{Filename: "design.pdf", MediaType: "application/pdf", Data: []byte("PDF")}},
+				{Text: "PROMPT"},
+			}},
+		}, "gpt-4o", openAi.SendOptions{})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("APIキーが空の場合、Authorizationヘッダーが送信されないこと", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Empty(t, r.Header.Get("Authorization"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("Credentialが指定された場合、送信時に読み込んだAPIキーがAuthorizationヘッダーで送信されること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "Bearer command-key", r.Header.Get("Authorization"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{
+			Credential: credential.NewProvider().Credential(domainCredential.Source{Command: "echo command-key"}),
+		})
+
+		assert.NoError(t, err)
+	})
+
+	t.Run("認証に失敗した場合、APIキーの取得元がエラーメッセージに含まれること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":{"message":"Incorrect API key provided"}}`))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "gpt-4o", openAi.SendOptions{
+			Credential: credential.NewProvider().Credential(domainCredential.Source{Command: "echo wrong-key"}),
+		})
+
+		assert.ErrorContains(t, err, "authentication failed with the API key from api-key-command `echo wrong-key`")
+		assert.ErrorContains(t, err, "Incorrect API key provided")
+	})
+
+	t.Run("OnDeltaにテキストを渡した後にStreamが失敗した場合、テキストが重複しないように再試行されないこと", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hel\"},\"finish_reason\":null}]}\n\n"))
+			w.Write([]byte("data: {\"error\":{\"type\":\"server_error\",\"message\":\"internal error\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		var deltas []string
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{
+			Retry: retry.Policy{MaxAttempts: 3},
+			OnDelta: func(delta string) {
+				deltas = append(deltas, delta)
+			},
+		})
+
+		assert.ErrorContains(t, err, "server_error: internal error")
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, []string{"Hel"}, deltas)
+	})
+
+	t.Run("Stream中に再試行しても成功しないエラーを受信した場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.Write([]byte("data: {\"error\":{\"type\":\"invalid_request_error\",\"code\":\"context_length_exceeded\",\"message\":\"maximum context length exceeded\"}}\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{Retry: retry.Policy{MaxAttempts: 3}})
+
+		assert.ErrorContains(t, err, "invalid_request_error: maximum context length exceeded")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("Stream中にサーバーのエラーを受信した場合、再試行されること", func(t *testing.T) {
+		calls := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				w.Write([]byte("data: {\"error\":{\"type\":\"server_error\",\"message\":\"internal error\"}}\n\n"))
+				return
+			}
+			w.Write([]byte("data: {\"choices\":[{\"delta\":{\"content\":\"Hello\"},\"finish_reason\":\"stop\"}]}\n\n"))
+			w.Write([]byte("data: [DONE]\n\n"))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		result, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "llama3", openAi.SendOptions{Retry: retry.Policy{MaxAttempts: 3}})
+
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", result.Content)
+		assert.Equal(t, 2, calls)
+	})
+
+	t.Run("ステータスコード200以外の場合、レスポンスボディがエラーメッセージに含まれること", func(t *testing.T) {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"model not found"}`))
+		}))
+		defer server.Close()
+
+		client := NewOpenAICompatibleClient(server.URL, "", nil)
+		_, err := client.SendMessage(context.Background(), []openAi.Message{
+			{Role: "user", Content: "こんにちは"},
+		}, "unknown", openAi.SendOptions{})
+
+		assert.ErrorContains(t, err, "model not found")
+	})
+}
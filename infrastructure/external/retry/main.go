@@ -0,0 +1,187 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	domainRetry "github.com/t-kuni/sisho/domain/model/retry"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error wraps an error returned from an LLM API with the information needed to decide whether to retry.
+type Error struct {
+	Err        error
+	Retryable  bool
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// NewError wraps err with the retry information.
+func NewError(err error, retryable bool, retryAfter time.Duration) error {
+	return &Error{
+		Err:        err,
+		Retryable:  retryable,
+		RetryAfter: retryAfter,
+	}
+}
+
+// IsRetryableStatus reports whether a request that failed with the HTTP status code should be retried.
+// 429 (rate limit) and 5xx (including Anthropic's 529 "overloaded") are retryable.
+func IsRetryableStatus(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests || statusCode >= 500
+}
+
+// IsAuthStatus reports whether a request failed with the HTTP status code because of the API key.
+func IsAuthStatus(statusCode int) bool {
+	return statusCode == http.StatusUnauthorized || statusCode == http.StatusForbidden
+}
+
+// ParseRetryAfter parses the value of a retry-after header. It accepts both delay-seconds and HTTP-date.
+// It returns 0 if the value is empty or invalid.
+func ParseRetryAfter(value string) time.Duration {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds * float64(time.Second))
+	}
+
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+
+	return 0
+}
+
+// Do calls fn until it succeeds, returns a non-retryable error or policy.MaxAttempts is reached.
+// Only errors created by NewError with retryable=true are retried.
+// Each attempt is given a context limited by policy.Timeout. An attempt that timed out is retried.
+// When ctx is done, Do stops immediately and returns ctx.Err().
+// onRetry is called before waiting for the next attempt, if not nil.
+func Do(ctx context.Context, policy domainRetry.Policy, onRetry func(event domainRetry.Event), fn func(ctx context.Context) error) error {
+	maxAttempts := policy.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := attemptWithTimeout(ctx, policy.Timeout, fn)
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		var retryErr *Error
+		if !errors.As(err, &retryErr) || !retryErr.Retryable || attempt >= maxAttempts {
+			return err
+		}
+
+		wait := backoff(policy, attempt)
+		if retryErr.RetryAfter > 0 {
+			if policy.MaxWait > 0 && retryErr.RetryAfter > policy.MaxWait {
+				return fmt.Errorf("retry-after %s exceeds max wait %s: %w", retryErr.RetryAfter, policy.MaxWait, err)
+			}
+			wait = retryErr.RetryAfter
+		}
+
+		if onRetry != nil {
+			onRetry(domainRetry.Event{
+				Attempt:     attempt,
+				MaxAttempts: maxAttempts,
+				Wait:        wait,
+				Err:         err,
+			})
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// DoStream is Do for a streaming request. fn is given onDelta to pass the received text to.
+// Once a delta has been passed to onDelta, a failure of the attempt is not retried, because a retried stream would
+// deliver the text from the beginning again and the caller would see the partial text twice.
+// If onDelta is nil, nothing is delivered to the caller and failures are retried as in Do.
+func DoStream(ctx context.Context, policy domainRetry.Policy, onRetry func(event domainRetry.Event), onDelta func(delta string), fn func(ctx context.Context, onDelta func(delta string)) error) error {
+	delivered := false
+	var deliver func(delta string)
+	if onDelta != nil {
+		deliver = func(delta string) {
+			delivered = true
+			onDelta(delta)
+		}
+	}
+
+	return Do(ctx, policy, onRetry, func(ctx context.Context) error {
+		err := fn(ctx, deliver)
+		if err != nil && delivered {
+			return NewError(fmt.Errorf("the stream failed after part of the answer was received: %w", err), false, 0)
+		}
+		return err
+	})
+}
+
+// attemptWithTimeout calls fn with a context limited by timeout. A timeout of 0 means no limit.
+// If the attempt exceeds the timeout, a retryable error is returned unless fn explicitly returned a non-retryable error.
+func attemptWithTimeout(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout <= 0 {
+		return fn(ctx)
+	}
+
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err := fn(attemptCtx)
+	var retryErr *Error
+	if errors.As(err, &retryErr) && !retryErr.Retryable {
+		return err
+	}
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		return NewError(fmt.Errorf("request timed out after %s: %w", timeout, err), true, 0)
+	}
+	return err
+}
+
+// backoff returns the exponential backoff with jitter for the attempt.
+// The wait is between half and all of InitialWait * 2^(attempt-1), capped at MaxWait.
+func backoff(policy domainRetry.Policy, attempt int) time.Duration {
+	wait := policy.InitialWait
+	for i := 1; i < attempt; i++ {
+		wait *= 2
+		if policy.MaxWait > 0 && wait >= policy.MaxWait {
+			break
+		}
+	}
+	if policy.MaxWait > 0 && wait > policy.MaxWait {
+		wait = policy.MaxWait
+	}
+	if wait <= 0 {
+		return 0
+	}
+
+	half := wait / 2
+	return half + time.Duration(rand.Int63n(int64(wait-half)+1))
+}
@@ -0,0 +1,229 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	domainRetry "github.com/t-kuni/sisho/domain/model/retry"
+	"testing"
+	"time"
+)
+
+func TestDo(t *testing.T) {
+	policy := domainRetry.Policy{
+		MaxAttempts: 3,
+		InitialWait: time.Millisecond,
+		MaxWait:     5 * time.Millisecond,
+	}
+
+	t.Run("再試行可能なエラーの場合、成功するまで再試行されること", func(t *testing.T) {
+		var events []domainRetry.Event
+		calls := 0
+		err := Do(context.Background(), policy, func(event domainRetry.Event) {
+			events = append(events, event)
+		}, func(ctx context.Context) error {
+			calls++
+			if calls < 3 {
+				return NewError(errors.New("overloaded"), true, 0)
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 3, calls)
+		assert.Len(t, events, 2)
+		assert.Equal(t, 1, events[0].Attempt)
+		assert.Equal(t, 3, events[0].MaxAttempts)
+		assert.ErrorContains(t, events[0].Err, "overloaded")
+	})
+
+	t.Run("最大試行回数に達した場合、最後のエラーが返ること", func(t *testing.T) {
+		calls := 0
+		err := Do(context.Background(), policy, nil, func(ctx context.Context) error {
+			calls++
+			return NewError(errors.New("server error"), true, 0)
+		})
+
+		assert.ErrorContains(t, err, "server error")
+		assert.Equal(t, 3, calls)
+	})
+
+	t.Run("再試行不可能なエラーの場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		err := Do(context.Background(), policy, nil, func(ctx context.Context) error {
+			calls++
+			return NewError(errors.New("invalid request"), false, 0)
+		})
+
+		assert.ErrorContains(t, err, "invalid request")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("ゼロ値の方針の場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		err := Do(context.Background(), domainRetry.Policy{}, nil, func(ctx context.Context) error {
+			calls++
+			return NewError(errors.New("overloaded"), true, 0)
+		})
+
+		assert.Error(t, err)
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("retry-afterが指定された場合、その時間待機すること", func(t *testing.T) {
+		var events []domainRetry.Event
+		calls := 0
+		err := Do(context.Background(), policy, func(event domainRetry.Event) {
+			events = append(events, event)
+		}, func(ctx context.Context) error {
+			calls++
+			if calls < 2 {
+				return NewError(errors.New("rate limited"), true, 2*time.Millisecond)
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2*time.Millisecond, events[0].Wait)
+	})
+
+	t.Run("retry-afterが最大待機時間を超える場合、再試行されないこと", func(t *testing.T) {
+		calls := 0
+		err := Do(context.Background(), policy, nil, func(ctx context.Context) error {
+			calls++
+			return NewError(errors.New("rate limited"), true, time.Minute)
+		})
+
+		assert.ErrorContains(t, err, "exceeds max wait")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("試行が制限時間を超えた場合、再試行されること", func(t *testing.T) {
+		timeoutPolicy := policy
+		timeoutPolicy.Timeout = 5 * time.Millisecond
+		var events []domainRetry.Event
+		calls := 0
+		err := Do(context.Background(), timeoutPolicy, func(event domainRetry.Event) {
+			events = append(events, event)
+		}, func(ctx context.Context) error {
+			calls++
+			if calls < 2 {
+				<-ctx.Done()
+				return ctx.Err()
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.ErrorContains(t, events[0].Err, "request timed out after 5ms")
+	})
+
+	t.Run("contextがキャンセルされた場合、再試行せずにキャンセルのエラーが返ること", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		calls := 0
+		err := Do(ctx, policy, nil, func(ctx context.Context) error {
+			calls++
+			cancel()
+			return NewError(errors.New("connection reset"), true, 0)
+		})
+
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, calls)
+	})
+}
+
+func TestDoStream(t *testing.T) {
+	policy := domainRetry.Policy{
+		MaxAttempts: 3,
+		InitialWait: time.Millisecond,
+		MaxWait:     5 * time.Millisecond,
+	}
+
+	t.Run("onDeltaに断片を渡す前に失敗した場合、再試行されること", func(t *testing.T) {
+		var deltas []string
+		calls := 0
+		err := DoStream(context.Background(), policy, nil, func(delta string) {
+			deltas = append(deltas, delta)
+		}, func(ctx context.Context, onDelta func(delta string)) error {
+			calls++
+			if calls < 2 {
+				return NewError(errors.New("overloaded"), true, 0)
+			}
+			onDelta("Hello")
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+		assert.Equal(t, []string{"Hello"}, deltas)
+	})
+
+	t.Run("onDeltaに断片を渡した後に失敗した場合、再試行されないこと", func(t *testing.T) {
+		var deltas []string
+		calls := 0
+		err := DoStream(context.Background(), policy, nil, func(delta string) {
+			deltas = append(deltas, delta)
+		}, func(ctx context.Context, onDelta func(delta string)) error {
+			calls++
+			onDelta("Hel")
+			return NewError(errors.New("connection reset"), true, 0)
+		})
+
+		assert.ErrorContains(t, err, "the stream failed after part of the answer was received: connection reset")
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, []string{"Hel"}, deltas)
+	})
+
+	t.Run("onDeltaに断片を渡した後に制限時間を超えた場合、再試行されないこと", func(t *testing.T) {
+		timeoutPolicy := policy
+		timeoutPolicy.Timeout = 5 * time.Millisecond
+		calls := 0
+		err := DoStream(context.Background(), timeoutPolicy, nil, func(delta string) {}, func(ctx context.Context, onDelta func(delta string)) error {
+			calls++
+			onDelta("Hel")
+			<-ctx.Done()
+			return ctx.Err()
+		})
+
+		assert.ErrorContains(t, err, "the stream failed after part of the answer was received")
+		assert.Equal(t, 1, calls)
+	})
+
+	t.Run("onDeltaがnilの場合、受信の途中で失敗しても再試行されること", func(t *testing.T) {
+		calls := 0
+		err := DoStream(context.Background(), policy, nil, nil, func(ctx context.Context, onDelta func(delta string)) error {
+			calls++
+			assert.Nil(t, onDelta)
+			if calls < 2 {
+				return NewError(errors.New("connection reset"), true, 0)
+			}
+			return nil
+		})
+
+		assert.NoError(t, err)
+		assert.Equal(t, 2, calls)
+	})
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	assert.Equal(t, 3*time.Second, ParseRetryAfter("3"))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter(""))
+	assert.Equal(t, time.Duration(0), ParseRetryAfter("invalid"))
+	assert.Greater(t, ParseRetryAfter(time.Now().Add(time.Hour).UTC().Format("Mon, 02 Jan 2006 15:04:05 GMT")), 50*time.Minute)
+}
+
+func TestIsRetryableStatus(t *testing.T) {
+	assert.True(t, IsRetryableStatus(429))
+	assert.True(t, IsRetryableStatus(500))
+	assert.True(t, IsRetryableStatus(529))
+	assert.False(t, IsRetryableStatus(400))
+	assert.False(t, IsRetryableStatus(401))
+}
+
+func TestIsAuthStatus(t *testing.T) {
+	assert.True(t, IsAuthStatus(401))
+	assert.True(t, IsAuthStatus(403))
+	assert.False(t, IsAuthStatus(429))
+	assert.False(t, IsAuthStatus(500))
+}
@@ -1,6 +1,7 @@
 package config
 
 import (
+	"errors"
 	"github.com/t-kuni/sisho/domain/repository/config"
 	"gopkg.in/yaml.v3"
 	"os"
@@ -41,3 +42,36 @@ func (r *ConfigRepository) Write(path string, cfg *config.Config) error {
 
 	return os.WriteFile(path, content, 0644)
 }
+
+// ReadUser はユーザーコンフィグ（ユーザーコンフィグのフォルダのconfig.yml）を読み込みます。
+func (r *ConfigRepository) ReadUser() (*config.UserConfig, error) {
+	dir, err := r.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "config.yml"))
+	if errors.Is(err, os.ErrNotExist) {
+		return &config.UserConfig{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg config.UserConfig
+	err = yaml.Unmarshal(content, &cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// UserConfigDir はユーザーコンフィグのフォルダ（Linuxでは$XDG_CONFIG_HOME/sisho、未設定の場合は~/.config/sisho）を返します。
+func (r *ConfigRepository) UserConfigDir() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "sisho"), nil
+}
@@ -0,0 +1,37 @@
+package snapshot
+
+import (
+	"github.com/t-kuni/sisho/domain/repository/snapshot"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+type repositoryImpl struct{}
+
+func NewRepository() snapshot.Repository {
+	return &repositoryImpl{}
+}
+
+func (r *repositoryImpl) Read(path string) (snapshot.Snapshots, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return snapshot.Snapshots{}, err
+	}
+
+	var s snapshot.Snapshots
+	err = yaml.Unmarshal(content, &s)
+	if err != nil {
+		return snapshot.Snapshots{}, err
+	}
+
+	return s, nil
+}
+
+func (r *repositoryImpl) Write(path string, s snapshot.Snapshots) error {
+	content, err := yaml.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0644)
+}
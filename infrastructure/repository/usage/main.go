@@ -0,0 +1,37 @@
+package usage
+
+import (
+	"github.com/t-kuni/sisho/domain/repository/usage"
+	"gopkg.in/yaml.v3"
+	"os"
+)
+
+type repositoryImpl struct{}
+
+func NewRepository() usage.Repository {
+	return &repositoryImpl{}
+}
+
+func (r *repositoryImpl) Read(path string) (usage.Usage, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return usage.Usage{}, err
+	}
+
+	var u usage.Usage
+	err = yaml.Unmarshal(content, &u)
+	if err != nil {
+		return usage.Usage{}, err
+	}
+
+	return u, nil
+}
+
+func (r *repositoryImpl) Write(path string, u usage.Usage) error {
+	content, err := yaml.Marshal(u)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, content, 0644)
+}
@@ -0,0 +1,127 @@
+package credential
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+type Provider struct {
+	// credentials は取得元毎のCredentialです。生成ターゲット毎にチャットモデルを生成しても、APIキーを読み込むのは1回にします
+	mu          sync.Mutex
+	credentials map[credential.Source]*lazyCredential
+}
+
+func NewProvider() *Provider {
+	return &Provider{
+		credentials: map[credential.Source]*lazyCredential{},
+	}
+}
+
+// Credential はsourceのCredentialを返します。同じsourceには同じCredentialを返します。
+func (p *Provider) Credential(source credential.Source) credential.Credential {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c, ok := p.credentials[source]
+	if !ok {
+		c = &lazyCredential{source: source}
+		p.credentials[source] = c
+	}
+	return c
+}
+
+// lazyCredential は最初に必要になった時点でAPIキーを読み込み、以降は読み込んだ値を返します。
+type lazyCredential struct {
+	source credential.Source
+	mu     sync.Mutex
+	apiKey string
+}
+
+func (c *lazyCredential) Source() credential.Source {
+	return c.source
+}
+
+func (c *lazyCredential) APIKey(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.apiKey != "" {
+		return c.apiKey, nil
+	}
+
+	apiKey, err := read(ctx, c.source)
+	if err != nil {
+		return "", err
+	}
+	apiKey = strings.TrimSpace(apiKey)
+	if apiKey == "" {
+		return "", fmt.Errorf("the API key read from %s is empty", c.source)
+	}
+
+	c.apiKey = apiKey
+	return apiKey, nil
+}
+
+func read(ctx context.Context, source credential.Source) (string, error) {
+	switch {
+	case source.Command != "":
+		return runCommand(ctx, source.Command)
+	case source.File != "":
+		path, err := expandHome(source.File)
+		if err != nil {
+			return "", err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("failed to read the API key from %s: %w", source, err)
+		}
+		return string(content), nil
+	case source.Env != "":
+		apiKey, ok := os.LookupEnv(source.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", source.Env)
+		}
+		return apiKey, nil
+	default:
+		return "", fmt.Errorf("no source of the API key is configured")
+	}
+}
+
+// runCommand はコマンドをシェルで実行し、標準出力を返します。
+func runCommand(ctx context.Context, command string) (string, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.CommandContext(ctx, "cmd", "/C", command)
+	} else {
+		cmd = exec.CommandContext(ctx, "sh", "-c", command)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return "", fmt.Errorf("api-key-command `%s` failed: %w: %s", command, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
+
+// expandHome は`~/`で始まるパスをホームディレクトリからのパスに展開します。
+func expandHome(path string) (string, error) {
+	if !strings.HasPrefix(path, "~/") {
+		return path, nil
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the home directory: %w", err)
+	}
+	return filepath.Join(home, path[2:]), nil
+}
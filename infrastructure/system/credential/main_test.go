@@ -0,0 +1,101 @@
+package credential
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/domain/system/credential"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProvider_Credential(t *testing.T) {
+	t.Run("環境変数からAPIキーを読み込めること", func(t *testing.T) {
+		t.Setenv("SISHO_TEST_API_KEY", "env-key")
+
+		apiKey, err := NewProvider().Credential(credential.Source{Env: "SISHO_TEST_API_KEY"}).APIKey(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "env-key", apiKey)
+	})
+
+	t.Run("環境変数が設定されていない場合はエラーになること", func(t *testing.T) {
+		_, err := NewProvider().Credential(credential.Source{Env: "SISHO_TEST_UNSET_KEY"}).APIKey(context.Background())
+
+		assert.ErrorContains(t, err, "environment variable SISHO_TEST_UNSET_KEY is not set")
+	})
+
+	t.Run("ファイルからAPIキーを読み込み、前後の空白と改行が取り除かれること", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "api-key")
+		err := os.WriteFile(path, []byte("  file-key\n"), 0600)
+		assert.NoError(t, err)
+
+		apiKey, err := NewProvider().Credential(credential.Source{File: path}).APIKey(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "file-key", apiKey)
+	})
+
+	t.Run("~/で始まるファイルのパスはホームディレクトリからのパスとして読み込むこと", func(t *testing.T) {
+		home := t.TempDir()
+		t.Setenv("HOME", home)
+		err := os.WriteFile(filepath.Join(home, "api-key"), []byte("home-key"), 0600)
+		assert.NoError(t, err)
+
+		apiKey, err := NewProvider().Credential(credential.Source{File: "~/api-key"}).APIKey(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "home-key", apiKey)
+	})
+
+	t.Run("コマンドの標準出力をAPIキーとして読み込めること", func(t *testing.T) {
+		apiKey, err := NewProvider().Credential(credential.Source{Command: "echo command-key"}).APIKey(context.Background())
+
+		assert.NoError(t, err)
+		assert.Equal(t, "command-key", apiKey)
+	})
+
+	t.Run("コマンドが失敗した場合、標準エラー出力がエラーメッセージに含まれること", func(t *testing.T) {
+		_, err := NewProvider().Credential(credential.Source{Command: "echo locked >&2; exit 1"}).APIKey(context.Background())
+
+		assert.ErrorContains(t, err, "api-key-command `echo locked >&2; exit 1` failed")
+		assert.ErrorContains(t, err, "locked")
+	})
+
+	t.Run("読み込んだ値が空の場合、取得元を含むエラーになること", func(t *testing.T) {
+		_, err := NewProvider().Credential(credential.Source{Command: "true"}).APIKey(context.Background())
+
+		assert.ErrorContains(t, err, "the API key read from api-key-command `true` is empty")
+	})
+
+	t.Run("APIキーは最初の呼び出しでのみ読み込まれること", func(t *testing.T) {
+		counter := filepath.Join(t.TempDir(), "counter")
+		cred := NewProvider().Credential(credential.Source{Command: "echo x >> " + counter + "; echo cached-key"})
+
+		for i := 0; i < 2; i++ {
+			apiKey, err := cred.APIKey(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "cached-key", apiKey)
+		}
+
+		content, err := os.ReadFile(counter)
+		assert.NoError(t, err)
+		assert.Equal(t, "x\n", string(content))
+	})
+
+	t.Run("同じ取得元には同じCredentialを返し、APIキーの読み込みは1回だけであること", func(t *testing.T) {
+		counter := filepath.Join(t.TempDir(), "counter")
+		provider := NewProvider()
+		source := credential.Source{Command: "echo x >> " + counter + "; echo shared-key"}
+
+		for i := 0; i < 2; i++ {
+			apiKey, err := provider.Credential(source).APIKey(context.Background())
+			assert.NoError(t, err)
+			assert.Equal(t, "shared-key", apiKey)
+		}
+
+		content, err := os.ReadFile(counter)
+		assert.NoError(t, err)
+		assert.Equal(t, "x\n", string(content))
+	})
+}
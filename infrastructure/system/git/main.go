@@ -0,0 +1,75 @@
+package git
+
+import (
+	"bytes"
+	"fmt"
+	domainGit "github.com/t-kuni/sisho/domain/system/git"
+	"os/exec"
+	"strings"
+)
+
+type Git struct{}
+
+func NewGit() domainGit.Git {
+	return &Git{}
+}
+
+func (g *Git) IsRepository(dir string) bool {
+	out, err := run(dir, "rev-parse", "--is-inside-work-tree")
+	return err == nil && strings.TrimSpace(out) == "true"
+}
+
+func (g *Git) DirtyFiles(dir string, paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	args := append([]string{"status", "--porcelain", "-z", "--untracked-files=all", "--"}, paths...)
+	out, err := run(dir, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	// 各エントリは "XY PATH\x00"。名前の変更の場合は後ろに元のパスのエントリが続く
+	var files []string
+	entries := strings.Split(out, "\x00")
+	for i := 0; i < len(entries); i++ {
+		entry := entries[i]
+		if len(entry) < 4 {
+			continue
+		}
+		files = append(files, entry[3:])
+		if entry[0] == 'R' || entry[0] == 'C' {
+			i++
+		}
+	}
+	return files, nil
+}
+
+func (g *Git) CreateBranch(dir, name string) error {
+	_, err := run(dir, "switch", "-c", name)
+	return err
+}
+
+func (g *Git) Commit(dir string, paths []string, message string) error {
+	_, err := run(dir, append([]string{"add", "--"}, paths...)...)
+	if err != nil {
+		return err
+	}
+
+	_, err = run(dir, append([]string{"commit", "-m", message, "--"}, paths...)...)
+	return err
+}
+
+func run(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.String(), nil
+}
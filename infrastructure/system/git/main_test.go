@@ -0,0 +1,93 @@
+package git_test
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/t-kuni/sisho/infrastructure/system/git"
+	"github.com/t-kuni/sisho/testUtil"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// initRepository はspaceにgitリポジトリを作成し、filesをコミットします。
+func initRepository(t *testing.T, space testUtil.Space, files map[string]string) {
+	t.Helper()
+	for path, content := range files {
+		space.WriteFile(path, []byte(content))
+	}
+	runGit(t, space.Dir, "init", "-q", "-b", "main")
+	runGit(t, space.Dir, "config", "user.name", "test")
+	runGit(t, space.Dir, "config", "user.email", "test@example.com")
+	runGit(t, space.Dir, "add", "-A")
+	runGit(t, space.Dir, "commit", "-q", "-m", "initial")
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	out, err := cmd.CombinedOutput()
+	assert.NoError(t, err, string(out))
+	return string(out)
+}
+
+func TestGit(t *testing.T) {
+	t.Run("IsRepository", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		testee := git.NewGit()
+		assert.False(t, testee.IsRepository(space.Dir))
+
+		initRepository(t, space, map[string]string{"a.txt": "A"})
+		assert.True(t, testee.IsRepository(space.Dir))
+	})
+
+	t.Run("DirtyFilesは変更されたファイルと未追跡のファイルを返すこと", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		initRepository(t, space, map[string]string{"clean.txt": "A", "modified.txt": "B"})
+		space.WriteFile("modified.txt", []byte("CHANGED"))
+		space.WriteFile("untracked.txt", []byte("C"))
+
+		files, err := git.NewGit().DirtyFiles(space.Dir, []string{"clean.txt", "modified.txt", "untracked.txt", "missing.txt"})
+
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"modified.txt", "untracked.txt"}, files)
+	})
+
+	t.Run("Commitは指定したファイルだけをコミットすること", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		initRepository(t, space, map[string]string{"a.txt": "A", "b.txt": "B"})
+		testee := git.NewGit()
+
+		err := testee.CreateBranch(space.Dir, "sisho/test")
+		assert.NoError(t, err)
+
+		space.WriteFile("a.txt", []byte("CHANGED"))
+		space.WriteFile("new.txt", []byte("NEW"))
+		space.WriteFile("b.txt", []byte("NOT COMMITTED"))
+		err = testee.Commit(space.Dir, []string{"a.txt", "new.txt"}, "update files")
+		assert.NoError(t, err)
+
+		// Assert
+		assert.Equal(t, "sisho/test", strings.TrimSpace(runGit(t, space.Dir, "branch", "--show-current")))
+		assert.Equal(t, "update files", strings.TrimSpace(runGit(t, space.Dir, "log", "-1", "--format=%s")))
+		assert.Equal(t, "a.txt\nnew.txt", strings.TrimSpace(runGit(t, space.Dir, "show", "--name-only", "--format=")))
+		assert.Equal(t, " M b.txt", strings.TrimRight(runGit(t, space.Dir, "status", "--porcelain"), "\n"))
+	})
+
+	t.Run("gitコマンドが失敗した場合は標準エラー出力を含むエラーを返すこと", func(t *testing.T) {
+		space := testUtil.BeginTestSpace(t)
+		defer space.CleanUp()
+
+		initRepository(t, space, map[string]string{"a.txt": "A"})
+
+		err := git.NewGit().CreateBranch(space.Dir, "main")
+		assert.ErrorContains(t, err, "git switch failed")
+		assert.ErrorContains(t, err, "already exists")
+	})
+}
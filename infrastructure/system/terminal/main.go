@@ -0,0 +1,64 @@
+package terminal
+
+import (
+	"bufio"
+	"github.com/rotisserie/eris"
+	domainTerminal "github.com/t-kuni/sisho/domain/system/terminal"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+type Terminal struct {
+	reader *bufio.Reader
+}
+
+func NewTerminal() domainTerminal.Terminal {
+	return &Terminal{
+		reader: bufio.NewReader(os.Stdin),
+	}
+}
+
+func (t *Terminal) ReadLine() (string, error) {
+	line, err := t.reader.ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func (t *Terminal) Edit(text string) (string, error) {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	tempFile, err := os.CreateTemp("", "sisho-hunk-*.txt")
+	if err != nil {
+		return "", eris.Wrap(err, "failed to create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	_, err = tempFile.WriteString(text)
+	tempFile.Close()
+	if err != nil {
+		return "", eris.Wrap(err, "failed to write temporary file")
+	}
+
+	cmd := exec.Command(editor, tempFile.Name())
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Run()
+	if err != nil {
+		return "", eris.Wrap(err, "failed to run editor")
+	}
+
+	edited, err := os.ReadFile(tempFile.Name())
+	if err != nil {
+		return "", eris.Wrap(err, "failed to read temporary file")
+	}
+	return string(edited), nil
+}
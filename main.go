@@ -1,16 +1,34 @@
 package main
 
 import (
+	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/t-kuni/sisho/cmd"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
 	godotenv.Load(".env")
 
-	err := cmd.NewRootCommand().CobraCommand.Execute()
+	// Ctrl-Cで実行中の処理を中断する。2回目のCtrl-Cでは即座に終了する
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := cmd.NewRootCommand().CobraCommand.ExecuteContext(ctx)
 	if err != nil {
+		if errors.Is(err, context.Canceled) {
+			fmt.Fprintln(os.Stderr, "Aborted")
+			os.Exit(130)
+		}
 		panic(err)
 	}
 }